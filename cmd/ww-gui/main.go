@@ -0,0 +1,457 @@
+// Command ww-gui is a minimal desktop frontend to webwormhole, for people
+// who'd rather not use a terminal.
+//
+// It shows its window in the default browser, but it moves files itself
+// using the wormhole package: dropped files are sent straight from disk, and
+// received files go into the downloads directory.
+package main
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"rsc.io/qr"
+	"webwormhole.io/wordlist"
+	"webwormhole.io/wormhole"
+)
+
+const (
+	// msgChunkSize is the size of the messages files are sent in. Peers
+	// may send longer ones, up to wormhole.MaxMessage.
+	msgChunkSize = 32 << 10
+)
+
+var (
+	iceserv   = flag.String("ice", strings.Join(wormhole.DefaultICEServers, ","), "stun or turn servers to use")
+	sigserv   = flag.String("signal", wormhole.DefaultSignalServer, "signalling server to use")
+	directory = flag.String("dir", downloads(), "directory to put downloaded files")
+	httpaddr  = flag.String("http", "localhost:0", "http listen address for the window")
+	noopen    = flag.Bool("no-open", false, "don't open the window in the browser, just print its address")
+)
+
+// downloads guesses the user's downloads directory.
+func downloads() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(home, "Downloads")
+}
+
+type header struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+	// Resume is set if the sender can resume sending the file. ww-gui
+	// doesn't keep partial files, so it always asks for all of it.
+	Resume string `json:"resume,omitempty"`
+}
+
+// transfer is a send or receive started from the window.
+type transfer struct {
+	sync.Mutex
+	Code  string `json:"code,omitempty"`
+	State string `json:"state"`
+	Name  string `json:"name,omitempty"`
+	Size  int64  `json:"size"`
+	Bytes int64  `json:"bytes"`
+	Error string `json:"error,omitempty"`
+	// Route is direct, relayed or disconnected, once connected.
+	Route wormhole.State `json:"route,omitempty"`
+}
+
+func (t *transfer) Write(p []byte) (int, error) {
+	t.Lock()
+	t.Bytes += int64(len(p))
+	t.Unlock()
+	return len(p), nil
+}
+
+func (t *transfer) set(state string, err error) {
+	t.Lock()
+	t.State = state
+	if err != nil {
+		t.Error = err.Error()
+	}
+	t.Unlock()
+}
+
+// transfers is a map of transfers by id.
+var transfers = struct {
+	m map[string]*transfer
+	sync.Mutex
+}{m: make(map[string]*transfer)}
+
+func randhex(n int) string {
+	b := make([]byte, n)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newTransfer() (string, *transfer) {
+	id, t := randhex(8), &transfer{State: "connecting"}
+	transfers.Lock()
+	transfers.m[id] = t
+	transfers.Unlock()
+	return id, t
+}
+
+func dialer(t *transfer) *wormhole.Dialer {
+	return &wormhole.Dialer{
+		SignalServer: *sigserv,
+		ICEServers:   strings.Split(*iceserv, ","),
+		OnState: func(s wormhole.State) {
+			if s != wormhole.Connecting {
+				t.Lock()
+				t.Route = s
+				t.Unlock()
+			}
+		},
+	}
+}
+
+// send sends the file at path over a new wormhole, removing the file once
+// done. codec receives the code as soon as it's known.
+func send(t *transfer, path string, codec chan<- string) {
+	defer os.Remove(path)
+	passbytes := make([]byte, 2)
+	if _, err := io.ReadFull(crand.Reader, passbytes); err != nil {
+		t.set("failed", err)
+		close(codec)
+		return
+	}
+	password := wordlist.Encode(passbytes)
+	slotc := make(chan string, 1)
+	dialed := make(chan struct{})
+	go func() {
+		select {
+		case slot := <-slotc:
+			t.Lock()
+			t.Code, t.State = slot+"-"+password, "waiting"
+			t.Unlock()
+			codec <- t.Code
+		case <-dialed:
+			close(codec)
+		}
+	}()
+	c, err := dialer(t).Wormhole(password, slotc)
+	close(dialed)
+	if err != nil {
+		t.set("failed", err)
+		return
+	}
+	defer c.Close()
+	t.set("transferring", nil)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.set("failed", err)
+		return
+	}
+	defer f.Close()
+	h, err := json.Marshal(header{Name: t.Name, Size: int(t.Size)})
+	if err != nil {
+		t.set("failed", err)
+		return
+	}
+	if _, err := c.Write(h); err != nil {
+		t.set("failed", err)
+		return
+	}
+	if _, err := io.CopyBuffer(io.MultiWriter(c, t), f, make([]byte, msgChunkSize)); err != nil {
+		t.set("failed", err)
+		return
+	}
+	t.set("done", nil)
+}
+
+// receive receives files over the wormhole with the given code into
+// -dir.
+func receive(t *transfer, code string) {
+	slot, pass, err := wormhole.ParseCode(code)
+	if err != nil {
+		t.set("failed", err)
+		return
+	}
+	c, err := dialer(t).Dial(slot, pass)
+	if err != nil {
+		t.set("failed", err)
+		return
+	}
+	defer c.Close()
+	t.set("transferring", nil)
+
+	for {
+		buf := make([]byte, wormhole.MaxMessage)
+		n, err := c.Read(buf)
+		if err == nil && bytes.HasPrefix(buf[:n], batchPrefix) {
+			if err := acceptBatch(c, append([]byte(nil), buf[:n]...)); err != nil {
+				t.set("failed", err)
+				return
+			}
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.set("failed", err)
+			return
+		}
+		var h header
+		if err := json.Unmarshal(buf[:n], &h); err != nil {
+			t.set("failed", err)
+			return
+		}
+		if h.Resume != "" {
+			if err := restart(c); err != nil {
+				t.set("failed", err)
+				return
+			}
+		}
+		t.Lock()
+		t.Name, t.Size, t.Bytes = h.Name, int64(h.Size), 0
+		t.Unlock()
+		f, err := os.Create(filepath.Join(*directory, filepath.Base(filepath.Clean(h.Name))))
+		if err != nil {
+			t.set("failed", err)
+			return
+		}
+		written, err := io.CopyBuffer(io.MultiWriter(f, t), io.LimitReader(c, int64(h.Size)), make([]byte, wormhole.MaxMessage))
+		f.Close()
+		if err == nil && written != int64(h.Size) {
+			err = fmt.Errorf("EOF before receiving all bytes: (%d/%d)", written, h.Size)
+		}
+		if err != nil {
+			t.set("failed", err)
+			return
+		}
+	}
+	t.set("done", nil)
+}
+
+// batchPrefix starts the list of files senders may start with, see
+// wormhole.MinBatch.
+var batchPrefix = []byte(`{"files":`)
+
+// acceptBatch answers the list of files a sender started with, the first
+// message of which is first, asking for all of them.
+func acceptBatch(c *wormhole.Conn, first []byte) error {
+	var b struct {
+		Files []json.RawMessage `json:"files"`
+	}
+	r := io.MultiReader(bytes.NewReader(first), &messageReader{r: c, buf: make([]byte, wormhole.MaxMessage)})
+	if err := json.NewDecoder(r).Decode(&b); err != nil {
+		return err
+	}
+	var a struct {
+		Accept []int `json:"accept"`
+	}
+	a.Accept = make([]int, len(b.Files))
+	for i := range a.Accept {
+		a.Accept[i] = i
+	}
+	msg, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	for len(msg) > 0 {
+		n := len(msg)
+		if n > msgChunkSize {
+			n = msgChunkSize
+		}
+		if _, err := c.Write(msg[:n]); err != nil {
+			return err
+		}
+		msg = msg[n:]
+	}
+	return nil
+}
+
+// messageReader reads whole messages from r, however little it's asked
+// for at a time, since a message can't be read in parts.
+type messageReader struct {
+	r   io.Reader
+	buf []byte
+	p   []byte
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	if len(r.p) == 0 {
+		n, err := r.r.Read(r.buf)
+		r.p = r.buf[:n]
+		if n == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, r.p)
+	r.p = r.p[n:]
+	return n, nil
+}
+
+// restart answers a sender offering to resume a file that it should send
+// it from the start.
+func restart(c *wormhole.Conn) error {
+	if _, err := c.Write([]byte(`{"offset":0}`)); err != nil {
+		return err
+	}
+	buf := make([]byte, 1<<10)
+	n, err := c.Read(buf)
+	if err != nil {
+		return err
+	}
+	var start struct {
+		Start int64 `json:"start"`
+	}
+	if err := json.Unmarshal(buf[:n], &start); err != nil {
+		return err
+	}
+	if start.Start != 0 {
+		return fmt.Errorf("sender resumed at %d", start.Start)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func lookup(w http.ResponseWriter, r *http.Request) *transfer {
+	transfers.Lock()
+	t := transfers.m[r.URL.Query().Get("id")]
+	transfers.Unlock()
+	if t == nil {
+		http.Error(w, "no such transfer", http.StatusNotFound)
+	}
+	return t
+}
+
+// handler serves the window and its API under a random prefix, so that
+// neither web sites nor other users on this machine can reach it.
+func handler(prefix string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, page)
+	})
+	mux.HandleFunc(prefix+"send", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// The browser can't tell us where the file is, so it hands over the
+		// contents instead.
+		f, err := ioutil.TempFile("", "ww-gui")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		size, err := io.Copy(f, r.Body)
+		f.Close()
+		if err != nil {
+			os.Remove(f.Name())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id, t := newTransfer()
+		t.Name = filepath.Base(filepath.Clean(r.URL.Query().Get("name")))
+		t.Size = size
+		codec := make(chan string)
+		go send(t, f.Name(), codec)
+		<-codec
+		writeJSON(w, map[string]string{"id": id})
+	})
+	mux.HandleFunc(prefix+"receive", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, t := newTransfer()
+		go receive(t, strings.TrimSpace(r.URL.Query().Get("code")))
+		writeJSON(w, map[string]string{"id": id})
+	})
+	mux.HandleFunc(prefix+"status", func(w http.ResponseWriter, r *http.Request) {
+		t := lookup(w, r)
+		if t == nil {
+			return
+		}
+		t.Lock()
+		defer t.Unlock()
+		writeJSON(w, t)
+	})
+	mux.HandleFunc(prefix+"qr", func(w http.ResponseWriter, r *http.Request) {
+		t := lookup(w, r)
+		if t == nil {
+			return
+		}
+		t.Lock()
+		code := t.Code
+		t.Unlock()
+		u, err := url.Parse(*sigserv)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		u.Fragment = code
+		qrcode, err := qr.Encode(u.String(), qr.L)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(qrcode.PNG())
+	})
+	return mux
+}
+
+// open opens u in the default browser.
+func open(u string) error {
+	switch runtime.GOOS {
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", u).Start()
+	case "darwin":
+		return exec.Command("open", u).Start()
+	default:
+		return exec.Command("xdg-open", u).Start()
+	}
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "a window to send and receive files with webwormhole\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags]\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "flags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	l, err := net.Listen("tcp", *httpaddr)
+	if err != nil {
+		log.Fatalf("could not listen: %v", err)
+	}
+	prefix := "/" + randhex(16) + "/"
+	u := "http://" + l.Addr().String() + prefix
+	fmt.Println(u)
+	if !*noopen {
+		if err := open(u); err != nil {
+			log.Printf("could not open browser: %v", err)
+		}
+	}
+	log.Fatal(http.Serve(l, handler(prefix)))
+}
@@ -0,0 +1,91 @@
+package main
+
+// page is the window. It talks to the API relative to its own address.
+const page = `<!doctype html>
+<meta charset=utf-8>
+<title>WEBWORMHOLE</title>
+<style>
+body { font-family: monospace; background: #222; color: #eee; margin: 2em; text-align: center; }
+#drop { border: 2px dashed #888; padding: 3em 1em; margin-bottom: 1em; }
+#drop.over { border-color: #eee; }
+input, button { font: inherit; padding: 0.5em; }
+#transfers { list-style: none; padding: 0; }
+#transfers li { margin: 1em 0; }
+.code { font-size: 1.5em; user-select: all; }
+.failed { color: #f66; }
+</style>
+<body>
+<div id="drop">DROP A FILE HERE TO SEND IT<br><br><input type="file" id="picker"></div>
+<form id="receive"><input type="text" id="code" placeholder="GOT A CODE? TYPE HERE" autocomplete="off"> <button>RECEIVE</button></form>
+<ul id="transfers"></ul>
+<script>
+const list = document.getElementById("transfers");
+
+function watch(id, li) {
+	const info = document.createElement("div");
+	li.appendChild(info);
+	const poll = async () => {
+		const t = await (await fetch("status?id=" + id)).json();
+		let s = (t.name || "") + " " + t.state.toUpperCase();
+		if (t.size > 0 && t.state === "transferring") {
+			s += " " + Math.floor(100 * t.bytes / t.size) + "%";
+		}
+		if (t.route && t.state === "transferring") {
+			s += " (" + t.route.toUpperCase() + ")";
+		}
+		if (t.error) {
+			s += ": " + t.error;
+			li.className = "failed";
+		}
+		info.textContent = s;
+		if (t.state === "waiting" && !li.querySelector("img")) {
+			const code = document.createElement("div");
+			code.className = "code";
+			code.textContent = t.code;
+			const img = document.createElement("img");
+			img.src = "qr?id=" + id;
+			li.insertBefore(img, info);
+			li.insertBefore(code, info);
+		}
+		if (t.state !== "waiting" && li.querySelector("img")) {
+			li.querySelector("img").remove();
+		}
+		if (t.state !== "done" && t.state !== "failed") {
+			setTimeout(poll, 500);
+		}
+	};
+	poll();
+}
+
+async function send(file) {
+	const li = document.createElement("li");
+	li.textContent = "SENDING " + file.name;
+	list.prepend(li);
+	const r = await fetch("send?name=" + encodeURIComponent(file.name), {method: "POST", body: file});
+	watch((await r.json()).id, li);
+}
+
+const drop = document.getElementById("drop");
+drop.ondragover = e => { e.preventDefault(); drop.className = "over"; };
+drop.ondragleave = () => { drop.className = ""; };
+drop.ondrop = e => {
+	e.preventDefault();
+	drop.className = "";
+	for (const f of e.dataTransfer.files) send(f);
+};
+document.getElementById("picker").onchange = e => {
+	for (const f of e.target.files) send(f);
+	e.target.value = "";
+};
+document.getElementById("receive").onsubmit = async e => {
+	e.preventDefault();
+	const code = document.getElementById("code");
+	const li = document.createElement("li");
+	li.textContent = "RECEIVING " + code.value;
+	list.prepend(li);
+	const r = await fetch("receive?code=" + encodeURIComponent(code.value), {method: "POST"});
+	code.value = "";
+	watch((await r.json()).id, li);
+};
+</script>
+`
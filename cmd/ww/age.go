@@ -0,0 +1,225 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+	"webwormhole.io/cmd/ww/internal/age"
+	"webwormhole.io/wormhole"
+)
+
+// Senders can encrypt files to the age or ssh public keys of whoever they
+// are for, on top of the wormhole's own encryption, so that they stay
+// encrypted once received, e.g. by a daemon shared with others. They're
+// sent in the age format, which the age and rage tools decrypt; see
+// internal/age.
+
+// splitWriter writes to w in messages of up to a chunk.
+type splitWriter struct {
+	w io.Writer
+}
+
+func (s splitWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		k := len(p)
+		if k > msgChunkSize {
+			k = msgChunkSize
+		}
+		k, err := s.w.Write(p[:k])
+		n += k
+		if err != nil {
+			return n, err
+		}
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// sealedFile is a file to send encrypted.
+type sealedFile struct {
+	path    string
+	name    string
+	size    int64
+	entries []tarEntry
+	modtime time.Time
+	key     []byte
+	header  []byte
+	// nonce is what its contents are encrypted with, the same every time,
+	// so that it can be hashed before it's sent.
+	nonce []byte
+}
+
+// sendSealed sends files over c as sendFiles does, but each encrypted to
+// rs, with .age on the end of its name. Directories are sent as tar files,
+// and not unpacked. Nothing is resumed, as it's encrypted afresh every
+// time.
+func sendSealed(c *wormhole.Conn, files []string, rs []age.Recipient, depth int, keep bool, m meter) error {
+	buf := make([]byte, msgChunkSize)
+	var sealed []*sealedFile
+	for _, filename := range files {
+		f := &sealedFile{path: filename}
+		switch info, err := os.Stat(filename); {
+		case isRemote(filename):
+			bf, err := statRemote(filename)
+			if err != nil {
+				return err
+			}
+			f.name, f.size = bf.Name, bf.Size
+		case err != nil:
+			return transferErrorf(exitDisk, "could not stat file %s: %v", filename, err)
+		case info.IsDir():
+			f.entries, f.size, err = walkTar(filename, keep)
+			if err != nil {
+				return transferErrorf(exitDisk, "could not read directory %s: %v", filename, err)
+			}
+			f.name = norm.NFC.String(filepath.Base(filepath.Clean(filename))) + ".tar"
+		default:
+			f.name = norm.NFC.String(filepath.Base(filepath.Clean(filename)))
+			f.size = info.Size()
+			f.modtime = info.ModTime()
+		}
+		var err error
+		f.key, f.header, err = age.Header(rs)
+		if err != nil {
+			return transferErrorf(exitFailure, "could not encrypt %s: %v", filename, err)
+		}
+		f.nonce = make([]byte, age.NonceSize)
+		if _, err := crand.Read(f.nonce); err != nil {
+			return transferErrorf(exitFailure, "could not encrypt %s: %v", filename, err)
+		}
+		f.name += ".age"
+		sealed = append(sealed, f)
+	}
+	if c.PeerVersion() >= wormhole.MinBatch {
+		b := []wormhole.OfferedFile{}
+		for _, f := range sealed {
+			// Receivers want the hash of what they'll get, which is
+			// encrypted, so it's encrypted once first to hash it.
+			h := sha256.New()
+			if _, err := f.seal(h, depth, buf); err != nil {
+				if _, ok := err.(*transferError); ok {
+					return err
+				}
+				return transferErrorf(copyStatus(err), "could not read %s: %v", f.path, err)
+			}
+			b = append(b, wormhole.OfferedFile{
+				Name:   f.name,
+				Size:   age.Size(len(f.header), f.size),
+				SHA256: hex.EncodeToString(h.Sum(nil)),
+			})
+		}
+		// They're encrypted, which doesn't compress.
+		picked, _, err := offer(c, b, nil, m)
+		if err != nil {
+			return err
+		}
+		var wanted []*sealedFile
+		for _, i := range picked {
+			wanted = append(wanted, sealed[i])
+		}
+		sealed = wanted
+	}
+	sums := &summer{}
+	m = meters{m, sums}
+	for _, f := range sealed {
+		if err := sendSealedFile(c, f, depth, keep, m, buf); err != nil {
+			return err
+		}
+		if err := sendTrailer(c, sums.digest()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// open opens the file f is of, or returns nil for a directory, which is
+// sent with writeTar instead.
+func (f *sealedFile) open() (io.ReadCloser, error) {
+	switch {
+	case isRemote(f.path):
+		r, _, err := openRemote(f.path)
+		if err != nil {
+			return nil, transferErrorf(exitUsage, "could not use %s: %v", f.path, err)
+		}
+		body, _, _, err := r.open()
+		if err != nil {
+			return nil, transferErrorf(exitDisk, "could not open %s: %v", f.path, err)
+		}
+		return body, nil
+	case f.entries == nil:
+		body, err := os.Open(f.path)
+		if err != nil {
+			return nil, transferErrorf(exitDisk, "could not open file %s: %v", f.path, err)
+		}
+		return body, nil
+	}
+	return nil, nil
+}
+
+// seal writes f, encrypted, to w, and returns how much of it there was
+// before it was.
+func (f *sealedFile) seal(w io.Writer, depth int, buf []byte) (int64, error) {
+	body, err := f.open()
+	if err != nil {
+		return 0, err
+	}
+	aw, err := age.NewWriterNonce(w, f.key, f.header, f.nonce)
+	if err != nil {
+		if body != nil {
+			body.Close()
+		}
+		return 0, err
+	}
+	if body == nil {
+		err = writeTar(aw, f.entries, buf)
+	} else {
+		ra := newReadAhead(body, depth, msgChunkSize)
+		_, err = io.CopyBuffer(aw, io.LimitReader(ra, f.size), buf)
+		ra.Close()
+		body.Close()
+	}
+	if err == nil {
+		err = aw.Close()
+	}
+	return aw.Written(), err
+}
+
+func sendSealedFile(c *wormhole.Conn, f *sealedFile, depth int, keep bool, m meter, buf []byte) error {
+	size := age.Size(len(f.header), f.size)
+	hdr := header{Name: f.name, Size: int(size)}
+	if keep && !f.modtime.IsZero() {
+		hdr.Modified = f.modtime.UnixNano() / int64(time.Millisecond)
+	}
+	h, err := json.Marshal(hdr)
+	if err != nil {
+		return transferErrorf(exitFailure, "could not encode file header: %v", err)
+	}
+	if _, err = c.Write(h); err != nil {
+		return transferErrorf(exitNetwork, "could not send file header: %v", err)
+	}
+	m.start(f.name, size)
+	span := tr.start("transfer", root, "")
+	span.set("size", strconv.FormatInt(size, 10))
+	n, err := f.seal(splitWriter{io.MultiWriter(c, m)}, depth, buf)
+	span.end(err)
+	if _, ok := err.(*transferError); ok {
+		return err
+	}
+	if err != nil {
+		return transferErrorf(copyStatus(err), "could not send file: %v", err)
+	}
+	if n != f.size {
+		return transferErrorf(exitDisk, "EOF before sending all bytes: (%d/%d)", n, f.size)
+	}
+	m.done("")
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// archiveTar is the Archive of a header for a directory sent as a tar
+// stream. Receivers that don't know about archives save it as a file, so
+// its name ends in .tar.
+const archiveTar = "tar"
+
+// A tarEntry is a file or directory to put in a tar stream.
+type tarEntry struct {
+	path string // On disk.
+	hdr  *tar.Header
+}
+
+// countWriter counts what's written to it.
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// walkTar lists what goes in the tar stream dir is sent as, with paths
+// relative to dir's parent, and returns how long the stream will be. Only
+// regular files and directories go in. Modes and modification times are
+// only kept if keep is set, and owners never are. Directories with a
+// snapshot are read from it.
+func walkTar(dir string, keep bool) ([]tarEntry, int64, error) {
+	dir = filepath.Clean(dir)
+	base := norm.NFC.String(filepath.Base(dir))
+	dir = snapshotOf(dir)
+	var entries []tarEntry
+	// The stream ends with two empty blocks.
+	size := int64(2 * 512)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			fmt.Fprintf(flag.CommandLine.Output(), "skipping %s, it's not a file or directory\n", path)
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    norm.NFC.String(filepath.ToSlash(filepath.Join(base, rel))),
+			ModTime: time.Unix(0, 0),
+		}
+		if info.IsDir() {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			hdr.Mode = 0755
+		} else {
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = info.Size()
+			hdr.Mode = 0644
+		}
+		if keep {
+			hdr.Mode = int64(info.Mode().Perm())
+			hdr.ModTime = info.ModTime().Truncate(time.Second)
+		}
+		// Headers come out the same whatever comes before them, so
+		// writing each on its own says how long it is.
+		w := &countWriter{}
+		if err := tar.NewWriter(w).WriteHeader(hdr); err != nil {
+			return err
+		}
+		size += w.n + (hdr.Size+511)&^511
+		entries = append(entries, tarEntry{path, hdr})
+		return nil
+	})
+	return entries, size, err
+}
+
+// writeTar writes entries to w as a tar stream, in messages of up to
+// len(buf).
+func writeTar(w io.Writer, entries []tarEntry, buf []byte) error {
+	bw := bufio.NewWriterSize(w, len(buf))
+	tw := tar.NewWriter(bw)
+	for _, e := range entries {
+		if err := tw.WriteHeader(e.hdr); err != nil {
+			return err
+		}
+		if e.hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		f, err := os.Open(e.path)
+		if err != nil {
+			return err
+		}
+		n, err := io.CopyBuffer(tw, f, buf)
+		f.Close()
+		if err == tar.ErrWriteTooLong || err == nil && n != e.hdr.Size {
+			return fmt.Errorf("%s changed while sending it", e.path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// chunkReader reads whole messages from r, however little it's asked for
+// at a time, since a message can't be read in parts.
+type chunkReader struct {
+	r   io.Reader
+	buf []byte
+	p   []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.p) == 0 {
+		n, err := r.r.Read(r.buf)
+		r.p = r.buf[:n]
+		if n == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, r.p)
+	r.p = r.p[n:]
+	return n, nil
+}
+
+// extractTar unpacks the tar stream in r into a new directory in dir, named
+// for the archive the peer calls name, and returns the directory's name.
+// Paths in it are made valid the same way file names are, element by
+// element, so files can't end up outside it. Only regular files and
+// directories are made. Modes and modification times are kept if keep is
+// set.
+func extractTar(r io.Reader, dir, name string, names *namer, keep bool) (string, error) {
+	top, err := names.mkdir(dir, strings.TrimSuffix(name, ".tar"))
+	if err != nil {
+		return top, err
+	}
+	root := filepath.Join(dir, top)
+	// Directories get their modes and times once everything's in them.
+	var dirs []string
+	var dirHeaders []header
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return top, err
+		}
+		// The first element is the directory sent, which is top here.
+		var elems []string
+		for _, e := range strings.Split(hdr.Name, "/")[1:] {
+			if e != "" {
+				elems = append(elems, names.clean(e))
+			}
+		}
+		path := filepath.Join(append([]string{root}, elems...)...)
+		h := header{
+			Mode:     os.FileMode(hdr.Mode).Perm(),
+			Modified: hdr.ModTime.UnixNano() / int64(time.Millisecond),
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return top, err
+			}
+			dirs = append(dirs, path)
+			dirHeaders = append(dirHeaders, h)
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return top, err
+			}
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+			if err != nil {
+				return top, err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return top, err
+			}
+			if keep {
+				preserve(path, h)
+			}
+		}
+	}
+	// The stream may be padded past its end.
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return top, err
+	}
+	if keep {
+		for i := len(dirs) - 1; i >= 0; i-- {
+			preserve(dirs[i], dirHeaders[i])
+		}
+	}
+	return top, nil
+}
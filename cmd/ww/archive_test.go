@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTarSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ww")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(filepath.Join(src, "sub", strings.Repeat("d", 120)), 0755)
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("hello"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "sub", "ünïcödé"), bytes.Repeat([]byte{1}, 513), 0600)
+
+	for _, keep := range []bool{true, false} {
+		entries, size, err := walkTar(src, keep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := writeTar(&buf, entries, make([]byte, msgChunkSize)); err != nil {
+			t.Fatal(err)
+		}
+		if int64(buf.Len()) != size {
+			t.Errorf("keep %v got %v bytes want %v", keep, buf.Len(), size)
+		}
+	}
+}
+
+func TestTarSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ww")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, snap := filepath.Join(dir, "src"), filepath.Join(dir, ".ww-snapshot-1")
+	os.MkdirAll(src, 0755)
+	os.MkdirAll(snap, 0755)
+	ioutil.WriteFile(filepath.Join(snap, "a.txt"), []byte("then"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("now"), 0644)
+	snapshots[src] = snap
+	defer delete(snapshots, src)
+
+	entries, _, err := walkTar(src, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].hdr.Name != "src/a.txt" || entries[1].path != filepath.Join(snap, "a.txt") {
+		t.Errorf("got %+v, want src/a.txt from the snapshot", entries)
+	}
+}
+
+func TestExtractTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ww")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "x/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "x/../../escape", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		{Name: "x//abs", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		{Name: "x/link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		{Name: "x/a/b", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+	} {
+		tw.WriteHeader(h)
+		if h.Size > 0 {
+			tw.Write([]byte("!"))
+		}
+	}
+	tw.Close()
+
+	top, err := extractTar(&buf, dir, "x.tar", newNamer(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(dir, path)
+		got = append(got, filepath.ToSlash(rel))
+		return nil
+	})
+	want := []string{".", "x", "x/a", "x/a/b", "x/abs", "x/unnamed", "x/unnamed/unnamed", "x/unnamed/unnamed/escape"}
+	if top != "x" || strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v %v want x %v", top, got, want)
+	}
+}
@@ -0,0 +1,267 @@
+// +build !lite
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authPolicy restricts who may signal through a private server. Clients
+// authenticate with either a bearer token or a TLS client certificate
+// signed by a given CA. A token is good if it's in the token file, or if
+// the check URL accepts it, e.g. an OIDC provider's userinfo endpoint.
+//
+// Each client also gets a namespace, so that codes only match between
+// clients of the same user or team. Slots are numbered separately in each,
+// and so stay short. The namespace is the one given for the token in the
+// token file, the claim named by claim in the check URL's JSON response,
+// or the organizational unit of the certificate, and "" if there's none.
+//
+// The CLI sends tokens in the Authorization header. Browsers can't set
+// headers on WebSockets, so the web client posts its token to /auth once,
+// and gets it back as a cookie.
+type authPolicy struct {
+	tokens   map[[32]byte]string // SHA-256 of each token, to its namespace.
+	checkURL string
+	claim    string
+	clientCA *x509.CertPool
+	client   *http.Client
+
+	mu      sync.Mutex
+	checked map[[32]byte]checkedToken // Tokens checkURL accepted.
+}
+
+type checkedToken struct {
+	namespace string
+	until     time.Time
+}
+
+// authCookie is the cookie the web client's token is kept in.
+const authCookie = "ww_auth"
+
+// authCacheTime is how long to trust the check URL's answer for a token.
+const authCacheTime = time.Minute
+
+// newAuthPolicy loads the tokens in tokenfile, one per line optionally
+// followed by a namespace, and the CA certificates in cafile. It returns
+// nil if none of them are set, for servers open to all.
+func newAuthPolicy(tokenfile, checkURL, claim, cafile string) (*authPolicy, error) {
+	if tokenfile == "" && checkURL == "" && cafile == "" {
+		return nil, nil
+	}
+	p := &authPolicy{
+		tokens:   make(map[[32]byte]string),
+		checkURL: checkURL,
+		claim:    claim,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		checked:  make(map[[32]byte]checkedToken),
+	}
+	if tokenfile != "" {
+		f, err := os.Open(tokenfile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			namespace := ""
+			if len(fields) > 1 {
+				namespace = fields[1]
+			}
+			p.tokens[sha256.Sum256([]byte(fields[0]))] = namespace
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if cafile != "" {
+		pem, err := ioutil.ReadFile(cafile)
+		if err != nil {
+			return nil, err
+		}
+		p.clientCA = x509.NewCertPool()
+		if !p.clientCA.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", cafile)
+		}
+	}
+	return p, nil
+}
+
+// configureTLS asks clients for certificates, if there's a CA to check
+// them against.
+func (p *authPolicy) configureTLS(c *tls.Config) {
+	if p == nil || p.clientCA == nil {
+		return
+	}
+	c.ClientCAs = p.clientCA
+	c.ClientAuth = tls.VerifyClientCertIfGiven
+}
+
+// identify returns the namespace of the client r comes from, and whether
+// it authenticated at all.
+func (p *authPolicy) identify(r *http.Request) (namespace string, ok bool) {
+	if p.clientCA != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if ou := r.TLS.VerifiedChains[0][0].Subject.OrganizationalUnit; len(ou) > 0 {
+			return ou[0], true
+		}
+		return "", true
+	}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return p.check(h[len("Bearer "):])
+	}
+	if c, err := r.Cookie(authCookie); err == nil {
+		return p.check(c.Value)
+	}
+	return "", false
+}
+
+// check returns the namespace of token, and whether it's good.
+func (p *authPolicy) check(token string) (namespace string, ok bool) {
+	if token == "" {
+		return "", false
+	}
+	h := sha256.Sum256([]byte(token))
+	if namespace, ok := p.tokens[h]; ok {
+		return namespace, true
+	}
+	if p.checkURL == "" {
+		return "", false
+	}
+	p.mu.Lock()
+	c, ok := p.checked[h]
+	p.mu.Unlock()
+	if ok && time.Now().Before(c.until) {
+		return c.namespace, true
+	}
+	req, err := http.NewRequest(http.MethodGet, p.checkURL, nil)
+	if err != nil {
+		return "", false
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		log.Printf("could not check token: %v", err)
+		return "", false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", false
+	}
+	if p.claim != "" {
+		var claims map[string]interface{}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&claims); err != nil {
+			log.Printf("could not read claims for token: %v", err)
+			return "", false
+		}
+		// A missing claim leaves the client in the shared namespace.
+		namespace, _ = claims[p.claim].(string)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for k, c := range p.checked {
+		if now.After(c.until) {
+			delete(p.checked, k)
+		}
+	}
+	p.checked[h] = checkedToken{namespace, now.Add(authCacheTime)}
+	return namespace, true
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="webwormhole"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+// namespaceKey is the request context key for the client's namespace.
+type namespaceKey struct{}
+
+// namespaceOf returns the namespace guard found for r.
+func namespaceOf(r *http.Request) string {
+	namespace, _ := r.Context().Value(namespaceKey{}).(string)
+	return namespace
+}
+
+// guard only lets authenticated clients through to h, with their namespace
+// in the request's context.
+func (p *authPolicy) guard(h http.HandlerFunc) http.HandlerFunc {
+	if p == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authed, ok := r.Context().Value(namespacedKey{}).(bool); ok {
+			// The namespace in the path stands, and its own tokens
+			// stand in for the server's.
+			if !authed {
+				if _, ok := p.identify(r); !ok {
+					log.Printf("refused unauthenticated %s from %s", r.URL.Path, r.RemoteAddr)
+					unauthorized(w)
+					return
+				}
+			}
+			h(w, r)
+			return
+		}
+		namespace, ok := p.identify(r)
+		if !ok {
+			log.Printf("refused unauthenticated %s from %s", r.URL.Path, r.RemoteAddr)
+			unauthorized(w)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), namespaceKey{}, namespace)))
+	}
+}
+
+// serveAuth tells the web client whether it needs to authenticate, with
+// a 401 on GET if so. It then posts a token, which is set as a cookie if
+// it's good.
+func (p *authPolicy) serveAuth(w http.ResponseWriter, r *http.Request) {
+	if p == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if _, ok := p.identify(r); !ok {
+			unauthorized(w)
+			return
+		}
+	case http.MethodPost:
+		token, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 4<<10))
+		if _, ok := p.check(strings.TrimSpace(string(token))); err != nil || !ok {
+			unauthorized(w)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     authCookie,
+			Value:    strings.TrimSpace(string(token)),
+			Path:     "/",
+			MaxAge:   int((30 * 24 * time.Hour).Seconds()),
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
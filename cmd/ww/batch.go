@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+	"webwormhole.io/wormhole"
+)
+
+// Senders list the files they're about to send in an offer ahead of them,
+// if the receiver is new enough, and the receiver answers with the ones it
+// wants; see wormhole.Offer.
+
+// A batchMeter is a meter that's told about the files it'll see, once the
+// receiver has picked them.
+type batchMeter interface {
+	batch(files []wormhole.OfferedFile)
+}
+
+func (ms meters) batch(files []wormhole.OfferedFile) {
+	for _, m := range ms {
+		if bm, ok := m.(batchMeter); ok {
+			bm.batch(files)
+		}
+	}
+}
+
+// newBatch lists files, as sendFiles sends them.
+func newBatch(files []string, keep bool, buf []byte) ([]wormhole.OfferedFile, error) {
+	b := []wormhole.OfferedFile{}
+	for _, filename := range files {
+		if filename == "-" {
+			b = append(b, wormhole.OfferedFile{Name: stdinName, Type: mime.TypeByExtension(path.Ext(stdinName)), Chunked: true})
+			continue
+		}
+		if isRemote(filename) {
+			bf, err := statRemote(filename)
+			if err != nil {
+				return nil, err
+			}
+			if bf.SHA256, err = hashRemote(filename, buf); err != nil {
+				return nil, err
+			}
+			b = append(b, bf)
+			continue
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			return nil, transferErrorf(exitDisk, "could not stat file %s: %v", filename, err)
+		}
+		name := norm.NFC.String(filepath.Base(filepath.Clean(filename)))
+		if info.IsDir() {
+			_, size, err := walkTar(filename, keep)
+			if err != nil {
+				return nil, transferErrorf(exitDisk, "could not read directory %s: %v", filename, err)
+			}
+			b = append(b, wormhole.OfferedFile{Name: name + ".tar", Size: size, Type: "application/x-tar", Archive: archiveTar})
+			continue
+		}
+		bf := wormhole.OfferedFile{Name: name, Size: info.Size(), Type: mime.TypeByExtension(path.Ext(name))}
+		if info.Mode().IsRegular() {
+			f, err := os.Open(filename)
+			if err != nil {
+				return nil, transferErrorf(exitDisk, "could not open file %s: %v", filename, err)
+			}
+			h := sha256.New()
+			_, err = io.CopyBuffer(h, f, buf)
+			f.Close()
+			if err != nil {
+				return nil, transferErrorf(exitDisk, "could not read file %s: %v", filename, err)
+			}
+			bf.SHA256 = hex.EncodeToString(h.Sum(nil))
+		}
+		b = append(b, bf)
+	}
+	return b, nil
+}
+
+// statRemote lists the file in cloud storage at rawurl, without its hash.
+func statRemote(rawurl string) (wormhole.OfferedFile, error) {
+	r, name, err := openRemote(rawurl)
+	if err != nil {
+		return wormhole.OfferedFile{}, transferErrorf(exitUsage, "could not use %s: %v", rawurl, err)
+	}
+	size, _, err := r.stat()
+	if err != nil {
+		return wormhole.OfferedFile{}, transferErrorf(exitDisk, "could not stat %s: %v", rawurl, err)
+	}
+	name = norm.NFC.String(name)
+	return wormhole.OfferedFile{Name: name, Size: size, Type: mime.TypeByExtension(path.Ext(name))}, nil
+}
+
+// hashRemote hashes the file in cloud storage at rawurl, for the receiver
+// to check what it gets against. It's read twice, as local files are.
+func hashRemote(rawurl string, buf []byte) (string, error) {
+	r, _, err := openRemote(rawurl)
+	if err != nil {
+		return "", transferErrorf(exitUsage, "could not use %s: %v", rawurl, err)
+	}
+	body, _, _, err := r.open()
+	if err != nil {
+		return "", transferErrorf(exitDisk, "could not open %s: %v", rawurl, err)
+	}
+	defer body.Close()
+	h := sha256.New()
+	if _, err := io.CopyBuffer(h, body, buf); err != nil {
+		return "", transferErrorf(exitDisk, "could not read %s: %v", rawurl, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// offerBatch lists files for the receiver on c, and returns the ones it
+// wants, and how it wants them compressed.
+func offerBatch(c *wormhole.Conn, files []string, keep bool, m meter, buf []byte) ([]string, string, error) {
+	b, err := newBatch(files, keep, buf)
+	if err != nil {
+		return nil, "", err
+	}
+	picked, alg, err := offer(c, b, compressions(c), m)
+	if err != nil {
+		return nil, "", err
+	}
+	var wanted []string
+	for _, i := range picked {
+		wanted = append(wanted, files[i])
+	}
+	return wanted, alg, nil
+}
+
+// offer offers files to the receiver on c, compressed with one of algs, and
+// returns the indices of the ones it wants, and the way it picked.
+func offer(c *wormhole.Conn, files []wormhole.OfferedFile, algs []string, m meter) ([]int, string, error) {
+	picked, alg, err := c.SendOfferCompressed(files, algs)
+	if err == wormhole.ErrRejected || err == nil && len(picked) == 0 && len(files) > 0 {
+		// Older receivers pick none instead of declining.
+		return nil, "", transferErrorf(exitRejected, "receiver declined the files")
+	}
+	if err == wormhole.ErrBadAnswer {
+		return nil, "", transferErrorf(exitFailure, "receiver picked files that weren't listed")
+	}
+	if err != nil {
+		return nil, "", transferErrorf(exitNetwork, "could not offer the files: %v", err)
+	}
+	out := flag.CommandLine.Output()
+	if p, ok := m.(*printer); ok {
+		out = p.w
+	}
+	var listed []wormhole.OfferedFile
+	next := 0
+	for _, i := range picked {
+		for ; next < i; next++ {
+			fmt.Fprintf(out, "receiver declined %s\n", files[next].Name)
+		}
+		listed = append(listed, files[i])
+		next = i + 1
+	}
+	for ; next < len(files); next++ {
+		fmt.Fprintf(out, "receiver declined %s\n", files[next].Name)
+	}
+	if bm, ok := m.(batchMeter); ok {
+		bm.batch(listed)
+	}
+	return picked, alg, nil
+}
+
+// A picker picks the files of a batch to receive, by index.
+type picker func(files []wormhole.OfferedFile) []int
+
+// pickAll is the picker that wants everything.
+func pickAll(files []wormhole.OfferedFile) []int {
+	all := make([]int, len(files))
+	for i := range all {
+		all[i] = i
+	}
+	return all
+}
+
+// pickMatching returns a picker that wants the files whose names match any
+// of the comma separated patterns, as in path.Match.
+func pickMatching(patterns string) picker {
+	return func(files []wormhole.OfferedFile) []int {
+		var picked []int
+		for i, f := range files {
+			for _, p := range strings.Split(patterns, ",") {
+				if ok, _ := path.Match(strings.TrimSpace(p), f.Name); ok {
+					picked = append(picked, i)
+					break
+				}
+			}
+		}
+		return picked
+	}
+}
+
+// pickAsking asks the user at the terminal which files to receive, after
+// narrowing them down with then. Without a terminal, it leaves it to then.
+func pickAsking(then picker) picker {
+	return func(files []wormhole.OfferedFile) []int {
+		offered := then(files)
+		w := flag.CommandLine.Output()
+		if !interactive || len(offered) == 0 {
+			return offered
+		}
+		listOffered(w, files, offered)
+		in := bufio.NewReader(os.Stdin)
+		for {
+			fmt.Fprintf(w, "receive which? all, none, or numbers like 1,3-5 [all] ")
+			answer, err := in.ReadString('\n')
+			if err != nil {
+				return nil
+			}
+			picked, ok := parsePicks(strings.TrimSpace(answer), len(offered))
+			if !ok {
+				continue
+			}
+			for i := range picked {
+				picked[i] = offered[picked[i]]
+			}
+			return picked
+		}
+	}
+}
+
+// pickConfirming lists the files then picks at the terminal, and asks the
+// user whether to receive them, defaulting to no. Without a terminal, it
+// leaves it to then.
+func pickConfirming(then picker) picker {
+	return func(files []wormhole.OfferedFile) []int {
+		offered := then(files)
+		w := flag.CommandLine.Output()
+		if !interactive || len(offered) == 0 {
+			return offered
+		}
+		listOffered(w, files, offered)
+		in := bufio.NewReader(os.Stdin)
+		for {
+			fmt.Fprintf(w, "receive them? [y/N] ")
+			answer, err := in.ReadString('\n')
+			if err != nil {
+				return nil
+			}
+			switch strings.ToLower(strings.TrimSpace(answer)) {
+			case "y", "yes":
+				return offered
+			case "", "n", "no":
+				return nil
+			}
+		}
+	}
+}
+
+// listOffered writes the files at indices offered to w, one per line with
+// what the sender said about them, and their total size.
+func listOffered(w io.Writer, files []wormhole.OfferedFile, offered []int) {
+	var total int64
+	for i, k := range offered {
+		f := files[k]
+		about := []string{formatSize(f.Size)}
+		if f.Chunked {
+			about[0] = "size unknown"
+		}
+		if f.Type != "" {
+			about = append(about, f.Type)
+		}
+		if f.SHA256 != "" {
+			about = append(about, "sha256 "+f.SHA256)
+		}
+		fmt.Fprintf(w, "%3d  %s (%s)\n", i+1, f.Name, strings.Join(about, ", "))
+		total += f.Size
+	}
+	fmt.Fprintf(w, "%d files, %s\n", len(offered), formatSize(total))
+}
+
+// parsePicks parses an answer to pickAsking for a list of n, returning the
+// indexes picked in increasing order.
+func parsePicks(answer string, n int) ([]int, bool) {
+	switch strings.ToLower(answer) {
+	case "", "all", "a", "y", "yes":
+		return pickAll(make([]wormhole.OfferedFile, n)), true
+	case "none", "n", "no":
+		return []int{}, true
+	}
+	want := make([]bool, n)
+	for _, r := range strings.Split(answer, ",") {
+		r = strings.TrimSpace(r)
+		first, last := r, r
+		if dash := strings.Index(r, "-"); dash >= 0 {
+			first, last = r[:dash], r[dash+1:]
+		}
+		i, err := strconv.Atoi(first)
+		j, err2 := strconv.Atoi(last)
+		if err != nil || err2 != nil || i < 1 || j > n || i > j {
+			return nil, false
+		}
+		for k := i; k <= j; k++ {
+			want[k-1] = true
+		}
+	}
+	picked := []int{}
+	for i, ok := range want {
+		if ok {
+			picked = append(picked, i)
+		}
+	}
+	return picked, true
+}
+
+// pickBatch reads the offer the sender started with on c, the first
+// message of which is in first, answers it with the files pick picks, and
+// returns those.
+func pickBatch(c *wormhole.Conn, first []byte, pick picker, m meter) ([]wormhole.OfferedFile, error) {
+	o, err := c.ReadOffer(first)
+	if err != nil {
+		return nil, transferErrorf(exitNetwork, "could not read the list of files: %v", err)
+	}
+	if pick == nil {
+		pick = pickAll
+	}
+	accept := pick(o.Files)
+	if len(accept) == 0 && len(o.Files) > 0 {
+		// Picking none is turning the lot down, so say so, for the sender
+		// to tell its user rather than send nothing.
+		if err := o.Reject(); err != nil {
+			return nil, transferErrorf(exitNetwork, "could not decline the files: %v", err)
+		}
+		fmt.Fprintf(flag.CommandLine.Output(), "declined %d files\n", len(o.Files))
+		return nil, nil
+	}
+	if alg := pickCompression(o.Compressions); alg != "" {
+		o.UseCompression(alg)
+	}
+	err = o.AcceptOnly(accept)
+	if err == wormhole.ErrBadAnswer {
+		return nil, transferErrorf(exitFailure, "could not say which files to send: %v", err)
+	}
+	if err != nil {
+		return nil, transferErrorf(exitNetwork, "could not say which files to send: %v", err)
+	}
+	picked := make([]wormhole.OfferedFile, len(accept))
+	for i, k := range accept {
+		picked[i] = o.Files[k]
+	}
+	if bm, ok := m.(batchMeter); ok {
+		bm.batch(picked)
+	}
+	return picked, nil
+}
+
+// summer is a meter that hashes each file, to check against its batch and
+// trailer.
+type summer struct {
+	h hash.Hash
+}
+
+func (s *summer) start(name string, size int64) { s.h = sha256.New() }
+func (s *summer) Write(p []byte) (int, error)   { return s.h.Write(p) }
+func (s *summer) done(limit string)             {}
+
+func (s *summer) sum() string    { return hex.EncodeToString(s.h.Sum(nil)) }
+func (s *summer) digest() []byte { return s.h.Sum(nil) }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"webwormhole.io/wormhole"
+)
+
+func TestParsePicks(t *testing.T) {
+	cases := []struct {
+		answer string
+		want   []int
+		ok     bool
+	}{
+		{"", []int{0, 1, 2, 3, 4}, true},
+		{"all", []int{0, 1, 2, 3, 4}, true},
+		{"none", []int{}, true},
+		{"2", []int{1}, true},
+		{"1,3-4", []int{0, 2, 3}, true},
+		{"4, 1 ,1", []int{0, 3}, true},
+		{"0", nil, false},
+		{"6", nil, false},
+		{"3-2", nil, false},
+		{"x", nil, false},
+	}
+	for _, c := range cases {
+		got, ok := parsePicks(c.answer, 5)
+		if ok != c.ok || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("testcase %q got %v %v want %v %v", c.answer, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestPickMatching(t *testing.T) {
+	files := []wormhole.OfferedFile{{Name: "a.jpg"}, {Name: "b.txt"}, {Name: "c.png"}, {Name: "photos.tar"}}
+	cases := []struct {
+		patterns string
+		want     []int
+	}{
+		{"*.jpg", []int{0}},
+		{"*.jpg, *.png", []int{0, 2}},
+		{"*", []int{0, 1, 2, 3}},
+		{"*.gif", nil},
+	}
+	for _, c := range cases {
+		if got := pickMatching(c.patterns)(files); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("testcase %q got %v want %v", c.patterns, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// +build !lite
+
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+// canaryLimit is the most a canary echoes back to each peer.
+const canaryLimit = 1 << 20
+
+// runCanary keeps a test peer waiting on canarySlot for ww doctor, using
+// iceServers. It reaches the server through a listener of its own on the
+// loopback interface, so that it's neither authenticated nor fenced, and
+// serves the shared namespace.
+func runCanary(iceServers []string) error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	// Other users of this machine shouldn't be able to get past
+	// authentication through the listener.
+	secret := make([]byte, 16)
+	if _, err := crand.Read(secret); err != nil {
+		return err
+	}
+	bearer := "Bearer " + hex.EncodeToString(secret)
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != bearer {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		relay(w, r)
+	}))
+	d := &wormhole.Dialer{
+		SignalServer: "http://" + l.Addr().String() + "/",
+		ICEServers:   iceServers,
+		Header:       http.Header{"Authorization": {bearer}},
+	}
+	go func() {
+		for {
+			c, err := d.Reserve(canarySlot, canaryPass)
+			if err != nil && err != wormhole.ErrTimedOut {
+				log.Printf("canary: %v", err)
+				time.Sleep(time.Second)
+			}
+			if err == nil {
+				go echo(c)
+			}
+		}
+	}()
+	return nil
+}
+
+// echo sends back what the peer sends over c, up to canaryLimit bytes or
+// for a minute.
+func echo(c *wormhole.Conn) {
+	defer c.Close()
+	t := time.AfterFunc(time.Minute, func() { c.Close() })
+	defer t.Stop()
+	buf := make([]byte, msgChunkSize)
+	for total := 0; total < canaryLimit; {
+		n, err := c.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := c.Write(buf[:n]); err != nil {
+			return
+		}
+		total += n
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"webwormhole.io/wormhole"
+)
+
+func init() {
+	subcmds["cancel"] = cancel
+}
+
+// While a code waits for the peer, the secret that cancels its slot is kept
+// in the user's cache directory, so that ww cancel can free it from another
+// terminal. Interrupting ww frees it too.
+
+// interrupted is set once ww is cancelling its own code on the way out.
+var interrupted int32
+
+// waitingSlot is a slot booked on a signalling server, waiting for the
+// peer.
+type waitingSlot struct {
+	Server string `json:"server"`
+	Revoke string `json:"revoke"`
+}
+
+// waitingPath returns where the waitingSlot for slot is kept.
+func waitingPath(slot string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "webwormhole", "waiting", filepath.Base(slot)), nil
+}
+
+// revocable gives d a secret to cancel the slot it books with.
+func revocable(d *wormhole.Dialer) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	d.Revoke = hex.EncodeToString(b)
+}
+
+// waitOn keeps the secret to cancel slot, booked by d, for ww cancel, and
+// cancels it if ww is interrupted before release is called.
+func waitOn(d *wormhole.Dialer, slot string) (release func()) {
+	p, err := waitingPath(slot)
+	if err == nil {
+		b, _ := json.Marshal(waitingSlot{d.SignalServer, d.Revoke})
+		if err = os.MkdirAll(filepath.Dir(p), 0700); err == nil {
+			err = ioutil.WriteFile(p, b, 0600)
+		}
+	}
+	if err != nil {
+		p = ""
+	}
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			if p != "" {
+				os.Remove(p)
+			}
+		})
+	}
+	onexit(func() {
+		waiting := false
+		once.Do(func() { waiting = true })
+		if !waiting {
+			return
+		}
+		if p != "" {
+			os.Remove(p)
+		}
+		out := flag.CommandLine.Output()
+		atomic.StoreInt32(&interrupted, 1)
+		if err := d.Cancel(slot); err != nil {
+			fmt.Fprintf(out, "could not cancel the code, it may work until it expires: %v\n", err)
+			return
+		}
+		fmt.Fprintf(out, "cancelled the code\n")
+	})
+	return release
+}
+
+func cancel(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "cancel a code this machine is waiting on, freeing its slot\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s code\n", os.Args[0], args[0])
+	}
+	set.Parse(args[1:])
+	if set.NArg() != 1 {
+		set.Usage()
+		os.Exit(exitUsage)
+	}
+	slot := strings.Split(set.Arg(0), "-")[0]
+	p, err := waitingPath(slot)
+	if err != nil {
+		fatalf("could not find waiting codes: %v", err)
+	}
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		exitf(exitFailure, "nothing here is waiting on %s", set.Arg(0))
+	}
+	var ws waitingSlot
+	if err == nil {
+		err = json.Unmarshal(b, &ws)
+	}
+	if err != nil {
+		exitf(exitDisk, "could not read %s: %v", p, err)
+	}
+	d := dialer()
+	d.SignalServer, d.Revoke = ws.Server, ws.Revoke
+	err = d.Cancel(slot)
+	switch err {
+	case nil:
+		os.Remove(p)
+		fmt.Fprintf(set.Output(), "cancelled %s, the signalling server has freed its slot\n", set.Arg(0))
+	case wormhole.ErrNoSuchSlot:
+		os.Remove(p)
+		exitf(exitFailure, "%s isn't waiting anymore, it was used or has expired", set.Arg(0))
+	case wormhole.ErrBadVersion:
+		exitf(exitFailure, "the signalling server is too old to cancel codes")
+	default:
+		exitf(exitstatus(err), "could not cancel: %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+// catalogLabel labels the stream a sender opens to let the receiver browse
+// a directory tree and pick files from it before any are sent. Directories
+// are listed as the receiver asks for them, so huge trees are quick to
+// start browsing.
+const catalogLabel = "webwormhole-catalog"
+
+// catalogRequest is a receiver's request on the catalog stream, either to
+// list the directory at Path, or to get the files picked, which ends
+// browsing. Paths are slash separated and relative to the tree's root.
+type catalogRequest struct {
+	Op   string   `json:"op"` // "list" or "get".
+	Path string   `json:"path,omitempty"`
+	Get  []string `json:"get,omitempty"`
+}
+
+type catalogEntry struct {
+	Name string    `json:"name"`
+	Size int64     `json:"size"`
+	Dir  bool      `json:"dir,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// catalogPage is part of a listing. Big directories take several pages,
+// all but the last with More set.
+type catalogPage struct {
+	Entries []catalogEntry `json:"entries"`
+	More    bool           `json:"more,omitempty"`
+	Err     string         `json:"err,omitempty"`
+}
+
+func writeMsg(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func readMsg(r io.Reader, buf []byte, v interface{}) error {
+	n, err := r.Read(buf)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf[:n], v)
+}
+
+// catalogPath returns the local path of p in the tree at root, and whether
+// it's really in the tree, rather than somewhere a link leads to.
+func catalogPath(root, p string) (string, bool) {
+	f := filepath.Join(root, filepath.FromSlash(path.Clean("/"+p)))
+	r, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return f, false
+	}
+	real, err := filepath.EvalSymlinks(f)
+	if err != nil {
+		return f, false
+	}
+	rel, err := filepath.Rel(r, real)
+	return f, err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// serveCatalog lets the receiver browse the tree at root, and returns the
+// files they picked.
+func serveCatalog(c *wormhole.Conn, root string) ([]string, error) {
+	s, err := c.OpenStream(catalogLabel)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	buf := make([]byte, msgChunkSize)
+	for {
+		var req catalogRequest
+		if err := readMsg(s, buf, &req); err != nil {
+			return nil, err
+		}
+		switch req.Op {
+		case "list":
+			dir, ok := catalogPath(root, req.Path)
+			if !ok {
+				err = writeMsg(s, catalogPage{Err: "no such directory"})
+			} else {
+				err = sendListing(s, dir)
+			}
+			if err != nil {
+				return nil, err
+			}
+		case "get":
+			var files []string
+			for _, p := range req.Get {
+				f, ok := catalogPath(root, p)
+				if info, err := os.Stat(f); ok && err == nil && info.Mode().IsRegular() {
+					files = append(files, f)
+				}
+			}
+			return files, nil
+		}
+	}
+}
+
+// sendListing sends the files and directories in dir, in pages of up to
+// about half a chunk.
+func sendListing(w io.Writer, dir string) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		// Don't tell the peer where the tree is.
+		if e, ok := err.(*os.PathError); ok {
+			err = e.Err
+		}
+		return writeMsg(w, catalogPage{Err: err.Error()})
+	}
+	var page catalogPage
+	size := 0
+	for _, info := range infos {
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			continue
+		}
+		e := catalogEntry{info.Name(), info.Size(), info.IsDir(), info.ModTime()}
+		b, _ := json.Marshal(e)
+		if size+len(b) > msgChunkSize/2 && len(page.Entries) > 0 {
+			page.More = true
+			if err := writeMsg(w, page); err != nil {
+				return err
+			}
+			page, size = catalogPage{}, 0
+		}
+		page.Entries = append(page.Entries, e)
+		size += len(b) + 1
+	}
+	return writeMsg(w, page)
+}
+
+// list asks for the listing of the directory at p.
+func list(s *wormhole.Stream, buf []byte, p string) ([]catalogEntry, error) {
+	if err := writeMsg(s, catalogRequest{Op: "list", Path: p}); err != nil {
+		return nil, err
+	}
+	var entries []catalogEntry
+	for {
+		var page catalogPage
+		if err := readMsg(s, buf, &page); err != nil {
+			return nil, err
+		}
+		if page.Err != "" {
+			return nil, fmt.Errorf("%s", page.Err)
+		}
+		entries = append(entries, page.Entries...)
+		if !page.More {
+			return entries, nil
+		}
+	}
+}
+
+// resolve returns the path p names relative to directory cwd.
+func resolve(cwd, p string) string {
+	if strings.HasPrefix(p, "/") {
+		return path.Clean(p)
+	}
+	return path.Join(cwd, p)
+}
+
+// browse lets the user at the terminal look through the tree the sender
+// offers on s, and pick files to get. Without a terminal, it gets nothing.
+func browse(s *wormhole.Stream, w io.Writer) {
+	defer s.Close()
+	if !interactive {
+		fmt.Fprintf(w, "the sender offered files to pick from, which needs a terminal\n")
+		writeMsg(s, catalogRequest{Op: "get"})
+		return
+	}
+	fmt.Fprintf(w, "the sender offered files to pick from\n")
+	help := func() {
+		fmt.Fprintf(w, "  ls [dir]        list a directory\n")
+		fmt.Fprintf(w, "  cd dir          change directory\n")
+		fmt.Fprintf(w, "  get file...     pick files to get\n")
+		fmt.Fprintf(w, "  done            get the files picked\n")
+	}
+	help()
+	buf := make([]byte, msgChunkSize)
+	cwd := "/"
+	var picked []string
+	in := bufio.NewScanner(os.Stdin)
+loop:
+	for {
+		fmt.Fprintf(w, "%s> ", cwd)
+		if !in.Scan() {
+			break loop
+		}
+		args := strings.Fields(in.Text())
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "done":
+			break loop
+		case "ls":
+			p := cwd
+			if len(args) > 1 {
+				p = resolve(cwd, args[1])
+			}
+			entries, err := list(s, buf, p)
+			if err != nil {
+				fmt.Fprintf(w, "could not list %s: %v\n", p, err)
+				continue
+			}
+			tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+			for _, e := range entries {
+				if e.Dir {
+					fmt.Fprintf(tw, "-\t%s\t%s/\n", e.Time.Format("2006-01-02 15:04"), e.Name)
+				} else {
+					fmt.Fprintf(tw, "%s\t%s\t%s\n", formatSize(e.Size), e.Time.Format("2006-01-02 15:04"), e.Name)
+				}
+			}
+			tw.Flush()
+		case "cd":
+			if len(args) < 2 {
+				cwd = "/"
+				continue
+			}
+			p := resolve(cwd, args[1])
+			if _, err := list(s, buf, p); err != nil {
+				fmt.Fprintf(w, "could not change to %s: %v\n", p, err)
+				continue
+			}
+			cwd = p
+		case "get":
+			for _, f := range args[1:] {
+				picked = append(picked, resolve(cwd, f))
+			}
+			fmt.Fprintf(w, "%d files picked\n", len(picked))
+		default:
+			help()
+		}
+	}
+	if err := writeMsg(s, catalogRequest{Op: "get", Get: picked}); err != nil {
+		fmt.Fprintf(w, "could not ask for files: %v\n", err)
+	}
+}
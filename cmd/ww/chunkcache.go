@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+
+	"webwormhole.io/wormhole"
+)
+
+// With -chunk-cache, ww keeps the chunk hashes of the files it sends and
+// receives whole in the user's cache directory, by resume token, so that
+// the same file sent again, to any peer, needn't be hashed or sent again:
+//
+//   - Senders answer resume offers from the hashes they kept rather than
+//     reading and hashing what the receiver says it has.
+//   - Receivers that got the file before, and still have it as it was,
+//     start from a copy of it, and offer to resume at its end.
+//
+// Either side can have it on without the other.
+
+// chunkMeter hashes what's sent or received in chunks, for the cache.
+type chunkMeter struct {
+	*wormhole.ChunkHasher
+}
+
+func (chunkMeter) start(name string, size int64) {}
+func (chunkMeter) done(limit string)             {}
+
+// cachePath returns where the chunk hashes of the file with token are
+// kept.
+func cachePath(token string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "webwormhole", "chunks", filepath.Base(token)), nil
+}
+
+// cachedChunks returns what's kept of the file with token: the path it
+// was sent from or received into, and its chunk hashes. It returns nil if
+// there's nothing.
+func cachedChunks(token string) (*wormhole.Partial, [][]byte) {
+	path, err := cachePath(token)
+	if err != nil {
+		return nil, nil
+	}
+	p, err := wormhole.LoadPartial(path)
+	if err != nil || p.Token != token {
+		return nil, nil
+	}
+	sums, err := p.Chunks()
+	if err != nil {
+		return nil, nil
+	}
+	return p, sums
+}
+
+// cacheChunks keeps the chunk hashes of the file at name with token.
+// It's only a cache, so it doesn't complain.
+func cacheChunks(token, name string, size int64, sums [][]byte) {
+	if len(sums) == 0 {
+		return
+	}
+	path, err := cachePath(token)
+	if err != nil {
+		return
+	}
+	if abs, err := filepath.Abs(name); err == nil {
+		name = abs
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	p := &wormhole.Partial{Token: token, Name: name, Size: size}
+	p.SetSums(sums)
+	p.Save(path)
+}
+
+// copyReceived starts receiving the file h describes into dir from a copy
+// of the one received with the same token before, as far as it still
+// checks out, and returns it and the partial to go on with, the way
+// loadPartial does. It returns nil if there's nothing to copy from.
+func copyReceived(dir string, h header, names *namer, buf []byte) (*os.File, *partial) {
+	cp, sums := cachedChunks(h.Resume)
+	if cp == nil || cp.Size != int64(h.Size) {
+		return nil, nil
+	}
+	src, err := os.Open(cp.Name)
+	if err != nil {
+		return nil, nil
+	}
+	defer src.Close()
+	f, name, err := names.create(dir, h.Name)
+	if err != nil {
+		return nil, nil
+	}
+	// Resuming reads back what's there.
+	f.Close()
+	f, err = os.OpenFile(filepath.Join(dir, name), os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil
+	}
+	hasher := &wormhole.ChunkHasher{}
+	io.CopyBuffer(io.MultiWriter(f, hasher), io.LimitReader(src, int64(len(sums))*wormhole.ResumeChunk), buf)
+	k := 0
+	for k < len(hasher.Sums) && bytes.Equal(hasher.Sums[k], sums[k]) {
+		k++
+	}
+	return f, &partial{
+		Partial: &wormhole.Partial{Token: h.Resume, Name: name, Size: int64(h.Size)},
+		path:    partialPath(dir, h.Resume),
+		hasher:  &wormhole.ChunkHasher{Sums: hasher.Sums[:k]},
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"webwormhole.io/wormhole"
+)
+
+func TestCopyReceived(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ww")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("XDG_CACHE_HOME", os.Getenv("XDG_CACHE_HOME"))
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "cache"))
+	os.Setenv("HOME", dir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 5*wormhole.ResumeChunk/2/16)
+	h := header{Name: "f", Size: len(data), Resume: "token"}
+	hasher := &wormhole.ChunkHasher{}
+	hasher.Write(data)
+	old := filepath.Join(dir, "old")
+	cacheChunks(h.Resume, old, int64(h.Size), hasher.Sums)
+
+	tests := []struct {
+		data []byte
+		h    header
+		want int64
+	}{
+		{data, h, 2 * wormhole.ResumeChunk},
+		{append(append([]byte{}, data[:wormhole.ResumeChunk]...), make([]byte, wormhole.ResumeChunk)...), h, wormhole.ResumeChunk},
+		{append([]byte{1}, data[1:]...), h, 0},
+		{nil, h, -1},
+		{data, header{Name: h.Name, Size: h.Size + 1, Resume: h.Resume}, -1},
+	}
+	for _, test := range tests {
+		os.Remove(old)
+		if test.data != nil {
+			ioutil.WriteFile(old, test.data, 0644)
+		}
+		into, _ := ioutil.TempDir(dir, "into")
+		f, got := copyReceived(into, test.h, newNamer(), make([]byte, msgChunkSize))
+		if (got == nil) != (test.want < 0) || got != nil && got.hasher.Offset() != test.want {
+			t.Errorf("testcase %v got %v want %v", len(test.data), got, test.want)
+		}
+		if f != nil {
+			f.Close()
+			b, _ := ioutil.ReadFile(filepath.Join(into, got.Name))
+			if !bytes.HasPrefix(test.data, b[:got.hasher.Offset()]) {
+				t.Errorf("testcase %v copied the wrong bytes", len(test.data))
+			}
+		}
+	}
+}
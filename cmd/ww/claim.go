@@ -0,0 +1,68 @@
+// +build !lite
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A claim is a slot whose peers have met, and are still signalling. Anyone
+// else trying the slot meanwhile may have intercepted the code, so the
+// peers are told and the handshake called off.
+type claim struct {
+	tried chan struct{}
+	once  sync.Once
+}
+
+// claims holds the slots being signalled on. It's guarded by slots' lock.
+var claims = make(map[string]*claim)
+
+// claimSlot records that the peers on the slot with key have met. This
+// assumes slots is locked.
+func claimSlot(key string) *claim {
+	c := &claim{tried: make(chan struct{})}
+	claims[key] = c
+	return c
+}
+
+// unclaim forgets claim c on the slot with key, once its peers are done.
+func unclaim(key string, c *claim) {
+	slots.Lock()
+	if claims[key] == c {
+		delete(claims, key)
+	}
+	slots.Unlock()
+}
+
+// try raises the alarm for the peers on the slot with key, if they're
+// still signalling, and reports whether they were. This assumes slots is
+// locked.
+func try(key string) bool {
+	c, ok := claims[key]
+	if ok {
+		c.once.Do(func() { close(c.tried) })
+	}
+	return ok
+}
+
+// watch tells whoever's on conn, and then hangs up, if somebody else tries
+// claim c before ctx is done.
+func (c *claim) watch(ctx context.Context, key string, conn sigConn) {
+	select {
+	case <-ctx.Done():
+	case <-c.tried:
+		log.Printf("%s tried again", key)
+		conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(4000+http.StatusLocked, "somebody else tried the code"),
+			time.Now().Add(10*time.Second),
+		)
+		conn.Close()
+	}
+}
@@ -0,0 +1,839 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+	"webwormhole.io/wormhole"
+)
+
+// Cloud storage is reached over its HTTP APIs directly, rather than through
+// each provider's SDK. S3 and S3 compatible services are signed with AWS
+// Signature Version 4, which GCS accepts with HMAC keys too. WebDAV is plain
+// HTTP with basic auth.
+
+// A sink is somewhere other than local disk to receive files into.
+type sink interface {
+	// exists reports whether there's a file called name already.
+	exists(name string) (bool, error)
+	// create starts receiving a file of size bytes called name.
+	create(name string, size int64) (upload, error)
+}
+
+// An upload is a file on its way into a sink. Nothing's there until it's
+// committed.
+type upload interface {
+	io.Writer
+	commit() error
+	abort()
+}
+
+// A remote is a file in cloud storage to send.
+type remote interface {
+	// stat returns the file's size and modification time, if it's known.
+	stat() (int64, time.Time, error)
+	// open returns the file's contents, along with what stat does.
+	open() (io.ReadCloser, int64, time.Time, error)
+}
+
+// remoteSchemes are the schemes of the URLs openRemote opens.
+var remoteSchemes = map[string]bool{"s3": true, "gs": true, "webdav": true, "webdavs": true, "dav": true, "davs": true}
+
+// isRemote reports whether the file to send called name is a URL for
+// openRemote rather than a local path.
+func isRemote(name string) bool {
+	u, err := url.Parse(name)
+	return err == nil && remoteSchemes[u.Scheme]
+}
+
+// openRemote returns the file in cloud storage at rawurl, one of
+//
+//	s3://bucket/key
+//	gs://bucket/key
+//	webdav://host/path or webdavs://host/path for https
+//
+// and its name.
+func openRemote(rawurl string) (remote, string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, "", err
+	}
+	name := path.Base(u.Path)
+	if u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return nil, "", fmt.Errorf("no file in %s", rawurl)
+	}
+	switch u.Scheme {
+	case "s3", "gs":
+		b, err := newBucket(&url.URL{Scheme: u.Scheme, Host: u.Host})
+		if err != nil {
+			return nil, "", err
+		}
+		return &s3Object{b, strings.TrimPrefix(u.Path, "/")}, name, nil
+	case "webdav", "webdavs", "dav", "davs":
+		dir := *u
+		dir.Path = path.Dir(u.Path)
+		return &webdavFile{newWebDAV(&dir), name}, name, nil
+	}
+	return nil, "", fmt.Errorf("unknown kind of storage %q", u.Scheme)
+}
+
+// sizeOf returns the size and modification time of what resp is about.
+func sizeOf(resp *http.Response) (int64, time.Time, error) {
+	if resp.ContentLength < 0 {
+		return 0, time.Time{}, errors.New("server didn't say how big it is")
+	}
+	t, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return resp.ContentLength, t, nil
+}
+
+// openSink returns the sink at rawurl, one of
+//
+//	s3://bucket/prefix/
+//	gs://bucket/prefix/
+//	webdav://host/path/ or webdavs://host/path/ for https
+func openSink(rawurl string) (sink, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "s3", "gs":
+		return newBucket(u)
+	case "webdav", "webdavs", "dav", "davs":
+		return newWebDAV(u), nil
+	case "smb":
+		return nil, fmt.Errorf("can't write to SMB shares directly, mount the share, or on Windows use -dir \\\\host\\share")
+	}
+	return nil, fmt.Errorf("unknown kind of storage %q", u.Scheme)
+}
+
+// cloudClient is for talking to storage services. Uploads can take a
+// while, so there's no overall timeout.
+var cloudClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: time.Minute,
+	},
+}
+
+// s3Bucket is a bucket in S3 or GCS, or a storage service with the same API,
+// with keys under prefix.
+type s3Bucket struct {
+	base   *url.URL // The bucket's URL, with a trailing slash.
+	prefix string
+
+	region     string
+	id, secret string
+	token      string
+	now        func() time.Time
+	partSize   int
+}
+
+// maxParts is the most parts an upload can have.
+const maxParts = 10000
+
+// newBucket returns the bucket at s3://bucket/prefix, or gs://bucket/prefix.
+// Credentials come from the usual AWS environment variables for S3, and
+// $GS_ACCESS_KEY_ID and $GS_SECRET_ACCESS_KEY, HMAC keys, for GCS. For other
+// services with the S3 API, set $AWS_ENDPOINT_URL.
+func newBucket(u *url.URL) (*s3Bucket, error) {
+	b := &s3Bucket{
+		prefix:   strings.TrimPrefix(u.Path, "/"),
+		now:      time.Now,
+		partSize: 8 << 20,
+	}
+	if b.prefix != "" && !strings.HasSuffix(b.prefix, "/") {
+		b.prefix += "/"
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no bucket in %s", u)
+	}
+	var endpoint string
+	switch u.Scheme {
+	case "gs":
+		b.region = "auto"
+		b.id, b.secret = os.Getenv("GS_ACCESS_KEY_ID"), os.Getenv("GS_SECRET_ACCESS_KEY")
+		endpoint = "https://storage.googleapis.com"
+	default:
+		b.region = os.Getenv("AWS_REGION")
+		if b.region == "" {
+			b.region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+		if b.region == "" {
+			b.region = "us-east-1"
+		}
+		b.id, b.secret = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		b.token = os.Getenv("AWS_SESSION_TOKEN")
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if b.id == "" || b.secret == "" {
+		return nil, fmt.Errorf("no credentials for %s:// in the environment", u.Scheme)
+	}
+	if endpoint == "" {
+		// Virtual hosted, which AWS prefers.
+		b.base = &url.URL{Scheme: "https", Host: u.Host + ".s3." + b.region + ".amazonaws.com", Path: "/"}
+		return b, nil
+	}
+	e, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("bad endpoint %q: %v", endpoint, err)
+	}
+	b.base = &url.URL{Scheme: e.Scheme, Host: e.Host, Path: strings.TrimSuffix(e.Path, "/") + "/" + u.Host + "/"}
+	return b, nil
+}
+
+// s3Error is the body of an error response.
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// send makes a request about key, signed. It's up to the caller to close
+// the response's body.
+func (b *s3Bucket) send(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *b.base
+	u.Path += b.prefix + key
+	u.RawPath = b.base.EscapedPath() + uriEncode(b.prefix+key, false)
+	u.RawQuery = canonicalQuery(query)
+	r, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	b.sign(r, body)
+	return cloudClient.Do(r)
+}
+
+// do is send, but only returns the response if it's a success.
+func (b *s3Bucket) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	resp, err := b.send(method, key, query, header, body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		var e s3Error
+		xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&e)
+		if e.Code == "" {
+			return nil, fmt.Errorf("%s %s: %s", method, key, resp.Status)
+		}
+		return nil, fmt.Errorf("%s %s: %s: %s", method, key, e.Code, e.Message)
+	}
+	return resp, nil
+}
+
+// sign signs r, with body, with Signature Version 4. It signs every header
+// that's set, so set them first.
+func (b *s3Bucket) sign(r *http.Request, body []byte) {
+	t := b.now().UTC()
+	date := t.Format("20060102")
+	payload := sha256.Sum256(body)
+	r.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	r.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+	if b.token != "" {
+		r.Header.Set("X-Amz-Security-Token", b.token)
+	}
+
+	names := []string{"host"}
+	values := map[string]string{"host": r.URL.Host}
+	for k, v := range r.Header {
+		k = strings.ToLower(k)
+		names = append(names, k)
+		values[k] = strings.Join(v, ",")
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&headers, "%s:%s\n", k, strings.TrimSpace(values[k]))
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.RawQuery,
+		headers.String(),
+		signed,
+		hex.EncodeToString(payload[:]),
+	}, "\n")
+	scope := date + "/" + b.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := signingKey(b.secret, date, b.region, "s3")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", b.id, scope, signed, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signingKey derives the key for signing requests to service in region
+// on date.
+func signingKey(secret, date, region, service string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), date)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, service)
+	return hmacSHA256(k, "aws4_request")
+}
+
+// uriEncode escapes s the way Signature Version 4 wants, which is stricter
+// than net/url. Slashes are kept as they are unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes q sorted by key, as signed.
+func canonicalQuery(q url.Values) string {
+	var keys []string
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Object is an object in a bucket, by its full key.
+type s3Object struct {
+	b   *s3Bucket
+	key string
+}
+
+func (o *s3Object) stat() (int64, time.Time, error) {
+	resp, err := o.b.do(http.MethodHead, o.key, nil, nil, nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	resp.Body.Close()
+	return sizeOf(resp)
+}
+
+func (o *s3Object) open() (io.ReadCloser, int64, time.Time, error) {
+	resp, err := o.b.do(http.MethodGet, o.key, nil, nil, nil)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	size, modified, err := sizeOf(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, 0, time.Time{}, err
+	}
+	return resp.Body, size, modified, nil
+}
+
+func (b *s3Bucket) exists(name string) (bool, error) {
+	resp, err := b.send(http.MethodHead, name, nil, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode/100 == 2:
+		return true, nil
+	}
+	return false, fmt.Errorf("HEAD %s: %s", name, resp.Status)
+}
+
+func (b *s3Bucket) create(name string, size int64) (upload, error) {
+	u := &s3Upload{b: b, key: name, size: int(b.partSize)}
+	// Parts have to be big enough for the file to fit in the most there
+	// can be, rounded up to a MiB.
+	if size/maxParts >= int64(u.size) {
+		u.size = int((size/maxParts + 1<<20) &^ (1<<20 - 1))
+	}
+	return u, nil
+}
+
+// s3Upload uploads a file a part at a time, or all at once if it fits
+// in one part. Every part is signed with its hash, so the service checks
+// each made it whole.
+type s3Upload struct {
+	b     *s3Bucket
+	key   string
+	size  int    // Of parts.
+	part  []byte // Of the next part, up to size.
+	id    string // Of the multipart upload, once started.
+	parts []completedPart
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (u *s3Upload) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if u.part == nil {
+			u.part = make([]byte, 0, u.size)
+		}
+		k := u.size - len(u.part)
+		if k > len(p) {
+			k = len(p)
+		}
+		u.part = append(u.part, p[:k]...)
+		p = p[k:]
+		if len(u.part) == u.size {
+			if err := u.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush uploads the part so far, starting a multipart upload if it has to.
+func (u *s3Upload) flush() error {
+	if u.id == "" {
+		resp, err := u.b.do(http.MethodPost, u.key, url.Values{"uploads": {""}}, nil, nil)
+		if err != nil {
+			return err
+		}
+		var started struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&started)
+		resp.Body.Close()
+		if err != nil || started.UploadID == "" {
+			return fmt.Errorf("could not start upload of %s: %v", u.key, err)
+		}
+		u.id = started.UploadID
+	}
+	number := len(u.parts) + 1
+	resp, err := u.b.do(http.MethodPut, u.key, url.Values{
+		"partNumber": {fmt.Sprint(number)},
+		"uploadId":   {u.id},
+	}, nil, u.part)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	u.parts = append(u.parts, completedPart{number, resp.Header.Get("ETag")})
+	u.part = u.part[:0]
+	return nil
+}
+
+func (u *s3Upload) commit() error {
+	if u.id == "" {
+		resp, err := u.b.do(http.MethodPut, u.key, nil, nil, u.part)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if len(u.part) > 0 {
+		if err := u.flush(); err != nil {
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: u.parts})
+	if err != nil {
+		return err
+	}
+	resp, err := u.b.do(http.MethodPost, u.key, url.Values{"uploadId": {u.id}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Completing can fail after it's said OK, in the body.
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	var e s3Error
+	if xml.Unmarshal(b, &e) == nil && e.Code != "" {
+		return fmt.Errorf("could not finish upload of %s: %s: %s", u.key, e.Code, e.Message)
+	}
+	return nil
+}
+
+func (u *s3Upload) abort() {
+	if u.id == "" {
+		return
+	}
+	resp, err := u.b.do(http.MethodDelete, u.key, url.Values{"uploadId": {u.id}}, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// webdav is a directory on a WebDAV server.
+type webdav struct {
+	base *url.URL // With a trailing slash.
+	user string
+	pass string
+}
+
+// newWebDAV returns the directory at webdav://[user:password@]host/path,
+// or webdavs:// for https. The password can be in $WW_WEBDAV_PASSWORD
+// instead.
+func newWebDAV(u *url.URL) *webdav {
+	d := &webdav{base: &url.URL{Scheme: "http", Host: u.Host, Path: u.Path}}
+	if strings.HasSuffix(u.Scheme, "s") {
+		d.base.Scheme = "https"
+	}
+	if !strings.HasSuffix(d.base.Path, "/") {
+		d.base.Path += "/"
+	}
+	if u.User != nil {
+		d.user = u.User.Username()
+		d.pass, _ = u.User.Password()
+	}
+	if p := os.Getenv("WW_WEBDAV_PASSWORD"); d.pass == "" && p != "" {
+		d.pass = p
+	}
+	return d
+}
+
+func (d *webdav) url(name string) string {
+	u := *d.base
+	u.Path += name
+	return u.String()
+}
+
+func (d *webdav) request(method, name string, body io.Reader) (*http.Request, error) {
+	r, err := http.NewRequest(method, d.url(name), body)
+	if err != nil {
+		return nil, err
+	}
+	if d.user != "" {
+		r.SetBasicAuth(d.user, d.pass)
+	}
+	return r, nil
+}
+
+func (d *webdav) do(r *http.Request) error {
+	resp, err := cloudClient.Do(r)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s", r.Method, r.URL.Path, resp.Status)
+	}
+	return nil
+}
+
+// webdavFile is a file on a WebDAV server.
+type webdavFile struct {
+	d    *webdav
+	name string
+}
+
+// get makes a request for the file, and returns the response if it's a
+// success.
+func (f *webdavFile) get(method string) (*http.Response, error) {
+	r, err := f.d.request(method, f.name, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cloudClient.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", method, r.URL.Path, resp.Status)
+	}
+	return resp, nil
+}
+
+func (f *webdavFile) stat() (int64, time.Time, error) {
+	resp, err := f.get(http.MethodHead)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	resp.Body.Close()
+	return sizeOf(resp)
+}
+
+func (f *webdavFile) open() (io.ReadCloser, int64, time.Time, error) {
+	resp, err := f.get(http.MethodGet)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	size, modified, err := sizeOf(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, 0, time.Time{}, err
+	}
+	return resp.Body, size, modified, nil
+}
+
+func (d *webdav) exists(name string) (bool, error) {
+	r, err := d.request(http.MethodHead, name, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := cloudClient.Do(r)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode/100 == 2:
+		return true, nil
+	}
+	return false, fmt.Errorf("HEAD %s: %s", r.URL.Path, resp.Status)
+}
+
+// create streams the file to a temporary name, and moves it into place
+// once it's committed.
+func (d *webdav) create(name string, size int64) (upload, error) {
+	pr, pw := io.Pipe()
+	u := &webdavUpload{d: d, name: name, tmp: ".ww-upload-" + randhex(8), pw: pw, done: make(chan struct{})}
+	r, err := d.request(http.MethodPut, u.tmp, pr)
+	if err != nil {
+		return nil, err
+	}
+	r.ContentLength = size
+	go func() {
+		u.err = d.do(r)
+		pr.CloseWithError(u.err)
+		close(u.done)
+	}()
+	return u, nil
+}
+
+type webdavUpload struct {
+	d         *webdav
+	name, tmp string
+	pw        *io.PipeWriter
+	done      chan struct{} // Closed once the PUT is over, with err.
+	err       error
+}
+
+func (u *webdavUpload) Write(p []byte) (int, error) { return u.pw.Write(p) }
+
+func (u *webdavUpload) commit() error {
+	u.pw.Close()
+	<-u.done
+	if u.err != nil {
+		return u.err
+	}
+	r, err := u.d.request("MOVE", u.tmp, nil)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Destination", u.d.url(u.name))
+	r.Header.Set("Overwrite", "T")
+	if err := u.d.do(r); err != nil {
+		u.abort()
+		return err
+	}
+	return nil
+}
+
+func (u *webdavUpload) abort() {
+	u.pw.CloseWithError(errors.New("aborted"))
+	<-u.done
+	if r, err := u.d.request(http.MethodDelete, u.tmp, nil); err == nil {
+		u.d.do(r)
+	}
+}
+
+// uploadWriter tells errors writing to an upload apart from those reading
+// from the peer.
+type uploadWriter struct {
+	upload
+	name string
+}
+
+func (w uploadWriter) Write(p []byte) (int, error) {
+	n, err := w.upload.Write(p)
+	if err != nil {
+		return n, transferErrorf(exitDisk, "could not upload %s: %v", w.name, err)
+	}
+	return n, nil
+}
+
+// receiveInto is receiveFiles for a sink. Files there can't be resumed or
+// unpacked, so directories are kept as archives, and the hashes the sender
+// lists or sends are checked before anything's committed.
+func receiveInto(c *wormhole.Conn, s sink, pick picker, m meter) error {
+	// Object stores take any name.
+	names := &namer{used: make(map[string]bool)}
+	buf := make([]byte, wormhole.MaxMessage)
+	go acceptStreams(c)
+	var listed []wormhole.OfferedFile
+	sums := &summer{}
+	m = meters{m, sums}
+	for {
+		n, err := c.Read(buf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return transferErrorf(exitNetwork, "could not read file header: %v", err)
+		}
+		if wormhole.IsOffer(buf[:n]) {
+			first := append([]byte(nil), buf[:n]...)
+			listed, err = pickBatch(c, first, pick, m)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		var h header
+		if err := json.Unmarshal(buf[:n], &h); err != nil {
+			return transferErrorf(exitFailure, "could not decode file header: %v", err)
+		}
+		var want string
+		if len(listed) > 0 {
+			want, listed = listed[0].SHA256, listed[1:]
+		}
+		if h.Text && h.Size <= maxText {
+			if err := receiveText(c, h, m, buf); err != nil {
+				return err
+			}
+			continue
+		}
+		if h.Resume != "" {
+			if err := startOver(c, buf); err != nil {
+				return err
+			}
+		}
+
+		name, err := names.pick(s, h.Name)
+		if err != nil {
+			return transferErrorf(exitDisk, "could not name %s: %v", h.Name, err)
+		}
+		if name != h.Name {
+			fmt.Fprintf(flag.CommandLine.Output(), "saving %q as %s\n", h.Name, name)
+		}
+		u, err := s.create(name, fileSize(h))
+		if err != nil {
+			return transferErrorf(exitDisk, "could not create %s: %v", name, err)
+		}
+		m.start(name, fileSize(h))
+		span := tr.start("transfer", root, "")
+		span.set("size", strconv.Itoa(h.Size))
+		contents, err := contentsOf(c, h, 0)
+		if err != nil {
+			u.abort()
+			return transferErrorf(exitFailure, "could not receive %s: %v", name, err)
+		}
+		written, err := io.CopyBuffer(io.MultiWriter(uploadWriter{u, name}, m), contents, buf)
+		if err == nil && !h.Chunked && written != int64(h.Size) {
+			err = transferErrorf(exitNetwork, "EOF before receiving all bytes: (%d/%d)", written, h.Size)
+		}
+		if err == nil {
+			err = checkTrailer(c, name, sums.digest(), m, buf)
+		}
+		if err == nil && want != "" && sums.sum() != want {
+			err = transferErrorf(exitFailure, "%s does not match the hash the sender listed", name)
+		}
+		if err == nil {
+			if err = u.commit(); err != nil {
+				err = transferErrorf(exitDisk, "could not upload %s: %v", name, err)
+			}
+		} else {
+			u.abort()
+		}
+		span.end(err)
+		if _, ok := err.(*transferError); ok {
+			return err
+		}
+		if err != nil {
+			return transferErrorf(exitNetwork, "could not receive file: %v", err)
+		}
+		m.done("")
+	}
+}
+
+// sendRemote sends the file in cloud storage at rawurl, as sendFiles sends
+// local files, streaming it through without keeping a copy. It can't be
+// resumed.
+func sendRemote(c *wormhole.Conn, rawurl string, depth int, keep bool, m meter, buf []byte) error {
+	r, name, err := openRemote(rawurl)
+	if err != nil {
+		return transferErrorf(exitUsage, "could not use %s: %v", rawurl, err)
+	}
+	body, size, modified, err := r.open()
+	if err != nil {
+		return transferErrorf(exitDisk, "could not open %s: %v", rawurl, err)
+	}
+	defer body.Close()
+	hdr := header{Name: norm.NFC.String(name), Size: int(size)}
+	if keep && !modified.IsZero() {
+		hdr.Modified = modified.UnixNano() / int64(time.Millisecond)
+	}
+	h, err := json.Marshal(hdr)
+	if err != nil {
+		return transferErrorf(exitFailure, "could not encode file header: %v", err)
+	}
+	if _, err = c.Write(h); err != nil {
+		return transferErrorf(exitNetwork, "could not send file header: %v", err)
+	}
+	m.start(hdr.Name, size)
+	span := tr.start("transfer", root, "")
+	span.set("size", strconv.FormatInt(size, 10))
+	stalled := c.Congestion().Stalled
+	ra := newReadAhead(body, depth, len(buf))
+	rd := &timedReader{Reader: io.LimitReader(ra, size)}
+	written, err := io.CopyBuffer(io.MultiWriter(c, m), rd, buf)
+	ra.Close()
+	limit := bottleneck(c.Congestion().Stalled-stalled, rd.d)
+	if limit != "" {
+		span.set("limited_by", limit)
+	}
+	span.end(err)
+	if err != nil {
+		return transferErrorf(exitNetwork, "could not send file: %v", err)
+	}
+	if written != size {
+		return transferErrorf(exitDisk, "EOF before sending all bytes: (%d/%d)", written, size)
+	}
+	m.done(limit)
+	return nil
+}
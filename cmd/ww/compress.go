@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"webwormhole.io/wormhole"
+)
+
+// With -compress, senders offer to compress what they send, and receivers
+// new enough take them up on it, unless they say -compress none. Files the
+// receiver gets compressed have the way they're compressed in their header,
+// and are sent in chunks, as with Chunked, since how long they'll be isn't
+// known up front. Their Size is still that of the file itself, which is
+// what resuming and the trailer go by too. Files that are compressed
+// already, going by their names, are sent as they are.
+
+// compressFlag checks -compress.
+func compressFlag() {
+	switch *compress {
+	case "", "none", wormhole.Gzip:
+	case "zstd":
+		exitf(exitUsage, "bad -compress zstd: this ww doesn't have it, use gzip")
+	default:
+		exitf(exitUsage, "bad -compress %q: want gzip or none", *compress)
+	}
+}
+
+// compressions returns the ways to offer to compress files in to the peer
+// on c.
+func compressions(c *wormhole.Conn) []string {
+	if *compress == "" || *compress == "none" || c.PeerVersion() < wormhole.MinCompress {
+		return nil
+	}
+	return []string{*compress}
+}
+
+// pickCompression picks one of the ways a sender offered to compress
+// files in, or "" for none.
+func pickCompression(offered []string) string {
+	if *compress == "none" {
+		return ""
+	}
+	for _, alg := range offered {
+		for _, ours := range wormhole.Compressions {
+			if alg == ours && (*compress == "" || *compress == alg) {
+				return alg
+			}
+		}
+	}
+	return ""
+}
+
+// precompressed are extensions of files that compressing again does
+// little for.
+var precompressed = map[string]bool{
+	".7z": true, ".avi": true, ".br": true, ".bz2": true, ".deb": true,
+	".docx": true, ".flac": true, ".gif": true, ".gz": true, ".heic": true,
+	".jar": true, ".jpeg": true, ".jpg": true, ".lz": true, ".lz4": true,
+	".m4a": true, ".mkv": true, ".mov": true, ".mp3": true, ".mp4": true,
+	".ogg": true, ".opus": true, ".png": true, ".pptx": true, ".rar": true,
+	".rpm": true, ".tgz": true, ".webm": true, ".webp": true, ".xlsx": true,
+	".xz": true, ".zip": true, ".zst": true, ".age": true,
+}
+
+// compressible is whether a file called name is worth compressing.
+func compressible(name string) bool {
+	return !precompressed[strings.ToLower(filepath.Ext(name))]
+}
+
+// A chunkWriter sends what's written to it over c in chunks, as
+// chunkedReader reads them, of up to len(buf)-1 bytes each. Close sends
+// the last one.
+type chunkWriter struct {
+	c   io.Writer
+	buf []byte
+	n   int
+}
+
+func newChunkWriter(c io.Writer, size int) *chunkWriter {
+	return &chunkWriter{c: c, buf: make([]byte, size), n: 1}
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		k := copy(w.buf[w.n:], p)
+		w.n += k
+		p = p[k:]
+		written += k
+		if w.n == len(w.buf) {
+			w.buf[0] = chunkMore
+			if _, err := w.c.Write(w.buf); err != nil {
+				return written, err
+			}
+			w.n = 1
+		}
+	}
+	return written, nil
+}
+
+func (w *chunkWriter) Close() error {
+	w.buf[0] = chunkLast
+	_, err := w.c.Write(w.buf[:w.n])
+	return err
+}
+
+// compressTo returns a writer that compresses what's written to it with
+// alg over c, in chunks of up to size bytes, and a function that sends
+// what's left once it's all written.
+func compressTo(c io.Writer, alg string, size int) (io.Writer, func() error, error) {
+	cw := newChunkWriter(c, size)
+	zw, err := wormhole.NewCompressor(alg, cw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return zw, func() error {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		return cw.Close()
+	}, nil
+}
+
+// drain reads the rest of a compressed file, past what its size says,
+// which ought to be nothing but the end of how it's compressed.
+func drain(r io.Reader) error {
+	n, err := io.Copy(ioutil.Discard, r)
+	if err == nil && n > 0 {
+		err = errors.New("more than its size")
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"webwormhole.io/wormhole"
+)
+
+// sent records each message written to it, like a data channel.
+type sent struct{ messages }
+
+func (s *sent) Write(p []byte) (int, error) {
+	s.messages = append(s.messages, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func TestCompressTo(t *testing.T) {
+	data := bytes.Repeat([]byte("all work and no play makes jack a dull boy\n"), 10000)
+	for _, n := range []int{0, 1, len(data)} {
+		s := &sent{}
+		w, flush, err := compressTo(s, wormhole.Gzip, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data[:n])
+		if err := flush(); err != nil {
+			t.Fatal(err)
+		}
+		total := 0
+		for _, m := range s.messages {
+			if len(m) > 1024 {
+				t.Errorf("%d bytes: sent a message of %d bytes", n, len(m))
+			}
+			total += len(m)
+		}
+		if n == len(data) && total > n/10 {
+			t.Errorf("%d bytes compressed into %d", n, total)
+		}
+		// Followed by the trailer, which mustn't be read as part of it.
+		s.messages = append(s.messages, []byte("trailer"))
+		h := header{Size: n, Compress: wormhole.Gzip}
+		r, err := wormhole.NewDecompressor(h.Compress, &chunkedReader{r: &s.messages, buf: make([]byte, wormhole.MaxMessage)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(got, data[:n]) {
+			t.Errorf("%d bytes: got %d bytes back, %v", n, len(got), err)
+		}
+		if len(s.messages) != 1 {
+			t.Errorf("%d bytes: %d messages left over, want the trailer", n, len(s.messages))
+		}
+	}
+}
+
+func TestPickCompression(t *testing.T) {
+	defer func(old string) { *compress = old }(*compress)
+	for _, tt := range []struct {
+		flag    string
+		offered []string
+		want    string
+	}{
+		{"", nil, ""},
+		{"", []string{"zstd", "gzip"}, "gzip"},
+		{"", []string{"zstd"}, ""},
+		{"gzip", []string{"gzip"}, "gzip"},
+		{"none", []string{"gzip"}, ""},
+	} {
+		*compress = tt.flag
+		if got := pickCompression(tt.offered); got != tt.want {
+			t.Errorf("-compress %q picked %q of %q, want %q", tt.flag, got, tt.offered, tt.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func init() {
+	subcmds["config"] = config
+}
+
+// A setting is something kept in the config file between runs.
+type setting struct {
+	def    string   // Value when not set.
+	values []string // Values allowed, or nil for any.
+	help   string
+}
+
+var settings = map[string]setting{
+	"telemetry": {"", []string{"on", "off"},
+		"on to send an anonymous report after connecting: the ww version, OS and\n" +
+			"architecture, whether connecting worked or how it failed, and whether the\n" +
+			"connection is direct or relayed. never anything about what's sent. off by\n" +
+			"default, and asked about once when run at a terminal."},
+	"stun": {"", nil,
+		"stun servers to use when there's no -stun, comma separated."},
+	"turn": {"", nil,
+		"turn servers to use when there's no -turn, comma separated."},
+	"turn-credentials": {"", nil,
+		"username:password for turn servers when there's no -turn-credentials."},
+	"wordlist": {"", nil,
+		"words to make codes of when there's no -wordlist: pgp, or a file of them."},
+	"qr": {"", []string{"on", "off"},
+		"off to not draw QR codes of links to new codes when there's no -qr."},
+}
+
+// configFlags sets the global flags that weren't given on the command line
+// to their settings in the config file, for those that have one.
+func configFlags() {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	c, _ := loadConfig()
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, ok := settings[f.Name]; !ok || given[f.Name] {
+			return
+		}
+		if v := c[f.Name]; v != "" {
+			f.Value.Set(v)
+		}
+	})
+}
+
+// configPath returns where the config file is kept.
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "webwormhole", "config"), nil
+}
+
+// loadConfig reads the config file, one "key value" per line. A missing
+// file is an empty config.
+func loadConfig() (map[string]string, error) {
+	c := make(map[string]string)
+	path, err := configPath()
+	if err != nil {
+		return c, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) == 2 {
+			c[fields[0]] = strings.TrimSpace(fields[1])
+		}
+	}
+	return c, s.Err()
+}
+
+// getConfig returns the value of a setting, or its default.
+func getConfig(key string) string {
+	c, _ := loadConfig()
+	if v, ok := c[key]; ok {
+		return v
+	}
+	return settings[key].def
+}
+
+// setConfig changes a setting in the config file.
+func setConfig(key, value string) error {
+	s, ok := settings[key]
+	if !ok {
+		return fmt.Errorf("no setting %q", key)
+	}
+	if s.values != nil {
+		ok = false
+		for _, v := range s.values {
+			ok = ok || v == value
+		}
+		if !ok {
+			return fmt.Errorf("%s must be %s", key, strings.Join(s.values, " or "))
+		}
+	}
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	c[key] = value
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	var keys []string
+	for k := range c {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s %s\n", k, c[k])
+	}
+	return ioutil.WriteFile(path, []byte(b.String()), 0600)
+}
+
+func config(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "show or change settings kept between runs\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s [setting [value]]\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "settings:\n")
+		var keys []string
+		for k := range settings {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(set.Output(), "  %s\n    \t%s\n", k, strings.Replace(settings[k].help, "\n", "\n    \t", -1))
+		}
+		if path, err := configPath(); err == nil {
+			fmt.Fprintf(set.Output(), "\nthey're kept in %s.\n", path)
+		}
+	}
+	set.Parse(args[1:])
+
+	switch set.NArg() {
+	case 0:
+		c, err := loadConfig()
+		if err != nil {
+			fatalf("could not read config: %v", err)
+		}
+		var keys []string
+		for k := range settings {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v, ok := c[k]
+			if !ok {
+				v = settings[k].def
+			}
+			fmt.Printf("%s %s\n", k, v)
+		}
+	case 1:
+		if _, ok := settings[set.Arg(0)]; !ok {
+			exitf(exitUsage, "no setting %q", set.Arg(0))
+		}
+		fmt.Println(getConfig(set.Arg(0)))
+	case 2:
+		if err := setConfig(set.Arg(0), set.Arg(1)); err != nil {
+			status := exitUsage
+			if _, ok := err.(*os.PathError); ok {
+				status = exitDisk
+			}
+			exitf(status, "could not change %s: %v", set.Arg(0), err)
+		}
+	default:
+		set.Usage()
+		os.Exit(exitUsage)
+	}
+}
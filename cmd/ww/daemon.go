@@ -0,0 +1,685 @@
+package main
+
+// This is the daemon. It runs transfers on behalf of other programs on the
+// same machine, like NAS package UIs and scripts, which drive it over a small
+// HTTP+JSON API:
+//
+//	POST /send       {"files": ["/abs/path", ...], "code": "", "length": 2}
+//	POST /send       {"text": "a message", "code": "", "length": 2}
+//	POST /receive    {"code": "7-some-words", "dir": "/abs/path"}
+//	POST /receive    {"from": "laptop", "dir": "/abs/path"}
+//	GET    /transfers
+//	GET    /transfers/<id>
+//	GET    /transfers/<id>/events
+//	DELETE /transfers/<id>
+//
+// Starting a transfer responds with its status once the code is known.
+// Leave the code empty to have one generated. The events endpoint streams
+// the status as a JSON object per line every time it changes, until the
+// transfer ends. DELETE cancels a transfer, freeing its code on the
+// signalling server if it's still waiting. Files' modes and modification
+// times are kept unless "no_preserve" is set to true. Directories received
+// are unpacked unless "no_extract" is. Of the files a sender lists, "only"
+// receives those matching comma separated patterns, like ww receive -only.
+// Set "to" to receive into cloud storage instead of "dir", like -to. Set
+// "from" instead of "code" to receive from a paired device, like -from.
+// Text messages received are in the transfer's "texts". Set "encrypt_to" to
+// send files encrypted to recipients, like ww send -encrypt-to.
+//
+// With -rules, what's received is up to the rules in the file it names,
+// see rules.go, rather than to whoever asks for it to be received. They
+// can't be used with "to".
+//
+// With -socket, the API is served on a unix socket instead, so that access
+// to it can be controlled with file permissions. ww tui is a terminal UI
+// for it.
+//
+// On Windows, -install-service installs the daemon, with the rest of the
+// flags it was given, as a service that starts with the machine, is
+// restarted when it fails, and logs to the event log. -uninstall-service
+// removes it again.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"webwormhole.io/cmd/ww/internal/age"
+	"webwormhole.io/wormhole"
+)
+
+// Transfer states.
+const (
+	stateConnecting   = "connecting"   // Talking to the signalling server.
+	stateWaiting      = "waiting"      // The code is known, waiting for the peer.
+	stateTransferring = "transferring" // Connected to the peer.
+	stateDone         = "done"
+	stateFailed       = "failed"
+	stateCancelled    = "cancelled"
+)
+
+// transferStatus is what the API reports about a transfer.
+type transferStatus struct {
+	ID      string          `json:"id"`
+	Kind    string          `json:"kind"`
+	Code    string          `json:"code,omitempty"`
+	State   string          `json:"state"`
+	Files   []*fileProgress `json:"files"`
+	Error   string          `json:"error,omitempty"`
+	Started time.Time       `json:"started"`
+	// Route is whether the connection is direct, relayed, or disconnected
+	// since, once connected.
+	Route wormhole.State `json:"route,omitempty"`
+	// Texts are the text messages received.
+	Texts []string `json:"texts,omitempty"`
+	// From is the paired device received from, if not with a code.
+	From string `json:"from,omitempty"`
+}
+
+type fileProgress struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	Bytes int64  `json:"bytes"`
+	// LimitedBy is what held up the file once it's done, see meter.
+	LimitedBy string `json:"limited_by,omitempty"`
+	// SHA256 is the digest of what was received, once the sender's
+	// trailer checks out.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// transfer is a transfer run by the daemon. It is the meter of its own
+// progress.
+type transfer struct {
+	mu      sync.Mutex
+	st      transferStatus
+	changed chan struct{}  // Closed and replaced on every change.
+	c       *wormhole.Conn // Set once connected.
+	free    func() error   // Frees the slot, while waiting for the peer.
+	ready   chan struct{}  // Closed once the code is known or the transfer ended.
+	once    sync.Once
+}
+
+// transfers is a map of transfers by id.
+var transfers = struct {
+	m map[string]*transfer
+	sync.RWMutex
+}{m: make(map[string]*transfer)}
+
+func newTransfer(kind string) *transfer {
+	t := &transfer{
+		st: transferStatus{
+			ID:      randhex(8),
+			Kind:    kind,
+			State:   stateConnecting,
+			Files:   []*fileProgress{},
+			Started: time.Now(),
+		},
+		changed: make(chan struct{}),
+		ready:   make(chan struct{}),
+	}
+	transfers.Lock()
+	transfers.m[t.st.ID] = t
+	transfers.Unlock()
+	return t
+}
+
+func (t *transfer) status() transferStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := t.st
+	st.Files = make([]*fileProgress, len(t.st.Files))
+	for i := range t.st.Files {
+		f := *t.st.Files[i]
+		st.Files[i] = &f
+	}
+	st.Texts = append([]string(nil), t.st.Texts...)
+	return st
+}
+
+// ended reports whether the transfer is over. This assumes t is locked.
+func (t *transfer) ended() bool {
+	return t.st.State == stateDone || t.st.State == stateFailed || t.st.State == stateCancelled
+}
+
+// notify wakes up subscribers. This assumes t is locked.
+func (t *transfer) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+	if t.ended() || t.st.State != stateConnecting {
+		t.once.Do(func() { close(t.ready) })
+	}
+}
+
+func (t *transfer) set(state string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ended() {
+		return
+	}
+	t.st.State = state
+	t.notify()
+}
+
+func (t *transfer) setCode(code string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ended() {
+		return
+	}
+	// Codes for paired devices are as good as the pairing, so they aren't
+	// handed out.
+	if t.st.From == "" {
+		t.st.Code = code
+	}
+	t.st.State = stateWaiting
+	t.notify()
+}
+
+func (t *transfer) fail(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ended() {
+		return
+	}
+	t.st.State = stateFailed
+	t.st.Error = err.Error()
+	t.notify()
+}
+
+// connected records c, so that it can be closed if the transfer gets
+// cancelled. It reports whether the transfer should go ahead.
+func (t *transfer) connected(c *wormhole.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ended() {
+		return false
+	}
+	t.c = c
+	t.st.State = stateTransferring
+	t.notify()
+	return true
+}
+
+// cancel stops the transfer. If it is still waiting for the peer, its slot
+// is freed, and otherwise the connection is closed as soon as it's made.
+func (t *transfer) cancel() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ended() {
+		return
+	}
+	t.st.State = stateCancelled
+	if t.c != nil {
+		t.c.Close()
+	} else if t.free != nil {
+		go t.free()
+	}
+	t.notify()
+}
+
+func (t *transfer) start(name string, size int64) {
+	t.mu.Lock()
+	t.st.Files = append(t.st.Files, &fileProgress{Name: name, Size: size})
+	t.notify()
+	t.mu.Unlock()
+}
+
+func (t *transfer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	t.st.Files[len(t.st.Files)-1].Bytes += int64(len(p))
+	t.notify()
+	t.mu.Unlock()
+	return len(p), nil
+}
+
+func (t *transfer) text(msg string) {
+	t.mu.Lock()
+	t.st.Texts = append(t.st.Texts, msg)
+	t.notify()
+	t.mu.Unlock()
+}
+
+func (t *transfer) digested(sum string) {
+	t.mu.Lock()
+	if len(t.st.Files) > 0 {
+		t.st.Files[len(t.st.Files)-1].SHA256 = sum
+		t.notify()
+	}
+	t.mu.Unlock()
+}
+
+func (t *transfer) done(limit string) {
+	t.mu.Lock()
+	t.st.Files[len(t.st.Files)-1].LimitedBy = limit
+	t.notify()
+	t.mu.Unlock()
+}
+
+// setRoute records the route the connection takes, as it changes. Once the
+// transfer's over, it keeps the route it took.
+func (t *transfer) setRoute(s wormhole.State) {
+	if s == wormhole.Connecting {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ended() {
+		return
+	}
+	t.st.Route = s
+	t.notify()
+}
+
+// connect joins the wormhole with the given code, or creates a new one if
+// code is empty. The code for a paired device is either, like rendezvous,
+// whichever side gets there first.
+func (t *transfer) connect(code string, length int) (*wormhole.Conn, error) {
+	d := dialer()
+	d.OnState = t.setRoute
+	if code != "" {
+		t.setCode(code)
+		parts := strings.Split(code, "-")
+		slot, pass := parts[0], strings.Join(parts[1:], "-")
+		c, err := d.Dial(slot, pass)
+		if err != wormhole.ErrNoSuchSlot || t.st.From == "" {
+			return c, err
+		}
+		d = dialer()
+		d.OnState = t.setRoute
+		revocable(d)
+		t.mu.Lock()
+		t.free = func() error { return d.Cancel(slot) }
+		cancelled := t.ended()
+		t.mu.Unlock()
+		if cancelled {
+			return nil, wormhole.ErrCancelled
+		}
+		c, err = d.Reserve(slot, pass)
+		if err == wormhole.ErrSlotTaken {
+			// The peer reserved it at the same time we did.
+			d = dialer()
+			d.OnState = t.setRoute
+			return d.Dial(slot, pass)
+		}
+		return c, err
+	}
+	password, err := newPassword(length)
+	if err != nil {
+		return nil, err
+	}
+	revocable(d)
+	slotc := make(chan string, 1)
+	dialed := make(chan struct{})
+	defer close(dialed)
+	go func() {
+		select {
+		case slot := <-slotc:
+			t.mu.Lock()
+			t.free = func() error { return d.Cancel(slot) }
+			cancelled := t.ended()
+			t.mu.Unlock()
+			if cancelled {
+				t.free()
+			}
+			t.setCode(slot + "-" + password)
+		case <-dialed:
+		}
+	}()
+	return d.Wormhole(password, slotc)
+}
+
+// run connects and calls fn to move the files.
+func (t *transfer) run(code string, length int, fn func(c *wormhole.Conn) error) {
+	c, err := t.connect(code, length)
+	reportUsage(c, err)
+	if err != nil {
+		log.Printf("%s: could not dial: %v", t.st.ID, err)
+		t.fail(fmt.Errorf("could not dial: %v", err))
+		return
+	}
+	defer c.Close()
+	if !t.connected(c) {
+		return
+	}
+	if err := fn(c); err != nil {
+		log.Printf("%s: %v", t.st.ID, err)
+		t.fail(err)
+		return
+	}
+	log.Printf("%s: done", t.st.ID)
+	t.set(stateDone)
+}
+
+// local rejects requests that don't look like they came from a program on
+// this machine. Requiring a JSON content type keeps web pages from posting
+// to the API, and checking the host keeps them from reaching it through
+// DNS rebinding.
+func local(w http.ResponseWriter, r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		http.Error(w, "forbidden host", http.StatusForbidden)
+		return false
+	}
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Method == http.MethodPost && mediatype != "application/json" {
+		http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// started waits until the transfer has a code, then reports it.
+func started(w http.ResponseWriter, r *http.Request, t *transfer) {
+	select {
+	case <-t.ready:
+	case <-r.Context().Done():
+		return
+	}
+	writeJSON(w, http.StatusAccepted, t.status())
+}
+
+// events streams the status of t every time it changes, until it ends.
+func events(w http.ResponseWriter, r *http.Request, t *transfer) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for {
+		t.mu.Lock()
+		changed, ended := t.changed, t.ended()
+		t.mu.Unlock()
+		if enc.Encode(t.status()) != nil || ended {
+			return
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		// Don't send more than a few updates a second.
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func daemon(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "run transfers driven by a local HTTP+JSON API\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "flags:\n")
+		set.PrintDefaults()
+	}
+	httpaddr := set.String("http", "localhost:7796", "http listen address, should be on localhost")
+	socket := set.String("socket", "", "listen on this unix socket instead of -http")
+	directory := set.String("dir", ".", "default directory to put downloaded files")
+	length := set.Int("length", 2, "length of generated secrets")
+	rulesFile := set.String("rules", "", "receive only what the rules in this file accept, and put it where they say")
+	install := set.Bool("install-service", false, "install the daemon with these flags as a Windows service, and exit")
+	uninstall := set.Bool("uninstall-service", false, "remove the Windows service, and exit")
+	set.Parse(args[1:])
+
+	if set.NArg() > 0 || (*install && *uninstall) {
+		set.Usage()
+		os.Exit(exitUsage)
+	}
+	if *install {
+		if err := installService(serviceArgs(args[0], set)); err != nil {
+			fatalf("could not install service: %v", err)
+		}
+		fmt.Fprintf(set.Output(), "installed service %s\n", serviceName)
+		return
+	}
+	if *uninstall {
+		if err := removeService(); err != nil {
+			fatalf("could not remove service: %v", err)
+		}
+		fmt.Fprintf(set.Output(), "removed service %s\n", serviceName)
+		return
+	}
+
+	var rs rules
+	if *rulesFile != "" {
+		var err error
+		if rs, err = loadRules(*rulesFile); err != nil {
+			exitf(exitUsage, "could not load rules: %v", err)
+		}
+	}
+
+	if tr != nil {
+		go func() {
+			for range time.Tick(5 * time.Second) {
+				tr.flush()
+			}
+		}()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/send", func(w http.ResponseWriter, r *http.Request) {
+		if !local(w, r) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Files      []string `json:"files"`
+			Text       string   `json:"text"`
+			Code       string   `json:"code"`
+			Length     int      `json:"length"`
+			NoPreserve bool     `json:"no_preserve"`
+			EncryptTo  string   `json:"encrypt_to"`
+		}
+		// The daemon's stdin is nobody's to send.
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (len(req.Files) == 0) == (req.Text == "") || indexOf(req.Files, "-") >= 0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var recipients []age.Recipient
+		if req.EncryptTo != "" {
+			var err error
+			if recipients, err = age.ParseRecipients(req.EncryptTo); err != nil || req.Text != "" {
+				http.Error(w, "bad recipients", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Length == 0 {
+			req.Length = *length
+		}
+		t := newTransfer("send")
+		go t.run(req.Code, req.Length, func(c *wormhole.Conn) error {
+			if req.Text != "" {
+				return sendText(c, req.Text)
+			}
+			_, depth := buffers()
+			if recipients != nil {
+				return sendSealed(c, req.Files, recipients, depth, !req.NoPreserve, t)
+			}
+			return sendFiles(c, req.Files, depth, msgChunkSize, !req.NoPreserve, t)
+		})
+		started(w, r, t)
+	})
+	mux.HandleFunc("/receive", func(w http.ResponseWriter, r *http.Request) {
+		if !local(w, r) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Code       string `json:"code"`
+			From       string `json:"from"`
+			Dir        string `json:"dir"`
+			Length     int    `json:"length"`
+			NoPreserve bool   `json:"no_preserve"`
+			NoExtract  bool   `json:"no_extract"`
+			Only       string `json:"only"`
+			To         string `json:"to"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.From != "" && req.Code != "") {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if req.From != "" {
+			ds, err := loadDevices()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			d, ok := ds[req.From]
+			if ok {
+				req.Code, err = d.code()
+			}
+			if !ok || err != nil {
+				http.Error(w, "no such device", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Dir == "" {
+			req.Dir = *directory
+		}
+		var to sink
+		if req.To != "" {
+			if rs != nil {
+				http.Error(w, "to can't be used with -rules", http.StatusBadRequest)
+				return
+			}
+			var err error
+			if to, err = openSink(req.To); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Length == 0 {
+			req.Length = *length
+		}
+		t := newTransfer("receive")
+		t.mu.Lock()
+		t.st.From = req.From
+		t.mu.Unlock()
+		go t.run(req.Code, req.Length, func(c *wormhole.Conn) error {
+			var pick picker
+			if req.Only != "" {
+				pick = pickMatching(req.Only)
+			}
+			var route func(f wormhole.OfferedFile) string
+			if rs != nil {
+				rl := &ruling{rules: rs, from: req.From}
+				pick, route = rl.pick(pick), rl.route
+			}
+			if to != nil {
+				return receiveInto(c, to, pick, t)
+			}
+			return receiveFiles(c, req.Dir, !req.NoPreserve, !req.NoExtract, pick, route, t)
+		})
+		started(w, r, t)
+	})
+	mux.HandleFunc("/transfers", func(w http.ResponseWriter, r *http.Request) {
+		if !local(w, r) {
+			return
+		}
+		transfers.RLock()
+		list := make([]transferStatus, 0, len(transfers.m))
+		for _, t := range transfers.m {
+			list = append(list, t.status())
+		}
+		transfers.RUnlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+		writeJSON(w, http.StatusOK, list)
+	})
+	mux.HandleFunc("/transfers/", func(w http.ResponseWriter, r *http.Request) {
+		if !local(w, r) {
+			return
+		}
+		id := strings.TrimSuffix(r.URL.Path[len("/transfers/"):], "/events")
+		transfers.RLock()
+		t, ok := transfers.m[id]
+		transfers.RUnlock()
+		if !ok {
+			http.Error(w, "no such transfer", http.StatusNotFound)
+			return
+		}
+		switch {
+		case r.Method == http.MethodDelete:
+			t.cancel()
+			writeJSON(w, http.StatusOK, t.status())
+		case strings.HasSuffix(r.URL.Path, "/events"):
+			events(w, r, t)
+		default:
+			writeJSON(w, http.StatusOK, t.status())
+		}
+	})
+
+	serve := func() error {
+		if *socket == "" {
+			return http.ListenAndServe(*httpaddr, mux)
+		}
+		if info, err := os.Lstat(*socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			// Left over from a previous run.
+			os.Remove(*socket)
+		}
+		l, err := listenUnix(*socket)
+		if err != nil {
+			fatalf("could not listen: %v", err)
+		}
+		onexit(func() { os.Remove(*socket) })
+		return http.Serve(l, mux)
+	}
+	if err := runService(serve); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serviceName is what the daemon is installed as, and the event log source
+// it logs as.
+const serviceName = "webwormhole"
+
+// serviceArgs is the command line to run the daemon subcommand name as a
+// service with the flags given to it and to ww. Services start in the
+// system directory, so paths are made absolute.
+func serviceArgs(name string, set *flag.FlagSet) []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		args = append(args, "-"+f.Name+"="+f.Value.String())
+	})
+	args = append(args, name)
+	set.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		switch f.Name {
+		case "install-service":
+			return
+		case "dir", "socket":
+			if v == "" {
+				return
+			}
+			v, _ = filepath.Abs(v)
+		default:
+			if v == f.DefValue {
+				return
+			}
+		}
+		args = append(args, "-"+f.Name+"="+v)
+	})
+	return args
+}
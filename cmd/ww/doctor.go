@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+func init() {
+	subcmds["doctor"] = doctor
+}
+
+// canarySlot and canaryPass make up the code of the test peer that servers
+// run with -canary. It's no secret: the canary only echoes back what it's
+// sent.
+const (
+	canarySlot = "canary"
+	canaryPass = "canary"
+)
+
+// doctorTimeout is how long each check may take.
+const doctorTimeout = 30 * time.Second
+
+// doctorBytes is how much to send the canary and expect back.
+const doctorBytes = 64 << 10
+
+func doctor(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	natSTUN := set.String("nat-stun", "stun:stun1.l.google.com:19302", "another stun server to tell the nat type with, if -ice doesn't have two, or none")
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "check that a signalling server works from here, end to end\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s [signalling server]\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "the server needs to run with -canary. it defaults to -signal. the stun and\n")
+		fmt.Fprintf(set.Output(), "turn servers in -ice or -via are checked on their own first, along with what\n")
+		fmt.Fprintf(set.Output(), "kind of nat this machine is behind, and if there are turn servers, relaying\n")
+		fmt.Fprintf(set.Output(), "through them to the canary too. the ice candidates each side found are\n")
+		fmt.Fprintf(set.Output(), "listed, and the pair ice picked.\n\n")
+		set.PrintDefaults()
+	}
+	set.Parse(args[1:])
+
+	if set.NArg() > 1 {
+		set.Usage()
+		os.Exit(exitUsage)
+	}
+	if set.NArg() == 1 {
+		*sigserv = set.Arg(0)
+	}
+	out := set.Output()
+
+	status := 0
+	fail := func(what string, s int, err error) {
+		fmt.Fprintf(out, "%s: FAILED, %v\n", what, err)
+		if status == 0 {
+			status = s
+		}
+	}
+
+	version, min, err := serverVersion(*sigserv)
+	switch {
+	case err != nil:
+		fail("signalling server "+*sigserv, exitNetwork, err)
+	case version < wormhole.MinSignalProtocol:
+		fail("signalling server "+*sigserv, exitAuth, fmt.Errorf("it speaks version %d, this client needs %d or newer", version, wormhole.MinSignalProtocol))
+	case min > wormhole.SignalProtocol:
+		fail("signalling server "+*sigserv, exitAuth, fmt.Errorf("it needs version %d or newer, this client speaks %d", min, wormhole.SignalProtocol))
+	default:
+		fmt.Fprintf(out, "signalling server %s: ok, version %d\n", *sigserv, version)
+	}
+
+	d := dialer()
+	doctorSTUN(d.ICEServers, *natSTUN, out, fail)
+	for _, s := range d.ICEServers {
+		if !strings.HasPrefix(s, "turn") {
+			continue
+		}
+		relayed, err := turnAllocate(s)
+		if err != nil {
+			fail("turn "+hostOf(s), exitNetwork, err)
+			continue
+		}
+		fmt.Fprintf(out, "turn %s: ok, relays from %v\n", hostOf(s), relayed)
+	}
+
+	policies := []wormhole.TransportPolicy{d.TransportPolicy}
+	if d.TransportPolicy == wormhole.AllTransports {
+		for _, s := range d.ICEServers {
+			if strings.HasPrefix(s, "turn") {
+				policies = append(policies, wormhole.RelayOnly)
+				break
+			}
+		}
+	}
+	for _, policy := range policies {
+		suffix := ""
+		if policy == wormhole.RelayOnly {
+			suffix = " through relay"
+		}
+		d := dialer()
+		d.TransportPolicy = policy
+		c, candidates, err := doctorDial(d, out)
+		if err == wormhole.ErrNoSuchSlot {
+			fail("connecting"+suffix, exitFailure, fmt.Errorf("no canary on the server, is it running with -canary?"))
+			continue
+		}
+		if err != nil {
+			fail("connecting"+suffix, exitstatus(err), err)
+			fmt.Fprint(out, candidates)
+			continue
+		}
+		fmt.Fprint(out, candidates)
+		start := time.Now()
+		if err := echoCheck(c); err != nil {
+			fail("transfer"+suffix, exitNetwork, err)
+		} else {
+			fmt.Fprintf(out, "transfer%s: ok, echoed %s in %v\n", suffix, formatSize(doctorBytes), time.Since(start).Round(time.Millisecond))
+		}
+		c.Close()
+	}
+	if status != 0 {
+		exitf(status, "some checks failed")
+	}
+}
+
+// serverVersion returns the signalling protocol version of the server at
+// addr, and the oldest one it accepts. Servers that don't say accept only
+// their own.
+func serverVersion(addr string) (version, min int, err error) {
+	client := &http.Client{Timeout: doctorTimeout}
+	resp, err := client.Get(addr)
+	if err != nil {
+		return 0, 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("%s", resp.Status)
+	}
+	version, _ = strconv.Atoi(resp.Header.Get("X-Version"))
+	min = version
+	if m, err := strconv.Atoi(resp.Header.Get("X-Min-Version")); err == nil {
+		min = m
+	}
+	return version, min, nil
+}
+
+// doctorSTUN checks the STUN servers among servers answer, all from one
+// socket, and says what kind of NAT that shows this machine is behind. If
+// fewer than two at different addresses answer, it asks extra too, if
+// it's set, for that. Those of servers that don't answer it reports to
+// fail.
+func doctorSTUN(servers []string, extra string, out io.Writer, fail func(string, int, error)) {
+	conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		fail("stun", exitNetwork, err)
+		return
+	}
+	defer conn.Close()
+	var mapped []*net.UDPAddr
+	seen := make(map[string]bool)
+	check := func(s, what string) bool {
+		addr, _ := iceAddr(s)
+		m, rtt, err := stunBinding(conn, addr)
+		if err != nil {
+			if what == "" {
+				fail("stun "+s, exitNetwork, err)
+			} else {
+				// Only the NAT type hangs on it.
+				fmt.Fprintf(out, "stun %s%s: FAILED, %v\n", s, what, err)
+			}
+			return false
+		}
+		fmt.Fprintf(out, "stun %s%s: ok, sees us at %v, round trip %v\n", s, what, m, rtt.Round(time.Millisecond))
+		if to, err := net.ResolveUDPAddr("udp4", addr); err == nil && !seen[to.String()] {
+			seen[to.String()] = true
+			mapped = append(mapped, m)
+		}
+		return true
+	}
+	for _, s := range servers {
+		if strings.HasPrefix(s, "stun:") {
+			check(s, "")
+		}
+	}
+	if len(mapped) < 2 && extra != "" {
+		check(extra, " (for the nat type)")
+	}
+	fmt.Fprintf(out, "nat: %s\n", natType(mapped))
+}
+
+// doctorDial connects to the canary with d, and reports how long each
+// phase took. It returns a list of the ICE candidates either side found,
+// and the pair ICE picked, to print after.
+func doctorDial(d *wormhole.Dialer, out io.Writer) (*wormhole.Conn, string, error) {
+	var phases []string
+	d.Trace = func(phase string) func(error) {
+		start := time.Now()
+		return func(error) {
+			phases = append(phases, fmt.Sprintf("%s %v", phase, time.Since(start).Round(time.Millisecond)))
+		}
+	}
+	var (
+		mu             sync.Mutex
+		ours, theirs   []string
+		selected       string
+		relayCandidate bool
+	)
+	d.OnCandidate = func(c wormhole.Candidate) {
+		mu.Lock()
+		defer mu.Unlock()
+		if c.Remote {
+			theirs = append(theirs, c.String())
+			return
+		}
+		ours = append(ours, c.String())
+		relayCandidate = relayCandidate || c.Type == "relay"
+	}
+	d.OnSelectedPair = func(local, remote wormhole.Candidate) {
+		mu.Lock()
+		defer mu.Unlock()
+		selected = local.String() + " <-> " + remote.String()
+	}
+	candidates := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		var b strings.Builder
+		if len(ours) > 0 {
+			fmt.Fprintf(&b, "  our candidates: %s\n", strings.Join(ours, ", "))
+		}
+		if len(theirs) > 0 {
+			fmt.Fprintf(&b, "  canary's candidates: %s\n", strings.Join(theirs, ", "))
+		}
+		if selected != "" {
+			fmt.Fprintf(&b, "  selected pair: %s\n", selected)
+		}
+		if d.TransportPolicy == wormhole.RelayOnly && len(ours)+len(theirs) > 0 && !relayCandidate {
+			fmt.Fprintf(&b, "  no relay candidates of ours, so no turn server would relay for us\n")
+		}
+		return b.String()
+	}
+	type result struct {
+		c   *wormhole.Conn
+		err error
+	}
+	done := make(chan result, 1)
+	start := time.Now()
+	go func() {
+		for attempt := 0; ; attempt++ {
+			c, err := d.Dial(canarySlot, canaryPass)
+			if err == wormhole.ErrNoSuchSlot && attempt < 3 {
+				// Somebody else may be using the canary.
+				time.Sleep(time.Second)
+				continue
+			}
+			done <- result{c, err}
+			return
+		}
+	}()
+	var r result
+	select {
+	case r = <-done:
+	case <-time.After(doctorTimeout):
+		return nil, candidates(), wormhole.ErrTimedOut
+	}
+	if r.err != nil {
+		return nil, candidates(), r.err
+	}
+	suffix := ""
+	if d.TransportPolicy == wormhole.RelayOnly {
+		suffix = " through relay"
+	}
+	fmt.Fprintf(out, "connecting%s: ok in %v (%s)", suffix, time.Since(start).Round(time.Millisecond), strings.Join(phases, ", "))
+	if route, ok := r.c.Route(); ok {
+		fmt.Fprintf(out, ", %s, %s to %s candidates, round trip %v", route, route.Local, route.Remote, route.RTT.Round(time.Millisecond))
+	}
+	fmt.Fprintf(out, "\n")
+	// The selected pair can lag the data channel opening a little.
+	for i := 0; i < 10; i++ {
+		mu.Lock()
+		picked := selected != ""
+		mu.Unlock()
+		if picked {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return r.c, candidates(), nil
+}
+
+// echoCheck sends the canary some random bytes and checks they come back.
+func echoCheck(c *wormhole.Conn) error {
+	sent := make([]byte, doctorBytes)
+	if _, err := crand.Read(sent); err != nil {
+		return err
+	}
+	errc := make(chan error, 1)
+	go func() {
+		for p := sent; len(p) > 0; {
+			n := len(p)
+			if n > msgChunkSize {
+				n = msgChunkSize
+			}
+			if _, err := c.Write(p[:n]); err != nil {
+				errc <- err
+				return
+			}
+			p = p[n:]
+		}
+		errc <- nil
+	}()
+	got := make([]byte, 0, doctorBytes)
+	buf := make([]byte, msgChunkSize)
+	timeout := time.AfterFunc(doctorTimeout, func() { c.Close() })
+	defer timeout.Stop()
+	for len(got) < doctorBytes {
+		n, err := c.Read(buf)
+		if err != nil {
+			return fmt.Errorf("got %d of %d bytes back: %v", len(got), doctorBytes, err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if err := <-errc; err != nil {
+		return err
+	}
+	if !bytes.Equal(got, sent) {
+		return fmt.Errorf("got different bytes back")
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+// Exit statuses, so that scripts can tell failures apart without
+// parsing error messages.
+const (
+	exitFailure  = 1 // Anything not covered below.
+	exitUsage    = 2 // Bad command line.
+	exitNetwork  = 3 // Could not reach the signalling server or the peer.
+	exitAuth     = 4 // Wrong code or incompatible peer.
+	exitRejected = 5 // The peer declined the transfer, or the code was busy.
+	exitDisk     = 6 // Could not read or write local files.
+	exitTimeout  = 7 // Gave up waiting.
+)
+
+// exitClasses names the exit statuses -retry-on accepts.
+var exitClasses = map[string]int{
+	"network":  exitNetwork,
+	"auth":     exitAuth,
+	"rejected": exitRejected,
+	"disk":     exitDisk,
+	"timeout":  exitTimeout,
+}
+
+var (
+	retries = flag.Int("retries", 0, "number of times to retry connecting")
+	retryOn = flag.String("retry-on", "network,timeout", "comma separated failure classes to retry: "+
+		"network, auth, rejected, disk, timeout")
+	codeAttempts = flag.Int("code-attempts", 3, "number of times to get a new code if the slot is lost, or the signalling server has none free")
+)
+
+func exitf(status int, format string, v ...interface{}) {
+	fmt.Fprintf(flag.CommandLine.Output(), format+"\n", v...)
+	root.end(fmt.Errorf(strings.TrimSpace(format), v...))
+	cleanup()
+	os.Exit(status)
+}
+
+// exitstatus classifies an error returned while connecting.
+func exitstatus(err error) int {
+	switch err {
+	case wormhole.ErrBadKey, wormhole.ErrNoSuchSlot, wormhole.ErrSlotTried, wormhole.ErrBadVersion, wormhole.ErrForbidden, wormhole.ErrUnauthorized:
+		return exitAuth
+	case wormhole.ErrTimedOut:
+		return exitTimeout
+	case wormhole.ErrSlotBusy:
+		return exitRejected
+	case wormhole.ErrNoRelay:
+		return exitUsage
+	case wormhole.ErrCancelled:
+		return exitFailure
+	}
+	if _, ok := err.(*wormhole.VersionError); ok {
+		return exitAuth
+	}
+	if _, ok := err.(*wormhole.SignalVersionError); ok {
+		return exitAuth
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return exitTimeout
+	}
+	if _, ok := err.(*os.PathError); ok {
+		return exitDisk
+	}
+	return exitNetwork
+}
+
+// copyStatus classifies an error from copying between the connection and
+// local files.
+func copyStatus(err error) int {
+	if _, ok := err.(*os.PathError); ok {
+		return exitDisk
+	}
+	return exitNetwork
+}
+
+func retryable(status int) bool {
+	for _, class := range strings.Split(*retryOn, ",") {
+		if exitClasses[strings.TrimSpace(class)] == status {
+			return true
+		}
+	}
+	return false
+}
+
+// dial calls fn to connect to a peer, retrying with exponential backoff
+// as instructed by -retries and -retry-on. It exits if it can't connect,
+// or later if the connection sits idle.
+func dial(fn func() (*wormhole.Conn, error)) *wormhole.Conn {
+	askTelemetry()
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		c, err := fn()
+		if err == nil {
+			reportUsage(c, nil)
+			go watchIdle(c)
+			return c
+		}
+		status := exitstatus(err)
+		if attempt < *retries && retryable(status) {
+			fmt.Fprintf(flag.CommandLine.Output(), "could not dial: %v, retrying in %v\n", err, backoff)
+			time.Sleep(backoff)
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		reportUsage(nil, err)
+		if err == wormhole.ErrBadVersion {
+			exitf(
+				status,
+				"%s%s%s",
+				"the signalling server is running an incompatable version.\n",
+				"try upgrading the client:\n\n",
+				"    go get webwormhole.io/cmd/ww\n",
+			)
+		}
+		if e, ok := err.(*wormhole.SignalVersionError); ok {
+			if e.Server < wormhole.MinSignalProtocol {
+				exitf(status, "the signalling server is running an older, incompatible version (protocol %d).\n"+
+					"ask whoever runs it to upgrade, or pick another one with -signal.", e.Server)
+			}
+			exitf(
+				status,
+				"%s%s%s",
+				fmt.Sprintf("the signalling server is running a newer, incompatible version (protocol %d).\n", e.Server),
+				"try upgrading the client:\n\n",
+				"    go get webwormhole.io/cmd/ww\n",
+			)
+		}
+		if e, ok := err.(*wormhole.VersionError); ok {
+			if e.Peer < wormhole.MinProtocol {
+				exitf(status, "the peer is running an older, incompatible version of webwormhole (protocol %d).\n"+
+					"ask them to upgrade.", e.Peer)
+			}
+			exitf(
+				status,
+				"%s%s%s",
+				fmt.Sprintf("the peer is running a newer, incompatible version of webwormhole (protocol %d).\n", e.Peer),
+				"try upgrading the client:\n\n",
+				"    go get webwormhole.io/cmd/ww\n",
+			)
+		}
+		if err == wormhole.ErrSlotTried {
+			exitf(status, "somebody else tried to use the same code, so it may have been intercepted.\n"+
+				"gave up for safety. make a new code, and share it some other way if you can.")
+		}
+		if err == wormhole.ErrSlotBusy {
+			exitf(status, "somebody else is already connecting with that code.\n"+
+				"check you have the right one, or ask for a new code.")
+		}
+		if err == wormhole.ErrCancelled {
+			if atomic.LoadInt32(&interrupted) != 0 {
+				// We cancelled it ourselves, and are on the way out.
+				select {}
+			}
+			exitf(status, "the code was cancelled, with ww cancel or by the other side.")
+		}
+		exitf(status, "could not dial: %v", err)
+	}
+}
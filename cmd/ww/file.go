@@ -2,124 +2,1109 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+	"webwormhole.io/cmd/ww/internal/age"
+	"webwormhole.io/wormhole"
 )
 
 const (
-	// msgChunkSize is the maximum size of a WebRTC DataChannel message.
-	// 64k is okay for most modern browsers, 32 is conservative.
+	// msgChunkSize is the size of the messages files are sent in, unless
+	// send -chunk-size says otherwise, and the longest peers before
+	// wormhole.MinLargeMessages read. Messages are read into buffers of
+	// wormhole.MaxMessage.
 	msgChunkSize = 32 << 10
+
+	// readAheadDepth is the default number of chunks to read ahead of
+	// sending them.
+	readAheadDepth = 16
 )
 
 type header struct {
-	Name string `json:"name",omitempty`
-	Size int    `json:"size",omitempty`
-	Type string `json:"type",omitempty`
+	Name string `json:"name"`
+	Size int    `json:"size"`
+	Type string `json:"type,omitempty"`
+
+	// Mode is the file's permission bits, and Modified its modification
+	// time in milliseconds since the epoch, like a browser File's
+	// lastModified. They're left out if the sender doesn't preserve them.
+	Mode     os.FileMode `json:"mode,omitempty"`
+	Modified int64       `json:"modified,omitempty"`
+
+	// Archive is set if the file is an archive of a directory, to unpack
+	// on the fly, e.g. "tar".
+	Archive string `json:"archive,omitempty"`
+
+	// Resume is the file's resume token, if the sender can resume sending
+	// it. The receiver has to answer with where to resume from, see
+	// resumeOffer.
+	Resume string `json:"resume,omitempty"`
+
+	// Text is set if the file is a text message, for the receiver to show
+	// rather than save. See sendText.
+	Text bool `json:"text,omitempty"`
+
+	// Chunked is set if the file's size isn't known up front, and it's
+	// sent in chunks instead. Size is 0. See sendChunked.
+	Chunked bool `json:"chunked,omitempty"`
+
+	// Compress is how the file is compressed, if the receiver picked a
+	// way when its batch was offered. It's sent in chunks, like a Chunked
+	// one, but Size is still its own. See compressTo.
+	Compress string `json:"compress,omitempty"`
 }
 
-func receive(args ...string) {
-	set := flag.NewFlagSet(args[0], flag.ExitOnError)
-	set.Usage = func() {
-		fmt.Fprintf(set.Output(), "receive files\n\n")
-		fmt.Fprintf(set.Output(), "usage: %s %s [code]\n\n", os.Args[0], args[0])
-		fmt.Fprintf(set.Output(), "flags:\n")
-		set.PrintDefaults()
+// listedAs reports whether h is the header of f, as the sender listed it
+// in its offer.
+func (h header) listedAs(f wormhole.OfferedFile) bool {
+	return !h.Text && h.Name == f.Name && int64(h.Size) == f.Size &&
+		h.Chunked == f.Chunked && h.Archive == f.Archive
+}
+
+// transferError is an error that stopped a transfer, with the exit status
+// it maps to.
+type transferError struct {
+	status int
+	err    error
+}
+
+func (e *transferError) Error() string { return e.err.Error() }
+func (e *transferError) Unwrap() error { return e.err }
+
+func transferErrorf(status int, format string, v ...interface{}) error {
+	return &transferError{status, fmt.Errorf(format, v...)}
+}
+
+// A meter follows the progress of a transfer. Bytes are written to it as
+// they are copied. When a file is done, the meter is told what limited its
+// speed, "network", "disk", or "" if it's not clear.
+type meter interface {
+	io.Writer
+	start(name string, size int64)
+	done(limit string)
+}
+
+// timedReader and timedWriter add up the time spent reading and writing.
+type timedReader struct {
+	io.Reader
+	d time.Duration
+}
+
+func (r *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := r.Reader.Read(p)
+	r.d += time.Since(start)
+	return n, err
+}
+
+type timedWriter struct {
+	io.Writer
+	d time.Duration
+}
+
+func (w *timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := w.Writer.Write(p)
+	w.d += time.Since(start)
+	return n, err
+}
+
+// bottleneck names what held up a transfer, given how long it waited on the
+// network and on the disk.
+func bottleneck(network, disk time.Duration) string {
+	switch {
+	case network+disk < 100*time.Millisecond:
+		// Too quick to tell.
+		return ""
+	case network > 2*disk:
+		return "network"
+	case disk > 2*network:
+		return "disk"
 	}
-	length := set.Int("length", 2, "length of generated secret, if generating")
-	directory := set.String("dir", ".", "directory to put downloaded files")
-	set.Parse(args[1:])
+	return ""
+}
 
-	if set.NArg() > 1 {
-		set.Usage()
-		os.Exit(2)
+// printer is a meter that prints a line per file. At a terminal, it shows
+// how far along each file is too.
+type printer struct {
+	w    io.Writer
+	verb string
+	busy bool
+
+	// n counts files, out of the of listed up front, if they were.
+	n, of int
+
+	// line is the current file's line, redrawn with the percentage done
+	// so far, shown, at terminals.
+	line          string
+	size, written int64
+	shown         int
+
+	// sum is the current file's digest, once the sender's trailer checks
+	// out.
+	sum string
+
+	// clipboard is whether to put text messages on the clipboard.
+	clipboard bool
+
+	// plain is whether to leave out the percentages, e.g. when lines from
+	// more than one transfer are mixed.
+	plain bool
+}
+
+func (p *printer) batch(files []wormhole.OfferedFile) {
+	var total int64
+	chunked := 0
+	for _, f := range files {
+		total += f.Size
+		if f.Chunked {
+			chunked++
+		}
+	}
+	size := formatSize(total)
+	switch {
+	case chunked == len(files) && chunked > 0:
+		size = "size unknown"
+	case chunked > 0:
+		size += fmt.Sprintf(" and %d of unknown size", chunked)
+	}
+	p.of = len(files)
+	if p.of == 1 {
+		fmt.Fprintf(p.w, "%s 1 file, %s\n", p.verb, size)
+	} else {
+		fmt.Fprintf(p.w, "%s %d files, %s\n", p.verb, len(files), size)
+	}
+}
+
+func (p *printer) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	if !interactive || p.plain || p.size <= 0 {
+		return len(b), nil
+	}
+	if percent := int(p.written * 100 / p.size); percent != p.shown {
+		fmt.Fprintf(p.w, "\r\033[K%s%d%%", p.line, percent)
+		p.shown = percent
+	}
+	return len(b), nil
+}
+
+func (p *printer) start(name string, size int64) {
+	p.n++
+	s := formatSize(size)
+	if size < 0 {
+		s = "size unknown"
+	}
+	if p.of > 0 {
+		p.line = fmt.Sprintf("%s %v (%s, %d of %d)... ", p.verb, name, s, p.n, p.of)
+	} else {
+		p.line = fmt.Sprintf("%s %v (%s)... ", p.verb, name, s)
+	}
+	p.size, p.written, p.shown, p.sum = size, 0, -1, ""
+	fmt.Fprintf(p.w, "%s", p.line)
+	p.busy = true
+}
+
+func (p *printer) done(limit string) {
+	if interactive && p.shown >= 0 {
+		fmt.Fprintf(p.w, "\r\033[K%s", p.line)
+	}
+	if p.size < 0 {
+		// Now it's known.
+		fmt.Fprintf(p.w, "%s, ", formatSize(p.written))
+	}
+	if limit != "" {
+		fmt.Fprintf(p.w, "done, %s limited", limit)
+	} else {
+		fmt.Fprintf(p.w, "done")
+	}
+	if p.sum != "" {
+		fmt.Fprintf(p.w, ", sha256 %s", p.sum)
+	}
+	fmt.Fprintf(p.w, "\n")
+	p.busy = false
+}
+
+func (p *printer) digested(sum string) { p.sum = sum }
+
+func (p *printer) dropped(why string) {
+	if interactive && p.shown >= 0 {
+		fmt.Fprintf(p.w, "\r\033[K%s", p.line)
+	}
+	fmt.Fprintf(p.w, "%s\n", why)
+	p.busy = false
+}
+
+// fail exits with the status and message of err.
+func (p *printer) fail(err error) {
+	if p.busy {
+		fmt.Fprintf(p.w, "\n")
+	}
+	status := exitFailure
+	if e, ok := err.(*transferError); ok {
+		status = e.status
 	}
-	c := newConn(set.Arg(0), *length)
+	exitf(status, "%v", err)
+}
 
-	// TODO append number to existing filenames?
+// acceptStreams handles the streams a sender opens alongside its files,
+// for as long as c is open.
+func acceptStreams(c *wormhole.Conn) {
+	for {
+		s, err := c.AcceptStream()
+		if err != nil {
+			return
+		}
+		switch s.Label() {
+		case probeLabel:
+			go discard(s)
+		case catalogLabel:
+			go browse(s, flag.CommandLine.Output())
+		default:
+			s.Close()
+		}
+	}
+}
+
+// preserve gives the file at path the mode and modification time in h, if
+// they're set. Failing to isn't worth losing the file over, so it only
+// warns.
+func preserve(path string, h header) {
+	out := flag.CommandLine.Output()
+	if h.Mode != 0 {
+		// Never make files writable by others.
+		if err := os.Chmod(path, h.Mode.Perm()&^0022); err != nil {
+			fmt.Fprintf(out, "could not keep mode of %s: %v\n", filepath.Base(path), err)
+		}
+	}
+	if h.Modified != 0 {
+		t := time.Unix(0, h.Modified*int64(time.Millisecond))
+		if err := os.Chtimes(path, time.Now(), t); err != nil {
+			fmt.Fprintf(out, "could not keep modification time of %s: %v\n", filepath.Base(path), err)
+		}
+	}
+}
 
+// receiveFiles saves files sent over c into dir until the peer is done,
+// keeping the modes and modification times the peer sends if keep is set.
+// Directories sent as archives are unpacked unless extract is false. If the
+// sender lists the files first, pick picks which to receive, or all of them
+// if it's nil, and it's held to sending just those. If route is set, it
+// picks the directory each goes in instead, unless it gives "", and senders
+// that don't list their files are turned away.
+func receiveFiles(c *wormhole.Conn, dir string, keep, extract bool, pick picker, route func(f wormhole.OfferedFile) string, m meter) error {
+	names := newNamer()
+	// Reuse buffers between files rather than leave them to the garbage
+	// collector.
+	buf := make([]byte, wormhole.MaxMessage)
+	go acceptStreams(c)
+	// listed is what's left to come of the files the sender listed, if it
+	// did, and sums hashes them to check against the list and trailers.
+	var listed []wormhole.OfferedFile
+	offered := false
+	sums := &summer{}
+	m = meters{m, sums}
+	// torn are the files dropped for having changed while they were sent.
+	var torn []string
 	for {
-		// First message is the header. 1k should be enough.
-		buf := make([]byte, 1<<10)
+		// First message is the header, or the start of a batch.
 		n, err := c.Read(buf)
+		if err == io.EOF && len(torn) > 0 {
+			return transferErrorf(exitFailure, "dropped %s, which changed on the sender's side while it was being sent", strings.Join(torn, ", "))
+		}
 		if err == io.EOF {
-			break
+			return nil
 		}
 		if err != nil {
-			fatalf("could not read file header: %v", err)
+			return transferErrorf(exitNetwork, "could not read file header: %v", err)
+		}
+		if wormhole.IsOffer(buf[:n]) {
+			first := append([]byte(nil), buf[:n]...)
+			listed, err = pickBatch(c, first, pick, m)
+			if err != nil {
+				return err
+			}
+			offered = true
+			continue
 		}
 		var h header
 		err = json.Unmarshal(buf[:n], &h)
 		if err != nil {
-			fatalf("could not decode file header: %v", err)
+			return transferErrorf(exitFailure, "could not decode file header: %v", err)
+		}
+		var want string
+		into := dir
+		if offered {
+			// Whatever picked the files only saw the list, so hold the
+			// sender to it.
+			if len(listed) == 0 {
+				return transferErrorf(exitFailure, "the sender sent %s, which it didn't list", h.Name)
+			}
+			f := listed[0]
+			listed = listed[1:]
+			if !h.listedAs(f) {
+				return transferErrorf(exitFailure, "the sender sent %s, which isn't %s as it listed it", h.Name, f.Name)
+			}
+			if f.SHA256 == "" && !f.Chunked && f.Archive == "" {
+				return transferErrorf(exitFailure, "the sender listed %s without its hash", f.Name)
+			}
+			if route != nil && route(f) != "" {
+				into = route(f)
+			}
+			want = f.SHA256
+		}
+		if h.Text && h.Size <= maxText {
+			if err := receiveText(c, h, m, buf); err != nil {
+				return err
+			}
+			continue
+		}
+		if route != nil && !offered {
+			return transferErrorf(exitRejected, "the sender didn't list its files, so there's no telling where %s goes", h.Name)
 		}
 
-		f, err := os.Create(filepath.Join(*directory, filepath.Clean(h.Name)))
-		if err != nil {
-			fatalf("could not create output file %s: %v", h.Name, err)
+		if h.Archive == archiveTar && extract {
+			if err := receiveTar(c, into, h, names, keep, m, sums, buf); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var f *os.File
+		var name string
+		var start int64
+		var p *partial
+		if h.Resume != "" && !validToken(h.Resume) {
+			// Not one of ours, so it's sent from the start.
+			if err := startOver(c, buf); err != nil {
+				return err
+			}
+			h.Resume = ""
+		}
+		if h.Resume != "" {
+			f, name, start, p, err = offerResume(c, into, h, names, m, buf)
+			if err != nil {
+				return err
+			}
+		} else {
+			f, name, err = names.create(into, h.Name)
+			if err != nil {
+				return transferErrorf(exitDisk, "could not create output file %s: %v", name, err)
+			}
+			m.start(name, fileSize(h))
 		}
-		fmt.Fprintf(set.Output(), "receiving %v... ", h.Name)
-		written, err := io.CopyBuffer(f, io.LimitReader(c, int64(h.Size)), make([]byte, msgChunkSize))
+		if name != h.Name {
+			fmt.Fprintf(flag.CommandLine.Output(), "saving %q as %s\n", h.Name, name)
+		}
+		span := tr.start("transfer", root, "")
+		span.set("size", strconv.Itoa(h.Size))
+		contents, err := contentsOf(c, h, start)
 		if err != nil {
-			fatalf("\ncould not save file: %v", err)
+			f.Close()
+			return transferErrorf(exitFailure, "could not receive %s: %v", name, err)
+		}
+		r := &timedReader{Reader: contents}
+		w := &timedWriter{Writer: f}
+		var mw io.Writer = io.MultiWriter(w, m)
+		if p != nil {
+			mw = io.MultiWriter(w, m, p)
 		}
-		if written != int64(h.Size) {
-			fatalf("\nEOF before receiving all bytes: (%d/%d)", written, h.Size)
+		written, err := io.CopyBuffer(mw, r, buf)
+		limit := bottleneck(r.d, w.d)
+		if limit != "" {
+			span.set("limited_by", limit)
 		}
+		span.end(err)
 		f.Close()
-		fmt.Fprintf(set.Output(), "done\n")
+		if err == nil && !h.Chunked && written != int64(h.Size)-start {
+			err = transferErrorf(exitNetwork, "EOF before receiving all bytes: (%d/%d)", start+written, h.Size)
+		}
+		if err == nil {
+			err = checkTrailer(c, name, sums.digest(), m, buf)
+		}
+		if err == errChanged {
+			// There's nothing worth keeping, or resuming.
+			os.Remove(filepath.Join(into, name))
+			if p != nil {
+				p.finish(nil)
+			}
+			if dm, ok := m.(droppedMeter); ok {
+				dm.dropped("changed on the sender's side, dropped")
+			}
+			torn = append(torn, name)
+			continue
+		}
+		if p != nil {
+			p.finish(err)
+		}
+		if _, ok := err.(*transferError); ok {
+			return err
+		}
+		if err != nil {
+			return transferErrorf(copyStatus(err), "could not save file: %v", err)
+		}
+		if want != "" && sums.sum() != want {
+			return transferErrorf(exitFailure, "%s does not match the hash the sender listed", name)
+		}
+		if p != nil && *chunkCache {
+			cacheChunks(h.Resume, filepath.Join(into, name), int64(h.Size), p.hasher.Sums)
+		}
+		if keep {
+			preserve(filepath.Join(into, name), h)
+		}
+		m.done(limit)
+		if sm, ok := m.(savedMeter); ok {
+			sm.saved(name)
+		}
+	}
+}
+
+// receiveTar unpacks the directory sent over c as a tar stream described
+// by h into dir. The meter m includes sums.
+func receiveTar(c *wormhole.Conn, dir string, h header, names *namer, keep bool, m meter, sums *summer, buf []byte) error {
+	m.start(h.Name, int64(h.Size))
+	span := tr.start("transfer", root, "")
+	span.set("size", strconv.Itoa(h.Size))
+	var contents io.Reader = &chunkReader{r: c, buf: buf}
+	if h.Compress != "" {
+		var err error
+		if contents, err = contentsOf(c, h, 0); err != nil {
+			return transferErrorf(exitFailure, "could not receive %s: %v", h.Name, err)
+		}
+	}
+	r := &io.LimitedReader{R: contents, N: int64(h.Size)}
+	name, err := extractTar(io.TeeReader(r, m), dir, h.Name, names, keep)
+	if err == nil && r.N == 0 && h.Compress != "" {
+		err = drain(contents)
+	}
+	span.end(err)
+	if err != nil {
+		return transferErrorf(copyStatus(err), "could not unpack %s: %v", h.Name, err)
+	}
+	if r.N != 0 {
+		return transferErrorf(exitNetwork, "EOF before receiving all bytes: (%d/%d)", int64(h.Size)-r.N, h.Size)
+	}
+	if err := checkTrailer(c, h.Name, sums.digest(), m, buf); err != nil {
+		return err
+	}
+	m.done("")
+	if sm, ok := m.(savedMeter); ok {
+		sm.saved(name)
+	}
+	fmt.Fprintf(flag.CommandLine.Output(), "unpacked into %s\n", name)
+	return nil
+}
+
+// smallFirst moves files of up to limit bytes to the front of the queue,
+// keeping the order otherwise.
+func smallFirst(files []string, limit int64) []string {
+	if limit <= 0 {
+		return files
+	}
+	var small, large []string
+	for _, f := range files {
+		// Leave errors for sendFiles to report.
+		if info, err := os.Stat(f); err == nil && info.Size() <= limit {
+			small = append(small, f)
+		} else {
+			large = append(large, f)
+		}
+	}
+	return append(small, large...)
+}
+
+// sendFiles sends the named files over c in messages of up to chunk bytes,
+// or as many as the peer reads, reading depth chunks ahead. If keep is set,
+// it sends their modes and modification times too.
+func sendFiles(c *wormhole.Conn, files []string, depth, chunk int, keep bool, m meter) error {
+	var alg string
+	if chunk > c.MessageLimit() {
+		chunk = c.MessageLimit()
+	}
+	buf := make([]byte, chunk)
+	if c.PeerVersion() < wormhole.MinChunked {
+		var err error
+		if files, err = spoolStdin(files); err != nil {
+			return err
+		}
+	}
+	if c.PeerVersion() >= wormhole.MinBatch {
+		var err error
+		files, alg, err = offerBatch(c, files, keep, m, buf)
+		if err != nil {
+			return err
+		}
+	}
+	sums := &summer{}
+	m = meters{m, sums}
+	var torn []string
+	for _, filename := range files {
+		var err error
+		switch {
+		case filename == "-":
+			err = sendChunked(c, os.Stdin, stdinName, depth, m, buf)
+		case isRemote(filename):
+			err = sendRemote(c, filename, depth, keep, m, buf)
+		default:
+			err = sendFile(c, filename, depth, keep, alg, m, buf)
+		}
+		if err == errChanged {
+			err = sendChanged(c, filename, m)
+			torn = append(torn, filename)
+		} else if err == nil {
+			err = sendTrailer(c, sums.digest())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(torn) > 0 {
+		return transferErrorf(exitDisk, "%s %w, send again once done changing", strings.Join(torn, ", "), errChanged)
+	}
+	return nil
+}
+
+// sendFile sends the file or directory called filename over c, resuming
+// if the peer has part of it, and compressing it with alg if that's set and
+// it's worth it. It returns errChanged, with what the peer expects sent
+// anyway, if the file changed while it was being sent, for the trailer to
+// say so.
+func sendFile(c *wormhole.Conn, filename string, depth int, keep bool, alg string, m meter, buf []byte) error {
+	f, err := openShared(filename)
+	if err != nil {
+		return transferErrorf(exitDisk, "could not open file %s: %v", filename, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return transferErrorf(exitDisk, "could not stat file %s: %v", filename, err)
+	}
+	if info.IsDir() {
+		return sendTar(c, filename, keep, alg, m, buf)
+	}
+	hdr := header{
+		Name: norm.NFC.String(filepath.Base(filepath.Clean(filename))),
+		Size: int(info.Size()),
+	}
+	if compressible(hdr.Name) {
+		hdr.Compress = alg
+	}
+	if keep {
+		hdr.Mode = info.Mode().Perm()
+		hdr.Modified = info.ModTime().UnixNano() / int64(time.Millisecond)
+	}
+	if c.PeerVersion() >= wormhole.MinResume && info.Mode().IsRegular() {
+		hdr.Resume = resumeToken(filename, info)
+	}
+	h, err := json.Marshal(hdr)
+	if err != nil {
+		return transferErrorf(exitFailure, "could not encode file header: %v", err)
+	}
+	_, err = c.Write(h)
+	if err != nil {
+		return transferErrorf(exitNetwork, "could not send file header: %v", err)
+	}
+	m.start(filepath.Base(filepath.Clean(filename)), info.Size())
+	var chunks *wormhole.ChunkHasher
+	var cached [][]byte
+	if hdr.Resume != "" && *chunkCache {
+		_, cached = cachedChunks(hdr.Resume)
+		chunks = &wormhole.ChunkHasher{}
+		m = meters{m, chunkMeter{chunks}}
+	}
+	var start int64
+	if hdr.Resume != "" {
+		start, err = resumeFrom(c, f, info.Size(), cached, m, buf)
+		if err != nil {
+			return err
+		}
+	}
+	var out io.Writer = c
+	flush := func() error { return nil }
+	if hdr.Compress != "" {
+		out, flush, err = compressTo(c, hdr.Compress, len(buf))
+		if err != nil {
+			return transferErrorf(exitFailure, "could not compress %s: %v", filename, err)
+		}
+	}
+	span := tr.start("transfer", root, "")
+	span.set("size", strconv.FormatInt(info.Size(), 10))
+	// The network holds up writes when buffers are full, so count
+	// the time it stalls rather than the time spent in Write.
+	stalled := c.Congestion().Stalled
+	ra := newReadAhead(f, depth, len(buf))
+	// What's past the size the peer was told would be taken for the next
+	// file, if it grew.
+	r := &timedReader{Reader: io.LimitReader(ra, info.Size()-start)}
+	written, err := io.CopyBuffer(io.MultiWriter(out, m), r, buf)
+	ra.Close()
+	limit := bottleneck(c.Congestion().Stalled-stalled, r.d)
+	if limit != "" {
+		span.set("limited_by", limit)
+	}
+	span.end(err)
+	if err != nil {
+		return transferErrorf(copyStatus(err), "could not send file: %v", err)
+	}
+	if written != info.Size()-start || info.Mode().IsRegular() && changed(f, info) {
+		if !trailed(c) {
+			return transferErrorf(exitDisk, "%s changed while sending it", filename)
+		}
+		// Make up what's missing if it shrank, for the trailer to tell
+		// the peer to drop the lot.
+		for i := range buf {
+			buf[i] = 0
+		}
+		for n := info.Size() - start - written; n > 0; {
+			k := int64(len(buf))
+			if n < k {
+				k = n
+			}
+			if _, err := out.Write(buf[:k]); err != nil {
+				return transferErrorf(exitNetwork, "could not send file: %v", err)
+			}
+			n -= k
+		}
+		if err := flush(); err != nil {
+			return transferErrorf(exitNetwork, "could not send file: %v", err)
+		}
+		return errChanged
+	}
+	if err := flush(); err != nil {
+		return transferErrorf(exitNetwork, "could not send file: %v", err)
+	}
+	if chunks != nil {
+		cacheChunks(hdr.Resume, filename, info.Size(), chunks.Sums)
+	}
+	m.done(limit)
+	return nil
+}
+
+// sendTar sends directory dir over c as a tar stream, compressed with alg
+// if that's set.
+func sendTar(c *wormhole.Conn, dir string, keep bool, alg string, m meter, buf []byte) error {
+	entries, size, err := walkTar(dir, keep)
+	if err != nil {
+		return transferErrorf(exitDisk, "could not read directory %s: %v", dir, err)
+	}
+	name := norm.NFC.String(filepath.Base(filepath.Clean(dir))) + ".tar"
+	h, err := json.Marshal(header{Name: name, Size: int(size), Archive: archiveTar, Compress: alg})
+	if err != nil {
+		return transferErrorf(exitFailure, "could not encode file header: %v", err)
+	}
+	_, err = c.Write(h)
+	if err != nil {
+		return transferErrorf(exitNetwork, "could not send file header: %v", err)
+	}
+	m.start(name, size)
+	var out io.Writer = c
+	flush := func() error { return nil }
+	if alg != "" {
+		out, flush, err = compressTo(c, alg, len(buf))
+		if err != nil {
+			return transferErrorf(exitFailure, "could not compress %s: %v", dir, err)
+		}
+	}
+	span := tr.start("transfer", root, "")
+	span.set("size", strconv.FormatInt(size, 10))
+	err = writeTar(io.MultiWriter(out, m), entries, buf)
+	if err == nil {
+		err = flush()
+	}
+	span.end(err)
+	if err != nil {
+		return transferErrorf(copyStatus(err), "could not send directory: %v", err)
+	}
+	m.done("")
+	return nil
+}
+
+// dryRunFiles reports what sendFiles would send over c, and how.
+func dryRunFiles(c *wormhole.Conn, files []string, w io.Writer) {
+	var total int64
+	for _, filename := range files {
+		if filename == "-" {
+			fmt.Fprintf(w, "would send %s from stdin, size unknown\n", stdinName)
+			continue
+		}
+		if isRemote(filename) {
+			bf, err := statRemote(filename)
+			if err != nil {
+				exitf(exitDisk, "%v", err)
+			}
+			fmt.Fprintf(w, "would send %s (%s)\n", bf.Name, formatSize(bf.Size))
+			total += bf.Size
+			continue
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			exitf(exitDisk, "could not stat file %s: %v", filename, err)
+		}
+		if info.IsDir() {
+			entries, size, err := walkTar(filename, true)
+			if err != nil {
+				exitf(exitDisk, "could not read directory %s: %v", filename, err)
+			}
+			fmt.Fprintf(w, "would send %s.tar (%s, %d entries)\n", filepath.Base(filepath.Clean(filename)), formatSize(size), len(entries))
+			total += size
+			continue
+		}
+		fmt.Fprintf(w, "would send %s (%s)\n", filepath.Base(filepath.Clean(filename)), formatSize(info.Size()))
+		total += info.Size()
+	}
+	fmt.Fprintf(w, "%d files, %s\n", len(files), formatSize(total))
+	if r, ok := c.Route(); ok {
+		fmt.Fprintf(w, "connected %s, %s to %s candidates, round trip %v\n", r, r.Local, r.Remote, r.RTT.Round(time.Millisecond))
+	} else {
+		fmt.Fprintf(w, "connected, but could not tell how\n")
+	}
+}
+
+// rateLimitFlag returns the speed a -rate-limit flag caps transfers to in
+// bytes per second, or 0 if it's unset.
+func rateLimitFlag(limit string) int64 {
+	if limit == "" {
+		return 0
+	}
+	rate, err := parseRate(limit)
+	if err != nil {
+		exitf(exitUsage, "bad -rate-limit: %v", err)
+	}
+	return rate
+}
+
+func receive(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "receive files\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s [code] [-]\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "with -, files are written to stdout instead of -dir, one after another.\n\n")
+		fmt.Fprintf(set.Output(), "flags:\n")
+		set.PrintDefaults()
+	}
+	length := set.Int("length", 2, "length of generated secret, if generating")
+	code := set.String("code", "", "use a wormhole code instead of taking it as an argument")
+	directory := set.String("dir", ".", "directory to put downloaded files")
+	codefile := set.String("codefile", "", "read a pre-shared code from this file, for unattended use")
+	lockfile := set.String("lock", "", "hold this lockfile while running")
+	ttl := set.Duration("ttl", 0, "expire a generated code if nobody uses it for this long, e.g. 10m")
+	manifestOut := set.String("manifest-out", "", "write a manifest of the files received, with hashes and a MAC, to this file")
+	receiptQR := set.Bool("receipt-qr", false, "once done, show the manifest as a QR code, for a camera to capture as a receipt")
+	noPreserve := set.Bool("no-preserve", false, "don't keep the modification times and permissions the sender gives")
+	from := set.String("from", "", "receive from this paired device without a code, see self")
+	open := set.Bool("open", false, "open received images, PDFs and text files with the default application")
+	noExtract := set.Bool("no-extract", false, "save directories sent as archives, instead of unpacking them")
+	only := set.String("only", "", "of the files the sender lists, only receive those matching these comma separated patterns, e.g. '*.jpg,*.png'")
+	ask := set.Bool("pick", false, "ask which of the files the sender lists to receive")
+	yes := set.Bool("yes", false, "receive what the sender lists without asking first")
+	clipboard := set.Bool("clipboard", false, "put text messages on the clipboard instead of printing them")
+	to := set.String("to", "", "receive into cloud storage instead of -dir, e.g. s3://bucket/prefix/, gs://bucket/prefix/ or webdavs://host/path/")
+	rateLimit := set.String("rate-limit", "", "receive no faster than this, e.g. 5MB/s, to leave room on a shared link")
+	serve := set.Bool("serve", false, "once done, serve a received website, a directory with an index.html or an HTML file, on localhost for a look")
+	mailbox := set.Bool("mailbox", false, "pick up files left on the signalling server with send -mailbox, with the code it printed")
+	stateFile := set.String("resume-state", "", "resume files partly received into -dir with the progress in this file, e.g. from another machine, and keep it there for the next")
+	set.Parse(args[1:])
+
+	rest := set.Args()
+	stdout := len(rest) > 0 && rest[len(rest)-1] == "-"
+	if stdout {
+		rest = rest[:len(rest)-1]
+	}
+	if *code != "" {
+		rest = append(rest, *code)
+	}
+	if len(rest) > 1 || (len(rest) > 0 && *codefile != "") || (*from != "" && (len(rest) > 0 || *codefile != "")) || (*to != "" && (*open || *serve)) || (stdout && (*to != "" || *open || *serve)) || (*stateFile != "" && (stdout || *to != "")) {
+		set.Usage()
+		os.Exit(exitUsage)
+	}
+	if *mailbox && (len(rest) != 1 || *from != "" || *to != "" || stdout || *stateFile != "" || *serve || *open || *only != "" || *ask || *manifestOut != "" || *receiptQR) {
+		exitf(exitUsage, "-mailbox: needs a code, and can't be used with -from, -codefile, -to, -resume-state, -serve, -open, -only, -pick, -manifest-out, -receipt-qr or stdout")
+	}
+	if *receiptQR && !canDrawQR {
+		exitf(exitUsage, "-receipt-qr: lite builds don't draw QR codes")
+	}
+	rate := rateLimitFlag(*rateLimit)
+	var s sink
+	if stdout {
+		s = stdoutSink{}
+	}
+	if *to != "" {
+		var err error
+		if s, err = openSink(*to); err != nil {
+			exitf(exitUsage, "could not use %s: %v", *to, err)
+		}
+	}
+	if *lockfile != "" {
+		if err := lock(*lockfile); err != nil {
+			fatalf("could not lock: %v", err)
+		}
+	}
+	if *mailbox {
+		p := &printer{w: set.Output(), verb: "receiving"}
+		if err := pickUpMailbox(rest[0], *directory, !*noPreserve, p, set.Output()); err != nil {
+			p.fail(err)
+		}
+		return
+	}
+	if *stateFile != "" {
+		if err := importState(*stateFile, *directory); err != nil {
+			exitf(exitUsage, "could not read -resume-state: %v", err)
+		}
+		// Also when interrupted, with the progress saved so far.
+		onexit(func() {
+			if err := exportState(*stateFile, *directory); err != nil {
+				fmt.Fprintf(set.Output(), "could not save -resume-state: %v\n", err)
+			}
+		})
+	}
+	var c *wormhole.Conn
+	switch {
+	case *from != "":
+		c = rendezvous(deviceCode(*from))
+	case *codefile != "":
+		c = rendezvous(readCodeFile(*codefile))
+	default:
+		var code string
+		if len(rest) > 0 {
+			code = rest[0]
+		}
+		c = newConn(code, *length, *ttl)
+	}
+	c.SetRateLimit(rate)
+
+	p := &printer{w: set.Output(), verb: "receiving", clipboard: *clipboard}
+	m := meters{p}
+	man := &manifest{}
+	if *manifestOut != "" || *receiptQR {
+		// Only hash files if asked to.
+		m = append(m, man)
+	}
+	if *open {
+		m = append(m, &opener{dir: *directory})
+	}
+	preview := &previewer{dir: *directory}
+	if *serve {
+		m = append(m, preview)
+	}
+	var pick picker
+	if *only != "" {
+		pick = pickMatching(*only)
+	}
+	if pick == nil {
+		pick = pickAll
+	}
+	switch {
+	case *ask:
+		pick = pickAsking(pick)
+	case !*yes:
+		pick = pickConfirming(pick)
+	}
+	var err error
+	if s != nil {
+		err = receiveInto(c, s, pick, m)
+	} else {
+		err = receiveFiles(c, *directory, !*noPreserve, !*noExtract, pick, nil, m)
+	}
+	if err != nil {
+		p.fail(err)
+	}
+	if *manifestOut != "" {
+		man.save(*manifestOut, manifestKey(c), set.Output())
+	}
+	if *receiptQR {
+		man.showqr(manifestKey(c), set.Output())
 	}
 	c.Close()
+	if *serve {
+		preview.serve(set.Output())
+	}
 }
 
 func send(args ...string) {
 	set := flag.NewFlagSet(args[0], flag.ExitOnError)
 	set.Usage = func() {
 		fmt.Fprintf(set.Output(), "send files\n\n")
-		fmt.Fprintf(set.Output(), "usage: %s %s [files]...\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "usage: %s %s [files, directories, cloud storage URLs or - for stdin]...\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "       %s %s -browse dir\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "       %s %s -text message\n\n", os.Args[0], args[0])
 		fmt.Fprintf(set.Output(), "flags:\n")
 		set.PrintDefaults()
 	}
 	length := set.Int("length", 2, "length of generated secret")
 	code := set.String("code", "", "use a wormhole code instead of generating one")
+	codefile := set.String("codefile", "", "read a pre-shared code from this file, for unattended use")
+	lockfile := set.String("lock", "", "hold this lockfile while running")
+	ttl := set.Duration("ttl", 0, "expire a generated code if nobody uses it for this long, e.g. 10m")
+	small := set.Int64("small-first", 0, "send files of up to this many bytes ahead of larger ones")
+	depth := set.Int("read-ahead", readAheadDepth, "number of chunks to read ahead of the network, 0 to turn off")
+	chunk := set.Int("chunk-size", msgChunkSize, "bytes to send in each message, up to 65535 for receivers that read that many")
+	manifestOut := set.String("manifest-out", "", "write a manifest of the files sent, with hashes and a MAC, to this file")
+	receiptQR := set.Bool("receipt-qr", false, "once done, show the manifest as a QR code, for a camera to capture as a receipt")
+	dryRun := set.Bool("dry-run", false, "connect and report what would be sent and how, without sending anything")
+	check := set.Bool("precheck", false, "measure the link for a couple of seconds first, and estimate how long sending will take")
+	browseDir := set.Bool("browse", false, "let the receiver browse the directory given and pick files from it")
+	noPreserve := set.Bool("no-preserve", false, "don't send files' modification times and permissions")
+	snapshot := set.Bool("snapshot", false, "send directories from a snapshot of their filesystem, where one can be taken, so they're consistent while in use")
+	to := set.String("to", "", "send to this paired device without a code, see self")
+	text := set.String("text", "", "send this text message instead of files, for the receiver to print")
+	encryptTo := set.String("encrypt-to", "", "also encrypt files to these comma separated age or ssh public keys, or files of them, to keep them encrypted once received")
+	set.StringVar(&stdinName, "name", stdinName, "name to send what's piped in as, with -")
+	rateLimit := set.String("rate-limit", "", "send no faster than this, e.g. 5MB/s, to leave room on a shared link")
+	listenN := set.Int("listen-n", 0, "wait on this many codes at once, and send the same to whoever uses each")
+	mailbox := set.Bool("mailbox", false, "leave the files on the signalling server, encrypted, for the receiver to pick up later with receive -mailbox")
 	set.Parse(args[1:])
 
-	if set.NArg() < 1 {
+	stdin := 0
+	for _, f := range set.Args() {
+		if f == "-" {
+			stdin++
+		}
+	}
+	if (set.NArg() < 1) == (*text == "") || (*text != "" && *encryptTo != "") || (*code != "" && *codefile != "") || (*to != "" && (*code != "" || *codefile != "")) || (*browseDir && set.NArg() != 1) ||
+		stdin > 1 || (stdin > 0 && (*encryptTo != "" || *browseDir)) || filepath.Base(stdinName) != stdinName || stdinName == "." || stdinName == ".." {
 		set.Usage()
-		os.Exit(2)
+		os.Exit(exitUsage)
 	}
-	c := newConn(*code, *length)
-
-	for _, filename := range set.Args() {
-		f, err := os.Open(filename)
-		if err != nil {
-			fatalf("could not open file %s: %v", filename, err)
+	if *listenN < 0 || *listenN > 0 && (*code != "" || *codefile != "" || *to != "" || *browseDir || *dryRun || *check || stdin > 0 || *manifestOut != "" || *receiptQR) {
+		exitf(exitUsage, "-listen-n: can't be used with -code, -codefile, -to, -browse, -dry-run, -precheck, -manifest-out, -receipt-qr or stdin")
+	}
+	if *mailbox && (*listenN > 0 || *code != "" || *codefile != "" || *to != "" || *text != "" || *browseDir || *dryRun || *check || stdin > 0 || *encryptTo != "" || *manifestOut != "" || *receiptQR) {
+		exitf(exitUsage, "-mailbox: can't be used with -listen-n, -code, -codefile, -to, -text, -browse, -dry-run, -precheck, -encrypt-to, -manifest-out, -receipt-qr or stdin")
+	}
+	if *receiptQR && !canDrawQR {
+		exitf(exitUsage, "-receipt-qr: lite builds don't draw QR codes")
+	}
+	if *chunk < 1<<10 || *chunk > wormhole.MaxMessage {
+		exitf(exitUsage, "bad -chunk-size %d: want %d to %d", *chunk, 1<<10, wormhole.MaxMessage)
+	}
+	rate := rateLimitFlag(*rateLimit)
+	if _, max := buffers(); *depth > max {
+		*depth = max
+	}
+	var recipients []age.Recipient
+	if *encryptTo != "" {
+		var err error
+		if recipients, err = age.ParseRecipients(*encryptTo); err != nil {
+			exitf(exitUsage, "could not use recipients: %v", err)
 		}
-		info, err := f.Stat()
-		if err != nil {
-			fatalf("could not stat file %s: %v", filename, err)
+	}
+	if *lockfile != "" {
+		if err := lock(*lockfile); err != nil {
+			fatalf("could not lock: %v", err)
+		}
+	}
+	if *mailbox {
+		files := smallFirst(set.Args(), *small)
+		if *snapshot {
+			snapshotDirs(files, set.Output())
+		}
+		p := &printer{w: set.Output(), verb: "uploading"}
+		if err := leaveMailbox(files, *length, *ttl, !*noPreserve, p, set.Output()); err != nil {
+			p.fail(err)
+		}
+		return
+	}
+	if *listenN > 0 {
+		files := smallFirst(set.Args(), *small)
+		if *snapshot {
+			snapshotDirs(files, set.Output())
 		}
-		h, err := json.Marshal(header{
-			Name: filepath.Base(filepath.Clean(filename)),
-			Size: int(info.Size()),
+		failed, status := sendSessions(*listenN, *length, *ttl, func(c *wormhole.Conn, p *printer) error {
+			c.SetRateLimit(rate)
+			switch {
+			case *text != "":
+				if err := sendText(c, *text); err != nil {
+					return err
+				}
+				fmt.Fprintf(p.w, "sent message\n")
+				return nil
+			case recipients != nil:
+				return sendSealed(c, files, recipients, *depth, !*noPreserve, p)
+			}
+			return sendFiles(c, files, *depth, *chunk, !*noPreserve, p)
 		})
-		_, err = c.Write(h)
-		if err != nil {
-			fatalf("could not send file header: %v", err)
+		if failed > 0 {
+			exitf(status, "%d of %d sessions failed", failed, *listenN)
 		}
-		fmt.Fprintf(set.Output(), "sending %v... ", filepath.Base(filepath.Clean(filename)))
-		written, err := io.CopyBuffer(c, f, make([]byte, msgChunkSize))
-		if err != nil {
-			fatalf("\ncould not send file: %v", err)
+		return
+	}
+	var c *wormhole.Conn
+	switch {
+	case *to != "":
+		c = rendezvous(deviceCode(*to))
+	case *codefile != "":
+		c = rendezvous(readCodeFile(*codefile))
+	default:
+		c = newConn(*code, *length, *ttl)
+	}
+	c.SetRateLimit(rate)
+
+	if *text != "" {
+		if err := sendText(c, *text); err != nil {
+			(&printer{w: set.Output()}).fail(err)
 		}
-		if written != info.Size() {
-			fatalf("\nEOF before sending all bytes: (%d/%d)", written, info.Size())
+		fmt.Fprintf(set.Output(), "sent message\n")
+		c.Close()
+		return
+	}
+
+	files := set.Args()
+	if *browseDir {
+		var err error
+		files, err = serveCatalog(c, files[0])
+		if err == wormhole.ErrNoStreams {
+			exitf(exitFailure, "peer is too old to browse files")
 		}
-		f.Close()
-		fmt.Fprintf(set.Output(), "done\n")
+		if err != nil {
+			exitf(exitNetwork, "could not offer files: %v", err)
+		}
+	}
+	files = smallFirst(files, *small)
+	if *dryRun {
+		dryRunFiles(c, files, set.Output())
+		c.Close()
+		return
+	}
+	if *check {
+		precheck(c, files, set.Output())
+	}
+	if *snapshot {
+		snapshotDirs(files, set.Output())
+	}
+
+	p := &printer{w: set.Output(), verb: "sending"}
+	var m meter = p
+	man := &manifest{}
+	if *manifestOut != "" || *receiptQR {
+		// Only hash files if asked to.
+		m = meters{p, man}
+	}
+	var err error
+	if recipients != nil {
+		err = sendSealed(c, files, recipients, *depth, !*noPreserve, m)
+	} else {
+		err = sendFiles(c, files, *depth, *chunk, !*noPreserve, m)
+	}
+	if e, ok := err.(*transferError); ok && e.status == exitRejected || errors.Is(err, errChanged) {
+		// The receiver is still there, and hangs up once we do.
+		c.Close()
+	}
+	if err != nil {
+		p.fail(err)
+	}
+	if *manifestOut != "" {
+		man.save(*manifestOut, manifestKey(c), set.Output())
+	}
+	if *receiptQR {
+		man.showqr(manifestKey(c), set.Output())
 	}
 	c.Close()
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxNameLength is the longest file name, in bytes, that common filesystems
+// allow. It's also within Windows' limit of 255 UTF-16 code units.
+const maxNameLength = 255
+
+// reservedNames are device names Windows won't create files as, even with
+// an extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true, "CONIN$": true, "CONOUT$": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// A namer picks local names for files the peer sends. Names are made valid
+// here, whatever system they came from, and a name that had to be changed
+// never overwrites an existing file. Nor does a file overwrite another
+// received earlier from the same peer.
+type namer struct {
+	windows bool            // Avoid names Windows doesn't allow.
+	fold    bool            // Names that differ only in case are the same file.
+	used    map[string]bool // Names created so far.
+}
+
+func newNamer() *namer {
+	return &namer{
+		windows: runtime.GOOS == "windows",
+		fold:    runtime.GOOS == "windows" || runtime.GOOS == "darwin",
+		used:    make(map[string]bool),
+	}
+}
+
+// clean returns name made into a valid file name. Paths are cut down to
+// their last element, so files can only be created in the directory asked
+// for.
+func (n *namer) clean(name string) string {
+	// macOS may send names decomposed, which look the same but compare
+	// differently everywhere else.
+	name = norm.NFC.String(name)
+	seps := "/"
+	if n.windows {
+		seps = `/\`
+	}
+	if i := strings.LastIndexAny(name, seps); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		// Control characters are valid in most places, but make for
+		// names that are hard to type and that mess up terminals.
+		if r < 0x20 || r == 0x7f || n.windows && strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if n.windows {
+		name = strings.TrimRight(name, ". ")
+		stem := name
+		if i := strings.IndexByte(stem, '.'); i >= 0 {
+			stem = stem[:i]
+		}
+		if reservedNames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+			name = "_" + name
+		}
+	}
+	name = fit(name, "")
+	if n.windows {
+		name = strings.TrimRight(name, ". ")
+	}
+	if name == "" || name == "." || name == ".." {
+		name = "unnamed"
+	}
+	return name
+}
+
+// fit appends suffix to the name's stem, before its extension, cutting the
+// stem short if need be to keep it within maxNameLength.
+func fit(name, suffix string) string {
+	ext := filepath.Ext(name)
+	if len(ext)+len(suffix) > maxNameLength/2 {
+		// Not really an extension.
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	max := maxNameLength - len(ext) - len(suffix)
+	if len(stem) > max {
+		for max > 0 && !utf8.RuneStart(stem[max]) {
+			max--
+		}
+		stem = stem[:max]
+	}
+	return stem + suffix + ext
+}
+
+func (n *namer) key(name string) string {
+	if n.fold {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// create creates a file in dir for a file the peer calls name, and returns
+// it along with the name it's saved as. Where that isn't the name the peer
+// gave, or it was already used, it's numbered, e.g. "a (1).txt".
+func (n *namer) create(dir, name string) (*os.File, string, error) {
+	base := n.clean(name)
+	for i := 0; i < 1000; i++ {
+		local := base
+		if i > 0 {
+			local = fit(base, fmt.Sprintf(" (%d)", i))
+		}
+		if n.used[n.key(local)] {
+			continue
+		}
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if local != name {
+			flags |= os.O_EXCL
+		}
+		f, err := os.OpenFile(filepath.Join(dir, local), flags, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, local, err
+		}
+		n.used[n.key(local)] = true
+		return f, local, nil
+	}
+	return nil, base, fmt.Errorf("too many files named like %s", base)
+}
+
+// pick picks a name in s for a file the peer calls name, numbered like
+// create's. Where that isn't the name the peer gave, it's never one that's
+// there already.
+func (n *namer) pick(s sink, name string) (string, error) {
+	base := n.clean(name)
+	for i := 0; i < 1000; i++ {
+		local := base
+		if i > 0 {
+			local = fit(base, fmt.Sprintf(" (%d)", i))
+		}
+		if n.used[n.key(local)] {
+			continue
+		}
+		if local != name {
+			taken, err := s.exists(local)
+			if err != nil {
+				return local, err
+			}
+			if taken {
+				continue
+			}
+		}
+		n.used[n.key(local)] = true
+		return local, nil
+	}
+	return base, fmt.Errorf("too many files named like %s", base)
+}
+
+// mkdir makes a new directory in dir for a directory the peer calls name,
+// and returns the name it's made as, numbered like create's. It's never one
+// that's there already, so nothing in it is overwritten.
+func (n *namer) mkdir(dir, name string) (string, error) {
+	base := n.clean(name)
+	for i := 0; i < 1000; i++ {
+		local := base
+		if i > 0 {
+			local = fit(base, fmt.Sprintf(" (%d)", i))
+		}
+		if n.used[n.key(local)] {
+			continue
+		}
+		err := os.Mkdir(filepath.Join(dir, local), 0777)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return local, err
+		}
+		n.used[n.key(local)] = true
+		return local, nil
+	}
+	return base, fmt.Errorf("too many directories named like %s", base)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCleanName(t *testing.T) {
+	long := strings.Repeat("é", 200)
+	cases := []struct {
+		name    string
+		windows bool
+		want    string
+	}{
+		{"a.txt", false, "a.txt"},
+		{"../../etc/passwd", false, "passwd"},
+		{`..\..\a.txt`, false, `..\..\a.txt`},
+		{`..\..\a.txt`, true, "a.txt"},
+		{"..", false, "unnamed"},
+		{"", false, "unnamed"},
+		{"café.txt", false, "café.txt"},
+		{"a\nb\x1b[2J", false, "a_b_[2J"},
+		{"a:b?.txt", false, "a:b?.txt"},
+		{"a:b?.txt", true, "a_b_.txt"},
+		{"notes. ", true, "notes"},
+		{"COM1", true, "_COM1"},
+		{"con.tar.gz", true, "_con.tar.gz"},
+		{"nul .txt", true, "_nul .txt"},
+		{"console.txt", true, "console.txt"},
+		{"COM1", false, "COM1"},
+		{long + ".txt", false, strings.Repeat("é", 125) + ".txt"},
+		{long, false, strings.Repeat("é", 127)},
+	}
+	for _, c := range cases {
+		n := &namer{windows: c.windows}
+		if got := n.clean(c.name); got != c.want {
+			t.Errorf("testcase %q got %q want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCreateName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ww")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/a_b.txt", nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/c.txt", nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	n := &namer{windows: true, used: make(map[string]bool)}
+	cases := []struct {
+		name, want string
+	}{
+		{"a:b.txt", "a_b (1).txt"}, // Changed, so doesn't overwrite.
+		{"a_b.txt", "a_b.txt"},     // Same name the peer gave.
+		{"a|b.txt", "a_b (2).txt"},
+		{"c.txt", "c.txt"},
+		{"c.txt", "c (1).txt"}, // Already received.
+	}
+	for _, c := range cases {
+		f, got, err := n.create(dir, c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if got != c.want {
+			t.Errorf("testcase %q got %q want %q", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// +build !lite
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// unknownCountry is the country of addresses not in the database, such as
+// private ones.
+const unknownCountry = "ZZ"
+
+// georange is a range of addresses in a country.
+type georange struct {
+	first, last net.IP // 16-byte form.
+	country     string
+}
+
+// geodb maps addresses to countries.
+type geodb []georange
+
+// readGeoDB reads a CSV file of address ranges and the countries they belong
+// to, one "first,last,country" range per row. This is the format of the free
+// DB-IP and IP2Location country databases.
+func readGeoDB(r io.Reader) (geodb, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	var db geodb
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) < 3 {
+			return nil, fmt.Errorf("line %d: want first,last,country", len(db)+1)
+		}
+		first, last := net.ParseIP(rec[0]), net.ParseIP(rec[1])
+		if first == nil || last == nil {
+			return nil, fmt.Errorf("line %d: bad address range", len(db)+1)
+		}
+		db = append(db, georange{first.To16(), last.To16(), strings.ToUpper(rec[2])})
+	}
+	sort.Slice(db, func(i, j int) bool { return bytes.Compare(db[i].first, db[j].first) < 0 })
+	return db, nil
+}
+
+// country returns the country ip is in.
+func (db geodb) country(ip net.IP) string {
+	ip = ip.To16()
+	if ip == nil {
+		return unknownCountry
+	}
+	// Find the last range starting at or before ip.
+	i := sort.Search(len(db), func(i int) bool { return bytes.Compare(db[i].first, ip) > 0 }) - 1
+	if i < 0 || bytes.Compare(ip, db[i].last) > 0 {
+		return unknownCountry
+	}
+	return db[i].country
+}
+
+// geopolicy decides which countries may use the server.
+type geopolicy struct {
+	db    geodb
+	allow map[string]bool // If not empty, only these are allowed.
+	deny  map[string]bool
+}
+
+func countries(list string) map[string]bool {
+	m := make(map[string]bool)
+	for _, c := range strings.Split(list, ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			m[c] = true
+		}
+	}
+	return m
+}
+
+// newGeoPolicy returns a policy from the database at path and comma separated
+// lists of country codes. It returns nil if both lists are empty.
+func newGeoPolicy(path, allow, deny string) (*geopolicy, error) {
+	p := &geopolicy{allow: countries(allow), deny: countries(deny)}
+	if len(p.allow) == 0 && len(p.deny) == 0 {
+		return nil, nil
+	}
+	if path == "" {
+		return nil, fmt.Errorf("country lists need a database, see -geoip")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p.db, err = readGeoDB(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return p, nil
+}
+
+// permits reports whether addr, in host:port form, is allowed, and the
+// country it is in.
+func (p *geopolicy) permits(addr string) (country string, ok bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	country = p.db.country(net.ParseIP(host))
+	if p.deny[country] {
+		return country, false
+	}
+	if len(p.allow) > 0 && !p.allow[country] {
+		return country, false
+	}
+	return country, true
+}
+
+// fence wraps h to refuse requests from countries the policy denies. A nil
+// policy allows everything.
+func (p *geopolicy) fence(h http.HandlerFunc) http.HandlerFunc {
+	if p == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if country, ok := p.permits(r.RemoteAddr); !ok {
+			log.Printf("refused %s from %s", r.URL.Path, country)
+			http.Error(w, "not available in your country", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,41 @@
+// +build !lite
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testdb = `1.0.0.0,1.0.0.255,AU
+1.0.1.0,1.0.3.255,CN
+2001:200::,2001:200:ffff:ffff:ffff:ffff:ffff:ffff,JP
+`
+
+func TestGeoPolicy(t *testing.T) {
+	db, err := readGeoDB(strings.NewReader(testdb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		allow, deny string
+		addr        string
+		country     string
+		ok          bool
+	}{
+		{"", "cn", "1.0.2.3:443", "CN", false},
+		{"", "cn", "1.0.0.1:443", "AU", true},
+		{"au,jp", "", "[2001:200::1]:80", "JP", true},
+		{"au,jp", "", "1.0.1.0:80", "CN", false},
+		{"au", "", "10.0.0.1:80", "ZZ", false},
+		{"au,zz", "", "10.0.0.1:80", "ZZ", true},
+		{"", "cn", "1.0.4.0:80", "ZZ", true},
+	}
+	for _, c := range cases {
+		p := &geopolicy{db: db, allow: countries(c.allow), deny: countries(c.deny)}
+		country, ok := p.permits(c.addr)
+		if country != c.country || ok != c.ok {
+			t.Errorf("testcase %v got %v, %v want %v, %v", c.addr, country, ok, c.country, c.ok)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+// These are the checks ww doctor makes of the STUN and TURN servers on
+// their own, before connecting through them, to tell which of them is to
+// blame if connecting doesn't work.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2"
+	"webwormhole.io/wormhole"
+)
+
+// stunCheckTimeout is how long a STUN server has to answer, and stunRetry
+// how often to ask again meanwhile, in case a packet was lost.
+const (
+	stunCheckTimeout = 3 * time.Second
+	stunRetry        = 500 * time.Millisecond
+)
+
+// iceAddr returns the host and port of the STUN or TURN server at u, with
+// the default port if it doesn't say, and whether it's reached over UDP.
+func iceAddr(u string) (addr string, udp bool) {
+	s := wormhole.ICEServer(u).URLs[0]
+	udp = strings.HasPrefix(s, "stun:") || strings.HasPrefix(s, "turn:")
+	if i := strings.Index(s, ":"); i >= 0 {
+		s = s[i+1:]
+	}
+	if i := strings.Index(s, "?"); i >= 0 {
+		udp = udp && s[i+1:] == "transport=udp"
+		s = s[:i]
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		s = net.JoinHostPort(s, "3478")
+	}
+	return s, udp
+}
+
+// stunBinding asks the STUN server at addr where packets from conn come
+// from, and returns that and how long it took to answer.
+func stunBinding(conn net.PacketConn, addr string) (*net.UDPAddr, time.Duration, error) {
+	to, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return nil, 0, err
+	}
+	start := time.Now()
+	deadline := start.Add(stunCheckTimeout)
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		if _, err := conn.WriteTo(req.Raw, to); err != nil {
+			return nil, 0, err
+		}
+		retry := time.Now().Add(stunRetry)
+		if retry.After(deadline) {
+			retry = deadline
+		}
+		conn.SetReadDeadline(retry)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+			res := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+			if res.Decode() != nil || res.TransactionID != req.TransactionID {
+				// A late answer to an earlier request, or to another.
+				continue
+			}
+			var xor stun.XORMappedAddress
+			if err := xor.GetFrom(res); err == nil {
+				return &net.UDPAddr{IP: xor.IP, Port: xor.Port}, time.Since(start), nil
+			}
+			var mapped stun.MappedAddress
+			if err := mapped.GetFrom(res); err == nil {
+				return &net.UDPAddr{IP: mapped.IP, Port: mapped.Port}, time.Since(start), nil
+			}
+			return nil, 0, errors.New("it didn't say")
+		}
+	}
+	return nil, 0, fmt.Errorf("no answer in %v", stunCheckTimeout)
+}
+
+// natType describes the NAT in front of this machine from where STUN
+// servers, each at a different address, saw the packets of one socket
+// come from.
+//
+// NATs that keep the same port for a socket whoever it sends to
+// (endpoint-independent mapping) let peers connect directly, by sending
+// each other packets at the address STUN saw. NATs that give it another
+// for each address it sends to (address-dependent, or symmetric) only do
+// if the peer's NAT is kinder, or else it takes a relay.
+func natType(mapped []*net.UDPAddr) string {
+	if len(mapped) == 0 {
+		return "unknown, no STUN server answered"
+	}
+	if localIP(mapped[0].IP) {
+		return "none, this machine's address is its own"
+	}
+	if len(mapped) < 2 {
+		return "unknown, it takes two STUN servers at different addresses to tell"
+	}
+	for _, m := range mapped[1:] {
+		if !m.IP.Equal(mapped[0].IP) || m.Port != mapped[0].Port {
+			return "address-dependent mapping (symmetric), so connecting directly only works if the peer's NAT isn't, and otherwise takes a relay"
+		}
+	}
+	return "endpoint-independent mapping, so connecting directly should work"
+}
+
+// localIP is whether ip is one of this machine's.
+func localIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// turnAllocate checks the TURN server at u, with the credentials in it,
+// relays for us, by allocating a relayed address, and returns it.
+func turnAllocate(u string) (net.Addr, error) {
+	addr, udp := iceAddr(u)
+	if !udp {
+		return nil, errors.New("only TURN over UDP is checked")
+	}
+	s := wormhole.ICEServer(u)
+	if s.Username == "" {
+		return nil, errors.New("no credentials for it, see -turn-credentials")
+	}
+	conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: addr,
+		TURNServerAddr: addr,
+		Conn:           conn,
+		Username:       s.Username,
+		Password:       fmt.Sprint(s.Credential),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	if err := client.Listen(); err != nil {
+		return nil, err
+	}
+	type result struct {
+		addr net.Addr
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		relayed, err := client.Allocate()
+		if err != nil {
+			done <- result{nil, err}
+			return
+		}
+		done <- result{relayed.LocalAddr(), nil}
+		relayed.Close()
+	}()
+	select {
+	case r := <-done:
+		return r.addr, r.err
+	case <-time.After(doctorTimeout):
+		return nil, fmt.Errorf("no answer in %v", doctorTimeout)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+var (
+	idleTimeout = flag.Duration("idle-timeout", 10*time.Minute, "disconnect once nothing has been sent either way for this long, 0 to never")
+	idleWarning = flag.Duration("idle-warning", 30*time.Second, "count down for this long before disconnecting an idle connection")
+)
+
+// watchIdle disconnects c, and exits, once it's been idle for -idle-timeout,
+// so that forgotten sessions don't linger. Both sides see the same traffic,
+// so they count down together, and sending anything either way starts the
+// clock again.
+func watchIdle(c *wormhole.Conn) {
+	if *idleTimeout <= 0 {
+		return
+	}
+	out := flag.CommandLine.Output()
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	var last [2]uint64
+	active := time.Now()
+	warned := false
+	for range tick.C {
+		var now [2]uint64
+		now[0], now[1] = c.Traffic()
+		if now != last {
+			last, active = now, time.Now()
+			if warned && interactive {
+				fmt.Fprintf(out, "\r\033[K")
+			}
+			warned = false
+			continue
+		}
+		left := (*idleTimeout - time.Since(active)).Round(time.Second)
+		switch {
+		case left <= 0:
+			if warned && interactive {
+				fmt.Fprintf(out, "\r\033[K")
+			}
+			// Close the connection on the way out so the peer hears of
+			// it right away.
+			onexit(func() { c.Close() })
+			exitf(exitTimeout, "disconnected after %v idle", *idleTimeout)
+		case left > *idleWarning:
+		case interactive:
+			fmt.Fprintf(out, "\ridle, disconnecting in %v \033[K", left)
+			warned = true
+		case !warned:
+			fmt.Fprintf(out, "idle, disconnecting in %v\n", left)
+			warned = true
+		}
+	}
+}
@@ -0,0 +1,605 @@
+// Package age encrypts files in the age format,
+// https://age-encryption.org/v1, to age and ssh public keys or a
+// passphrase, for the age and rage tools to decrypt. It only decrypts files
+// encrypted with a passphrase, which is all ww needs of it.
+package age
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// random is where keys, salts and nonces come from.
+var random io.Reader = rand.Reader
+
+const (
+	// chunkSize is the size of the chunks age encrypts the contents in.
+	chunkSize = 64 << 10
+	// overhead is what ChaCha20-Poly1305 adds to each chunk.
+	overhead = 16
+)
+
+// A stanza is an age header entry, with the file key wrapped for one
+// recipient.
+type stanza struct {
+	typ  string
+	args []string
+	body []byte
+}
+
+// A Recipient is someone files are encrypted to.
+type Recipient interface {
+	wrap(fileKey []byte) (*stanza, error)
+}
+
+// ParseRecipients parses comma separated age public keys, ssh public keys,
+// or files of them, one per line.
+func ParseRecipients(s string) ([]Recipient, error) {
+	var rs []Recipient
+	for _, arg := range strings.Split(s, ",") {
+		arg = strings.TrimSpace(arg)
+		if arg == "" {
+			continue
+		}
+		lines := []string{arg}
+		if !strings.HasPrefix(arg, "age1") && !strings.HasPrefix(arg, "ssh-") {
+			b, err := ioutil.ReadFile(arg)
+			if err != nil {
+				return nil, err
+			}
+			lines = strings.Split(string(b), "\n")
+		}
+		for _, line := range lines {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			r, err := ParseRecipient(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", arg, err)
+			}
+			rs = append(rs, r)
+		}
+	}
+	if len(rs) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	return rs, nil
+}
+
+// ParseRecipient parses an age1 public key or an ssh-ed25519 or ssh-rsa
+// one, as in authorized_keys.
+func ParseRecipient(s string) (Recipient, error) {
+	if strings.HasPrefix(s, "age1") {
+		hrp, data, err := bech32Decode(s)
+		if err != nil || hrp != "age" || len(data) != curve25519.PointSize {
+			return nil, fmt.Errorf("malformed age public key %q", s)
+		}
+		return &x25519Recipient{data}, nil
+	}
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return nil, err
+	}
+	wire := pk.Marshal()
+	cpk, ok := pk.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported ssh key type %s", pk.Type())
+	}
+	switch k := cpk.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return &sshRSARecipient{wire, k}, nil
+	case ed25519.PublicKey:
+		u, err := edwardsToMontgomery(k)
+		if err != nil {
+			return nil, err
+		}
+		return &sshEd25519Recipient{wire, u}, nil
+	}
+	return nil, fmt.Errorf("unsupported ssh key type %s", pk.Type())
+}
+
+type x25519Recipient struct {
+	pk []byte
+}
+
+func (r *x25519Recipient) wrap(fileKey []byte) (*stanza, error) {
+	share, shared, err := ephemeral(r.pk)
+	if err != nil {
+		return nil, err
+	}
+	body, err := aeadWrap(shared, append(share, r.pk...), "age-encryption.org/v1/X25519", fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return &stanza{"X25519", []string{b64(share)}, body}, nil
+}
+
+type sshEd25519Recipient struct {
+	wire []byte
+	pk   []byte
+}
+
+func (r *sshEd25519Recipient) wrap(fileKey []byte) (*stanza, error) {
+	const label = "age-encryption.org/v1/ssh-ed25519"
+	share, shared, err := ephemeral(r.pk)
+	if err != nil {
+		return nil, err
+	}
+	tweak := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, nil, r.wire, []byte(label)), tweak); err != nil {
+		return nil, err
+	}
+	shared, err = curve25519.X25519(tweak, shared)
+	if err != nil {
+		return nil, err
+	}
+	body, err := aeadWrap(shared, append(share, r.pk...), label, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return &stanza{"ssh-ed25519", []string{sshTag(r.wire), b64(share)}, body}, nil
+}
+
+type sshRSARecipient struct {
+	wire []byte
+	pk   *rsa.PublicKey
+}
+
+func (r *sshRSARecipient) wrap(fileKey []byte) (*stanza, error) {
+	body, err := rsa.EncryptOAEP(sha256.New(), random, r.pk, fileKey, []byte("age-encryption.org/v1/ssh-rsa"))
+	if err != nil {
+		return nil, err
+	}
+	return &stanza{"ssh-rsa", []string{sshTag(r.wire)}, body}, nil
+}
+
+// A ScryptRecipient is a passphrase, as age -p takes one. LogN is the
+// scrypt work factor.
+type ScryptRecipient struct {
+	Passphrase string
+	LogN       int
+}
+
+func (r *ScryptRecipient) wrap(fileKey []byte) (*stanza, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(random, salt); err != nil {
+		return nil, err
+	}
+	aead, err := scryptAEAD(r.Passphrase, salt, r.LogN)
+	if err != nil {
+		return nil, err
+	}
+	body := aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil)
+	return &stanza{"scrypt", []string{b64(salt), strconv.Itoa(r.LogN)}, body}, nil
+}
+
+func scryptAEAD(passphrase string, salt []byte, logN int) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), append([]byte("age-encryption.org/v1/scrypt"), salt...), 1<<logN, 8, 1, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+// ephemeral makes an ephemeral X25519 key, and returns its public part and
+// the secret it shares with pk.
+func ephemeral(pk []byte) (share, shared []byte, err error) {
+	e := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(random, e); err != nil {
+		return nil, nil, err
+	}
+	share, err = curve25519.X25519(e, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err = curve25519.X25519(e, pk)
+	if err != nil {
+		return nil, nil, err
+	}
+	return share, shared, nil
+}
+
+// aeadWrap encrypts fileKey with a key derived from secret.
+func aeadWrap(secret, salt []byte, info string, fileKey []byte) ([]byte, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil), nil
+}
+
+// sshTag identifies an ssh key in a stanza, so that its owner can find the
+// stanza meant for them.
+func sshTag(wire []byte) string {
+	h := sha256.Sum256(wire)
+	return b64(h[:4])
+}
+
+func b64(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+// edwardsToMontgomery converts an Ed25519 public key to the X25519 one for
+// the same secret, u = (1+y)/(1-y).
+func edwardsToMontgomery(pk []byte) ([]byte, error) {
+	if len(pk) != 32 {
+		return nil, errors.New("malformed ed25519 public key")
+	}
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	le := make([]byte, 32)
+	for i := range pk {
+		le[31-i] = pk[i]
+	}
+	le[0] &= 0x7f
+	y := new(big.Int).SetBytes(le)
+	den := new(big.Int).Sub(big.NewInt(1), y)
+	den.Mod(den, p)
+	if den.ModInverse(den, p) == nil {
+		return nil, errors.New("malformed ed25519 public key")
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, den)
+	u.Mod(u, p)
+	b := make([]byte, 32)
+	be := u.Bytes()
+	for i, v := range be {
+		b[len(be)-1-i] = v
+	}
+	return b, nil
+}
+
+// bech32Decode decodes s, as in BIP 173, into its human readable part and
+// data.
+func bech32Decode(s string) (string, []byte, error) {
+	const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("mixed case")
+	}
+	s = strings.ToLower(s)
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+7 > len(s) {
+		return "", nil, errors.New("malformed bech32")
+	}
+	hrp := s[:sep]
+	var values []byte
+	for _, c := range hrp {
+		values = append(values, byte(c>>5))
+	}
+	values = append(values, 0)
+	for _, c := range hrp {
+		values = append(values, byte(c&31))
+	}
+	var data []byte
+	for i := sep + 1; i < len(s); i++ {
+		v := strings.IndexByte(charset, s[i])
+		if v < 0 {
+			return "", nil, errors.New("malformed bech32")
+		}
+		data = append(data, byte(v))
+	}
+	gen := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range append(values, data...) {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := range gen {
+			if top>>uint(i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	if chk != 1 {
+		return "", nil, errors.New("bad bech32 checksum")
+	}
+	// Regroup the 5 bit values, less the checksum, into bytes.
+	var out []byte
+	acc, bits := uint32(0), uint(0)
+	for _, v := range data[:len(data)-6] {
+		acc = acc<<5 | uint32(v)
+		bits += 5
+		if bits >= 8 {
+			bits -= 8
+			out = append(out, byte(acc>>bits))
+		}
+	}
+	if bits >= 5 || acc&(1<<bits-1) != 0 {
+		return "", nil, errors.New("malformed bech32")
+	}
+	return hrp, out, nil
+}
+
+// Header makes a file key, and a header with it wrapped for each of rs.
+func Header(rs []Recipient) (fileKey, header []byte, err error) {
+	fileKey = make([]byte, 16)
+	if _, err := io.ReadFull(random, fileKey); err != nil {
+		return nil, nil, err
+	}
+	var b bytes.Buffer
+	b.WriteString("age-encryption.org/v1\n")
+	for _, r := range rs {
+		s, err := r.wrap(fileKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		fmt.Fprintf(&b, "-> %s\n", strings.Join(append([]string{s.typ}, s.args...), " "))
+		body := b64(s.body)
+		for ; len(body) >= 64; body = body[64:] {
+			b.WriteString(body[:64] + "\n")
+		}
+		b.WriteString(body + "\n")
+	}
+	b.WriteString("---")
+	mac := hmac.New(sha256.New, derive(fileKey, nil, "header"))
+	mac.Write(b.Bytes())
+	b.WriteString(" " + b64(mac.Sum(nil)) + "\n")
+	return fileKey, b.Bytes(), nil
+}
+
+// derive derives a key with HKDF-SHA256.
+func derive(secret, salt []byte, info string) []byte {
+	key := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key)
+	return key
+}
+
+// Size is the size of a file of n bytes once encrypted, with a header of
+// hdr bytes.
+func Size(hdr int, n int64) int64 {
+	chunks := (n + chunkSize - 1) / chunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(hdr) + 16 + n + chunks*overhead
+}
+
+// A Writer encrypts what's written to it with a file key.
+type Writer struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce [chacha20poly1305.NonceSize]byte
+	buf   []byte
+	out   []byte
+	n     int64
+}
+
+// NonceSize is the size of the nonce a file's contents are encrypted with.
+const NonceSize = 16
+
+// NewWriter returns a Writer to w, which it writes header to first,
+// encrypting with fileKey, as Header made them.
+func NewWriter(w io.Writer, fileKey, header []byte) (*Writer, error) {
+	nonce := make([]byte, NonceSize)
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return nil, err
+	}
+	return NewWriterNonce(w, fileKey, header, nonce)
+}
+
+// NewWriterNonce is NewWriter, with the nonce given rather than made at
+// random, so that the same contents can be encrypted to the same file
+// twice, e.g. to hash it before sending it. It must never be used with the
+// same file key for different contents.
+func NewWriterNonce(w io.Writer, fileKey, header, nonce []byte) (*Writer, error) {
+	if len(nonce) != NonceSize {
+		return nil, errors.New("malformed nonce")
+	}
+	aead, err := chacha20poly1305.New(derive(fileKey, nonce, "payload"))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(header, nonce...)); err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, chunkSize),
+		out:  make([]byte, 0, chunkSize+overhead),
+	}, nil
+}
+
+func (a *Writer) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// Only seal a full chunk once there's more, since the last one is
+		// marked as such.
+		if len(a.buf) == chunkSize {
+			if err := a.seal(false); err != nil {
+				return n, err
+			}
+		}
+		k := copy(a.buf[len(a.buf):cap(a.buf)], p)
+		a.buf = a.buf[:len(a.buf)+k]
+		a.n += int64(k)
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+// Close seals the last chunk.
+func (a *Writer) Close() error {
+	return a.seal(true)
+}
+
+// Written returns how much has been written to a, before it's encrypted.
+func (a *Writer) Written() int64 {
+	return a.n
+}
+
+func (a *Writer) seal(last bool) error {
+	if last {
+		a.nonce[len(a.nonce)-1] = 1
+	}
+	a.out = a.aead.Seal(a.out[:0], a.nonce[:], a.buf, nil)
+	a.buf = a.buf[:0]
+	for i := len(a.nonce) - 2; i >= 0; i-- {
+		a.nonce[i]++
+		if a.nonce[i] != 0 {
+			break
+		}
+	}
+	_, err := a.w.Write(a.out)
+	return err
+}
+
+// ErrBadPassphrase is returned for age files not encrypted with the
+// passphrase given.
+var ErrBadPassphrase = errors.New("wrong passphrase")
+
+// maxScryptLogN is the highest scrypt work factor NewReader will do the
+// work for, which takes a second or so.
+const maxScryptLogN = 22
+
+// A Reader decrypts an age file encrypted with a passphrase.
+type Reader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	nonce [chacha20poly1305.NonceSize]byte
+	buf   []byte
+	p     []byte
+	last  bool
+}
+
+// NewReader reads the header of the age file in r, which has to be
+// encrypted with passphrase, and returns a reader of what's in it.
+func NewReader(r io.Reader, passphrase string) (*Reader, error) {
+	br := bufio.NewReader(r)
+	var hdr bytes.Buffer
+	line := func() (string, error) {
+		s, err := br.ReadString('\n')
+		if err != nil {
+			return "", errors.New("malformed age header")
+		}
+		hdr.WriteString(s)
+		return strings.TrimSuffix(s, "\n"), nil
+	}
+	if s, err := line(); err != nil || s != "age-encryption.org/v1" {
+		return nil, errors.New("not an age file")
+	}
+	var fileKey []byte
+	for {
+		s, err := line()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(s, "---") {
+			mac := hmac.New(sha256.New, derive(fileKey, nil, "header"))
+			mac.Write(hdr.Bytes()[:hdr.Len()-len(s)-1+3])
+			if fileKey == nil || strings.TrimPrefix(s, "--- ") != b64(mac.Sum(nil)) {
+				return nil, ErrBadPassphrase
+			}
+			break
+		}
+		args := strings.Fields(strings.TrimPrefix(s, "-> "))
+		var body string
+		for {
+			s, err := line()
+			if err != nil {
+				return nil, err
+			}
+			body += s
+			if len(s) < 64 {
+				break
+			}
+		}
+		if len(args) != 3 || args[0] != "scrypt" {
+			continue
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(args[1])
+		logN, nerr := strconv.Atoi(args[2])
+		wrapped, berr := base64.RawStdEncoding.DecodeString(body)
+		if err != nil || nerr != nil || berr != nil || logN < 1 {
+			return nil, errors.New("malformed age header")
+		}
+		if logN > maxScryptLogN {
+			return nil, fmt.Errorf("scrypt work factor %d is too high", logN)
+		}
+		aead, err := scryptAEAD(passphrase, salt, logN)
+		if err != nil {
+			return nil, err
+		}
+		if fileKey, err = aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), wrapped, nil); err != nil {
+			return nil, ErrBadPassphrase
+		}
+	}
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(br, nonce); err != nil {
+		return nil, errors.New("malformed age file")
+	}
+	aead, err := chacha20poly1305.New(derive(fileKey, nonce, "payload"))
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: br, aead: aead, buf: make([]byte, chunkSize+overhead)}, nil
+}
+
+func (a *Reader) Read(p []byte) (int, error) {
+	for len(a.p) == 0 {
+		if a.last {
+			return 0, io.EOF
+		}
+		if err := a.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, a.p)
+	a.p = a.p[n:]
+	return n, nil
+}
+
+// open decrypts the next chunk. The last one is the one at the end of the
+// file, which may be full too.
+func (a *Reader) open() error {
+	n, err := io.ReadFull(a.r, a.buf)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		a.last = true
+	case err != nil:
+		return err
+	default:
+		if _, err := a.r.Peek(1); err == io.EOF {
+			a.last = true
+		}
+	}
+	if a.last {
+		a.nonce[len(a.nonce)-1] = 1
+	}
+	p, err := a.aead.Open(a.buf[:0], a.nonce[:], a.buf[:n], nil)
+	if err != nil {
+		return errors.New("age file is corrupt or truncated")
+	}
+	a.p = p
+	for i := len(a.nonce) - 2; i >= 0; i-- {
+		a.nonce[i]++
+		if a.nonce[i] != 0 {
+			break
+		}
+	}
+	return nil
+}
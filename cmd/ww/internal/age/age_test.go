@@ -0,0 +1,182 @@
+package age
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestBech32(t *testing.T) {
+	cases := []struct {
+		s   string
+		hrp string
+		ok  bool
+	}{
+		{"A12UEL5L", "a", true},
+		{"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw", "abcdef", true},
+		{"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxx", "", false},
+		{"A12uEL5L", "", false},
+		{"pzry9x0s0muk", "", false},
+	}
+	for _, c := range cases {
+		hrp, _, err := bech32Decode(c.s)
+		if (err == nil) != c.ok || hrp != c.hrp {
+			t.Errorf("testcase %v got %q, %v want %q", c.s, hrp, err, c.hrp)
+		}
+	}
+}
+
+func TestEdwardsToMontgomery(t *testing.T) {
+	for i := 0; i < 8; i++ {
+		pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+		h := sha512.Sum512(priv.Seed())
+		want, _ := curve25519.X25519(h[:32], curve25519.Basepoint)
+		got, err := edwardsToMontgomery(pub)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("testcase %x got %x, %v want %x", pub, got, err, want)
+		}
+	}
+}
+
+// openAge decrypts an age file with the file key unwrap gets from the
+// recipient's stanza.
+func openAge(t *testing.T, b []byte, unwrap func(args []string, body []byte) []byte) []byte {
+	end := bytes.Index(b, []byte("\n---"))
+	lines := strings.Split(string(b[:end]), "\n")
+	if lines[0] != "age-encryption.org/v1" || len(lines) < 3 {
+		t.Fatalf("bad header %q", b[:end])
+	}
+	args := strings.Fields(lines[1])[2:]
+	body, _ := base64.RawStdEncoding.DecodeString(strings.Join(lines[2:], ""))
+	fileKey := unwrap(args, body)
+
+	macEnd := end + 1 + bytes.IndexByte(b[end+1:], '\n')
+	mac := hmac.New(sha256.New, derive(fileKey, nil, "header"))
+	mac.Write(b[:end+4])
+	if got := string(b[end+5 : macEnd]); got != b64(mac.Sum(nil)) {
+		t.Fatalf("bad mac %v", got)
+	}
+	nonce, payload := b[macEnd+1:macEnd+17], b[macEnd+17:]
+	aead, _ := chacha20poly1305.New(derive(fileKey, nonce, "payload"))
+	var out []byte
+	var counter [12]byte
+	for {
+		n := len(payload)
+		if n > chunkSize+overhead {
+			n = chunkSize + overhead
+		}
+		if n == len(payload) {
+			counter[11] = 1
+		}
+		chunk, err := aead.Open(nil, counter[:], payload[:n], nil)
+		if err != nil {
+			t.Fatalf("chunk %x: %v", counter, err)
+		}
+		out = append(out, chunk...)
+		payload = payload[n:]
+		if len(payload) == 0 {
+			return out
+		}
+		counter[10]++
+	}
+}
+
+func unwrapX25519(secret, pk []byte, label string, tweak []byte) func([]string, []byte) []byte {
+	return func(args []string, body []byte) []byte {
+		share, _ := base64.RawStdEncoding.DecodeString(args[len(args)-1])
+		shared, _ := curve25519.X25519(secret, share)
+		if tweak != nil {
+			shared, _ = curve25519.X25519(tweak, shared)
+		}
+		aead, _ := chacha20poly1305.New(derive(shared, append(share, pk...), label))
+		fileKey, _ := aead.Open(nil, make([]byte, 12), body, nil)
+		return fileKey
+	}
+}
+
+func TestAge(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	pk, _ := curve25519.X25519(secret, curve25519.Basepoint)
+
+	edPub, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+	sshPub, _ := ssh.NewPublicKey(edPub)
+	r, err := ParseRecipient(string(ssh.MarshalAuthorizedKey(sshPub)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha512.Sum512(edPriv.Seed())
+	edPK, _ := edwardsToMontgomery(edPub)
+	const label = "age-encryption.org/v1/ssh-ed25519"
+	tweak := derive(nil, sshPub.Marshal(), label)
+
+	recipients := []struct {
+		r      Recipient
+		unwrap func([]string, []byte) []byte
+	}{
+		{&x25519Recipient{pk}, unwrapX25519(secret, pk, "age-encryption.org/v1/X25519", nil)},
+		{r, unwrapX25519(h[:32], edPK, label, tweak)},
+	}
+	for _, n := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize} {
+		data := make([]byte, n)
+		rand.Read(data)
+		for i, rc := range recipients {
+			fileKey, hdr, err := Header([]Recipient{rc.r})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var b bytes.Buffer
+			aw, _ := NewWriter(&b, fileKey, hdr)
+			io.Copy(aw, bytes.NewReader(data))
+			aw.Close()
+			if int64(b.Len()) != Size(len(hdr), int64(n)) {
+				t.Errorf("testcase %v/%v got size %v want %v", n, i, b.Len(), Size(len(hdr), int64(n)))
+			}
+			if got := openAge(t, b.Bytes(), rc.unwrap); !bytes.Equal(got, data) {
+				t.Errorf("testcase %v/%v got different contents back", n, i)
+			}
+		}
+	}
+}
+
+func TestAgeReader(t *testing.T) {
+	for _, n := range []int{0, 1, chunkSize, chunkSize + 1, 2 * chunkSize} {
+		data := make([]byte, n)
+		rand.Read(data)
+		fileKey, hdr, err := Header([]Recipient{&ScryptRecipient{"hunter2", 10}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		aw, _ := NewWriter(&b, fileKey, hdr)
+		io.Copy(aw, bytes.NewReader(data))
+		aw.Close()
+
+		ar, err := NewReader(bytes.NewReader(b.Bytes()), "hunter2")
+		if err != nil {
+			t.Fatalf("testcase %v: %v", n, err)
+		}
+		if got, err := ioutil.ReadAll(ar); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("testcase %v got %v bytes back, %v", n, len(got), err)
+		}
+		if _, err := NewReader(bytes.NewReader(b.Bytes()), "hunter3"); err != ErrBadPassphrase {
+			t.Errorf("testcase %v with the wrong passphrase got %v", n, err)
+		}
+		ar, _ = NewReader(bytes.NewReader(b.Bytes()[:b.Len()-1]), "hunter2")
+		if _, err := ioutil.ReadAll(ar); err == nil {
+			t.Errorf("testcase %v read a truncated file", n)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package age
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The vectors in testdata/decrypt are in the format of the age project's,
+// https://c2sp.org/CCTV/age: a few lines saying what's expected, then the
+// file. They were made with filippo.io/age v1.3.2, and the broken ones
+// broken after, and it agrees with what they expect.
+//
+// Those in testdata/encrypt are what Header and NewWriter make of "hello,
+// world\n" for the keys next to them, with what would be random counting
+// up from 0 instead, and age decrypts them with the keys:
+//
+//	age -d -i testdata/encrypt/x25519.key testdata/encrypt/all.age
+//
+// The keys are only for these tests.
+
+// counter is a stand in for random, which reads 0, 1, 2, and so on.
+type counter struct{ n byte }
+
+func (r *counter) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.n
+		r.n++
+	}
+	return len(p), nil
+}
+
+func TestDecryptVectors(t *testing.T) {
+	files, err := filepath.Glob("testdata/decrypt/*")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no vectors: %v", err)
+	}
+	for _, name := range files {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i := bytes.Index(b, []byte("\n\n"))
+		if i < 0 {
+			t.Fatalf("%s: no file", name)
+		}
+		v := map[string]string{}
+		for _, line := range strings.Split(string(b[:i]), "\n") {
+			kv := strings.SplitN(line, ": ", 2)
+			if len(kv) != 2 {
+				t.Fatalf("%s: malformed line %q", name, line)
+			}
+			v[kv[0]] = kv[1]
+		}
+		file := b[i+2:]
+
+		r, err := NewReader(bytes.NewReader(file), v["passphrase"])
+		var got []byte
+		if err == nil {
+			got, err = ioutil.ReadAll(r)
+		}
+		sum := sha256.Sum256(got)
+		switch v["expect"] {
+		case "success":
+			if err != nil || hex.EncodeToString(sum[:]) != v["payload"] {
+				t.Errorf("%s: got %d bytes, %v", name, len(got), err)
+			}
+		case "no match":
+			if err != ErrBadPassphrase {
+				t.Errorf("%s: got %v, want %v", name, err, ErrBadPassphrase)
+			}
+		default:
+			if err == nil {
+				t.Errorf("%s: decrypted, want %s", name, v["expect"])
+			}
+		}
+	}
+}
+
+func TestEncryptVectors(t *testing.T) {
+	defer func(r io.Reader) { random = r }(random)
+	dir := "testdata/encrypt/"
+	for _, name := range []string{"x25519", "ssh-ed25519", "ssh-rsa", "all"} {
+		pubs := dir + name + ".pub"
+		if name == "all" {
+			pubs = dir + "x25519.pub," + dir + "ssh-ed25519.pub," + dir + "ssh-rsa.pub"
+		}
+		rs, err := ParseRecipients(pubs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		random = &counter{}
+		fileKey, hdr, err := Header(rs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		w, err := NewWriter(&b, fileKey, hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("hello, world\n"))
+		w.Close()
+		want, err := ioutil.ReadFile(dir + name + ".age")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), want) {
+			t.Errorf("%s: got\n%q\nwant\n%q", name, b.Bytes(), want)
+		}
+		if int64(b.Len()) != Size(len(hdr), 13) {
+			t.Errorf("%s: got %d bytes, want %d", name, b.Len(), Size(len(hdr), 13))
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Files are sent with other programs held off from writing to them where
+// the OS allows, see openShared, and checked for having changed anyway
+// once they're sent. Receivers since wormhole.MinChanged drop those that
+// did, rather than keep a torn copy, and the sender goes on to the next.
+
+// errInUse is returned by openShared for files another program has locked.
+var errInUse = errors.New("in use by another program")
+
+// errChanged is returned for a file that changed while it was being sent
+// or received.
+var errChanged = errors.New("changed while sending it")
+
+// changed reports whether the file f, which was info when it was opened,
+// has changed since.
+func changed(f *os.File, info os.FileInfo) bool {
+	now, err := f.Stat()
+	return err != nil || now.Size() != info.Size() || !now.ModTime().Equal(info.ModTime())
+}
+
+// A droppedMeter is a meter that's told when a file it was started on is
+// dropped, and why, instead of being done.
+type droppedMeter interface {
+	dropped(why string)
+}
+
+func (ms meters) dropped(why string) {
+	for _, m := range ms {
+		if dm, ok := m.(droppedMeter); ok {
+			dm.dropped(why)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// openShared opens the file called name to send it, with a shared lock,
+// which holds off programs that lock it to write to it. It fails with
+// errInUse if one already has.
+func openShared(name string) (*os.File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		f.Close()
+		return nil, errInUse
+	}
+	return f, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// webLangs are the languages other than English the web client has been
+// translated into, as in web/i18n.js. ww server serves it in each at
+// /lang/, e.g. /es/.
+var webLangs = []string{"de", "es"}
+
+// webLang returns the language to link receivers to the web client in:
+// the one asked for with -lang, or else that of the locale, if the web
+// client has been translated into it. It's "" for English.
+func webLang() string {
+	if *lang != "" {
+		l := strings.ToLower(*lang)
+		if l == "en" {
+			return ""
+		}
+		if indexOf(webLangs, l) < 0 {
+			exitf(exitUsage, "bad -lang %q: want en or one of %s", *lang, strings.Join(webLangs, ", "))
+		}
+		return l
+	}
+	if l := localeLang(); indexOf(webLangs, l) >= 0 {
+		return l
+	}
+	return ""
+}
+
+// localeLang returns the language of the locale set in the environment,
+// e.g. es for es_MX.UTF-8, the way POSIX looks it up.
+func localeLang() string {
+	for _, v := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if l := os.Getenv(v); l != "" {
+			l = strings.ToLower(l)
+			if i := strings.IndexAny(l, "_.@-"); i >= 0 {
+				l = l[:i]
+			}
+			return l
+		}
+	}
+	return ""
+}
+
+// splitLang splits the language a web client path starts with, if it's
+// one of webLangs, from the rest of it.
+func splitLang(path string) (lang, rest string) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	if indexOf(webLangs, parts[0]) < 0 {
+		return "", path
+	}
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], "/" + parts[1]
+}
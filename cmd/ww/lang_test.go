@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSplitLang(t *testing.T) {
+	cases := []struct {
+		path       string
+		lang, rest string
+	}{
+		{"/", "", "/"},
+		{"/es", "es", ""},
+		{"/es/", "es", "/"},
+		{"/de/main.js", "de", "/main.js"},
+		{"/fr/main.js", "", "/fr/main.js"},
+		{"/main.js", "", "/main.js"},
+		{"/s/es", "", "/s/es"},
+	}
+	for _, c := range cases {
+		lang, rest := splitLang(c.path)
+		if lang != c.lang || rest != c.rest {
+			t.Errorf("testcase %v got %q, %q want %q, %q", c.path, lang, rest, c.lang, c.rest)
+		}
+	}
+}
+
+func TestLocaleLang(t *testing.T) {
+	for _, v := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		defer os.Setenv(v, os.Getenv(v))
+	}
+	cases := []struct {
+		all, lang string
+		want      string
+	}{
+		{"", "es_MX.UTF-8", "es"},
+		{"de_DE@euro", "es_MX.UTF-8", "de"},
+		{"", "C", "c"},
+		{"", "", ""},
+	}
+	for _, c := range cases {
+		os.Setenv("LC_ALL", c.all)
+		os.Unsetenv("LC_MESSAGES")
+		os.Setenv("LANG", c.lang)
+		if got := localeLang(); got != c.want {
+			t.Errorf("testcase %v/%v got %q want %q", c.all, c.lang, got, c.want)
+		}
+	}
+}
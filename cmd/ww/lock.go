@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// errLocked is what lockFile returns when another process holds the lock.
+var errLocked = errors.New("locked")
+
+// heldLock is the lockfile we hold, kept open for as long as we run.
+var heldLock *os.File
+
+// lock takes the lockfile at path, so that overlapping invocations (e.g.
+// from cron) bail out instead of colliding. It's an advisory lock on the
+// file, held until the program exits, however it does, so there are no
+// stale ones to take over. The file is left behind, with our pid in it to
+// say who holds it: removing it would let a process that had just opened
+// it lock the old one, as another locks the new.
+func lock(path string) error {
+	f, err := lockFile(path)
+	if err == errLocked {
+		buf, _ := ioutil.ReadFile(path)
+		// It's empty until the holder's written its pid.
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(buf))); err == nil {
+			return fmt.Errorf("%s is held by process %d", path, pid)
+		}
+		return fmt.Errorf("%s is held by another process", path)
+	}
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return err
+	}
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	heldLock = f
+	return nil
+}
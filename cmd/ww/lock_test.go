@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ww")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lock")
+	// Left behind by a process that's gone, or one that's yet to say.
+	ioutil.WriteFile(path, []byte("x"), 0644)
+	if err := lock(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { heldLock.Close(); heldLock = nil }()
+	if _, err := lockFile(path); err != errLocked {
+		t.Errorf("locked a held lockfile again: %v", err)
+	}
+	if err := lock(path); err == nil || !strings.Contains(err.Error(), fmt.Sprint(os.Getpid())) {
+		t.Errorf("got %v, want it held by us", err)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+	"webwormhole.io/cmd/ww/internal/age"
+	"webwormhole.io/wormhole"
+)
+
+// Senders who can't wait for the receiver to be online too can leave files
+// in a mailbox on the signalling server, if it keeps them, with ww send
+// -mailbox, for the receiver to pick up later with ww receive -mailbox and
+// the code it prints. See mailstore.go for the server's side.
+//
+// There's no PAKE to stop anyone guessing at the code, since whoever has
+// the ciphertext can try as many as they like, so the code's words are
+// the passphrase of an age file, with scrypt, and there are more of them.
+// Its number is the mailbox's ID. In the age file is a mailboxContents, a
+// line of JSON, followed by the files in it, each as long as its header
+// says, with directories as tar streams. The receiver deletes the mailbox
+// once it has them, with the token in it, which the server only has the
+// SHA-256 of.
+
+// mailboxLength is the fewest words in a mailbox's code.
+const mailboxLength = 5
+
+// mailboxLogN is the scrypt work factor of mailboxes, age's default.
+const mailboxLogN = 18
+
+// mailboxContents lists what's in a mailbox.
+type mailboxContents struct {
+	Delete string   `json:"delete"`
+	Files  []header `json:"files"`
+}
+
+// mailboxRequest makes a request of the signalling server's mailboxes,
+// authenticated as the dialer is, of the one with id, or of none for "".
+func mailboxRequest(method, id string, body io.Reader, h http.Header) (*http.Response, error) {
+	u, err := url.Parse(*sigserv)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, "/m", id)
+	if id == "" {
+		u.Path += "/"
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	d := dialer()
+	for k, v := range d.Header {
+		req.Header[k] = v
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: d.TLSClientConfig,
+	}}
+	return client.Do(req)
+}
+
+// mailboxError is the error for a response other than the one hoped for.
+func mailboxError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		if resp.Request.Method == http.MethodPost {
+			return transferErrorf(exitUsage, "the signalling server doesn't keep mailboxes")
+		}
+		return transferErrorf(exitAuth, "no such mailbox, it may have been picked up or expired")
+	case http.StatusMethodNotAllowed:
+		return transferErrorf(exitUsage, "the signalling server doesn't keep mailboxes")
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return transferErrorf(exitAuth, "the signalling server refused: %s", resp.Status)
+	case http.StatusInsufficientStorage:
+		return transferErrorf(exitRejected, "the signalling server has no room for it")
+	}
+	return transferErrorf(exitNetwork, "the signalling server said %s", resp.Status)
+}
+
+// leaveMailbox uploads files to a new mailbox that expires after ttl, or
+// when the signalling server says, if sooner, and prints its code. If keep
+// is set, it keeps their modes and modification times too.
+func leaveMailbox(files []string, length int, ttl time.Duration, keep bool, m meter, out io.Writer) error {
+	if length < mailboxLength {
+		length = mailboxLength
+	}
+	password, err := newPassword(length)
+	if err != nil {
+		return err
+	}
+	token := make([]byte, 16)
+	if _, err := crand.Read(token); err != nil {
+		return err
+	}
+	contents := mailboxContents{Delete: hex.EncodeToString(token)}
+	trees := make([][]tarEntry, len(files))
+	for i, filename := range files {
+		if filename == "-" || isRemote(filename) {
+			return transferErrorf(exitUsage, "can only leave local files in a mailbox, not %s", filename)
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			return transferErrorf(exitDisk, "could not stat file %s: %v", filename, err)
+		}
+		h := header{
+			Name: norm.NFC.String(filepath.Base(filepath.Clean(filename))),
+			Size: int(info.Size()),
+		}
+		switch {
+		case info.IsDir():
+			var size int64
+			if trees[i], size, err = walkTar(filename, keep); err != nil {
+				return transferErrorf(exitDisk, "could not read directory %s: %v", filename, err)
+			}
+			h.Name += ".tar"
+			h.Size = int(size)
+			h.Archive = archiveTar
+		case keep:
+			h.Mode = info.Mode().Perm()
+			h.Modified = info.ModTime().UnixNano() / int64(time.Millisecond)
+		}
+		contents.Files = append(contents.Files, h)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(sealMailbox(pw, password, files, trees, contents, m))
+	}()
+	sum := sha256.Sum256(token)
+	h := http.Header{"X-Delete": {hex.EncodeToString(sum[:])}}
+	if ttl > 0 {
+		h.Set("X-TTL", strconv.Itoa(int(ttl/time.Second)))
+	}
+	resp, err := mailboxRequest(http.MethodPost, "", pr, h)
+	// Unblock the upload, if it's still going.
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return transferErrorf(exitNetwork, "could not upload: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return mailboxError(resp)
+	}
+	var box struct {
+		ID      string    `json:"id"`
+		Expires time.Time `json:"expires"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&box); err != nil {
+		return transferErrorf(exitNetwork, "could not upload: %v", err)
+	}
+	code := box.ID + "-" + password
+	fmt.Fprintf(out, "%s\n", code)
+	fmt.Fprintf(out, "left in a mailbox until %s, pick it up with: ww receive -mailbox %s\n", box.Expires.Local().Format("Jan 2 15:04"), code)
+	return nil
+}
+
+// sealMailbox writes what's in a mailbox to w, encrypted with password.
+func sealMailbox(w io.Writer, password string, files []string, trees [][]tarEntry, contents mailboxContents, m meter) error {
+	fileKey, hdr, err := age.Header([]age.Recipient{&age.ScryptRecipient{Passphrase: password, LogN: mailboxLogN}})
+	if err != nil {
+		return err
+	}
+	aw, err := age.NewWriter(w, fileKey, hdr)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(aw).Encode(contents); err != nil {
+		return err
+	}
+	buf := make([]byte, msgChunkSize)
+	for i, h := range contents.Files {
+		m.start(h.Name, int64(h.Size))
+		out := io.MultiWriter(aw, m)
+		if h.Archive != "" {
+			err = writeTar(out, trees[i], buf)
+		} else {
+			err = copyExactly(out, files[i], int64(h.Size), buf)
+		}
+		if err != nil {
+			return err
+		}
+		m.done("")
+	}
+	return aw.Close()
+}
+
+// copyExactly copies the size bytes of the file called filename to w.
+func copyExactly(w io.Writer, filename string, size int64, buf []byte) error {
+	f, err := openShared(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.CopyBuffer(w, io.LimitReader(f, size), buf)
+	if err == nil && n != size {
+		err = fmt.Errorf("%s changed while sending it", filename)
+	}
+	return err
+}
+
+// pickUpMailbox downloads the files in the mailbox with code into dir, and
+// deletes it. If keep is set, it keeps the modes and modification times
+// the sender gave.
+func pickUpMailbox(code, dir string, keep bool, m meter, out io.Writer) error {
+	id, password, err := wormhole.ParseCode(code)
+	if err != nil {
+		return transferErrorf(exitUsage, "bad code %q, want e.g. 7-tiger-jupiter-apple-thirty-bottle", code)
+	}
+	resp, err := mailboxRequest(http.MethodGet, id, nil, nil)
+	if err != nil {
+		return transferErrorf(exitNetwork, "could not download: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return mailboxError(resp)
+	}
+	ar, err := age.NewReader(resp.Body, password)
+	if err == age.ErrBadPassphrase {
+		return transferErrorf(exitAuth, "wrong code for mailbox %s", id)
+	}
+	if err != nil {
+		return transferErrorf(exitNetwork, "could not download: %v", err)
+	}
+	r := bufio.NewReader(ar)
+	line, err := r.ReadBytes('\n')
+	var contents mailboxContents
+	if err == nil {
+		err = json.Unmarshal(line, &contents)
+	}
+	if err != nil {
+		return transferErrorf(exitNetwork, "could not download: %v", err)
+	}
+	names := newNamer()
+	for _, h := range contents.Files {
+		if h.Size < 0 {
+			return transferErrorf(exitFailure, "bad size for %s", h.Name)
+		}
+		m.start(h.Name, int64(h.Size))
+		lr := &io.LimitedReader{R: r, N: int64(h.Size)}
+		if h.Archive == archiveTar {
+			name, err := extractTar(io.TeeReader(lr, m), dir, h.Name, names, keep)
+			if err != nil {
+				return transferErrorf(copyStatus(err), "could not unpack %s: %v", h.Name, err)
+			}
+			if lr.N != 0 {
+				return transferErrorf(exitNetwork, "EOF before receiving all bytes: (%d/%d)", int64(h.Size)-lr.N, h.Size)
+			}
+			m.done("")
+			fmt.Fprintf(out, "unpacked into %s\n", name)
+			continue
+		}
+		f, name, err := names.create(dir, h.Name)
+		if err != nil {
+			return transferErrorf(exitDisk, "could not create output file %s: %v", name, err)
+		}
+		_, err = io.Copy(f, io.TeeReader(lr, m))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return transferErrorf(copyStatus(err), "could not save %s: %v", name, err)
+		}
+		if lr.N != 0 {
+			return transferErrorf(exitNetwork, "EOF before receiving all bytes: (%d/%d)", int64(h.Size)-lr.N, h.Size)
+		}
+		if keep {
+			preserve(filepath.Join(dir, name), h)
+		}
+		m.done("")
+	}
+	// Reading to the end checks nothing was cut off.
+	if err := drain(r); err != nil {
+		return transferErrorf(exitNetwork, "could not download: %v", err)
+	}
+	resp, err = mailboxRequest(http.MethodDelete, id, nil, http.Header{"X-Delete": {contents.Delete}})
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			err = mailboxError(resp)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(out, "could not delete the mailbox, it's kept until it expires: %v\n", err)
+	}
+	return nil
+}
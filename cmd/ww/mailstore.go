@@ -0,0 +1,285 @@
+// +build !lite
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With ww server -mailbox, the signalling server also keeps files for
+// receivers to pick up later, for when both peers can't be online at once.
+// Senders encrypt them before uploading, see mailbox.go, so all it keeps
+// is ciphertext.
+//
+// POST /m/ uploads a mailbox, with how long to keep it in X-TTL, in
+// seconds, and the hex SHA-256 of a token to delete it with in X-Delete,
+// and is answered with its ID. GET /m/ID downloads it, and DELETE /m/ID
+// with the token in X-Delete deletes it. IDs are numbered separately in
+// each namespace, as slots are.
+//
+// Each mailbox is kept in the -mailbox directory as a file of its contents
+// and one of its mailboxMeta, until it expires or is deleted. Uploads that
+// would take them all over -mailbox-quota are cut off.
+
+// errQuota is returned for uploads that would go over the quota.
+var errQuota = errors.New("mailbox quota exceeded")
+
+// mailboxMeta is what's kept about a mailbox alongside its contents.
+type mailboxMeta struct {
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+	Delete  string    `json:"delete"`
+	Size    int64     `json:"size"`
+
+	// uploading is set until its contents are all there.
+	uploading bool
+}
+
+// A mailStore keeps mailboxes in a directory.
+type mailStore struct {
+	dir   string
+	quota int64
+	ttl   time.Duration // The longest mailboxes are kept.
+
+	sync.Mutex
+	used  int64
+	boxes map[string]*mailboxMeta // By slotKey.
+}
+
+// newMailStore opens the mailboxes kept in dir, and deletes those that
+// expired, or weren't all uploaded, while the server wasn't running.
+func newMailStore(dir string, quota int64, ttl time.Duration) (*mailStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &mailStore{dir: dir, quota: quota, ttl: ttl, boxes: map[string]*mailboxMeta{}}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		var m mailboxMeta
+		b, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err == nil {
+			err = json.Unmarshal(b, &m)
+		}
+		if err != nil || time.Now().After(m.Expires) || s.path(m.Key) != filepath.Join(dir, strings.TrimSuffix(f.Name(), ".json")) {
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		s.boxes[m.Key] = &m
+		s.used += m.Size
+	}
+	// Contents without their metadata were being uploaded.
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			if _, err := os.Stat(filepath.Join(dir, f.Name()+".json")); err != nil {
+				os.Remove(filepath.Join(dir, f.Name()))
+			}
+		}
+	}
+	go s.expire()
+	return s, nil
+}
+
+// path is where the contents of the mailbox with key are kept, and with
+// .json on the end its metadata.
+func (s *mailStore) path(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(h[:16]))
+}
+
+// expire deletes mailboxes once they expire.
+func (s *mailStore) expire() {
+	for range time.Tick(time.Minute) {
+		s.Lock()
+		for key, m := range s.boxes {
+			if !m.uploading && time.Now().After(m.Expires) {
+				s.remove(key)
+			}
+		}
+		s.Unlock()
+	}
+}
+
+// remove deletes the mailbox with key. This assumes s is locked.
+func (s *mailStore) remove(key string) {
+	m := s.boxes[key]
+	p := s.path(key)
+	os.Remove(p + ".json")
+	os.Remove(p)
+	s.used -= m.Size
+	delete(s.boxes, key)
+}
+
+// free finds an unused mailbox ID in namespace, favouring smaller numbers.
+// This assumes s is locked.
+func (s *mailStore) free(namespace string) (string, bool) {
+	for _, n := range []int{1 << 8, 1 << 16, 1 << 24} {
+		for i := 0; i < 64; i++ {
+			id := strconv.Itoa(rand.Intn(n))
+			if s.boxes[slotKey(namespace, id)] == nil {
+				return id, true
+			}
+		}
+	}
+	return "", false
+}
+
+// quotaWriter writes to w, counting what it writes against the quota of s
+// and the size of m.
+type quotaWriter struct {
+	w io.Writer
+	s *mailStore
+	m *mailboxMeta
+}
+
+func (q *quotaWriter) Write(p []byte) (int, error) {
+	q.s.Lock()
+	if q.s.quota > 0 && q.s.used+int64(len(p)) > q.s.quota {
+		q.s.Unlock()
+		return 0, errQuota
+	}
+	q.s.used += int64(len(p))
+	q.m.Size += int64(len(p))
+	q.s.Unlock()
+	return q.w.Write(p)
+}
+
+func (s *mailStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/m/")
+	if id != "" && !numericSlot.MatchString(id) {
+		// free only gives out numbers, and anything else might be the
+		// key of another namespace's.
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && id == "":
+		s.upload(w, r)
+	case r.Method == http.MethodGet && id != "":
+		s.download(w, r, slotKey(namespaceOf(r), id))
+	case r.Method == http.MethodDelete && id != "":
+		s.delete(w, r, slotKey(namespaceOf(r), id))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *mailStore) upload(w http.ResponseWriter, r *http.Request) {
+	ttl := s.ttl
+	if secs, err := strconv.Atoi(r.Header.Get("X-TTL")); err == nil && secs > 0 && time.Duration(secs)*time.Second < ttl {
+		ttl = time.Duration(secs) * time.Second
+	}
+	del := strings.ToLower(r.Header.Get("X-Delete"))
+	if b, err := hex.DecodeString(del); err != nil || len(b) != sha256.Size {
+		http.Error(w, "bad X-Delete", http.StatusBadRequest)
+		return
+	}
+	namespace := namespaceOf(r)
+	s.Lock()
+	id, ok := s.free(namespace)
+	if !ok {
+		s.Unlock()
+		http.Error(w, "no free mailboxes", http.StatusServiceUnavailable)
+		return
+	}
+	key := slotKey(namespace, id)
+	m := &mailboxMeta{Key: key, Expires: time.Now().Add(ttl), Delete: del, uploading: true}
+	s.boxes[key] = m
+	s.Unlock()
+
+	p := s.path(key)
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil {
+		_, err = io.Copy(&quotaWriter{f, s, m}, r.Body)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	var b []byte
+	if err == nil {
+		b, err = json.Marshal(m)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(p+".json", b, 0600)
+	}
+	s.Lock()
+	m.uploading = false
+	if err != nil {
+		s.remove(key)
+	}
+	s.Unlock()
+	switch {
+	case err == errQuota:
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	case err != nil:
+		log.Printf("could not keep mailbox %s: %v", key, err)
+		http.Error(w, "could not keep it", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("mailbox %s: kept %d bytes until %v", key, m.Size, m.Expires.Format(time.RFC3339))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ID      string    `json:"id"`
+		Expires time.Time `json:"expires"`
+	}{id, m.Expires})
+}
+
+func (s *mailStore) download(w http.ResponseWriter, r *http.Request, key string) {
+	s.Lock()
+	m := s.boxes[key]
+	var f *os.File
+	err := os.ErrNotExist
+	if m != nil && !m.uploading && time.Now().Before(m.Expires) {
+		// Once it's open, it can be read to the end even if it's deleted.
+		f, err = os.Open(s.path(key))
+	}
+	s.Unlock()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
+
+func (s *mailStore) delete(w http.ResponseWriter, r *http.Request, key string) {
+	token, _ := hex.DecodeString(r.Header.Get("X-Delete"))
+	sum := sha256.Sum256(token)
+	s.Lock()
+	defer s.Unlock()
+	m := s.boxes[key]
+	if m == nil || m.uploading {
+		http.NotFound(w, r)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(m.Delete)) != 1 {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	s.remove(key)
+	log.Printf("mailbox %s: picked up", key)
+	w.WriteHeader(http.StatusNoContent)
+}
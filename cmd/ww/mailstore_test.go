@@ -0,0 +1,99 @@
+// +build !lite
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMailStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ww-mailbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := newMailStore(dir, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := "00112233"
+	b, _ := hex.DecodeString(token)
+	sum := sha256.Sum256(b)
+	do := func(method, path, body, del string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("X-Delete", del)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(http.MethodPost, "/m/", "hello", hex.EncodeToString(sum[:]))
+	var box struct{ ID string }
+	if err := json.NewDecoder(w.Body).Decode(&box); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("upload got %d, %v", w.Code, err)
+	}
+	if w := do(http.MethodPost, "/m/", "too much", hex.EncodeToString(sum[:])); w.Code != http.StatusInsufficientStorage {
+		t.Errorf("upload over quota got %d", w.Code)
+	}
+	if s.used != 5 {
+		t.Errorf("using %d bytes, want 5", s.used)
+	}
+
+	// Mailboxes are still there once the server restarts.
+	if s, err = newMailStore(dir, 10, time.Hour); err != nil || len(s.boxes) != 1 {
+		t.Fatalf("reopened %d mailboxes, %v", len(s.boxes), err)
+	}
+	if w := do(http.MethodGet, "/m/"+box.ID, "", ""); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("download got %d %q", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodDelete, "/m/"+box.ID, "", "0011"); w.Code != http.StatusForbidden {
+		t.Errorf("delete with the wrong token got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/m/"+box.ID, "", token); w.Code != http.StatusNoContent {
+		t.Errorf("delete got %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/m/"+box.ID, "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("download once deleted got %d", w.Code)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 || s.used != 0 {
+		t.Errorf("%d files left, using %d bytes", len(files), s.used)
+	}
+}
+
+func TestMailStoreOtherNamespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ww-mailbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := newMailStore(dir, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte{0})
+	r := httptest.NewRequest(http.MethodPost, "/m/", strings.NewReader("acme's"))
+	r.Header.Set("X-Delete", hex.EncodeToString(sum[:]))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), namespaceKey{}, "acme")))
+	var box struct{ ID string }
+	if err := json.NewDecoder(w.Body).Decode(&box); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("upload got %d, %v", w.Code, err)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(method, "/m/acme/"+box.ID, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s from the shared namespace got %d", method, w.Code)
+		}
+	}
+}
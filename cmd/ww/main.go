@@ -2,15 +2,27 @@
 package main
 
 import (
+	"bufio"
 	crand "crypto/rand"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"rsc.io/qr"
+	"golang.org/x/crypto/ssh/terminal"
 	"webwormhole.io/wordlist"
 	"webwormhole.io/wormhole"
 )
@@ -19,12 +31,49 @@ var subcmds = map[string]func(args ...string){
 	"send":    send,
 	"receive": receive,
 	"pipe":    pipe,
-	"server":  server,
+	"daemon":  daemon,
+	"report":  report,
+	"replay":  replay,
+	"update":  update,
+	"verify":  verify,
 }
 
+// version is the version of ww, set at build time with
+// -ldflags "-X main.version=...".
+var version = "devel"
+
 var (
-	iceserv = flag.String("ice", "stun:stun.l.google.com:19302", "stun or turn servers to use")
-	sigserv = flag.String("signal", "https://wrmhl.link/", "signalling server to use")
+	iceserv    = flag.String("ice", strings.Join(wormhole.DefaultICEServers, ","), "stun or turn servers to use")
+	stunserv   = flag.String("stun", "", "stun servers to use instead of those in -ice, e.g. stun.example.com:3478")
+	stunWait   = flag.Duration("stun-timeout", 2*time.Second, "how long each stun server has to answer before it's left out")
+	turnserv   = flag.String("turn", "", "turn servers to use instead of those in -ice, e.g. turns:turn.example.com:5349")
+	turnCred   = flag.String("turn-credentials", "", "`username:password` for turn servers that don't have their own, defaults to $WW_TURN_CREDENTIALS")
+	sigserv    = flag.String("signal", wormhole.DefaultSignalServer, "signalling server to use")
+	record     = flag.String("record", "", "append a recording of the signalling session to this file, for ww replay")
+	otlp       = flag.String("otlp", "", "export OpenTelemetry traces to this OTLP/HTTP endpoint, e.g. http://localhost:4318")
+	policy     = flag.String("transport-policy", "all", "all, no-relay to never relay data, or relay-only to always relay it")
+	bearer     = flag.String("auth-token", "", "bearer token for private signalling servers, defaults to $WW_AUTH_TOKEN")
+	authCert   = flag.String("auth-cert", "", "PEM file with a TLS client certificate and key, for private signalling servers")
+	via        = flag.String("via", "", "relay through your own `[secret@]host[:port]` running ww relay, instead of turn servers in -ice")
+	nohost     = flag.Bool("no-host-candidates", false, "don't tell the peer this machine's local addresses")
+	longPoll   = flag.Bool("long-poll", false, "signal over plain HTTP without trying a websocket first, for proxies that hang them")
+	privacy    = flag.String("privacy", "normal", "normal, or strict to pad and delay messages to the signalling server, for untrusted servers")
+	reprobe    = flag.Duration("reprobe", 0, "with several turn servers, check this often whether another has become faster")
+	lang       = flag.String("lang", "", "language of the web client in links to codes, e.g. es, defaults to the locale's if it has been translated")
+	words      = flag.String("wordlist", "pgp", "words to make codes of: pgp, or a file of 256 words a line each, or 512 in even and odd pairs like pgp's")
+	qrCode     = flag.String("qr", "on", "on to draw a QR code of the link to a new code, for a phone to scan, or off")
+	compress   = flag.String("compress", "", "compress files sent with gzip, for slow links, if the receiver takes it, or none to turn down a sender's offer to")
+	chunkCache = flag.Bool("chunk-cache", false, "keep the chunk hashes of files sent and received, so that sending them again skips hashing them, and what the receiver still has")
+)
+
+// interactive is whether a user is at the terminal. It's checked before
+// keeplog replaces stderr.
+var interactive = terminal.IsTerminal(int(os.Stdin.Fd())) && terminal.IsTerminal(int(os.Stderr.Fd()))
+
+// tr and root trace this invocation, if -otlp is set.
+var (
+	tr   *tracer
+	root *span
 )
 
 func usage() {
@@ -38,114 +87,396 @@ func usage() {
 	}
 	fmt.Fprintf(w, "\nflags:\n")
 	flag.PrintDefaults()
+	fmt.Fprintf(w, "\nexit status:\n")
+	fmt.Fprintf(w, "  1 failure, 2 usage, 3 network, 4 auth, 5 rejected, 6 disk, 7 timeout\n")
 }
 
 func main() {
 	flag.Usage = usage
 	flag.Parse()
+	configFlags()
+	webLang() // Complain about -lang before booking a code.
+	if *qrCode != "on" && *qrCode != "off" {
+		exitf(exitUsage, "bad -qr %q: want on or off", *qrCode)
+	}
+	compressFlag()
 	if flag.NArg() < 1 {
 		usage()
-		os.Exit(2)
+		os.Exit(exitUsage)
 	}
 	cmd, ok := subcmds[flag.Arg(0)]
 	if !ok {
 		flag.Usage()
-		os.Exit(2)
+		os.Exit(exitUsage)
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		cleanup()
+		os.Exit(1)
+	}()
+	limitMemory()
+	if flag.Arg(0) != "server" && flag.Arg(0) != "relay" && flag.Arg(0) != "report" {
+		keeplog()
+		tr = newTracer(*otlp, "ww")
+		root = tr.start("ww "+flag.Arg(0), nil, "")
+		onexit(func() {
+			if memLimit > 0 {
+				root.set("peak_heap", strconv.FormatUint(atomic.LoadUint64(&peakHeap), 10))
+			}
+			root.end(nil)
+			tr.flush()
+		})
 	}
 	cmd(flag.Args()...)
+	cleanup()
+}
+
+// atexit is a list of functions to run before the program exits,
+// e.g. to remove lockfiles.
+var atexit struct {
+	fns []func()
+	sync.Mutex
+}
+
+func onexit(fn func()) {
+	atexit.Lock()
+	atexit.fns = append(atexit.fns, fn)
+	atexit.Unlock()
+}
+
+func cleanup() {
+	atexit.Lock()
+	defer atexit.Unlock()
+	for i := len(atexit.fns) - 1; i >= 0; i-- {
+		atexit.fns[i]()
+	}
+	atexit.fns = nil
+}
+
+// hostOf strips credentials from a TURN URL.
+func hostOf(url string) string {
+	if i := strings.LastIndex(url, "@"); i >= 0 {
+		return url[i+1:]
+	}
+	return url
+}
+
+// recording is the open -record file, if any.
+var recording *os.File
+
+// transportPolicies are the values of -transport-policy.
+var transportPolicies = map[string]wormhole.TransportPolicy{
+	"all":        wormhole.AllTransports,
+	"no-relay":   wormhole.NoRelay,
+	"relay-only": wormhole.RelayOnly,
+}
+
+// transportPolicy returns the policy named by -transport-policy.
+func transportPolicy() wormhole.TransportPolicy {
+	p, ok := transportPolicies[*policy]
+	if !ok {
+		exitf(exitUsage, "bad -transport-policy %q: want all, no-relay or relay-only", *policy)
+	}
+	return p
+}
+
+// authToken returns the token to authenticate to the signalling server
+// with, if any. It's best kept in the environment, out of sight of ps.
+func authToken() string {
+	if *bearer != "" {
+		return *bearer
+	}
+	return os.Getenv("WW_AUTH_TOKEN")
+}
+
+func turnCredentials() string {
+	if *turnCred != "" {
+		return *turnCred
+	}
+	return os.Getenv("WW_TURN_CREDENTIALS")
+}
+
+func dialer() *wormhole.Dialer {
+	d := &wormhole.Dialer{
+		SignalServer: *sigserv,
+		ICEServers:   iceServers(),
+	}
+	d.BufferSize, _ = buffers()
+	d.NoHostCandidates = *nohost
+	d.LongPoll = *longPoll
+	d.STUNTimeout = *stunWait
+	// Keep codes good if the signalling server restarts while waiting.
+	d.Rebook = time.Minute
+	d.TransportPolicy = transportPolicy()
+	if *reprobe > 0 {
+		d.ReprobeInterval = *reprobe
+		d.OnFasterRelay = func(old, new string) {
+			// Moving an open connection isn't supported yet, so just say so.
+			log.Printf("relay %s is now faster than %s", hostOf(new), hostOf(old))
+		}
+	}
+	d.Header = http.Header{}
+	if token := authToken(); token != "" {
+		d.Header.Set("Authorization", "Bearer "+token)
+	}
+	if *authCert != "" {
+		cert, err := tls.LoadX509KeyPair(*authCert, *authCert)
+		if err != nil {
+			exitf(exitUsage, "could not load -auth-cert: %v", err)
+		}
+		d.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	switch *privacy {
+	case "normal":
+	case "strict":
+		d.StrictPrivacy = true
+	default:
+		exitf(exitUsage, "bad -privacy %q: want normal or strict", *privacy)
+	}
+	if tr != nil {
+		if !d.StrictPrivacy {
+			// Let the server's spans join ours. Strict privacy doesn't
+			// tell it which invocation it's serving.
+			d.Header.Set("Traceparent", root.traceparent())
+		}
+		d.Trace = func(phase string) func(error) {
+			return tr.start(phase, root, "").end
+		}
+	}
+	if *record != "" {
+		if recording == nil {
+			f, err := os.OpenFile(*record, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+			if err != nil {
+				exitf(exitDisk, "could not open recording: %v", err)
+			}
+			recording = f
+			onexit(func() { f.Close() })
+		}
+		d.Record = recording
+	}
+	return d
 }
 
 func fatalf(format string, v ...interface{}) {
-	fmt.Fprintf(flag.CommandLine.Output(), format+"\n", v...)
-	os.Exit(1)
+	exitf(exitFailure, format, v...)
 }
 
-func newConn(code string, length int) *wormhole.Conn {
+// newConn joins the wormhole with the given code, or creates a new one if
+// code is empty. New wormholes expire after ttl, if it's not zero.
+func newConn(code string, length int, ttl time.Duration) *wormhole.Conn {
 	if code != "" {
 		// Join wormhole.
-		parts := strings.Split(code, "-")
-		c, err := wormhole.Dial(parts[0], strings.Join(parts[1:], "-"), *sigserv, strings.Split(*iceserv, ","))
-		if err == wormhole.ErrBadVersion {
-			fatalf(
-				"%s%s%s",
-				"the signalling server is running an incompatable version.\n",
-				"try upgrading the client:\n\n",
-				"    go get webwormhole.io/cmd/ww\n",
-			)
-		}
+		slot, pass, err := wormhole.ParseCode(code)
 		if err != nil {
-			fatalf("could not dial: %v", err)
+			exitf(exitUsage, "bad code %q, want e.g. 7-tiger-jupiter", code)
 		}
-		return c
+		return dial(func() (*wormhole.Conn, error) {
+			return dialer().Dial(slot, pass)
+		})
 	}
 	// New wormhole.
-	passbytes := make([]byte, length)
-	if _, err := io.ReadFull(crand.Reader, passbytes); err != nil {
+	return dial(func() (*wormhole.Conn, error) {
+		out := flag.CommandLine.Output()
+		backoff := time.Second
+		for attempt := 0; ; attempt++ {
+			c, err := newWormhole(length, ttl)
+			switch {
+			case attempt >= *codeAttempts:
+			case err == wormhole.ErrSlotTaken:
+				// The server dropped us while we waited and somebody else
+				// booked the slot before we could again.
+				fmt.Fprintf(out, "lost the slot to somebody else, the old code won't work. use this one:\n")
+				continue
+			case err == wormhole.ErrNoFreeSlot:
+				fmt.Fprintf(out, "the signalling server has no free slots, trying again in %v\n", backoff)
+				time.Sleep(backoff)
+				backoff *= 2
+				continue
+			}
+			return c, err
+		}
+	})
+}
+
+// newWormhole creates a new wormhole with a new code, and prints the code.
+func newWormhole(length int, ttl time.Duration) (*wormhole.Conn, error) {
+	password, err := newPassword(length)
+	if err != nil {
 		fatalf("could not generate password: %v", err)
 	}
-	password := strings.Join(wordlist.Encode(passbytes), "-")
+	d := dialer()
+	d.TTL = ttl
+	if ttl > 0 {
+		d.Renew = make(chan struct{})
+	}
+	revocable(d)
+	release := func() {}
 	slotc := make(chan string)
+	stop, done := make(chan struct{}), make(chan struct{})
 	go func() {
-		printcode(<-slotc + "-" + password)
+		defer close(done)
+		select {
+		case slot := <-slotc:
+			release = waitOn(d, slot)
+			printcode(slot + "-" + password)
+		case <-stop:
+			return
+		}
+		if ttl > 0 {
+			countdown(ttl, d.Renew, stop)
+		}
 	}()
-	c, err := wormhole.Wormhole(password, *sigserv, strings.Split(*iceserv, ","), slotc)
-	if err == wormhole.ErrBadVersion {
-		fatalf(
-			"%s%s%s",
-			"the signalling server is running an incompatable version.\n",
-			"try upgrading the client:\n\n",
-			"    go get webwormhole.io/cmd/ww\n",
-		)
+	c, err := d.Wormhole(password, slotc)
+	close(stop)
+	<-done
+	release()
+	return c, err
+}
+
+// countdown shows how long is left until the code expires, and renews it
+// when the user presses enter, until stop is closed. It only does so when
+// run interactively.
+func countdown(ttl time.Duration, renew chan<- struct{}, stop <-chan struct{}) {
+	if !interactive {
+		return
+	}
+	out := flag.CommandLine.Output()
+	enter := make(chan struct{})
+	go func() {
+		r := bufio.NewReader(os.Stdin)
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+			enter <- struct{}{}
+		}
+	}()
+	deadline := time.Now().Add(ttl)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		left := time.Until(deadline).Round(time.Second)
+		if left < 0 {
+			left = 0
+		}
+		fmt.Fprintf(out, "\rcode expires in %v, press enter to renew \033[K", left)
+		select {
+		case <-tick.C:
+		case <-enter:
+			select {
+			case renew <- struct{}{}:
+				deadline = time.Now().Add(ttl)
+			case <-stop:
+			}
+		case <-stop:
+			fmt.Fprintf(out, "\r\033[K")
+			return
+		}
+	}
+}
+
+// newPassword generates a random password of length bytes, encoded as words
+// in the -wordlist.
+func newPassword(length int) (string, error) {
+	passbytes := make([]byte, length)
+	if _, err := io.ReadFull(crand.Reader, passbytes); err != nil {
+		return "", err
+	}
+	return codeWords().Encode(passbytes), nil
+}
+
+// codeWords returns the -wordlist, by name or from the file it names.
+func codeWords() *wordlist.List {
+	if l, ok := wordlist.Lookup(*words); ok {
+		return l
 	}
+	f, err := os.Open(*words)
 	if err != nil {
-		fatalf("could not dial: %v", err)
+		exitf(exitUsage, "bad -wordlist %q: want one of %s, or a file: %v", *words, strings.Join(wordlist.Names(), ", "), err)
 	}
-	return c
+	defer f.Close()
+	l, err := wordlist.Read(*words, f)
+	if err != nil {
+		exitf(exitUsage, "bad -wordlist: %v", err)
+	}
+	// Keep it for next time.
+	wordlist.Register(l)
+	return l
 }
 
-func printcode(code string) {
-	out := flag.CommandLine.Output()
-	fmt.Fprintf(out, "%s\n", code)
-	u, err := url.Parse(*sigserv)
+// readCodeFile reads a pre-shared wormhole code from a file. Since the code
+// is long-lived, the file must not be accessible by other users.
+func readCodeFile(path string) string {
+	info, err := os.Stat(path)
 	if err != nil {
-		return
+		fatalf("could not read code file: %v", err)
 	}
-	u.Fragment = code
-	qrcode, err := qr.Encode(u.String(), qr.L)
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		fatalf("code file %s is accessible by other users, chmod it to 0600", path)
+	}
+	buf, err := ioutil.ReadFile(path)
 	if err != nil {
-		return
+		fatalf("could not read code file: %v", err)
 	}
-	for x := 0; x < qrcode.Size; x++ {
-		fmt.Fprintf(out, "█")
+	code := strings.TrimSpace(string(buf))
+	if !strings.Contains(code, "-") {
+		fatalf("code file %s does not contain a code", path)
 	}
-	fmt.Fprintf(out, "████████\n")
-	for x := 0; x < qrcode.Size; x++ {
-		fmt.Fprintf(out, "█")
+	return code
+}
+
+// rendezvous connects to a peer using a code both sides know ahead of time.
+// Either side may arrive first: it joins the slot if the peer is already
+// waiting on it, and reserves it otherwise.
+func rendezvous(code string) *wormhole.Conn {
+	slot, pass, err := wormhole.ParseCode(code)
+	if err != nil {
+		exitf(exitUsage, "bad code %q, want e.g. 7-tiger-jupiter", code)
 	}
-	fmt.Fprintf(out, "████████\n")
-	for y := 0; y < qrcode.Size; y += 2 {
-		fmt.Fprintf(out, "████")
-		for x := 0; x < qrcode.Size; x++ {
-			switch {
-			case qrcode.Black(x, y) && qrcode.Black(x, y+1):
-				fmt.Fprintf(out, " ")
-			case qrcode.Black(x, y):
-				fmt.Fprintf(out, "▄")
-			case qrcode.Black(x, y+1):
-				fmt.Fprintf(out, "▀")
-			default:
-				fmt.Fprintf(out, "█")
+	return dial(func() (*wormhole.Conn, error) {
+		for attempt := 0; ; attempt++ {
+			c, err := dialer().Dial(slot, pass)
+			if err == wormhole.ErrNoSuchSlot {
+				d := dialer()
+				revocable(d)
+				release := waitOn(d, slot)
+				c, err = d.Reserve(slot, pass)
+				release()
+				if err == wormhole.ErrSlotTaken && attempt < 3 {
+					// The peer reserved it at the same time we did. Join it instead.
+					continue
+				}
 			}
+			return c, err
 		}
-		fmt.Fprintf(out, "████\n")
+	})
+}
+
+func printcode(code string) {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "%s\n", code)
+	link, err := webLink(code)
+	if err != nil {
+		return
 	}
-	for x := 0; x < qrcode.Size; x++ {
-		fmt.Fprintf(out, "█")
+	if *qrCode == "on" {
+		printqr(out, link)
 	}
-	fmt.Fprintf(out, "████████\n")
-	for x := 0; x < qrcode.Size; x++ {
-		fmt.Fprintf(out, "█")
+	fmt.Fprintf(out, "%s\n", link)
+}
+
+// webLink returns the link to join with code in the web client, on the
+// signalling server, in the language of the locale.
+func webLink(code string) (string, error) {
+	u, err := url.Parse(*sigserv)
+	if err != nil {
+		return "", err
+	}
+	if l := webLang(); l != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + l + "/"
 	}
-	fmt.Fprintf(out, "████████\n")
-	fmt.Fprintf(out, "%s\n", u.String())
+	u.Fragment = code
+	return u.String(), nil
 }
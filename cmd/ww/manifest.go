@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+// manifest is a meter that records what was transferred, for -manifest-out.
+// The MAC is an HMAC-SHA256 of the JSON encoded files under a key exported
+// from the connection, so both peers have the key and can check each
+// other's manifests, and their own later on.
+type manifest struct {
+	Files []*manifestFile `json:"files"`
+	MAC   string          `json:"mac"`
+	h     hash.Hash
+	n     int64 // Bytes of the current file, for those of unknown size.
+}
+
+type manifestFile struct {
+	Name   string    `json:"name"`
+	Size   int64     `json:"size"`
+	SHA256 string    `json:"sha256"`
+	Time   time.Time `json:"time"`
+}
+
+func (m *manifest) start(name string, size int64) {
+	m.Files = append(m.Files, &manifestFile{Name: name, Size: size, Time: time.Now().UTC()})
+	m.h, m.n = sha256.New(), 0
+}
+
+func (m *manifest) Write(p []byte) (int, error) {
+	m.n += int64(len(p))
+	return m.h.Write(p)
+}
+
+func (m *manifest) done(limit string) {
+	f := m.Files[len(m.Files)-1]
+	f.SHA256 = hex.EncodeToString(m.h.Sum(nil))
+	if f.Size < 0 {
+		f.Size = m.n
+	}
+}
+
+func (m *manifest) mac(key []byte) string {
+	files, _ := json.Marshal(m.Files)
+	h := hmac.New(sha256.New, key)
+	h.Write(files)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// manifestKey is the key manifests for c are MACed under.
+func manifestKey(c *wormhole.Conn) []byte {
+	key, err := c.ExportKey("manifest", 32)
+	if err != nil {
+		fatalf("could not derive manifest key: %v", err)
+	}
+	return key
+}
+
+// save writes m to path, and prints the key to check it with.
+func (m *manifest) save(path string, key []byte, w io.Writer) {
+	if m.Files == nil {
+		m.Files = []*manifestFile{}
+	}
+	m.MAC = m.mac(key)
+	buf, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		fatalf("could not encode manifest: %v", err)
+	}
+	if err := ioutil.WriteFile(path, append(buf, '\n'), 0644); err != nil {
+		exitf(exitDisk, "could not write manifest: %v", err)
+	}
+	fmt.Fprintf(w, "wrote manifest %s, check it later with\n\n", path)
+	fmt.Fprintf(w, "  %s verify -key %x %s\n\n", os.Args[0], key, path)
+}
+
+// showqr draws m, with its MAC under key, as a QR code on w, for a camera
+// to capture as a receipt, and prints the key to check it with once it's
+// saved to a file.
+func (m *manifest) showqr(key []byte, w io.Writer) {
+	if m.Files == nil {
+		m.Files = []*manifestFile{}
+	}
+	m.MAC = m.mac(key)
+	buf, err := json.Marshal(m)
+	if err != nil {
+		fatalf("could not encode manifest: %v", err)
+	}
+	if err := printqr(w, string(buf)); err != nil {
+		exitf(exitFailure, "could not show receipt: %v", err)
+	}
+	if len(m.Files) == 1 {
+		fmt.Fprintf(w, "receipt of 1 file, check it once saved to a file with\n\n")
+	} else {
+		fmt.Fprintf(w, "receipt of %d files, check it once saved to a file with\n\n", len(m.Files))
+	}
+	fmt.Fprintf(w, "  %s verify -key %x receipt.json\n\n", os.Args[0], key)
+}
+
+// meters is a meter that passes everything on to several.
+type meters []meter
+
+func (ms meters) Write(p []byte) (int, error) {
+	for _, m := range ms {
+		m.Write(p)
+	}
+	return len(p), nil
+}
+
+func (ms meters) start(name string, size int64) {
+	for _, m := range ms {
+		m.start(name, size)
+	}
+}
+
+func (ms meters) done(limit string) {
+	for _, m := range ms {
+		m.done(limit)
+	}
+}
+
+func verify(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "check files against a manifest written with -manifest-out\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s -key key manifest\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "flags:\n")
+		set.PrintDefaults()
+	}
+	hexkey := set.String("key", "", "key printed when the manifest was written")
+	directory := set.String("dir", ".", "directory the files are in")
+	set.Parse(args[1:])
+
+	key, err := hex.DecodeString(*hexkey)
+	if set.NArg() != 1 || err != nil || len(key) == 0 {
+		set.Usage()
+		os.Exit(exitUsage)
+	}
+	buf, err := ioutil.ReadFile(set.Arg(0))
+	if err != nil {
+		exitf(exitDisk, "could not read manifest: %v", err)
+	}
+	var m manifest
+	if err := json.Unmarshal(buf, &m); err != nil {
+		fatalf("could not decode manifest: %v", err)
+	}
+	if !hmac.Equal([]byte(m.mac(key)), []byte(m.MAC)) {
+		exitf(exitAuth, "manifest does not match key, it may have been changed")
+	}
+
+	ok := true
+	for _, mf := range m.Files {
+		f, err := os.Open(filepath.Join(*directory, filepath.Clean(mf.Name)))
+		if err != nil {
+			fmt.Fprintf(set.Output(), "%s: %v\n", mf.Name, err)
+			ok = false
+			continue
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, f)
+		f.Close()
+		switch {
+		case err != nil:
+			fmt.Fprintf(set.Output(), "%s: %v\n", mf.Name, err)
+			ok = false
+		case n != mf.Size || hex.EncodeToString(h.Sum(nil)) != mf.SHA256:
+			fmt.Fprintf(set.Output(), "%s: does not match\n", mf.Name)
+			ok = false
+		default:
+			fmt.Fprintf(set.Output(), "%s: ok\n", mf.Name)
+		}
+	}
+	if !ok {
+		exitf(exitFailure, "some files do not match the manifest")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+var maxMemory = flag.String("max-memory", "", "rough cap on memory use, like 64M, for small machines")
+
+// memLimit is -max-memory in bytes, or 0 for no limit.
+var memLimit int64
+
+// memOverhead is what the limit needs to leave for everything but our own
+// buffers, mostly the runtime and pion's receive buffers.
+const memOverhead = 8 << 20
+
+// parseSize parses a number of bytes with an optional K, M or G suffix,
+// in powers of 1024.
+func parseSize(size string) (int64, error) {
+	if size == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+	s, mult := size, int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", size)
+	}
+	return n * mult, nil
+}
+
+// limitMemory sets up the -max-memory budget, if any.
+func limitMemory() {
+	if *maxMemory == "" {
+		return
+	}
+	n, err := parseSize(*maxMemory)
+	if err != nil {
+		exitf(exitUsage, "bad -max-memory: %v", err)
+	}
+	if n < memOverhead+2*msgChunkSize {
+		exitf(exitUsage, "-max-memory must be at least %dM", (memOverhead+2*msgChunkSize)>>20+1)
+	}
+	memLimit = n
+	// Collect garbage more eagerly than usual, rather than letting the
+	// heap grow to twice what's live.
+	debug.SetGCPercent(50)
+	go watchMemory()
+}
+
+// buffers splits the budget left after overheads between the data channel
+// send buffer and chunks read ahead of sending, half each.
+func buffers() (buffer int, depth int) {
+	buffer, depth = wormhole.MaxBufferSize, readAheadDepth
+	if memLimit == 0 {
+		return buffer, depth
+	}
+	half := int(memLimit-memOverhead) / 2
+	if half < buffer {
+		buffer = half
+	}
+	if half/msgChunkSize < depth {
+		depth = half / msgChunkSize
+	}
+	return buffer, depth
+}
+
+// peakHeap is the largest heap seen by watchMemory.
+var peakHeap uint64
+
+// watchMemory keeps track of the heap, and returns memory to the OS when
+// it goes over the limit. Go has no hard limits, so this is the best we
+// can do beyond sizing our own buffers.
+func watchMemory() {
+	var m runtime.MemStats
+	warned := false
+	for range time.Tick(time.Second) {
+		runtime.ReadMemStats(&m)
+		if m.HeapInuse > atomic.LoadUint64(&peakHeap) {
+			atomic.StoreUint64(&peakHeap, m.HeapInuse)
+		}
+		if int64(m.HeapInuse) > memLimit {
+			debug.FreeOSMemory()
+			runtime.ReadMemStats(&m)
+			if int64(m.HeapInuse) > memLimit && !warned {
+				log.Printf("using %dM of memory, over -max-memory %s", m.HeapInuse>>20, *maxMemory)
+				warned = true
+			}
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	cases := []struct {
+		s    string
+		n    int64
+		fail bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"64k", 64 << 10, false},
+		{"64M", 64 << 20, false},
+		{"2G", 2 << 30, false},
+		{"", 0, true},
+		{"M", 0, true},
+		{"-1M", 0, true},
+		{"1.5M", 0, true},
+		{"12MB", 0, true},
+	}
+	for _, c := range cases {
+		n, err := parseSize(c.s)
+		if n != c.n || (err != nil) != c.fail {
+			t.Errorf("testcase %q got %v, %v want %v", c.s, n, err, c.n)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// +build !lite
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// signalled counts what the signalling server has done since startup, for
+// /metrics.
+var signalled = struct {
+	websockets      int64 // Currently open.
+	websocketsTotal int64
+
+	mu      sync.Mutex
+	results map[string]int64 // Sessions by how they ended, as in traces.
+
+	wait    *histogram // Seconds from booking a slot to the peer joining.
+	session *histogram // Seconds each websocket was open.
+}{
+	results: make(map[string]int64),
+	wait:    newHistogram(1, 5, 15, 30, 60, 120, 300, 600, 1800),
+	session: newHistogram(1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600),
+}
+
+// countResult counts a session that ended with r.
+func countResult(r string) {
+	signalled.mu.Lock()
+	signalled.results[r]++
+	signalled.mu.Unlock()
+}
+
+// histogram counts observations in buckets, as Prometheus expects them.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []int64 // For each bound, not cumulative.
+	sum    float64
+	count  int64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var n int64
+	for i, b := range h.bounds {
+		n += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, b, n)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum, name, h.count)
+}
+
+// metric writes a single valued metric in the Prometheus text format.
+func metric(w io.Writer, name, typ, help string, v int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, typ, name, v)
+}
+
+// serveMetrics serves the server's metrics in the Prometheus text format,
+// to clients with token, if there is one.
+func serveMetrics(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		slots.RLock()
+		waiting := len(slots.m)
+		slots.RUnlock()
+		metric(w, "ww_slots_waiting", "gauge", "Slots booked, waiting for a peer.", int64(waiting))
+		metric(w, "ww_websockets_open", "gauge", "Signalling websockets open.", atomic.LoadInt64(&signalled.websockets))
+		metric(w, "ww_websockets_total", "counter", "Signalling websockets opened.", atomic.LoadInt64(&signalled.websocketsTotal))
+
+		signalled.mu.Lock()
+		results := make([]string, 0, len(signalled.results))
+		for r := range signalled.results {
+			results = append(results, r)
+		}
+		sort.Strings(results)
+		fmt.Fprintf(w, "# HELP ww_sessions_total Signalling sessions, by result: rendezvous and visit for the two sides of a match.\n")
+		fmt.Fprintf(w, "# TYPE ww_sessions_total counter\n")
+		for _, r := range results {
+			fmt.Fprintf(w, "ww_sessions_total{result=%q} %d\n", r, signalled.results[r])
+		}
+		signalled.mu.Unlock()
+
+		signalled.wait.write(w, "ww_rendezvous_wait_seconds", "Time from booking a slot to a peer joining it.")
+		signalled.session.write(w, "ww_session_seconds", "Time signalling websockets were open.")
+
+		if builtinRelay != nil {
+			metric(w, "ww_relay_allocations", "gauge", "TURN allocations open.", atomic.LoadInt64(&relayed.allocations))
+			fmt.Fprintf(w, "# HELP ww_relay_bytes_total Bytes relayed, from (in) and to (out) peers.\n")
+			fmt.Fprintf(w, "# TYPE ww_relay_bytes_total counter\n")
+			fmt.Fprintf(w, "ww_relay_bytes_total{direction=\"in\"} %d\n", atomic.LoadInt64(&relayed.in))
+			fmt.Fprintf(w, "ww_relay_bytes_total{direction=\"out\"} %d\n", atomic.LoadInt64(&relayed.out))
+		}
+	}
+}
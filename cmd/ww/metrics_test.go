@@ -0,0 +1,28 @@
+// +build !lite
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram(1, 10)
+	for _, v := range []float64{0.5, 1, 2, 20} {
+		h.observe(v)
+	}
+	var b bytes.Buffer
+	h.write(&b, "x", "help")
+	want := `# HELP x help
+# TYPE x histogram
+x_bucket{le="1"} 2
+x_bucket{le="10"} 3
+x_bucket{le="+Inf"} 4
+x_sum 23.5
+x_count 4
+`
+	if got := b.String(); got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
@@ -0,0 +1,195 @@
+// +build !lite
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Teams sharing a signalling server can each have a namespace of their own,
+// listed in the file given to ww server -namespaces. Clients use one by
+// signalling at its path, e.g. with ww -signal https://example.com/ns/acme/,
+// or by opening the web client there. Slots are numbered separately in each
+// namespace, so codes only match within it, and stay short.
+//
+// Each line of the file is a namespace's name, optionally followed by the
+// most slots it may have booked at once, and the bearer tokens its clients
+// need, if any:
+//
+//	acme slots=100 token=s3cret token=0ther
+//	public
+//
+// Namespaces without tokens are open to whoever the rest of the server is.
+// Limits also apply to the namespaces of -auth-tokens and the like.
+
+// A namespaceConfig is a namespace's line in the -namespaces file.
+type namespaceConfig struct {
+	slots  int               // Most slots booked at once, 0 for no limit.
+	tokens map[[32]byte]bool // SHA-256 of each token.
+}
+
+// namespaces are the namespaces in the -namespaces file, by name.
+var namespaces = map[string]*namespaceConfig{}
+
+// namespacedKey is the request context key for requests that came in at a
+// namespace's path, to whether one of its tokens authenticated them.
+type namespacedKey struct{}
+
+// loadNamespaces reads the namespaces in file.
+func loadNamespaces(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		name := fields[0]
+		if strings.ContainsAny(name, "/?#%") {
+			return fmt.Errorf("%s:%d: bad namespace %q", file, line, name)
+		}
+		ns := &namespaceConfig{tokens: make(map[[32]byte]bool)}
+		for _, f := range fields[1:] {
+			switch {
+			case strings.HasPrefix(f, "slots="):
+				n, err := strconv.Atoi(f[len("slots="):])
+				if err != nil || n < 0 {
+					return fmt.Errorf("%s:%d: bad %s", file, line, f)
+				}
+				ns.slots = n
+			case strings.HasPrefix(f, "token=") && len(f) > len("token="):
+				ns.tokens[sha256.Sum256([]byte(f[len("token="):]))] = true
+			default:
+				return fmt.Errorf("%s:%d: bad %s, want slots=N or token=T", file, line, f)
+			}
+		}
+		namespaces[name] = ns
+	}
+	return s.Err()
+}
+
+// namespaceFull is whether namespace has booked as many slots as it may.
+// This assumes slots is locked.
+func namespaceFull(namespace string) bool {
+	ns := namespaces[namespace]
+	if ns == nil || ns.slots == 0 {
+		return false
+	}
+	n := 0
+	for k := range slots.m {
+		if strings.HasPrefix(k, namespace+"/") {
+			n++
+		}
+	}
+	return n >= ns.slots
+}
+
+// check is whether token is one of the namespace's.
+func (ns *namespaceConfig) check(token string) bool {
+	return token != "" && ns.tokens[sha256.Sum256([]byte(token))]
+}
+
+// identify is whether r has one of the namespace's tokens, in its
+// Authorization header or a cookie.
+func (ns *namespaceConfig) identify(r *http.Request) bool {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return ns.check(h[len("Bearer "):])
+	}
+	// The server's own cookie may be there too.
+	for _, c := range r.Cookies() {
+		if c.Name == authCookie && ns.check(c.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveNamespace serves /ns/NAME/ the way mux serves /, for clients of
+// namespace NAME.
+func serveNamespace(mux http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(r.URL.Path[len("/ns/"):], "/", 2)
+		ns := namespaces[parts[0]]
+		if ns == nil {
+			http.Error(w, "no such namespace", http.StatusNotFound)
+			return
+		}
+		if len(parts) == 1 {
+			u := *r.URL
+			u.Path += "/"
+			http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+			return
+		}
+		name, rest := parts[0], "/"+parts[1]
+		if strings.HasPrefix(rest, "/ns/") {
+			http.NotFound(w, r)
+			return
+		}
+		authed := false
+		if len(ns.tokens) > 0 {
+			if rest == "/auth" {
+				ns.serveAuth(w, r, "/ns/"+name+"/")
+				return
+			}
+			authed = ns.identify(r)
+			if !authed && (strings.HasPrefix(rest, "/s/") || strings.HasPrefix(rest, "/m/") || rest == "/relay") {
+				log.Printf("refused unauthenticated %s from %s", r.URL.Path, r.RemoteAddr)
+				unauthorized(w)
+				return
+			}
+		}
+		ctx := context.WithValue(r.Context(), namespaceKey{}, name)
+		ctx = context.WithValue(ctx, namespacedKey{}, authed)
+		r = r.WithContext(ctx)
+		u := *r.URL
+		u.Path, u.RawPath = rest, ""
+		r.URL = &u
+		mux.ServeHTTP(w, r)
+	}
+}
+
+// serveAuth is authPolicy.serveAuth for the namespace's tokens, whose
+// cookie is only sent back under path.
+func (ns *namespaceConfig) serveAuth(w http.ResponseWriter, r *http.Request, path string) {
+	switch r.Method {
+	case http.MethodGet:
+		if !ns.identify(r) {
+			unauthorized(w)
+			return
+		}
+	case http.MethodPost:
+		b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 4<<10))
+		token := strings.TrimSpace(string(b))
+		if err != nil || !ns.check(token) {
+			unauthorized(w)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     authCookie,
+			Value:    token,
+			Path:     path,
+			MaxAge:   int((30 * 24 * time.Hour).Seconds()),
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
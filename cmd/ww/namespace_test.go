@@ -0,0 +1,130 @@
+// +build !lite
+
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServeNamespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ww-namespace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "namespaces")
+	if err := ioutil.WriteFile(file, []byte("# teams\nacme slots=2 token=s3cret\nopen\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old map[string]*namespaceConfig) { namespaces = old }(namespaces)
+	namespaces = map[string]*namespaceConfig{}
+	if err := loadNamespaces(file); err != nil {
+		t.Fatal(err)
+	}
+	if namespaces["acme"].slots != 2 || len(namespaces["acme"].tokens) != 1 || namespaces["open"] == nil {
+		t.Fatalf("loaded %v", namespaces)
+	}
+
+	// The server's own tokens, for clients outside namespaces.
+	auth := &authPolicy{tokens: map[[32]byte]string{sha256.Sum256([]byte("global")): "team"}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/s/", auth.guard(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(namespaceOf(r) + " " + r.URL.Path))
+	}))
+	mux.HandleFunc("/ns/", serveNamespace(mux))
+
+	for _, tt := range []struct {
+		path, token string
+		code        int
+		body        string
+	}{
+		{"/s/", "global", http.StatusOK, "team /s/"},
+		{"/s/", "s3cret", http.StatusUnauthorized, ""},
+		{"/ns/acme/s/7", "s3cret", http.StatusOK, "acme /s/7"},
+		{"/ns/acme/s/7", "global", http.StatusUnauthorized, ""},
+		{"/ns/acme/s/7", "", http.StatusUnauthorized, ""},
+		{"/ns/open/s/", "global", http.StatusOK, "open /s/"},
+		{"/ns/open/s/", "", http.StatusUnauthorized, ""},
+		{"/ns/open/ns/acme/s/", "global", http.StatusNotFound, ""},
+		{"/ns/other/s/", "global", http.StatusNotFound, ""},
+		{"/ns/acme", "", http.StatusMovedPermanently, ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != tt.code || tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s with %q: got %d %q, want %d %q", tt.path, tt.token, w.Code, w.Body.String(), tt.code, tt.body)
+		}
+	}
+}
+
+func TestNamespaceFull(t *testing.T) {
+	defer func(old map[string]*namespaceConfig) { namespaces = old }(namespaces)
+	namespaces = map[string]*namespaceConfig{"acme": {slots: 1}}
+	slots.Lock()
+	defer slots.Unlock()
+	if namespaceFull("acme") {
+		t.Errorf("empty namespace full")
+	}
+	slots.m["acme/1"] = nil
+	defer delete(slots.m, "acme/1")
+	if !namespaceFull("acme") {
+		t.Errorf("namespace not full at its limit")
+	}
+	if namespaceFull("") || namespaceFull("other") {
+		t.Errorf("unlimited namespace full")
+	}
+}
+
+func TestRelayOtherNamespace(t *testing.T) {
+	slots.Lock()
+	slots.m["acme/5"] = nil
+	slots.Unlock()
+	defer func() {
+		slots.Lock()
+		delete(slots.m, "acme/5")
+		slots.Unlock()
+	}()
+	for _, tt := range []struct {
+		method, path string
+		code         int
+	}{
+		{http.MethodGet, "/s/acme/5", http.StatusNotFound},
+		{http.MethodPost, "/s/acme/5", http.StatusNotFound},
+		{http.MethodDelete, "/s/acme/5", http.StatusNotFound},
+		{http.MethodGet, "/s/5x", http.StatusNotFound},
+		{http.MethodGet, "/s/?slot=acme/5", http.StatusBadRequest},
+		{http.MethodPost, "/s/?slot=acme/6", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		relay(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s %s: got %d, want %d", tt.method, tt.path, w.Code, tt.code)
+		}
+	}
+	slots.RLock()
+	_, ok := slots.m["acme/5"]
+	slots.RUnlock()
+	if !ok {
+		t.Errorf("acme's slot went from the shared namespace")
+	}
+	for _, slot := range []string{"0", "16777215", "0123456789abcdef"} {
+		if !validSlot(slot) {
+			t.Errorf("%s not valid", slot)
+		}
+	}
+	for _, slot := range []string{"", "acme/5", "5-word", "0123456789ABCDEF", "0123456789abcde"} {
+		if validSlot(slot) {
+			t.Errorf("%s valid", slot)
+		}
+	}
+}
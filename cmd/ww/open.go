@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mime"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// safeTypes are the types of files opener opens, by extension, since
+// that's what picks the application that opens them. None of them run
+// anything. SVG and HTML can have scripts in them, so they're not here.
+var safeTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".bmp":  "image/bmp",
+	".pdf":  "application/pdf",
+	".txt":  "text/plain",
+}
+
+// sniffLen is how much of a file http.DetectContentType looks at.
+const sniffLen = 512
+
+// safeType returns the type of the file called name starting with head,
+// and whether it's safe to open. It has to be safe by its extension, and
+// look like it too, so that nothing gets opened as something it isn't.
+func safeType(name string, head []byte) (string, bool) {
+	want, ok := safeTypes[strings.ToLower(filepath.Ext(name))]
+	if !ok {
+		return "", false
+	}
+	got, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "", false
+	}
+	return want, got == want
+}
+
+// opener is a meter that opens files with the default application once
+// they're saved in dir, if safeType says they're safe to.
+type opener struct {
+	dir  string
+	name string
+	head []byte
+}
+
+func (o *opener) Write(p []byte) (int, error) {
+	if n := sniffLen - len(o.head); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		o.head = append(o.head, p[:n]...)
+	}
+	return len(p), nil
+}
+
+func (o *opener) start(name string, size int64) {
+	o.name = name
+	o.head = o.head[:0]
+}
+
+func (o *opener) done(limit string) {
+	out := flag.CommandLine.Output()
+	typ, ok := safeType(o.name, o.head)
+	if !ok {
+		fmt.Fprintf(out, "not opening %s, it's not a type that's safe to\n", o.name)
+		return
+	}
+	if err := openFile(filepath.Join(o.dir, o.name)); err != nil {
+		fmt.Fprintf(out, "could not open %s: %v\n", o.name, err)
+		return
+	}
+	fmt.Fprintf(out, "opened %s as %s\n", o.name, typ)
+}
+
+// openFile opens path with the default application, without waiting for
+// it.
+func openFile(path string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", path)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", path)
+	default:
+		cmd = exec.Command("xdg-open", path)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestSafeType(t *testing.T) {
+	png := []byte("\x89PNG\x0D\x0A\x1A\x0A")
+	cases := []struct {
+		name string
+		head []byte
+		ok   bool
+	}{
+		{"shot.png", png, true},
+		{"SHOT.PNG", png, true},
+		{"notes.txt", []byte("hello"), true},
+		{"doc.pdf", []byte("%PDF-1.4"), true},
+		{"shot.exe", png, false},
+		{"shot.png", []byte("MZ\x90\x00\x03\x00\x00\x00\x04\x00\x00\x00\xff\xff"), false},
+		{"page.html", []byte("<html>"), false},
+		{"notes.txt", []byte("<html><script>"), false},
+		{"drawing.svg", []byte("<svg>"), false},
+		{"shot", png, false},
+	}
+	for _, c := range cases {
+		if _, got := safeType(c.name, c.head); got != c.ok {
+			t.Errorf("testcase %v got %v want %v", c.name, got, c.ok)
+		}
+	}
+}
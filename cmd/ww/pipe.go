@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+
+	"webwormhole.io/wormhole"
 )
 
 func pipe(args ...string) {
@@ -20,24 +22,34 @@ func pipe(args ...string) {
 
 	if set.NArg() > 1 {
 		set.Usage()
-		os.Exit(2)
+		os.Exit(exitUsage)
+	}
+	c := newConn(set.Arg(0), *length, 0)
+	// Pipes may be left open for days, so change keys as they go, where
+	// the peer can.
+	var rw io.ReadWriteCloser = c
+	if c.PeerVersion() >= wormhole.MinRatchet {
+		var err error
+		rw, err = c.Ratcheted()
+		if err != nil {
+			exitf(exitFailure, "could not start ratchets: %v", err)
+		}
 	}
-	c := newConn(set.Arg(0), *length)
 
 	done := make(chan struct{})
 	// The recieve end of the pipe.
 	go func() {
-		_, err := io.CopyBuffer(os.Stdout, c, make([]byte, msgChunkSize))
+		_, err := io.CopyBuffer(os.Stdout, rw, make([]byte, msgChunkSize))
 		if err != nil {
-			fatalf("could not write to stdout: %v", err)
+			exitf(copyStatus(err), "could not write to stdout: %v", err)
 		}
 		done <- struct{}{}
 	}()
 	// The send end of the pipe.
 	go func() {
-		_, err := io.CopyBuffer(c, os.Stdin, make([]byte, msgChunkSize))
+		_, err := io.CopyBuffer(rw, os.Stdin, make([]byte, msgChunkSize))
 		if err != nil {
-			fatalf("could not write to channel: %v", err)
+			exitf(copyStatus(err), "could not write to channel: %v", err)
 		}
 		done <- struct{}{}
 	}()
@@ -0,0 +1,257 @@
+// +build !lite
+
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Clients behind proxies that don't let websockets through can signal over
+// plain HTTP instead, by long-polling. They POST to the URL they would have
+// opened the websocket on, and get back the ID of a session that stands in
+// for it, with the same headers. They go on at /poll/ID:
+//
+//	GET    /poll/ID  waits for messages from the server, see pollBatch
+//	POST   /poll/ID  sends the text message in the body
+//	DELETE /poll/ID  hangs up
+//
+// Like the websocket it stands in for, the session is all it takes.
+
+// pollWait is the longest a GET waits for messages, before answering with
+// none. It's under the usual proxy timeouts.
+const pollWait = 25 * time.Second
+
+// pollIdle is how long a session lasts without being polled.
+const pollIdle = time.Minute
+
+// maxPollMessage is the most a client can POST at once.
+const maxPollMessage = 1 << 20
+
+// A pollBatch is what a GET gets: the messages since the last one, and how
+// the session was closed, once it is.
+type pollBatch struct {
+	Messages []string   `json:"messages"`
+	Close    *pollClose `json:"close,omitempty"`
+}
+
+// A pollClose is a websocket close frame.
+type pollClose struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// A pollConn is a long-polling session, standing in for a websocket.
+type pollConn struct {
+	id string
+	in chan []byte // Messages the client sent.
+
+	mu      sync.Mutex
+	out     []string      // Messages for the next GET.
+	closing *pollClose    // Once closed.
+	wake    chan struct{} // Closed and replaced when out or closing change.
+	seen    time.Time     // The last GET.
+
+	gone chan struct{} // Closed by Close.
+	once sync.Once
+}
+
+// polls are the open pollConns by ID.
+var polls = struct {
+	m map[string]*pollConn
+	sync.Mutex
+}{m: make(map[string]*pollConn)}
+
+// openPoll starts a session, answering with its ID and header.
+func openPoll(w http.ResponseWriter, header http.Header) *pollConn {
+	b := make([]byte, 16)
+	crand.Read(b)
+	pc := &pollConn{
+		id:   hex.EncodeToString(b),
+		in:   make(chan []byte),
+		wake: make(chan struct{}),
+		seen: time.Now(),
+		gone: make(chan struct{}),
+	}
+	polls.Lock()
+	polls.m[pc.id] = pc
+	polls.Unlock()
+	go pc.reap()
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Session string `json:"session"`
+	}{pc.id})
+	return pc
+}
+
+func (pc *pollConn) ReadMessage() (int, []byte, error) {
+	select {
+	case p := <-pc.in:
+		return websocket.TextMessage, p, nil
+	case <-pc.gone:
+		return 0, nil, &websocket.CloseError{Code: websocket.CloseNormalClosure}
+	}
+}
+
+func (pc *pollConn) WriteMessage(messageType int, data []byte) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.closing != nil {
+		return websocket.ErrCloseSent
+	}
+	pc.out = append(pc.out, string(data))
+	pc.wakeup()
+	return nil
+}
+
+// WriteControl hands close frames to the client. Pings and pongs aren't
+// needed.
+func (pc *pollConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if messageType != websocket.CloseMessage {
+		return nil
+	}
+	c := &pollClose{Code: websocket.CloseNoStatusReceived}
+	if len(data) >= 2 {
+		c.Code, c.Reason = int(binary.BigEndian.Uint16(data)), string(data[2:])
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.closing != nil {
+		return websocket.ErrCloseSent
+	}
+	pc.closing = c
+	pc.wakeup()
+	return nil
+}
+
+// Close hangs up. The client gets there being no close frame as an
+// abnormal closure, unless it was sent one.
+func (pc *pollConn) Close() error {
+	pc.mu.Lock()
+	if pc.closing == nil {
+		pc.closing = &pollClose{Code: websocket.CloseAbnormalClosure}
+		pc.wakeup()
+	}
+	pc.mu.Unlock()
+	pc.once.Do(func() { close(pc.gone) })
+	return nil
+}
+
+// wakeup wakes up a waiting GET. This assumes pc is locked.
+func (pc *pollConn) wakeup() {
+	close(pc.wake)
+	pc.wake = make(chan struct{})
+}
+
+// forget drops the session, once the client's done with it.
+func (pc *pollConn) forget() {
+	polls.Lock()
+	delete(polls.m, pc.id)
+	polls.Unlock()
+}
+
+// reap closes and forgets the session once the client stops polling.
+func (pc *pollConn) reap() {
+	t := time.NewTicker(pollIdle / 4)
+	defer t.Stop()
+	for range t.C {
+		polls.Lock()
+		_, ok := polls.m[pc.id]
+		polls.Unlock()
+		pc.mu.Lock()
+		idle := time.Since(pc.seen) > pollIdle
+		pc.mu.Unlock()
+		if !ok || idle {
+			pc.Close()
+			pc.forget()
+			return
+		}
+	}
+}
+
+// poll answers a GET with what's for the client, once there is something,
+// or with nothing after pollWait.
+func (pc *pollConn) poll(w http.ResponseWriter, r *http.Request) {
+	timeout := time.NewTimer(pollWait)
+	defer timeout.Stop()
+	for {
+		pc.mu.Lock()
+		pc.seen = time.Now()
+		if len(pc.out) > 0 || pc.closing != nil {
+			b := pollBatch{Messages: pc.out, Close: pc.closing}
+			pc.out = nil
+			pc.mu.Unlock()
+			if b.Messages == nil {
+				b.Messages = []string{}
+			}
+			if b.Close != nil {
+				pc.forget()
+			}
+			writeJSON(w, http.StatusOK, b)
+			return
+		}
+		wake := pc.wake
+		pc.mu.Unlock()
+		select {
+		case <-wake:
+		case <-timeout.C:
+			writeJSON(w, http.StatusOK, pollBatch{Messages: []string{}})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// send hands the message POSTed in r to whoever's reading pc.
+func (pc *pollConn) send(w http.ResponseWriter, r *http.Request) {
+	p, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPollMessage+1))
+	if err == nil && len(p) > maxPollMessage {
+		err = errors.New("message too long")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	select {
+	case pc.in <- p:
+		w.WriteHeader(http.StatusNoContent)
+	case <-pc.gone:
+		http.Error(w, "closed", http.StatusGone)
+	case <-r.Context().Done():
+	}
+}
+
+// servePoll serves the sessions at /poll/.
+func servePoll(w http.ResponseWriter, r *http.Request) {
+	polls.Lock()
+	pc := polls.m[r.URL.Path[len("/poll/"):]]
+	polls.Unlock()
+	if pc == nil {
+		http.Error(w, "no such session", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		pc.poll(w, r)
+	case http.MethodPost:
+		pc.send(w, r)
+	case http.MethodDelete:
+		pc.Close()
+		pc.forget()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
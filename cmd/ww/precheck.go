@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+// probeLabel labels the stream a sender fills for a while to measure the
+// link before sending files. Receivers discard what's sent on it.
+const probeLabel = "webwormhole-probe"
+
+// probeTime is how long to measure the link for.
+const probeTime = 2 * time.Second
+
+// probeLink fills a stream to the peer for probeTime, and returns the rate
+// the peer took data at in bytes per second.
+func probeLink(c *wormhole.Conn) (float64, error) {
+	s, err := c.OpenStream(probeLabel)
+	if err != nil {
+		return 0, err
+	}
+	// Only count the second half, once congestion control has opened
+	// up the window.
+	buf := make([]byte, msgChunkSize)
+	var sent, from int64
+	start := time.Now()
+	warm := start.Add(probeTime / 2)
+	for time.Since(start) < probeTime {
+		n, err := s.Write(buf)
+		if err != nil {
+			return 0, err
+		}
+		sent += int64(n)
+		if from == 0 && time.Now().After(warm) {
+			from, warm = sent-int64(c.Congestion().Buffered), time.Now()
+		}
+	}
+	rate := float64(sent-int64(c.Congestion().Buffered)-from) / time.Since(warm).Seconds()
+
+	// Let what's still buffered drain before sending files, but not
+	// forever if the peer doesn't read it.
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(probeTime):
+	}
+	return rate, nil
+}
+
+// precheck measures the link and prints how long sending files should
+// take. When run interactively, it asks whether to go ahead, and exits if
+// not.
+func precheck(c *wormhole.Conn, files []string, w io.Writer) {
+	var total int64
+	for _, filename := range files {
+		if isRemote(filename) {
+			if bf, err := statRemote(filename); err == nil {
+				total += bf.Size
+			}
+		} else if info, err := os.Stat(filename); err == nil {
+			total += info.Size()
+		}
+	}
+	rate, err := probeLink(c)
+	if err == wormhole.ErrNoStreams {
+		fmt.Fprintf(w, "peer is too old to measure the link, sending anyway\n")
+		return
+	}
+	if err != nil || rate <= 0 {
+		fmt.Fprintf(w, "could not measure the link, sending anyway\n")
+		return
+	}
+	fmt.Fprintf(w, "link takes about %s", formatRate(rate))
+	if r, ok := c.Route(); ok {
+		fmt.Fprintf(w, ", %s with a %v round trip", r, r.RTT.Round(time.Millisecond))
+	}
+	eta := time.Duration(float64(total) / rate * float64(time.Second))
+	fmt.Fprintf(w, "\n%s should take about %v\n", formatSize(total), eta.Round(time.Second))
+	if !interactive {
+		return
+	}
+	fmt.Fprintf(w, "send now? [Y/n] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if a := strings.ToLower(strings.TrimSpace(answer)); a == "n" || a == "no" {
+		c.Close()
+		exitf(exitFailure, "not sending")
+	}
+}
+
+// discard throws away what the peer sends on s to measure the link.
+func discard(s *wormhole.Stream) {
+	// Messages are up to a chunk each, more than io.Copy reads.
+	io.CopyBuffer(struct{ io.Writer }{ioutil.Discard}, s, make([]byte, msgChunkSize))
+	s.Close()
+}
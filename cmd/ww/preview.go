@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Receivers given -serve look for a website among what they receive, a
+// directory with an index.html in it or a lone HTML file, and serve it to
+// the browser on localhost once the transfer is done, at a path with a
+// random token in it so nothing else on the machine stumbles on it. It's
+// only for a look before deciding what to do with it, so it stops after
+// previewFor.
+
+// previewFor is how long a received website is served for.
+const previewFor = time.Hour
+
+// A savedMeter is a meter that's told the name of each file saved, or
+// directory unpacked, in the receiving directory once it's done.
+type savedMeter interface {
+	saved(name string)
+}
+
+func (ms meters) saved(name string) {
+	for _, m := range ms {
+		if sm, ok := m.(savedMeter); ok {
+			sm.saved(name)
+		}
+	}
+}
+
+// previewer is a meter that picks the first website saved in dir, for
+// serve to serve.
+type previewer struct {
+	dir  string
+	site string
+}
+
+func (pv *previewer) Write(p []byte) (int, error)   { return len(p), nil }
+func (pv *previewer) start(name string, size int64) {}
+func (pv *previewer) done(limit string)             {}
+
+func (pv *previewer) saved(name string) {
+	if pv.site == "" && isSite(filepath.Join(pv.dir, name)) {
+		pv.site = name
+	}
+}
+
+// isSite reports whether path is a website: an HTML file, or a directory
+// with an index.html.
+func isSite(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if !info.IsDir() {
+		ext := strings.ToLower(filepath.Ext(path))
+		return ext == ".html" || ext == ".htm"
+	}
+	index, err := os.Stat(filepath.Join(path, "index.html"))
+	return err == nil && index.Mode().IsRegular()
+}
+
+// serve serves the website picked on localhost, printing where to out,
+// until previewFor is up or ww is interrupted.
+func (pv *previewer) serve(out io.Writer) {
+	if pv.site == "" {
+		fmt.Fprintf(out, "nothing to serve, no HTML file or directory with an index.html was received\n")
+		return
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	h, path := previewHandler(filepath.Join(pv.dir, pv.site), "/"+hex.EncodeToString(b)+"/")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintf(out, "could not serve %s: %v\n", pv.site, err)
+		return
+	}
+	go http.Serve(l, h)
+	fmt.Fprintf(out, "serving %s at http://%s%s for %v, or until interrupted\n", pv.site, l.Addr(), path, previewFor)
+	time.Sleep(previewFor)
+	l.Close()
+}
+
+// previewHandler serves the website at site under prefix, which ends in a
+// slash, and nothing else. It returns the path to open it at.
+func previewHandler(site, prefix string) (http.Handler, string) {
+	var h http.Handler
+	path := prefix
+	if info, err := os.Stat(site); err == nil && info.IsDir() {
+		h = http.StripPrefix(strings.TrimSuffix(prefix, "/"), http.FileServer(http.Dir(site)))
+	} else {
+		name := filepath.Base(site)
+		path = prefix + url.PathEscape(name)
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != prefix+name {
+				http.NotFound(w, r)
+				return
+			}
+			f, err := os.Open(site)
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			defer f.Close()
+			info, err := f.Stat()
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			http.ServeContent(w, r, name, info.ModTime(), f)
+		})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			http.NotFound(w, r)
+			return
+		}
+		// Keep the token out of requests the site makes elsewhere, and
+		// out of the browser's cache.
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		w.Header().Set("Cache-Control", "no-store")
+		h.ServeHTTP(w, r)
+	}), path
+}
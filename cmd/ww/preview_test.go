@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreviewHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ww-preview")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	site := filepath.Join(dir, "site")
+	os.MkdirAll(filepath.Join(site, "css"), 0700)
+	ioutil.WriteFile(filepath.Join(site, "index.html"), []byte("<html>"), 0600)
+	ioutil.WriteFile(filepath.Join(site, "css", "a.css"), []byte("a{}"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "page one.html"), []byte("<p>"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0600)
+
+	if !isSite(site) || !isSite(filepath.Join(dir, "page one.html")) || isSite(filepath.Join(dir, "secret.txt")) || isSite(filepath.Join(site, "css")) {
+		t.Errorf("isSite got the wrong idea")
+	}
+
+	cases := []struct {
+		site   string
+		path   string
+		status int
+	}{
+		{site, "/tok/", http.StatusOK},
+		{site, "/tok/css/a.css", http.StatusOK},
+		{site, "/tok/../secret.txt", http.StatusNotFound},
+		{site, "/", http.StatusNotFound},
+		{site, "/other/", http.StatusNotFound},
+		{filepath.Join(dir, "page one.html"), "/tok/page%20one.html", http.StatusOK},
+		{filepath.Join(dir, "page one.html"), "/tok/secret.txt", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		h, _ := previewHandler(c.site, "/tok/")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", c.path, nil))
+		if w.Code != c.status {
+			t.Errorf("testcase %v got %v want %v", c.path, w.Code, c.status)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// +build !lite
+
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"rsc.io/qr"
+)
+
+// canDrawQR is whether printqr draws anything, which lite builds don't.
+const canDrawQR = true
+
+// printqr draws s as a QR code using block characters, or returns why it
+// can't, e.g. if s is too long for one.
+func printqr(out io.Writer, s string) error {
+	qrcode, err := qr.Encode(s, qr.L)
+	if err != nil {
+		return err
+	}
+	for x := 0; x < qrcode.Size; x++ {
+		fmt.Fprintf(out, "█")
+	}
+	fmt.Fprintf(out, "████████\n")
+	for x := 0; x < qrcode.Size; x++ {
+		fmt.Fprintf(out, "█")
+	}
+	fmt.Fprintf(out, "████████\n")
+	for y := 0; y < qrcode.Size; y += 2 {
+		fmt.Fprintf(out, "████")
+		for x := 0; x < qrcode.Size; x++ {
+			switch {
+			case qrcode.Black(x, y) && qrcode.Black(x, y+1):
+				fmt.Fprintf(out, " ")
+			case qrcode.Black(x, y):
+				fmt.Fprintf(out, "▄")
+			case qrcode.Black(x, y+1):
+				fmt.Fprintf(out, "▀")
+			default:
+				fmt.Fprintf(out, "█")
+			}
+		}
+		fmt.Fprintf(out, "████\n")
+	}
+	for x := 0; x < qrcode.Size; x++ {
+		fmt.Fprintf(out, "█")
+	}
+	fmt.Fprintf(out, "████████\n")
+	for x := 0; x < qrcode.Size; x++ {
+		fmt.Fprintf(out, "█")
+	}
+	fmt.Fprintf(out, "████████\n")
+	return nil
+}
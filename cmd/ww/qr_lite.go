@@ -0,0 +1,16 @@
+// +build lite
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// canDrawQR is whether printqr draws anything, which lite builds don't.
+const canDrawQR = false
+
+// printqr is a no-op in lite builds, which print only the code and URL.
+func printqr(out io.Writer, s string) error {
+	return errors.New("lite builds don't draw QR codes")
+}
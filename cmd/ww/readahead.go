@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+// readAhead reads from r in the background, up to a number of chunks ahead
+// of Read. This keeps sources with slow or high latency reads, like spinning
+// disks and network filesystems, from holding up every write in turn.
+type readAhead struct {
+	chunks chan []byte // Read so far.
+	free   chan []byte // Buffers to read into.
+	stop   chan struct{}
+	err    error // Set before chunks is closed.
+	cur    []byte
+	buf    []byte // Backing cur, to hand back.
+}
+
+// newReadAhead starts reading r in chunks of size, at most depth ahead. A
+// depth of 0 means no read-ahead, and returns r as it is.
+func newReadAhead(r io.Reader, depth, size int) io.ReadCloser {
+	if depth <= 0 {
+		return ioutil.NopCloser(r)
+	}
+	ra := &readAhead{
+		chunks: make(chan []byte, depth),
+		free:   make(chan []byte, depth+1),
+		stop:   make(chan struct{}),
+	}
+	for i := 0; i < depth+1; i++ {
+		ra.free <- make([]byte, size)
+	}
+	go ra.run(r)
+	return ra
+}
+
+func (ra *readAhead) run(r io.Reader) {
+	for {
+		var buf []byte
+		select {
+		case buf = <-ra.free:
+		case <-ra.stop:
+			return
+		}
+		n, err := r.Read(buf[:cap(buf)])
+		if n > 0 {
+			select {
+			case ra.chunks <- buf[:n]:
+			case <-ra.stop:
+				return
+			}
+		}
+		if err != nil {
+			ra.err = err
+			close(ra.chunks)
+			return
+		}
+	}
+}
+
+func (ra *readAhead) Read(p []byte) (int, error) {
+	if len(ra.cur) == 0 {
+		if ra.buf != nil {
+			ra.free <- ra.buf
+			ra.buf = nil
+		}
+		b, ok := <-ra.chunks
+		if !ok {
+			return 0, ra.err
+		}
+		ra.cur, ra.buf = b, b
+	}
+	n := copy(p, ra.cur)
+	ra.cur = ra.cur[n:]
+	return n, nil
+}
+
+// Close stops reading ahead. It doesn't close the underlying reader.
+func (ra *readAhead) Close() error {
+	close(ra.stop)
+	return nil
+}
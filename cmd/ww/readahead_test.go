@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadAhead(t *testing.T) {
+	data := make([]byte, 100<<10)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	cases := []struct {
+		r     io.Reader
+		depth int
+		size  int
+	}{
+		{bytes.NewReader(data), 0, 1 << 10},
+		{bytes.NewReader(data), 1, 1 << 10},
+		{bytes.NewReader(data), 4, 3000},
+		{iotest.HalfReader(bytes.NewReader(data)), 16, 32 << 10},
+		{iotest.DataErrReader(bytes.NewReader(data)), 2, 5000},
+	}
+	for i, c := range cases {
+		ra := newReadAhead(c.r, c.depth, c.size)
+		got, err := ioutil.ReadAll(iotest.OneByteReader(ra))
+		ra.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("testcase %v got %v bytes, %v want %v bytes", i, len(got), err, len(data))
+		}
+	}
+
+	// TimeoutReader fails on the second read, after one chunk.
+	ra := newReadAhead(iotest.TimeoutReader(bytes.NewReader(data)), 4, 1<<10)
+	got, err := ioutil.ReadAll(ra)
+	ra.Close()
+	if err != iotest.ErrTimeout || !bytes.Equal(got, data[:1<<10]) {
+		t.Errorf("got %v bytes, %v want %v bytes, %v", len(got), err, 1<<10, iotest.ErrTimeout)
+	}
+}
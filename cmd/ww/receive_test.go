@@ -0,0 +1,145 @@
+// +build !lite
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"webwormhole.io/wormhole"
+)
+
+func TestReceiveHostileResumeToken(t *testing.T) {
+	root, err := ioutil.TempDir("", "ww")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "in")
+	os.Mkdir(dir, 0755)
+	// Joined with dir as a partial's name, it's root/pwn.
+	outside := filepath.Join(root, "pwn")
+	token := "/../../pwn"
+	data := []byte("hello")
+
+	// Partials are saved when a file is cut off, and removed once it's
+	// all there.
+	for _, cut := range []bool{false, true} {
+		os.RemoveAll(dir)
+		os.Mkdir(dir, 0755)
+		ioutil.WriteFile(outside, []byte("mine"), 0644)
+		a, z, done := connect(t, func(d *wormhole.Dialer) {})
+		errc := make(chan error, 1)
+		go func() { errc <- receiveFiles(z, dir, false, true, nil, nil, &summer{}) }()
+
+		h, _ := json.Marshal(header{Name: "f", Size: len(data), Resume: token})
+		if _, err := a.Write(h); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, wormhole.MaxMessage)
+		n, err := a.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var offer resumeOffer
+		if err := json.Unmarshal(buf[:n], &offer); err != nil || offer.Offset != 0 {
+			t.Fatalf("resume offer %q, want to start over", buf[:n])
+		}
+		b, _ := json.Marshal(resumeStart{0})
+		a.Write(b)
+		if cut {
+			a.Write(data[:2])
+		} else {
+			a.Write(data)
+			sum := sha256.Sum256(data)
+			sendTrailer(a, sum[:])
+		}
+		a.Close()
+		err = <-errc
+		done()
+
+		if got, _ := ioutil.ReadFile(outside); string(got) != "mine" {
+			t.Errorf("cut %v: wrote %q outside the directory", cut, got)
+		}
+		if cut {
+			if err == nil {
+				t.Errorf("cut %v: received all of a file cut off", cut)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("cut %v: %v", cut, err)
+		}
+		if got, err := ioutil.ReadFile(filepath.Join(dir, "f")); err != nil || string(got) != string(data) {
+			t.Errorf("cut %v: received %q, %v, want %q", cut, got, err, data)
+		}
+	}
+}
+
+func TestReceiveUnlisted(t *testing.T) {
+	data := []byte("hello")
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	photo := wormhole.OfferedFile{Name: "a.jpg", Size: int64(len(data)), SHA256: hash}
+	tests := []struct {
+		name    string
+		offered []wormhole.OfferedFile
+		sent    []header
+		ok      bool
+	}{
+		{"as listed", []wormhole.OfferedFile{photo}, []header{{Name: "a.jpg", Size: len(data)}}, true},
+		{"another name", []wormhole.OfferedFile{photo}, []header{{Name: "evil.exe", Size: len(data)}}, false},
+		{"another size", []wormhole.OfferedFile{photo}, []header{{Name: "a.jpg", Size: 100 << 30}}, false},
+		{"chunked", []wormhole.OfferedFile{photo}, []header{{Name: "a.jpg", Chunked: true}}, false},
+		{"an archive", []wormhole.OfferedFile{photo}, []header{{Name: "a.jpg", Size: len(data), Archive: archiveTar}}, false},
+		{"a message", []wormhole.OfferedFile{photo}, []header{{Name: "a.jpg", Size: len(data), Text: true}}, false},
+		{"past the list", []wormhole.OfferedFile{photo}, []header{{Name: "a.jpg", Size: len(data)}, {Name: "b.jpg", Size: len(data)}}, false},
+		{"without a hash", []wormhole.OfferedFile{{Name: "a.jpg", Size: int64(len(data))}}, []header{{Name: "a.jpg", Size: len(data)}}, false},
+		{"after declining", []wormhole.OfferedFile{{Name: "evil.exe", Size: int64(len(data)), SHA256: hash}}, []header{{Name: "evil.exe", Size: len(data)}}, false},
+	}
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "ww")
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, z, done := connect(t, func(d *wormhole.Dialer) {})
+		errc := make(chan error, 1)
+		go func() { errc <- receiveFiles(z, dir, false, true, pickMatching("*.jpg"), nil, &summer{}) }()
+
+		a.SendOffer(tt.offered)
+		for _, h := range tt.sent {
+			b, _ := json.Marshal(h)
+			if _, err := a.Write(b); err != nil {
+				break
+			}
+			if _, err := a.Write(data); err != nil {
+				break
+			}
+			if err := sendTrailer(a, sum[:]); err != nil {
+				break
+			}
+		}
+		a.Close()
+		err = <-errc
+		done()
+
+		got, _ := ioutil.ReadDir(dir)
+		os.RemoveAll(dir)
+		if tt.ok && (err != nil || len(got) != 1) {
+			t.Errorf("%s: got %v, %d files", tt.name, err, len(got))
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: received it", tt.name)
+		}
+		for _, f := range got {
+			if f.Name() != "a.jpg" {
+				t.Errorf("%s: saved %s", tt.name, f.Name())
+			}
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// +build !lite
+
+package main
+
+// This is the relay. It's a TURN server for peers that can't reach each
+// other directly. It knows nothing about slots or codes, so it can be run
+// and scaled separately from the signalling server.
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/turn/v2"
+	"webwormhole.io/wormhole"
+)
+
+func init() {
+	subcmds["relay"] = relayServer
+}
+
+// relayRealm is the TURN realm the relay uses.
+const relayRealm = "webwormhole"
+
+// relayed counts bytes relayed since startup.
+var relayed struct {
+	in, out     int64 // From and to peers.
+	allocations int64 // Currently open.
+}
+
+// meteredConn is a relay socket, relaying between a client and its peers.
+// It counts bytes, and enforces rate limits and quotas.
+type meteredConn struct {
+	net.PacketConn
+	b        *wormhole.Bucket
+	quota    int64 // Bytes, or 0 for unlimited.
+	in, out  int64
+	started  time.Time
+	closeOne sync.Once
+}
+
+// ReadFrom reads packets from peers to relay to the client. Each allocation
+// has its own reader, so it's safe to slow it down.
+func (c *meteredConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err != nil {
+		return n, addr, err
+	}
+	atomic.AddInt64(&relayed.in, int64(n))
+	if total := atomic.AddInt64(&c.in, int64(n)) + atomic.LoadInt64(&c.out); c.quota > 0 && total > c.quota {
+		c.Close()
+		return 0, addr, fmt.Errorf("quota exceeded")
+	}
+	time.Sleep(c.b.Wait(n))
+	return n, addr, err
+}
+
+// WriteTo sends packets from the client to a peer. It's called from the
+// server's shared read loop, so packets over the rate are dropped instead
+// of blocking.
+func (c *meteredConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.b.Allow(len(p)) {
+		return len(p), nil
+	}
+	if total := atomic.AddInt64(&c.out, int64(len(p))) + atomic.LoadInt64(&c.in); c.quota > 0 && total > c.quota {
+		c.Close()
+		return 0, fmt.Errorf("quota exceeded")
+	}
+	atomic.AddInt64(&relayed.out, int64(len(p)))
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *meteredConn) Close() error {
+	c.closeOne.Do(func() {
+		atomic.AddInt64(&relayed.allocations, -1)
+		log.Printf("%s closed after %v, relayed %d bytes in, %d bytes out",
+			c.LocalAddr(), time.Since(c.started).Round(time.Second), atomic.LoadInt64(&c.in), atomic.LoadInt64(&c.out))
+	})
+	return c.PacketConn.Close()
+}
+
+// meteredGenerator allocates metered relay sockets.
+type meteredGenerator struct {
+	turn.RelayAddressGeneratorStatic
+	rate  int64
+	quota int64
+}
+
+func (g *meteredGenerator) AllocatePacketConn(network string, port int) (net.PacketConn, net.Addr, error) {
+	c, addr, err := g.RelayAddressGeneratorStatic.AllocatePacketConn(network, port)
+	if err != nil {
+		return nil, nil, err
+	}
+	atomic.AddInt64(&relayed.allocations, 1)
+	log.Printf("%s allocated", addr)
+	b := &wormhole.Bucket{}
+	b.SetRate(g.rate)
+	return &meteredConn{
+		PacketConn: c,
+		b:          b,
+		quota:      g.quota,
+		started:    time.Now(),
+	}, addr, nil
+}
+
+// startRelay starts a TURN server on the UDP address listen, relaying from
+// ip. Clients authenticate with credentials derived from secret, and are
+// held to rate and quota.
+func startRelay(listen string, ip net.IP, rate, quota int64, secret string, geo *geopolicy) error {
+	conn, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(listen)
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	_, err = turn.NewServer(turn.ServerConfig{
+		Realm: relayRealm,
+		AuthHandler: func(username, realm string, src net.Addr) ([]byte, bool) {
+			if geo != nil {
+				if country, ok := geo.permits(src.String()); !ok {
+					log.Printf("refused %s from %s", src, country)
+					return nil, false
+				}
+			}
+			expiry, err := relayExpiry(username)
+			if err != nil || time.Now().After(expiry) {
+				return nil, false
+			}
+			return turn.GenerateAuthKey(username, realm, relayPassword(secret, username)), true
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn: conn,
+			RelayAddressGenerator: &meteredGenerator{
+				RelayAddressGeneratorStatic: turn.RelayAddressGeneratorStatic{
+					RelayAddress: ip,
+					Address:      host,
+				},
+				rate:  rate,
+				quota: quota,
+			},
+		}},
+	})
+	if err != nil {
+		conn.Close()
+	}
+	return err
+}
+
+// builtinRelay is the relay ww server runs itself with -turn, if any.
+var builtinRelay *sessionRelay
+
+// sessionRelay hands out credentials for a relay to each client that
+// signals, so that the server relays for its own clients only.
+type sessionRelay struct {
+	secret string
+	addr   string // Where clients reach the relay, as host:port.
+}
+
+// credentials returns credentials for one session. The username is the
+// expiry and a random session ID, so that each client's can be told apart.
+func (r *sessionRelay) credentials() (username, password string) {
+	id := make([]byte, 8)
+	crand.Read(id)
+	username = strconv.FormatInt(time.Now().Add(viaExpiry).Unix(), 10) + ":" + hex.EncodeToString(id)
+	return username, relayPassword(r.secret, username)
+}
+
+// url returns a TURN URL with credentials for one session, as ww takes in
+// -ice.
+func (r *sessionRelay) url() string {
+	username, password := r.credentials()
+	return "turn:" + username + ":" + password + "@" + r.addr
+}
+
+// serveRelay gives clients that can't read the signalling server's headers,
+// i.e. browsers, credentials for the built in relay, as RTCIceServers.
+func serveRelay(w http.ResponseWriter, r *http.Request) {
+	if builtinRelay == nil {
+		http.NotFound(w, r)
+		return
+	}
+	username, password := builtinRelay.credentials()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode([]struct {
+		URLs       string `json:"urls"`
+		Username   string `json:"username"`
+		Credential string `json:"credential"`
+	}{{"turn:" + builtinRelay.addr, username, password}})
+}
+
+func relayServer(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "run a TURN relay for peers that can't connect directly\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "flags:\n")
+		set.PrintDefaults()
+		fmt.Fprintf(set.Output(), "\nclients authenticate with credentials derived from the secret in $WW_RELAY_SECRET,\n")
+		fmt.Fprintf(set.Output(), "which -issue prints, e.g.\n\n")
+		fmt.Fprintf(set.Output(), "  %s -ice \"$(%s %s -ip 203.0.113.1 -issue 24h)\" send file\n", os.Args[0], os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "\nor, for clients that know the secret themselves,\n\n")
+		fmt.Fprintf(set.Output(), "  %s -via 203.0.113.1 send file\n", os.Args[0])
+	}
+	listen := set.String("listen", ":3478", "udp listen address")
+	publicIP := set.String("ip", "", "public IP address of the relay")
+	rate := set.Int64("rate", 0, "maximum bytes per second relayed for each client, 0 for unlimited")
+	quota := set.Int64("quota", 0, "maximum bytes relayed for each client, 0 for unlimited")
+	issue := set.Duration("issue", 0, "print a TURN URL with credentials valid for this long, then exit")
+	geoip := set.String("geoip", "", "path to a first,last,country CSV of address ranges, for -allow-countries and -deny-countries")
+	allow := set.String("allow-countries", "", "comma separated list of country codes allowed to relay, ZZ for addresses not in -geoip")
+	deny := set.String("deny-countries", "", "comma separated list of country codes not allowed to relay")
+	set.Parse(args[1:])
+
+	secret := os.Getenv("WW_RELAY_SECRET")
+	if secret == "" {
+		fatalf("refusing to run an open relay: set $WW_RELAY_SECRET")
+	}
+	ip := net.ParseIP(*publicIP)
+	if ip == nil || set.NArg() > 0 {
+		set.Usage()
+		os.Exit(exitUsage)
+	}
+	_, port, err := net.SplitHostPort(*listen)
+	if err != nil {
+		fatalf("bad listen address: %v", err)
+	}
+
+	if *issue > 0 {
+		username, password := relayCredentials(secret, time.Now().Add(*issue))
+		fmt.Printf("turn:%s:%s@%s\n", username, password, net.JoinHostPort(ip.String(), port))
+		return
+	}
+
+	geo, err := newGeoPolicy(*geoip, *allow, *deny)
+	if err != nil {
+		fatalf("could not load country policy: %v", err)
+	}
+
+	if err := startRelay(*listen, ip, *rate, *quota, secret, geo); err != nil {
+		fatalf("could not start relay: %v", err)
+	}
+	log.Printf("relaying on %s", *listen)
+	logRelayed()
+}
+
+// logRelayed logs how much has been relayed every minute, when it changes.
+func logRelayed() {
+	var lastin, lastout int64
+	for range time.Tick(time.Minute) {
+		in, out := atomic.LoadInt64(&relayed.in), atomic.LoadInt64(&relayed.out)
+		if in == lastin && out == lastout {
+			continue
+		}
+		log.Printf("%d allocations, relayed %d bytes in, %d bytes out, %d/%d in the last minute",
+			atomic.LoadInt64(&relayed.allocations), in, out, in-lastin, out-lastout)
+		lastin, lastout = in, out
+	}
+}
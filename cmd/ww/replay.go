@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"webwormhole.io/wormhole"
+)
+
+func replay(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "explain a session recorded with -record\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s <recording>\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "flags:\n")
+		set.PrintDefaults()
+	}
+	set.Parse(args[1:])
+	if set.NArg() != 1 {
+		set.Usage()
+		os.Exit(exitUsage)
+	}
+	f, err := os.Open(set.Arg(0))
+	if err != nil {
+		exitf(exitDisk, "could not open recording: %v", err)
+	}
+	defer f.Close()
+
+	var (
+		dec     = json.NewDecoder(f)
+		session = 0
+		role    string
+		start   wormhole.Frame
+		in, out int
+		closed  bool
+	)
+	for {
+		var fr wormhole.Frame
+		err := dec.Decode(&fr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fatalf("could not read recording: %v", err)
+		}
+		if fr.Event == "book" || fr.Event == "join" {
+			session++
+			role, start, in, out, closed = fr.Event, fr, 0, 0, false
+			fmt.Printf("session %d at %s\n", session, fr.Time.Format("2006-01-02 15:04:05.000"))
+		}
+		if session == 0 {
+			fatalf("recording does not start with a session")
+		}
+		desc := describeFrame(role, fr, &in, &out)
+		if fr.Event == "error" && closed {
+			desc = "signalling connection closed"
+		}
+		closed = closed || fr.Event == "close"
+		fmt.Printf("  +%8.3fs  %s\n", fr.Time.Sub(start.Time).Seconds(), desc)
+	}
+}
+
+// describeFrame returns what a frame meant at its point in the handshake.
+// Messages are identified by their position, since most are encrypted.
+func describeFrame(role string, fr wormhole.Frame, in, out *int) string {
+	switch fr.Event {
+	case "book":
+		return "booking a slot at " + fr.Data
+	case "join":
+		return "joining a slot at " + fr.Data
+	case "error":
+		return "signalling connection failed: " + fr.Data
+	case "close":
+		return "handshake done, hung up on signalling server"
+	}
+	var n int
+	var names []string
+	if fr.Event == "in" {
+		*in++
+		n = *in
+		names = map[string][]string{
+			"book": {"", "slot assigned: " + fr.Data, "received pake message a", "received answer"},
+			"join": {"", "received pake message b", "received offer"},
+		}[role]
+	} else {
+		*out++
+		n = *out
+		names = map[string][]string{
+			"book": {"", "sent pake message b", "sent offer"},
+			"join": {"", "sent pake message a", "sent answer"},
+		}[role]
+	}
+	desc := "sent candidate"
+	if fr.Event == "in" {
+		desc = "received candidate"
+	}
+	if n < len(names) {
+		desc = names[n]
+	}
+	return fmt.Sprintf("%s (%d bytes)", desc, len(fr.Data))
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+	"webwormhole.io/wormhole"
+)
+
+// logpath returns the path of the file keeping the output of the last run.
+func logpath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "webwormhole", "last.log"), nil
+}
+
+// keeplog tees everything written to stderr to the last run log, for
+// ww report to pick up later. It does nothing if that file can't be made.
+func keeplog() {
+	path, err := logpath()
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		f.Close()
+		return
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	log.SetOutput(w)
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.MultiWriter(stderr, f), r)
+		f.Close()
+		close(done)
+	}()
+	onexit(func() {
+		os.Stderr = stderr
+		log.SetOutput(stderr)
+		w.Close()
+		<-done
+	})
+}
+
+var (
+	// codeRE matches wormhole codes, e.g. 8-enlist-decadence, and those from
+	// -wordlist in any script, with what comes before. Go's \b only knows
+	// ASCII, so it can't tell where those begin.
+	codeRE = regexp.MustCompile(`(^|[^\p{L}\p{M}\p{N}])[0-9]+(-[\p{L}\p{M}]+)+`)
+	// ipRE matches IPv4 and IPv6 addresses, roughly.
+	ipRE = regexp.MustCompile(`\b([0-9]{1,3}\.){3}[0-9]{1,3}\b|\b[0-9a-fA-F]{1,4}(:[0-9a-fA-F]{0,4}){3,7}\b`)
+	// qrRE matches lines of a QR code drawn in the terminal.
+	qrRE = regexp.MustCompile(`(?m)^[█▀▄ ]+\n`)
+)
+
+// redact removes codes, addresses and URL credentials from s.
+func redact(s string) string {
+	s = qrRE.ReplaceAllString(s, "")
+	s = codeRE.ReplaceAllString(s, "${1}[code]")
+	s = ipRE.ReplaceAllString(s, "[address]")
+	return s
+}
+
+// redactURL removes credentials and fragments from a URL.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "[unparsable url]"
+	}
+	if u.User != nil {
+		u.User = url.User("[redacted]")
+	}
+	if at := strings.LastIndex(u.Opaque, "@"); at >= 0 {
+		// As in turn:username:password@host.
+		u.Opaque = "[redacted]" + u.Opaque[at:]
+	}
+	if u.Fragment != "" {
+		u.Fragment = "[redacted]"
+	}
+	return u.String()
+}
+
+func report(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "gather information for a bug report\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "The report is written to a redacted tarball. Review each section before\n")
+		fmt.Fprintf(set.Output(), "it is included. Nothing is sent anywhere.\n\n")
+		fmt.Fprintf(set.Output(), "flags:\n")
+		set.PrintDefaults()
+	}
+	out := set.String("o", "ww-report-"+time.Now().Format("20060102-150405")+".tar.gz", "file to write the report to")
+	yes := set.Bool("y", false, "include all sections without asking")
+	set.Parse(args[1:])
+	if set.NArg() != 0 {
+		set.Usage()
+		os.Exit(exitUsage)
+	}
+
+	sections := []struct {
+		name string
+		fn   func() string
+	}{
+		{"version.txt", reportVersion},
+		{"config.txt", reportConfig},
+		{"system.txt", reportSystem},
+		{"network.txt", reportNetwork},
+		{"ice.txt", reportICE},
+		{"last.log", reportLog},
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	stdin := bufio.NewReader(os.Stdin)
+	for _, s := range sections {
+		content := s.fn()
+		if !*yes {
+			fmt.Printf("==== %s ====\n%s\n", s.name, content)
+			fmt.Printf("include %s in the report? [y/N] ", s.name)
+			answer, _ := stdin.ReadString('\n')
+			if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+				continue
+			}
+		}
+		err := tw.WriteHeader(&tar.Header{
+			Name:    s.name,
+			Mode:    0644,
+			Size:    int64(len(content)),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			fatalf("could not write report: %v", err)
+		}
+		if _, err := io.WriteString(tw, content); err != nil {
+			fatalf("could not write report: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		fatalf("could not write report: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		fatalf("could not write report: %v", err)
+	}
+	if err := ioutil.WriteFile(*out, buf.Bytes(), 0600); err != nil {
+		exitf(exitDisk, "could not write report: %v", err)
+	}
+	fmt.Fprintf(set.Output(), "wrote %s\n", *out)
+}
+
+func reportVersion() string {
+	return fmt.Sprintf("ww %s\nsignalling protocol %d, servers %d and up\npeer protocol %d, peers %d and up\n%s\n",
+		version, wormhole.SignalProtocol, wormhole.MinSignalProtocol, wormhole.Protocol, wormhole.MinProtocol, runtime.Version())
+}
+
+func reportConfig() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "signal: %s\n", redactURL(*sigserv))
+	for _, s := range iceServers() {
+		fmt.Fprintf(&b, "ice: %s\n", redactURL(s))
+	}
+	return b.String()
+}
+
+func reportSystem() string {
+	return fmt.Sprintf("os: %s\narch: %s\ncpus: %d\n", runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
+}
+
+// reportNetwork lists network interfaces and whether the signalling server
+// is reachable, without addresses.
+func reportNetwork() string {
+	var b strings.Builder
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		fmt.Fprintf(&b, "interfaces: %v\n", err)
+	}
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		v4, v6 := 0, 0
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				v4++
+			} else {
+				v6++
+			}
+		}
+		fmt.Fprintf(&b, "interface: mtu=%d flags=%v ipv4=%d ipv6=%d\n", iface.MTU, iface.Flags, v4, v6)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	start := time.Now()
+	resp, err := client.Get(*sigserv)
+	if err != nil {
+		fmt.Fprintf(&b, "signalling server: %s\n", redact(err.Error()))
+		return b.String()
+	}
+	resp.Body.Close()
+	fmt.Fprintf(&b, "signalling server: %s in %v, version %q, min version %q\n",
+		resp.Status, time.Since(start).Round(time.Millisecond), resp.Header.Get("X-Version"), resp.Header.Get("X-Min-Version"))
+	return b.String()
+}
+
+// reportICE gathers local ICE candidates and reports their types.
+func reportICE() string {
+	var b strings.Builder
+	cfg := webrtc.Configuration{}
+	for _, s := range iceServers() {
+		cfg.ICEServers = append(cfg.ICEServers, wormhole.ICEServer(s))
+	}
+	pc, err := webrtc.NewPeerConnection(cfg)
+	if err != nil {
+		return fmt.Sprintf("could not create peer connection: %v\n", err)
+	}
+	defer pc.Close()
+	if _, err := pc.CreateDataChannel("report", nil); err != nil {
+		return fmt.Sprintf("could not create data channel: %v\n", err)
+	}
+	start := time.Now()
+	// Without trickle ICE, creating the offer waits for gathering to finish.
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return fmt.Sprintf("could not gather candidates: %v\n", err)
+	}
+	fmt.Fprintf(&b, "gathering took %v\n", time.Since(start).Round(time.Millisecond))
+	var types []string
+	counts := map[string]int{}
+	for _, line := range strings.Split(offer.SDP, "\n") {
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := range fields {
+			if fields[i] == "typ" && i+1 < len(fields) {
+				typ := fields[i+1] + " " + strings.ToLower(fields[2])
+				if counts[typ] == 0 {
+					types = append(types, typ)
+				}
+				counts[typ]++
+			}
+		}
+	}
+	if len(types) == 0 {
+		fmt.Fprintf(&b, "no candidates\n")
+	}
+	sort.Strings(types)
+	for _, typ := range types {
+		fmt.Fprintf(&b, "candidates: %s %d\n", typ, counts[typ])
+	}
+	return b.String()
+}
+
+func reportLog() string {
+	path, err := logpath()
+	if err != nil {
+		return fmt.Sprintf("no log: %v\n", err)
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Sprintf("no log: %v\n", err)
+	}
+	return redact(string(buf))
+}
@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestRedact(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{"code 8-enlist-decadence\n", "code [code]\n"},
+		{"joining 12-café-überfall.", "joining [code]."},
+		{"(3-café-noël)", "([code])"},
+		{"7-ελάφι-θάλασσα, 9-слон-море", "[code], [code]"},
+		{"éa8-word", "éa8-word"},
+		{"connected to 192.0.2.1", "connected to [address]"},
+	} {
+		if got := redact(tt.in); got != tt.want {
+			t.Errorf("redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
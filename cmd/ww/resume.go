@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"webwormhole.io/wormhole"
+)
+
+// A receiver answers a header with a resume token with a resumeOffer of
+// the chunks it has of the file, and the sender answers that with a
+// resumeStart saying where it'll send from: Offset if the chunks check out,
+// or else the start of the file.
+type resumeOffer struct {
+	Offset int64  `json:"offset"`
+	Sum    []byte `json:"sum,omitempty"`
+}
+
+type resumeStart struct {
+	Start int64 `json:"start"`
+}
+
+// saveEvery is how many chunks a receiver gets between saving what it has.
+const saveEvery = 16
+
+// partialPath is where the receiver keeps what it has of the file with
+// token in dir. token has to be a validToken.
+func partialPath(dir, token string) string {
+	return filepath.Join(dir, ".ww-partial-"+token)
+}
+
+// validToken is whether token looks like one wormhole.ResumeToken made:
+// 32 lowercase hex digits. Tokens come from the sender, and end up in file
+// names, so others could be paths out of the directory.
+func validToken(token string) bool {
+	if len(token) != 32 {
+		return false
+	}
+	for _, r := range token {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// resumeToken returns the token for sending the file at path with info.
+func resumeToken(path string, info os.FileInfo) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return wormhole.ResumeToken(path, info.Size(), info.ModTime())
+}
+
+// resumeFrom reads the receiver's offer for f, of size, and answers it,
+// checking it against the chunk hashes in cached as far as they go. It
+// returns where to send f from, with f there, having fed m what's before
+// that.
+func resumeFrom(c *wormhole.Conn, f *os.File, size int64, cached [][]byte, m meter, buf []byte) (int64, error) {
+	n, err := c.Read(buf[:1<<10])
+	if err != nil {
+		return 0, transferErrorf(exitNetwork, "could not read resume offer: %v", err)
+	}
+	var offer resumeOffer
+	if err := json.Unmarshal(buf[:n], &offer); err != nil {
+		return 0, transferErrorf(exitFailure, "could not decode resume offer: %v", err)
+	}
+	var start int64
+	if k := offer.Offset / wormhole.ResumeChunk; offer.Offset > 0 && k <= int64(len(cached)) && offer.Offset <= size && offer.Offset%wormhole.ResumeChunk == 0 {
+		if bytes.Equal(wormhole.SumOf(cached[:k]), offer.Sum) {
+			start = offer.Offset
+		}
+	} else if offer.Offset > 0 && offer.Offset <= size && offer.Offset%wormhole.ResumeChunk == 0 {
+		hasher := &wormhole.ChunkHasher{}
+		if _, err := io.CopyBuffer(hasher, io.NewSectionReader(f, 0, offer.Offset), buf); err != nil {
+			return 0, transferErrorf(exitDisk, "could not read file: %v", err)
+		}
+		if bytes.Equal(wormhole.SumOf(hasher.Sums), offer.Sum) {
+			start = offer.Offset
+		}
+	}
+	b, _ := json.Marshal(resumeStart{start})
+	if _, err := c.Write(b); err != nil {
+		return 0, transferErrorf(exitNetwork, "could not send resume start: %v", err)
+	}
+	if start > 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "resuming at %s\n", formatSize(start))
+	}
+	// Meters count what's been sent, so that they add up to the whole
+	// file, e.g. for manifests.
+	if _, err := io.CopyBuffer(m, io.NewSectionReader(f, 0, start), buf); err != nil {
+		return 0, transferErrorf(exitDisk, "could not read file: %v", err)
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return 0, transferErrorf(exitDisk, "could not seek file: %v", err)
+	}
+	return start, nil
+}
+
+// A partial is a file being received that can be resumed.
+type partial struct {
+	*wormhole.Partial
+	path   string // Of the saved Partial.
+	hasher *wormhole.ChunkHasher
+	saved  int // Chunks in the saved Partial.
+	mu     sync.Mutex
+}
+
+// receiving are the partials being received into, to save if ww exits
+// before they're done, e.g. when interrupted.
+var receiving = struct {
+	m    map[*partial]bool
+	once sync.Once
+	sync.Mutex
+}{m: make(map[*partial]bool)}
+
+// track saves p if ww exits before p is finished.
+func (p *partial) track() {
+	receiving.once.Do(func() {
+		onexit(func() {
+			receiving.Lock()
+			defer receiving.Unlock()
+			for p := range receiving.m {
+				p.save()
+			}
+		})
+	})
+	receiving.Lock()
+	receiving.m[p] = true
+	receiving.Unlock()
+}
+
+// loadPartial returns the file and partial kept for the file h describes
+// in dir, if there are any, after checking the chunks it has.
+func loadPartial(dir string, h header, names *namer) (*os.File, *partial) {
+	path := partialPath(dir, h.Resume)
+	p, err := wormhole.LoadPartial(path)
+	// A name that isn't clean didn't come from here.
+	if err != nil || p.Token != h.Resume || p.Size != int64(h.Size) || names.clean(p.Name) != p.Name {
+		return nil, nil
+	}
+	sums, err := p.Chunks()
+	if err != nil {
+		return nil, nil
+	}
+	f, err := os.OpenFile(filepath.Join(dir, p.Name), os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil
+	}
+	k, err := wormhole.VerifyChunks(f, sums)
+	if err != nil {
+		f.Close()
+		return nil, nil
+	}
+	names.used[names.key(p.Name)] = true
+	return f, &partial{Partial: p, path: path, hasher: &wormhole.ChunkHasher{Sums: sums[:k]}, saved: k}
+}
+
+// offerResume offers the sender of the file h describes what's kept of it
+// in dir, and returns the file to receive it into, its name, where the
+// sender resumes from, and the partial to record progress in.
+func offerResume(c *wormhole.Conn, dir string, h header, names *namer, m meter, buf []byte) (*os.File, string, int64, *partial, error) {
+	f, p := loadPartial(dir, h, names)
+	if p == nil && *chunkCache {
+		f, p = copyReceived(dir, h, names, buf)
+	}
+	var offer resumeOffer
+	if p != nil {
+		offer = resumeOffer{p.hasher.Offset(), wormhole.SumOf(p.hasher.Sums)}
+	}
+	b, _ := json.Marshal(offer)
+	if _, err := c.Write(b); err != nil {
+		return nil, "", 0, nil, transferErrorf(exitNetwork, "could not send resume offer: %v", err)
+	}
+	n, err := c.Read(buf[:1<<10])
+	if err != nil {
+		return nil, "", 0, nil, transferErrorf(exitNetwork, "could not read resume start: %v", err)
+	}
+	var rs resumeStart
+	if err := json.Unmarshal(buf[:n], &rs); err != nil || rs.Start != 0 && rs.Start != offer.Offset {
+		return nil, "", 0, nil, transferErrorf(exitFailure, "bad resume start %q", buf[:n])
+	}
+
+	if f == nil {
+		var name string
+		f, name, err = names.create(dir, h.Name)
+		if err != nil {
+			return nil, name, 0, nil, transferErrorf(exitDisk, "could not create output file %s: %v", name, err)
+		}
+		p = &partial{
+			Partial: &wormhole.Partial{Token: h.Resume, Name: name, Size: int64(h.Size)},
+			path:    partialPath(dir, h.Resume),
+			hasher:  &wormhole.ChunkHasher{},
+		}
+	}
+	p.hasher.Sums = p.hasher.Sums[:rs.Start/wormhole.ResumeChunk]
+	if err := f.Truncate(rs.Start); err != nil {
+		f.Close()
+		return nil, p.Name, 0, nil, transferErrorf(exitDisk, "could not truncate %s: %v", p.Name, err)
+	}
+	if rs.Start > 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "resuming %s at %s\n", p.Name, formatSize(rs.Start))
+	}
+	m.start(p.Name, int64(h.Size))
+	if _, err := io.CopyBuffer(m, io.NewSectionReader(f, 0, rs.Start), buf); err != nil {
+		f.Close()
+		return nil, p.Name, 0, nil, transferErrorf(exitDisk, "could not read %s: %v", p.Name, err)
+	}
+	if _, err := f.Seek(rs.Start, io.SeekStart); err != nil {
+		f.Close()
+		return nil, p.Name, 0, nil, transferErrorf(exitDisk, "could not seek %s: %v", p.Name, err)
+	}
+	p.track()
+	return f, p.Name, rs.Start, p, nil
+}
+
+// Write hashes what's received, saving the partial every so often. The
+// chunks are checked again before resuming, so they needn't be synced.
+func (p *partial) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hasher.Write(b)
+	if len(p.hasher.Sums)-p.saved >= saveEvery {
+		p.saveLocked()
+	}
+	return len(b), nil
+}
+
+func (p *partial) save() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.saveLocked()
+}
+
+// saveLocked saves p. This assumes p is locked.
+func (p *partial) saveLocked() {
+	p.SetSums(p.hasher.Sums)
+	if err := p.Save(p.path); err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "could not save progress of %s: %v\n", p.Name, err)
+	}
+	p.saved = len(p.hasher.Sums)
+}
+
+// finish records how the transfer went: forgetting the partial if it was
+// received whole, or saving it to resume from if not.
+func (p *partial) finish(err error) {
+	receiving.Lock()
+	delete(receiving.m, p)
+	receiving.Unlock()
+	if err == nil {
+		os.Remove(p.path)
+		return
+	}
+	p.save()
+	if p.hasher.Offset() > 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "kept %s of %s, send it again to resume\n", formatSize(p.hasher.Offset()), p.Name)
+	}
+}
+
+// startOver answers a sender offering to resume a file that it should send
+// it from the start, for receivers that can't resume.
+func startOver(c *wormhole.Conn, buf []byte) error {
+	b, _ := json.Marshal(resumeOffer{})
+	if _, err := c.Write(b); err != nil {
+		return transferErrorf(exitNetwork, "could not send resume offer: %v", err)
+	}
+	n, err := c.Read(buf[:1<<10])
+	if err != nil {
+		return transferErrorf(exitNetwork, "could not read resume start: %v", err)
+	}
+	var rs resumeStart
+	if err := json.Unmarshal(buf[:n], &rs); err != nil || rs.Start != 0 {
+		return transferErrorf(exitFailure, "bad resume start %q", buf[:n])
+	}
+	return nil
+}
+
+// A resumeState is what ww receive -resume-state keeps of the files it
+// has part of, to resume them on another machine that has the same partial
+// files, e.g. on a share or copied over: their names and the hashes of the
+// chunks received. It has no keys, so resuming still takes a new code with
+// the same sender.
+type resumeState struct {
+	Partials []*wormhole.Partial `json:"partials"`
+}
+
+// importState saves the partials in the state at path into dir, for the
+// files that don't have their own there already. There being no state is
+// fine, for the first machine.
+func importState(path, dir string) error {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var s resumeState
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for _, p := range s.Partials {
+		if !validToken(p.Token) {
+			return fmt.Errorf("%s: bad token %q", path, p.Token)
+		}
+		if _, err := os.Stat(partialPath(dir, p.Token)); err == nil {
+			continue
+		}
+		if err := p.Save(partialPath(dir, p.Token)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportState writes the partials kept in dir to the state at path, or
+// removes it once there are none.
+func exportState(path, dir string) error {
+	matches, err := filepath.Glob(partialPath(dir, "*"))
+	if err != nil {
+		return err
+	}
+	var s resumeState
+	for _, m := range matches {
+		if strings.HasSuffix(m, ".tmp") {
+			continue
+		}
+		if p, err := wormhole.LoadPartial(m); err == nil {
+			s.Partials = append(s.Partials, p)
+		}
+	}
+	if len(s.Partials) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+func TestLoadPartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ww")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 5*wormhole.ResumeChunk/2/16)
+	h := header{Name: "f", Size: len(data), Resume: "token"}
+	hasher := &wormhole.ChunkHasher{}
+	hasher.Write(data)
+	p := &wormhole.Partial{Token: h.Resume, Name: h.Name, Size: int64(h.Size)}
+	p.SetSums(hasher.Sums)
+	if err := p.Save(partialPath(dir, h.Resume)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		data []byte
+		h    header
+		want int64
+	}{
+		{data, h, 2 * wormhole.ResumeChunk},
+		{data[:wormhole.ResumeChunk+10], h, wormhole.ResumeChunk},
+		{append(append([]byte{}, data[:wormhole.ResumeChunk]...), make([]byte, wormhole.ResumeChunk)...), h, wormhole.ResumeChunk},
+		{append([]byte{1}, data[1:]...), h, 0},
+		{nil, h, -1},
+		{data, header{Name: h.Name, Size: h.Size + 1, Resume: h.Resume}, -1},
+	}
+	for _, test := range tests {
+		os.Remove(filepath.Join(dir, h.Name))
+		if test.data != nil {
+			ioutil.WriteFile(filepath.Join(dir, h.Name), test.data, 0644)
+		}
+		f, got := loadPartial(dir, test.h, newNamer())
+		if (got == nil) != (test.want < 0) || got != nil && got.hasher.Offset() != test.want {
+			t.Errorf("testcase %v got %v want %v", len(test.data), got, test.want)
+		}
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+func TestResumeState(t *testing.T) {
+	from, err := ioutil.TempDir("", "ww")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(from)
+	to, err := ioutil.TempDir("", "ww")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(to)
+	data := bytes.Repeat([]byte("0123456789abcdef"), wormhole.ResumeChunk/16)
+	h := header{Name: "f", Size: 2 * len(data), Resume: wormhole.ResumeToken("f", int64(2*len(data)), time.Time{})}
+	hasher := &wormhole.ChunkHasher{}
+	hasher.Write(data)
+	p := &wormhole.Partial{Token: h.Resume, Name: h.Name, Size: int64(h.Size)}
+	p.SetSums(hasher.Sums)
+	if err := p.Save(partialPath(from, h.Resume)); err != nil {
+		t.Fatal(err)
+	}
+
+	state := filepath.Join(from, "state")
+	if err := exportState(state, from); err != nil {
+		t.Fatal(err)
+	}
+	if err := importState(state, to); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(to, h.Name), data, 0644)
+	f, got := loadPartial(to, h, newNamer())
+	if got == nil || got.hasher.Offset() != wormhole.ResumeChunk {
+		t.Fatalf("got %v after importing, want %d", got, wormhole.ResumeChunk)
+	}
+	f.Close()
+
+	// Once nothing's left to resume, neither is the state.
+	os.Remove(partialPath(from, h.Resume))
+	if err := exportState(state, from); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(state); !os.IsNotExist(err) {
+		t.Errorf("state kept with nothing to resume: %v", err)
+	}
+	if err := importState(state, to); err != nil {
+		t.Errorf("importing no state: %v", err)
+	}
+
+	ioutil.WriteFile(state, []byte(`{"partials":[{"token":"../x","name":"f"}]}`), 0600)
+	if err := importState(state, to); err == nil {
+		t.Errorf("imported a token that's a path")
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+// The daemon can be given rules, with -rules, deciding which of the files a
+// sender lists to receive and where to put them, so that it can be left to
+// receive unattended. Rules are a line each, made of conditions, all of
+// which have to hold, and then what to do:
+//
+//	# Photos from the phone go with the others, during the day.
+//	from=phone type=image/* time=07:00-23:00 route /srv/photos
+//	size>2GB reject
+//	name=*.exe reject
+//	accept
+//
+// Each file goes by the first rule it matches, and files that match none
+// are declined. The conditions are:
+//
+//	name=PATTERN      the file's name matches, as in path.Match
+//	type=PATTERN      its MIME type, as the sender lists it, matches
+//	size<N, size>N    it's smaller, or bigger, than N, e.g. 500MB
+//	from=PATTERN      it's from a paired device matching, see ww self
+//	time=HH:MM-HH:MM  it's offered between these times of day, locally
+//
+// Files of unknown size, like stdin, are taken to be bigger than anything.
+// Senders that don't list their files at all aren't received from.
+
+// A rule is a line of a rules file.
+type rule struct {
+	conds []func(f wormhole.OfferedFile, from string, now time.Time) bool
+	// accept is whether to receive the files it matches, and dir is where,
+	// or "" for the receiving directory.
+	accept bool
+	dir    string
+}
+
+// rules are the rules of a rules file, in order.
+type rules []rule
+
+// loadRules reads the rules file at name.
+func loadRules(name string) (rules, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rs, err := readRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", name, err)
+	}
+	return rs, nil
+}
+
+// readRules reads rules from r. Errors start with the line they're on.
+func readRules(r io.Reader) (rules, error) {
+	var rs rules
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ru, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %v", n, err)
+		}
+		rs = append(rs, ru)
+	}
+	return rs, s.Err()
+}
+
+func parseRule(line string) (rule, error) {
+	var ru rule
+	fields := strings.Fields(line)
+	for i, f := range fields {
+		switch f {
+		case "accept", "reject":
+			if i != len(fields)-1 {
+				return ru, fmt.Errorf("%s has to be last", f)
+			}
+			ru.accept = f == "accept"
+			return ru, nil
+		case "route":
+			if i == len(fields)-1 {
+				return ru, fmt.Errorf("route where?")
+			}
+			// The rest of the line, in case it has spaces in it.
+			rest := line
+			for _, f := range fields[:i+1] {
+				rest = strings.TrimSpace(rest[strings.Index(rest, f)+len(f):])
+			}
+			ru.accept = true
+			ru.dir = rest
+			if info, err := os.Stat(ru.dir); err != nil || !info.IsDir() {
+				return ru, fmt.Errorf("no directory %s to route to", ru.dir)
+			}
+			return ru, nil
+		}
+		cond, err := parseCond(f)
+		if err != nil {
+			return ru, err
+		}
+		ru.conds = append(ru.conds, cond)
+	}
+	return ru, fmt.Errorf("no accept, reject or route at the end")
+}
+
+func parseCond(s string) (func(f wormhole.OfferedFile, from string, now time.Time) bool, error) {
+	if strings.HasPrefix(s, "size<") || strings.HasPrefix(s, "size>") {
+		n, err := parseRate(s[len("size<"):])
+		if err != nil || strings.HasSuffix(s, "/s") {
+			return nil, fmt.Errorf("bad size in %s", s)
+		}
+		if s[len("size")] == '<' {
+			return func(f wormhole.OfferedFile, from string, now time.Time) bool {
+				return !f.Chunked && f.Size < n
+			}, nil
+		}
+		return func(f wormhole.OfferedFile, from string, now time.Time) bool {
+			return f.Chunked || f.Size > n
+		}, nil
+	}
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return nil, fmt.Errorf("bad condition %s", s)
+	}
+	key, pattern := s[:i], s[i+1:]
+	if key == "time" {
+		return parseWindow(pattern)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("bad pattern in %s", s)
+	}
+	match := func(v string) bool {
+		ok, _ := path.Match(pattern, v)
+		return ok
+	}
+	switch key {
+	case "name":
+		return func(f wormhole.OfferedFile, from string, now time.Time) bool { return match(f.Name) }, nil
+	case "type":
+		return func(f wormhole.OfferedFile, from string, now time.Time) bool { return match(f.Type) }, nil
+	case "from":
+		return func(f wormhole.OfferedFile, from string, now time.Time) bool { return from != "" && match(from) }, nil
+	}
+	return nil, fmt.Errorf("unknown condition %s", s)
+}
+
+// parseWindow parses a time of day window, like 09:00-17:30. One that
+// ends before it starts goes past midnight.
+func parseWindow(w string) (func(f wormhole.OfferedFile, from string, now time.Time) bool, error) {
+	i := strings.Index(w, "-")
+	if i < 0 {
+		return nil, fmt.Errorf("bad time %s, want e.g. 09:00-17:30", w)
+	}
+	start, err1 := time.Parse("15:04", w[:i])
+	end, err2 := time.Parse("15:04", w[i+1:])
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("bad time %s, want e.g. 09:00-17:30", w)
+	}
+	from, to := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+	return func(f wormhole.OfferedFile, _ string, now time.Time) bool {
+		m := now.Hour()*60 + now.Minute()
+		if from <= to {
+			return from <= m && m < to
+		}
+		return m >= from || m < to
+	}, nil
+}
+
+// match returns the first of rs that f matches, or nil.
+func (rs rules) match(f wormhole.OfferedFile, from string, now time.Time) *rule {
+	for i := range rs {
+		ok := true
+		for _, cond := range rs[i].conds {
+			ok = ok && cond(f, from, now)
+		}
+		if ok {
+			return &rs[i]
+		}
+	}
+	return nil
+}
+
+// A ruling is what rules decided about the files offered by a sender,
+// from the paired device called from, or "" if it's not one.
+type ruling struct {
+	rules rules
+	from  string
+	dirs  map[wormhole.OfferedFile]string
+}
+
+// pick returns a picker that wants the files then picks that the rules
+// accept, and keeps where they go for route.
+func (rl *ruling) pick(then picker) picker {
+	if then == nil {
+		then = pickAll
+	}
+	return func(files []wormhole.OfferedFile) []int {
+		now := time.Now()
+		rl.dirs = make(map[wormhole.OfferedFile]string)
+		var picked []int
+		for _, i := range then(files) {
+			if ru := rl.rules.match(files[i], rl.from, now); ru != nil && ru.accept {
+				picked = append(picked, i)
+				rl.dirs[files[i]] = ru.dir
+			}
+		}
+		return picked
+	}
+}
+
+// route returns the directory the rules put f in, or "" for the receiving
+// directory.
+func (rl *ruling) route(f wormhole.OfferedFile) string {
+	return rl.dirs[f]
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+func TestRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ww-rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	photos := filepath.Join(dir, "my photos")
+	os.Mkdir(photos, 0700)
+	rs, err := readRules(strings.NewReader(`
+# Photos from the phone go with the others, during the day.
+from=phone type=image/* time=07:00-23:00 route ` + photos + `
+size>2GB reject
+name=*.exe reject
+from=* accept
+time=22:00-06:00 reject
+size<1MB accept
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+	night := time.Date(2020, 1, 1, 23, 30, 0, 0, time.Local)
+	files := []wormhole.OfferedFile{
+		{Name: "a.jpg", Type: "image/jpeg", Size: 5 << 20},
+		{Name: "big.iso", Size: 3e9},
+		{Name: "setup.exe", Size: 100},
+		{Name: "notes.txt", Size: 100},
+		{Name: "stdin", Chunked: true},
+	}
+	cases := []struct {
+		from   string
+		now    time.Time
+		picked []int
+		dirs   []string
+	}{
+		{"phone", day, []int{0, 3}, []string{photos, ""}},
+		{"phone", night, []int{0, 3}, []string{"", ""}},
+		{"", day, []int{3}, []string{""}},
+		{"", night, nil, nil},
+	}
+	for _, c := range cases {
+		var picked []int
+		var dirs []string
+		for i, f := range files {
+			if ru := rs.match(f, c.from, c.now); ru != nil && ru.accept {
+				picked = append(picked, i)
+				dirs = append(dirs, ru.dir)
+			}
+		}
+		if !reflect.DeepEqual(picked, c.picked) || !reflect.DeepEqual(dirs, c.dirs) {
+			t.Errorf("testcase %q %v got %v %q want %v %q", c.from, c.now.Format("15:04"), picked, dirs, c.picked, c.dirs)
+		}
+	}
+	if got := (&ruling{rules: rs, from: "phone"}).pick(pickMatching("*.exe,*.txt"))(files); !reflect.DeepEqual(got, []int{3}) {
+		t.Errorf("picking from what -only picks got %v want [3]", got)
+	}
+
+	for _, bad := range []string{
+		"accept reject",
+		"name=*.jpg",
+		"size>lots accept",
+		"size>5MB/s accept",
+		"time=9-5 accept",
+		"colour=red accept",
+		"name=[ accept",
+		"route",
+		"route " + filepath.Join(dir, "nowhere"),
+	} {
+		if _, err := readRules(strings.NewReader(bad)); err == nil {
+			t.Errorf("testcase %q got no error", bad)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"webwormhole.io/wormhole/pake"
+)
+
+func init() {
+	subcmds["self"] = self
+}
+
+// A device is one of the user's own, paired with ww self pair. Both sides
+// keep the same secret, which codes for transfers between them are
+// derived from.
+type device struct {
+	Name   string    `json:"name"`
+	Secret string    `json:"secret"`
+	Paired time.Time `json:"paired"`
+}
+
+// devicesPath returns where paired devices are kept.
+func devicesPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "webwormhole", "devices"), nil
+}
+
+// loadDevices returns the paired devices by name.
+func loadDevices() (map[string]device, error) {
+	ds := make(map[string]device)
+	path, err := devicesPath()
+	if err != nil {
+		return ds, err
+	}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ds, nil
+	}
+	if err != nil {
+		return ds, err
+	}
+	var list []device
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return ds, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, d := range list {
+		ds[d.Name] = d
+	}
+	return ds, nil
+}
+
+// saveDevices replaces the paired devices with ds. Only this user can read
+// the file, since the secrets in it are as good as codes.
+func saveDevices(ds map[string]device) error {
+	path, err := devicesPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	list := []device{}
+	for _, d := range ds {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	buf, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(buf, '\n'), 0600)
+}
+
+// soleDevice returns the name of the only paired device.
+func soleDevice() string {
+	ds, err := loadDevices()
+	if err != nil {
+		exitf(exitDisk, "could not read devices: %v", err)
+	}
+	if len(ds) != 1 {
+		exitf(exitUsage, "%d devices paired, say which one", len(ds))
+	}
+	for n := range ds {
+		return n
+	}
+	return ""
+}
+
+// deviceCode returns the code for transfers with the paired device called
+// name.
+func deviceCode(name string) string {
+	ds, err := loadDevices()
+	if err != nil {
+		exitf(exitDisk, "could not read devices: %v", err)
+	}
+	d, ok := ds[name]
+	if !ok {
+		exitf(exitUsage, "no device called %q, see %s self list", name, os.Args[0])
+	}
+	code, err := d.code()
+	if err != nil {
+		fatalf("bad secret for device %q: %v", name, err)
+	}
+	return code
+}
+
+// code returns the code for transfers with d.
+func (d device) code() (string, error) {
+	secret, err := hex.DecodeString(d.Secret)
+	if err != nil {
+		return "", err
+	}
+	slot, pass := pake.Paired(secret)
+	return slot + "-" + pass, nil
+}
+
+func self(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "pair your own devices once, and send between them without codes\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s pair [-as name] [-name name] [code]\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "       %s %s send device [send flags] files...\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "       %s %s receive [device] [receive flags]\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "       %s %s list\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "       %s %s forget device\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "pair prints a code on one device to pair with on the other, like send and\n")
+		fmt.Fprintf(set.Output(), "receive. after that, either can send to the other by name. receive can leave\n")
+		fmt.Fprintf(set.Output(), "out the device if there's only one. send -to and receive -from do the same.\n")
+	}
+	set.Parse(args[1:])
+	if set.NArg() < 1 {
+		set.Usage()
+		os.Exit(exitUsage)
+	}
+	rest := set.Args()[1:]
+	switch set.Arg(0) {
+	case "pair":
+		pair(append([]string{args[0] + " pair"}, rest...)...)
+	case "send":
+		if len(rest) < 1 {
+			set.Usage()
+			os.Exit(exitUsage)
+		}
+		send(append([]string{args[0] + " send", "-to", rest[0]}, rest[1:]...)...)
+	case "receive":
+		var from string
+		if len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+			from, rest = rest[0], rest[1:]
+		} else {
+			from = soleDevice()
+		}
+		receive(append([]string{args[0] + " receive", "-from", from}, rest...)...)
+	case "list":
+		ds, err := loadDevices()
+		if err != nil {
+			exitf(exitDisk, "could not read devices: %v", err)
+		}
+		var names []string
+		for n := range ds {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			fmt.Printf("%s\tpaired %s\n", n, ds[n].Paired.Local().Format("2006-01-02"))
+		}
+	case "forget":
+		if len(rest) != 1 {
+			set.Usage()
+			os.Exit(exitUsage)
+		}
+		ds, err := loadDevices()
+		if err != nil {
+			exitf(exitDisk, "could not read devices: %v", err)
+		}
+		if _, ok := ds[rest[0]]; !ok {
+			exitf(exitUsage, "no device called %q", rest[0])
+		}
+		delete(ds, rest[0])
+		if err := saveDevices(ds); err != nil {
+			exitf(exitDisk, "could not save devices: %v", err)
+		}
+	default:
+		set.Usage()
+		os.Exit(exitUsage)
+	}
+}
+
+// pairHello is what devices tell each other when pairing.
+type pairHello struct {
+	Name string `json:"name"`
+}
+
+func pair(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "pair with another of your devices\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s [code]\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "flags:\n")
+		set.PrintDefaults()
+	}
+	hostname, _ := os.Hostname()
+	as := set.String("as", hostname, "name to give this device on the other")
+	name := set.String("name", "", "name to give the other device here, instead of the one it gives")
+	length := set.Int("length", 2, "length of generated secret, if generating")
+	set.Parse(args[1:])
+	if set.NArg() > 1 || *as == "" {
+		set.Usage()
+		os.Exit(exitUsage)
+	}
+
+	ds, err := loadDevices()
+	if err != nil {
+		exitf(exitDisk, "could not read devices: %v", err)
+	}
+	c := newConn(set.Arg(0), *length, 0)
+	defer c.Close()
+	errc := make(chan error, 1)
+	go func() { errc <- json.NewEncoder(c).Encode(pairHello{*as}) }()
+	var hello pairHello
+	if err := json.NewDecoder(c).Decode(&hello); err != nil {
+		exitf(exitNetwork, "could not pair: %v", err)
+	}
+	if err := <-errc; err != nil {
+		exitf(exitNetwork, "could not pair: %v", err)
+	}
+	if *name != "" {
+		hello.Name = *name
+	}
+	if hello.Name == "" {
+		exitf(exitFailure, "the other device gave no name, pick one with -name")
+	}
+	// Both sides get the same secret, without it ever being sent.
+	secret, err := c.ExportKey("self", 32)
+	if err != nil {
+		fatalf("could not derive secret: %v", err)
+	}
+
+	_, repaired := ds[hello.Name]
+	ds[hello.Name] = device{Name: hello.Name, Secret: hex.EncodeToString(secret), Paired: time.Now().UTC()}
+	if err := saveDevices(ds); err != nil {
+		exitf(exitDisk, "could not save devices: %v", err)
+	}
+	if repaired {
+		fmt.Fprintf(set.Output(), "paired with %s again, replacing the old pairing\n", hello.Name)
+	} else {
+		fmt.Fprintf(set.Output(), "paired with %s\n", hello.Name)
+	}
+}
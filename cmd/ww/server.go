@@ -1,75 +1,160 @@
+// +build !lite
+
 package main
 
 // This is the signalling server. It relays messages between peers wishing to connect.
 
 import (
 	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
 	"github.com/gorilla/websocket"
 	"golang.org/x/crypto/acme/autocert"
+	"webwormhole.io/wormhole"
 )
 
+func init() {
+	subcmds["server"] = server
+}
+
 // slotTimeout is the the maximum amount of time a client is allowed to
-// hold a slot.
+// hold a slot. Clients may ask for less with the ttl parameter, and renew
+// it by sending "renew" while they wait. They can give it up by sending
+// "cancel", which also hangs up on the peer if it's still signalling.
 const slotTimeout = 30 * time.Minute
 
-// protocolVersion is an identifier for the current signalling scheme.
-// It's intended to help clients print a friendlier message urging them
-// to upgrade.
-const protocolVersion = "3"
-
 const importMeta = `<!doctype html>
 <meta charset=utf-8>
 <meta name="go-import" content="webwormhole.io git https://github.com/saljam/webwormhole">
 <meta http-equiv="refresh" content="0;URL='https://github.com/saljam/webwormhole'">
 `
 
-// slots is a map of allocated slot numbers.
+// A sigConn is a client's connection to the signalling server, a websocket
+// or a stand-in for one, see pollConn.
+type sigConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	Close() error
+}
+
+// slots is a map of allocated slot numbers, keyed by slotKey.
 var slots = struct {
-	m map[string]chan *websocket.Conn
+	m map[string]chan sigConn
+	// revokers are the slots in m their bookers can cancel.
+	revokers map[string]*revoker
 	sync.RWMutex
-}{m: make(map[string]chan *websocket.Conn)}
+}{m: make(map[string]chan sigConn), revokers: make(map[string]*revoker)}
+
+// A revoker lets whoever has the secret a booker hashed cancel its slot.
+type revoker struct {
+	hash      []byte
+	cancelled chan struct{}
+}
+
+// newRevoker returns a revoker for the hash in a booking's revoke
+// parameter, or nil if there's none.
+func newRevoker(param string) *revoker {
+	hash, err := hex.DecodeString(param)
+	if err != nil || len(hash) != sha256.Size {
+		return nil
+	}
+	return &revoker{hash: hash, cancelled: make(chan struct{})}
+}
+
+// cancelSlot frees the slot named by a DELETE for it whose X-Revoke header
+// has the secret the booker hashed.
+func cancelSlot(w http.ResponseWriter, r *http.Request, slotkey string) {
+	h := sha256.Sum256([]byte(r.Header.Get("X-Revoke")))
+	slots.Lock()
+	rv := slots.revokers[slotkey]
+	if rv == nil {
+		slots.Unlock()
+		http.Error(w, "no such slot", http.StatusNotFound)
+		return
+	}
+	if subtle.ConstantTimeCompare(h[:], rv.hash) != 1 {
+		slots.Unlock()
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	delete(slots.m, slotkey)
+	delete(slots.revokers, slotkey)
+	close(rv.cancelled)
+	slots.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Slots are numbers, as freeslot gives out, or the hex pake.Paired makes.
+// Neither has a slash in it, so slotKey never gives a slot in one namespace
+// the key of one in another.
+var (
+	numericSlot = regexp.MustCompile(`^[0-9]+$`)
+	pairedSlot  = regexp.MustCompile(`^[0-9a-f]{16}$`)
+)
+
+// validSlot is whether a client may book or join slot.
+func validSlot(slot string) bool {
+	return numericSlot.MatchString(slot) || pairedSlot.MatchString(slot)
+}
+
+// slotKey returns the key in slots for a slot in a namespace. Slots in
+// different namespaces never match.
+func slotKey(namespace, slot string) string {
+	if namespace == "" {
+		return slot
+	}
+	return namespace + "/" + slot
+}
 
-// freeslot tries to find an available numeric slot, favouring smaller numbers.
-// This assume slots is locked.
-func freeslot() (slot string, ok bool) {
+// freeslot tries to find an available numeric slot in namespace, favouring
+// smaller numbers. This assume slots is locked.
+func freeslot(namespace string) (slot string, ok bool) {
 	// Try a single decimal digit number.
 	for i := 0; i < 3; i++ {
 		s := strconv.Itoa(rand.Intn(10))
-		if _, ok := slots.m[s]; !ok {
+		if !taken(slotKey(namespace, s)) {
 			return s, true
 		}
 	}
 	// Try a single byte number.
 	for i := 0; i < 64; i++ {
 		s := strconv.Itoa(rand.Intn(1 << 8))
-		if _, ok := slots.m[s]; !ok {
+		if !taken(slotKey(namespace, s)) {
 			return s, true
 		}
 	}
 	// Try a 2-byte number.
 	for i := 0; i < 1024; i++ {
 		s := strconv.Itoa(rand.Intn(1 << 16))
-		if _, ok := slots.m[s]; !ok {
+		if !taken(slotKey(namespace, s)) {
 			return s, true
 		}
 	}
 	// Try a 3-byte number.
 	for i := 0; i < 1024; i++ {
 		s := strconv.Itoa(rand.Intn(1 << 24))
-		if _, ok := slots.m[s]; !ok {
+		if !taken(slotKey(namespace, s)) {
 			return s, true
 		}
 	}
@@ -77,6 +162,9 @@ func freeslot() (slot string, ok bool) {
 	return "", false
 }
 
+// srvtracer exports spans for signalling sessions, if enabled.
+var srvtracer *tracer
+
 // upgrader is a used to start WebSocket connections.
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1 << 10,
@@ -84,38 +172,162 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin:     func(*http.Request) bool { return true },
 }
 
+// signalVersions are the headers that say which versions of the signalling
+// protocol the server speaks. It speaks the same ones as its clients.
+func signalVersions() http.Header {
+	return http.Header{
+		"X-Version":     {strconv.Itoa(wormhole.SignalProtocol)},
+		"X-Min-Version": {strconv.Itoa(wormhole.MinSignalProtocol)},
+	}
+}
+
+// versioned tells every response which signalling versions the server
+// speaks, and turns away clients that say they speak an older one. Those
+// that don't say, like browsers served by this server, get through.
+func versioned(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range signalVersions() {
+			w.Header()[k] = v
+		}
+		if v := r.Header.Get("X-Version"); v != "" {
+			if n, _ := strconv.Atoi(v); n < wormhole.MinSignalProtocol {
+				http.Error(w, "please upgrade", http.StatusUpgradeRequired)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 // relay sets up a rendezvous on a slot and pipes the two websockets together.
+// Clients that can't get a websocket through POST to it instead, and
+// long-poll; see pollConn.
 func relay(w http.ResponseWriter, r *http.Request) {
-	slotkey := r.URL.Path[len("/s/"):]
-	var rconn *websocket.Conn
-	conn, err := upgrader.Upgrade(w, r, nil)
+	namespace, slot := namespaceOf(r), r.URL.Path[len("/s/"):]
+	if slot != "" && !validSlot(slot) {
+		http.Error(w, "no such slot", http.StatusNotFound)
+		return
+	}
+	if asked := r.URL.Query().Get("slot"); asked != "" && !validSlot(asked) {
+		http.Error(w, "bad slot", http.StatusBadRequest)
+		return
+	}
+	slotkey := slotKey(namespace, slot)
+	if r.Method == http.MethodDelete {
+		cancelSlot(w, r, slotkey)
+		return
+	}
+	// Upgrade writes its own response, with only these headers.
+	header := signalVersions()
+	if builtinRelay != nil {
+		header.Set("X-Relay", builtinRelay.url())
+	}
+	if r.Method == http.MethodPost {
+		conn := openPoll(w, header)
+		go func() {
+			signalSlot(context.Background(), r, namespace, slot, conn)
+			conn.Close()
+		}()
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	signalSlot(r.Context(), r, namespace, slot, conn)
+}
+
+// signalSlot books or joins slot in namespace for conn, as r asks, and relays
+// messages between it and the peer once they meet.
+func signalSlot(ctx context.Context, r *http.Request, namespace, slot string, conn sigConn) {
+	slotkey := slotKey(namespace, slot)
+	var rconn sigConn
+	atomic.AddInt64(&signalled.websockets, 1)
+	atomic.AddInt64(&signalled.websocketsTotal, 1)
+	opened := time.Now()
+	defer func() {
+		atomic.AddInt64(&signalled.websockets, -1)
+		signalled.session.observe(time.Since(opened).Seconds())
+	}()
+
+	ttl := slotTimeout
+	if secs, err := strconv.Atoi(r.URL.Query().Get("ttl")); err == nil && secs > 0 && time.Duration(secs)*time.Second < ttl {
+		ttl = time.Duration(secs) * time.Second
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	expiry := time.AfterFunc(ttl, cancel)
+	defer expiry.Stop()
+	span := srvtracer.start("signal", nil, r.Header.Get("Traceparent"))
+	defer span.end(nil)
+	setResult := func(result string) {
+		span.set("result", result)
+		countResult(result)
+	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), slotTimeout)
+	// The slot may be from before a restart, with its booker yet to book
+	// it again.
+	waited := slot != "" && awaitRebook(ctx, slotkey)
 
+	matched := make(chan struct{})
+	// calledOff is closed when the client sends "cancel" before it's
+	// matched.
+	calledOff := make(chan struct{})
 	go func() {
-		if slotkey == "" {
-			// Book a new slot.
+		defer close(matched)
+		if slot == "" {
+			// Book a new slot, either the one the client asked for or a free one.
 			slots.Lock()
-			newslot, ok := freeslot()
+			newslot, ok := r.URL.Query().Get("slot"), true
+			if namespaceFull(namespace) {
+				slots.Unlock()
+				setResult("namespace full")
+				conn.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(4000+http.StatusServiceUnavailable, "namespace full"),
+					time.Now().Add(10*time.Second),
+				)
+				return
+			}
+			if newslot != "" {
+				if _, taken := slots.m[slotKey(namespace, newslot)]; taken || claims[slotKey(namespace, newslot)] != nil {
+					slots.Unlock()
+					setResult("slot taken")
+					conn.WriteControl(
+						websocket.CloseMessage,
+						websocket.FormatCloseMessage(4000+http.StatusConflict, "slot taken"),
+						time.Now().Add(10*time.Second),
+					)
+					return
+				}
+			} else {
+				newslot, ok = freeslot(namespace)
+			}
 			if !ok {
 				slots.Unlock()
+				setResult("no free slots")
 				conn.WriteControl(
 					websocket.CloseMessage,
-					websocket.FormatCloseMessage(http.StatusServiceUnavailable, "can't allocate slots"),
+					websocket.FormatCloseMessage(4000+http.StatusServiceUnavailable, "can't allocate slots"),
 					time.Now().Add(10*time.Second),
 				)
 				return
 			}
-			slotkey = newslot
-			sc := make(chan *websocket.Conn)
+			slotkey = slotKey(namespace, newslot)
+			sc := make(chan sigConn)
 			slots.m[slotkey] = sc
+			var cancelled chan struct{}
+			if rv := newRevoker(r.URL.Query().Get("revoke")); rv != nil {
+				slots.revokers[slotkey] = rv
+				cancelled = rv.cancelled
+			}
+			booked := time.Now()
+			rebooked(slotkey)
 			slots.Unlock()
 			log.Printf("%s book", slotkey)
-			err = conn.WriteMessage(websocket.TextMessage, []byte(slotkey))
+			hooks.notify("created", slotkey)
+			span.set("slot", slotkey)
+			err := conn.WriteMessage(websocket.TextMessage, []byte(newslot))
 			if err != nil {
 				log.Println(err)
 				return
@@ -123,41 +335,93 @@ func relay(w http.ResponseWriter, r *http.Request) {
 			select {
 			case <-ctx.Done():
 				log.Printf("%s timeout", slotkey)
+				hooks.notify("expired", slotkey)
+				setResult("timeout")
 				slots.Lock()
 				delete(slots.m, slotkey)
+				delete(slots.revokers, slotkey)
 				slots.Unlock()
 				conn.WriteControl(
 					websocket.CloseMessage,
-					websocket.FormatCloseMessage(http.StatusRequestTimeout, "timed out"),
+					websocket.FormatCloseMessage(4000+http.StatusRequestTimeout, "timed out"),
+					time.Now().Add(10*time.Second),
+				)
+				return
+			case <-cancelled:
+				// cancelSlot has freed it.
+				log.Printf("%s cancelled", slotkey)
+				hooks.notify("cancelled", slotkey)
+				setResult("cancelled")
+				conn.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(4000+http.StatusGone, "cancelled"),
 					time.Now().Add(10*time.Second),
 				)
 				return
+			case <-calledOff:
+				log.Printf("%s called off", slotkey)
+				hooks.notify("cancelled", slotkey)
+				setResult("cancelled")
+				slots.Lock()
+				delete(slots.m, slotkey)
+				delete(slots.revokers, slotkey)
+				slots.Unlock()
+				return
 			case sc <- conn:
+				signalled.wait.observe(time.Since(booked).Seconds())
 			}
 			rconn = <-sc
+			slots.RLock()
+			cl := claims[slotkey]
+			slots.RUnlock()
+			if cl != nil {
+				go cl.watch(ctx, slotkey, conn)
+			}
 			log.Printf("%s rendezvous", slotkey)
+			hooks.notify("matched", slotkey)
+			setResult("rendezvous")
 			return
 		}
 		// Join an existing slot.
 		slots.Lock()
 		sc, ok := slots.m[slotkey]
+		span.set("slot", slotkey)
+		if !ok && try(slotkey) {
+			slots.Unlock()
+			hooks.notify("tried", slotkey)
+			setResult("tried")
+			conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(4000+http.StatusTooManyRequests, "slot busy"),
+				time.Now().Add(10*time.Second),
+			)
+			return
+		}
 		if !ok {
 			slots.Unlock()
+			setResult("no such slot")
 			conn.WriteControl(
 				websocket.CloseMessage,
-				websocket.FormatCloseMessage(http.StatusNotFound, "no such slot"),
+				websocket.FormatCloseMessage(4000+http.StatusNotFound, "no such slot"),
 				time.Now().Add(10*time.Second),
 			)
 			return
 		}
 		delete(slots.m, slotkey)
+		delete(slots.revokers, slotkey)
+		cl := claimSlot(slotkey)
 		slots.Unlock()
+		go func() {
+			cl.watch(ctx, slotkey, conn)
+			unclaim(slotkey, cl)
+		}()
 		log.Printf("%s visit", slotkey)
+		setResult("visit")
 		select {
 		case <-ctx.Done():
 			conn.WriteControl(
 				websocket.CloseMessage,
-				websocket.FormatCloseMessage(http.StatusRequestTimeout, "timed out"),
+				websocket.FormatCloseMessage(4000+http.StatusRequestTimeout, "timed out"),
 				time.Now().Add(10*time.Second),
 			)
 		case rconn = <-sc:
@@ -166,11 +430,35 @@ func relay(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	defer cancel()
+	if waited {
+		// The peer's first message has likely come in while it waited.
+		// Don't take it for a protocol violation.
+		<-matched
+	}
 	for {
 		messageType, p, err := conn.ReadMessage()
 		if err != nil {
 			return
 		}
+		if rconn == nil && messageType == websocket.TextMessage && string(p) == "renew" {
+			expiry.Reset(ttl)
+			continue
+		}
+		if messageType == websocket.TextMessage && string(p) == "cancel" {
+			// Encrypted messages are longer, so this is for us.
+			if rconn == nil {
+				close(calledOff)
+			}
+			<-matched
+			if rconn != nil {
+				rconn.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(4000+http.StatusGone, "cancelled"),
+					time.Now().Add(10*time.Second),
+				)
+			}
+			return
+		}
 		if rconn == nil {
 			// We could synchronise with the rendezvous goroutine above and wait for
 			// B to connect, but receiving anything at this stage is a protocol violation
@@ -184,6 +472,23 @@ func relay(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// serveTelemetry logs usage reports from clients that opted in to sending
+// them. Addresses aren't logged.
+func serveTelemetry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var report usageReport
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1024)).Decode(&report); err != nil {
+		http.Error(w, "bad report", http.StatusBadRequest)
+		return
+	}
+	log.Printf("telemetry: version=%q os=%q arch=%q result=%q transport=%q",
+		report.Version, report.OS, report.Arch, report.Result, report.Transport)
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func server(args ...string) {
 	rand.Seed(time.Now().UnixNano())
 
@@ -193,23 +498,145 @@ func server(args ...string) {
 		fmt.Fprintf(set.Output(), "usage: %s %s\n\n", os.Args[0], args[0])
 		fmt.Fprintf(set.Output(), "flags:\n")
 		set.PrintDefaults()
+		fmt.Fprintf(set.Output(), "\nwebhooks are signed with the secret in $WW_WEBHOOK_SECRET, if set.\n")
+		fmt.Fprintf(set.Output(), "\nthe -turn relay's credentials are derived from the secret in $WW_RELAY_SECRET, if set,\n")
+		fmt.Fprintf(set.Output(), "so that ww relay -issue and ww -via work with it too. otherwise only this server's\n")
+		fmt.Fprintf(set.Output(), "clients can use it, with credentials they get as they signal.\n")
+		fmt.Fprintf(set.Output(), "\n-metrics only serves clients with the bearer token in $WW_METRICS_TOKEN, if set.\n")
 	}
 	httpaddr := set.String("http", ":http", "http listen address")
 	httpsaddr := set.String("https", ":https", "https listen address")
 	whitelist := set.String("hosts", "", "comma separated list of hosts for which to request let's encrypt certs")
 	secretpath := set.String("secrets", os.Getenv("HOME")+"/keys", "path to put let's encrypt cache")
 	html := set.String("ui", "./web", "path to the web interface files")
+	otlp := set.String("otlp", "", "export OpenTelemetry traces to this OTLP/HTTP endpoint, e.g. http://localhost:4318")
+	geoip := set.String("geoip", "", "path to a first,last,country CSV of address ranges, for -allow-countries and -deny-countries")
+	allow := set.String("allow-countries", "", "comma separated list of country codes allowed to signal, ZZ for addresses not in -geoip")
+	deny := set.String("deny-countries", "", "comma separated list of country codes not allowed to signal")
+	webhook := set.String("webhook", "", "comma separated list of URLs to post slot events to")
+	authTokens := set.String("auth-tokens", "", "only serve clients with one of the bearer tokens in this file, one per line, each optionally followed by a namespace")
+	authURL := set.String("auth-url", "", "only serve clients with a bearer token this URL accepts, e.g. an OIDC userinfo endpoint")
+	authClaim := set.String("auth-url-claim", "", "claim in the -auth-url response to use as the client's namespace, e.g. hd")
+	namespaceFile := set.String("namespaces", "", "serve the namespaces in this file at /ns/NAME/, one per line, each optionally followed by slots=N and token=T")
+	clientCA := set.String("client-ca", "", "only serve clients with a TLS certificate signed by a CA in this PEM file, namespaced by organizational unit")
+	state := set.String("state", "", "save the names of slots waiting for a peer to this file, so that codes survive a quick restart")
+	stateWindow := set.Duration("state-window", 2*time.Minute, "how long after a restart to hold slots saved in -state for their bookers")
+	embedOrigins := set.String("embed-origins", "", "comma separated list of origins allowed to embed the web interface in a frame, e.g. https://example.com, or * for any")
+	canary := set.Bool("canary", false, "keep a test peer waiting for ww doctor, using the stun and turn servers in the global -ice flag")
+	turnaddr := set.String("turn", "", "also run a TURN relay on this udp address, e.g. :3478, for clients that can't connect directly")
+	turnIP := set.String("turn-ip", "", "public IP address of the -turn relay")
+	turnRate := set.Int64("turn-rate", 0, "maximum bytes per second relayed for each client, 0 for unlimited")
+	turnQuota := set.Int64("turn-quota", 0, "maximum bytes relayed for each client, 0 for unlimited")
+	mailboxDir := set.String("mailbox", "", "keep files senders leave with ww send -mailbox in this directory, for receivers to pick up later")
+	mailboxQuota := set.Int64("mailbox-quota", 1<<30, "maximum bytes kept in -mailbox, 0 for unlimited")
+	mailboxTTL := set.Duration("mailbox-ttl", 24*time.Hour, "longest to keep a file in -mailbox")
+	metricsaddr := set.String("metrics", "", "serve Prometheus metrics on /metrics at this listen address, e.g. localhost:9100")
 	set.Parse(args[1:])
 
+	hooks = newWebhooks(*webhook, os.Getenv("WW_WEBHOOK_SECRET"))
+
+	geo, err := newGeoPolicy(*geoip, *allow, *deny)
+	if err != nil {
+		fatalf("could not load country policy: %v", err)
+	}
+
+	auth, err := newAuthPolicy(*authTokens, *authURL, *authClaim, *clientCA)
+	if err != nil {
+		fatalf("could not load authentication policy: %v", err)
+	}
+
+	if *namespaceFile != "" {
+		if err := loadNamespaces(*namespaceFile); err != nil {
+			fatalf("could not load namespaces: %v", err)
+		}
+	}
+
+	if *state != "" {
+		if err := restoreSlots(*state, *stateWindow); err != nil {
+			log.Printf("could not restore slots: %v", err)
+		}
+		go saveSlots(*state)
+	}
+
+	if *turnaddr != "" {
+		ip := net.ParseIP(*turnIP)
+		_, port, err := net.SplitHostPort(*turnaddr)
+		if ip == nil || err != nil {
+			fatalf("-turn needs a udp address and -turn-ip")
+		}
+		secret := os.Getenv("WW_RELAY_SECRET")
+		if secret == "" {
+			b := make([]byte, 32)
+			crand.Read(b)
+			secret = hex.EncodeToString(b)
+		}
+		if err := startRelay(*turnaddr, ip, *turnRate, *turnQuota, secret, geo); err != nil {
+			fatalf("could not start relay: %v", err)
+		}
+		builtinRelay = &sessionRelay{secret: secret, addr: net.JoinHostPort(ip.String(), port)}
+		log.Printf("relaying on %s", *turnaddr)
+		go logRelayed()
+	}
+
+	if *canary {
+		if err := runCanary(iceServers()); err != nil {
+			fatalf("could not start canary: %v", err)
+		}
+	}
+
+	srvtracer = newTracer(*otlp, "ww server")
+	if srvtracer != nil {
+		go func() {
+			for range time.Tick(5 * time.Second) {
+				srvtracer.flush()
+			}
+		}()
+	}
+
+	if *metricsaddr != "" {
+		mmux := http.NewServeMux()
+		mmux.HandleFunc("/metrics", serveMetrics(os.Getenv("WW_METRICS_TOKEN")))
+		go func() { log.Fatal(http.ListenAndServe(*metricsaddr, mmux)) }()
+	}
+
 	fs := gziphandler.GzipHandler(http.FileServer(http.Dir(*html)))
 	mux := http.NewServeMux()
-	mux.HandleFunc("/s/", relay)
+	mux.HandleFunc("/s/", auth.guard(geo.fence(relay)))
+	mux.HandleFunc("/poll/", servePoll)
+	mux.HandleFunc("/auth", auth.serveAuth)
+	mux.HandleFunc("/relay", auth.guard(geo.fence(serveRelay)))
+	mux.HandleFunc("/telemetry", serveTelemetry)
+	mux.HandleFunc("/ns/", serveNamespace(mux))
+	if *mailboxDir != "" {
+		store, err := newMailStore(*mailboxDir, *mailboxQuota, *mailboxTTL)
+		if err != nil {
+			fatalf("could not open mailboxes: %v", err)
+		}
+		mux.HandleFunc("/m/", auth.guard(geo.fence(store.ServeHTTP)))
+	}
+	ancestors := "'self'"
+	if *embedOrigins != "" {
+		ancestors += " " + strings.Join(strings.Fields(strings.Replace(*embedOrigins, ",", " ", -1)), " ")
+	}
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("X-Version", protocolVersion)
+		w.Header().Set("Content-Security-Policy", "frame-ancestors "+ancestors)
+		if r.URL.Path == "/embed.js" {
+			// Other sites import it to embed this one.
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
 		if r.URL.Query().Get("go-get") == "1" || r.URL.Path == "/cmd/ww" {
 			w.Write([]byte(importMeta))
 			return
 		}
+		// The same page in another language, see web/i18n.js.
+		if l, rest := splitLang(r.URL.Path); l != "" {
+			if rest == "" {
+				http.Redirect(w, r, "/"+l+"/", http.StatusMovedPermanently)
+				return
+			}
+			http.StripPrefix("/"+l, fs).ServeHTTP(w, r)
+			return
+		}
 		fs.ServeHTTP(w, r)
 	})
 
@@ -223,15 +650,16 @@ func server(args ...string) {
 		WriteTimeout: 60 * time.Minute,
 		IdleTimeout:  20 * time.Second,
 		Addr:         *httpsaddr,
-		Handler:      mux,
+		Handler:      versioned(mux),
 		TLSConfig:    &tls.Config{GetCertificate: m.GetCertificate},
 	}
+	auth.configureTLS(ssrv.TLSConfig)
 	srv := &http.Server{
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 60 * time.Minute,
 		IdleTimeout:  20 * time.Second,
 		Addr:         *httpaddr,
-		Handler:      m.HTTPHandler(mux),
+		Handler:      m.HTTPHandler(versioned(mux)),
 	}
 
 	if *httpsaddr != "" {
@@ -0,0 +1,13 @@
+// +build !windows
+
+package main
+
+import "errors"
+
+var errNoServices = errors.New("services are only for Windows, use the init system elsewhere")
+
+func installService(args []string) error { return errNoServices }
+func removeService() error               { return errNoServices }
+
+// runService calls serve.
+func runService(serve func() error) error { return serve() }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// installService installs ww with args as a service that starts with the
+// machine, and is restarted if it fails.
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s is already installed", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "WebWormhole",
+		Description: "Runs transfers driven by the ww daemon API.",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Minute},
+	}, uint32((24 * time.Hour).Seconds()))
+	if err != nil {
+		s.Delete()
+		return err
+	}
+	// This fails if the source is left over from an earlier install, which
+	// is fine.
+	eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	return nil
+}
+
+// removeService stops and removes the service.
+func removeService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	if st, err := s.Control(svc.Stop); err == nil {
+		for i := 0; st.State != svc.Stopped && i < 20; i++ {
+			time.Sleep(500 * time.Millisecond)
+			if st, err = s.Query(); err != nil {
+				break
+			}
+		}
+	}
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	eventlog.Remove(serviceName)
+	return nil
+}
+
+// runService calls serve, under the service manager if it started us.
+// There, logs and errors go to the event log, and it returns once the
+// service is stopped.
+func runService(serve func() error) error {
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil || interactive {
+		return serve()
+	}
+	l, err := eventlog.Open(serviceName)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.SetFlags(0)
+	log.SetOutput(eventWriter{l})
+	flag.CommandLine.SetOutput(eventWriter{l})
+	return svc.Run(serviceName, service{serve, l})
+}
+
+// service is the daemon as a service.
+type service struct {
+	serve func() error
+	l     *eventlog.Log
+}
+
+func (s service) Execute(args []string, r <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	errc := make(chan error, 1)
+	go func() { errc <- s.serve() }()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-errc:
+			// Exit without saying we've stopped, so that the service manager
+			// takes it for a failure and restarts us.
+			s.l.Error(1, err.Error())
+			cleanup()
+			os.Exit(exitFailure)
+		case req := <-r:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				return false, 0
+			}
+		}
+	}
+}
+
+// eventWriter writes each line logged to the event log.
+type eventWriter struct {
+	l *eventlog.Log
+}
+
+func (w eventWriter) Write(p []byte) (int, error) {
+	if err := w.l.Info(1, strings.TrimSpace(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
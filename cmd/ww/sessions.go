@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+// With ww send -listen-n, one ww waits on several codes at once, e.g. at an
+// event, and sends the same files to whoever uses each. Receivers take
+// what they want of them as they would from any sender. Each session
+// connects and fails on its own, and its lines are marked with its slot,
+// since more than one may be sending at a time.
+
+// A lineWriter writes whole lines to w, each after prefix, holding mu so
+// that lines from different sessions don't mix.
+type lineWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	i := bytes.LastIndexByte(l.buf, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range bytes.SplitAfter(l.buf[:i+1], []byte("\n")) {
+		if len(line) > 0 {
+			fmt.Fprintf(l.w, "%s%s", l.prefix, line)
+		}
+	}
+	l.buf = append(l.buf[:0], l.buf[i+1:]...)
+	return len(p), nil
+}
+
+// sendSessions books n new wormholes at once, printing the code for each,
+// and calls send with each connection once its peer arrives, and a
+// printer for it. It waits for them all, and returns how many failed, and
+// the exit status of the first of those.
+func sendSessions(n, length int, ttl time.Duration, send func(c *wormhole.Conn, p *printer) error) (failed, status int) {
+	askTelemetry()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out := &lineWriter{mu: &mu, w: flag.CommandLine.Output()}
+			st := session(out, length, ttl, send)
+			mu.Lock()
+			if st != 0 {
+				if failed == 0 {
+					status = st
+				}
+				failed++
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return failed, status
+}
+
+// session runs one of the sessions of sendSessions, writing what it has to
+// say to out, and returns its exit status.
+func session(out *lineWriter, length int, ttl time.Duration, send func(c *wormhole.Conn, p *printer) error) int {
+	password, err := newPassword(length)
+	if err != nil {
+		fmt.Fprintf(out, "could not generate password: %v\n", err)
+		return exitFailure
+	}
+	d := dialer()
+	d.TTL = ttl
+	revocable(d)
+	release := func() {}
+	slotc := make(chan string)
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case slot := <-slotc:
+			release = waitOn(d, slot)
+			out.mu.Lock()
+			printcode(slot + "-" + password)
+			out.mu.Unlock()
+			out.prefix = slot + ": "
+		case <-stop:
+		}
+	}()
+	c, err := d.Wormhole(password, slotc)
+	close(stop)
+	<-done
+	release()
+	reportUsage(c, err)
+	if err != nil {
+		fmt.Fprintf(out, "could not dial: %v\n", err)
+		return exitstatus(err)
+	}
+	defer c.Close()
+	// Progress is only shown line by line, which don't get redrawn.
+	p := &printer{w: out, verb: "sending", plain: true}
+	if err := send(c, p); err != nil {
+		if p.busy {
+			fmt.Fprintf(out, "\n")
+		}
+		fmt.Fprintf(out, "%v\n", err)
+		if e, ok := err.(*transferError); ok {
+			return e.status
+		}
+		return exitFailure
+	}
+	return 0
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestLineWriter(t *testing.T) {
+	var mu sync.Mutex
+	var out bytes.Buffer
+	a := &lineWriter{mu: &mu, w: &out, prefix: "1: "}
+	b := &lineWriter{mu: &mu, w: &out, prefix: "7: "}
+	a.Write([]byte("sending a.txt... "))
+	b.Write([]byte("sending 2 files\nsending b"))
+	a.Write([]byte("done\n"))
+	b.Write([]byte(".txt... done\nand"))
+	want := "7: sending 2 files\n1: sending a.txt... done\n7: sending b.txt... done\n"
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
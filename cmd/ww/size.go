@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+var rawBytes = flag.Bool("bytes", false, "print sizes and speeds as exact numbers of bytes, e.g. for scripts")
+
+// numbers formats numbers the way the user's locale does, e.g. with a
+// decimal comma.
+var numbers = message.NewPrinter(locale())
+
+// locale returns the language numbers are formatted for, from the usual
+// environment variables.
+func locale() language.Tag {
+	for _, v := range []string{"LC_ALL", "LC_NUMERIC", "LANG"} {
+		s := os.Getenv(v)
+		if s == "" {
+			continue
+		}
+		// E.g. de_DE.UTF-8@euro.
+		if i := strings.IndexAny(s, ".@"); i >= 0 {
+			s = s[:i]
+		}
+		t, err := language.Parse(strings.Replace(s, "_", "-", -1))
+		if err != nil {
+			// C and POSIX, or nonsense.
+			return language.English
+		}
+		return t
+	}
+	return language.English
+}
+
+var sizeUnits = []string{"kB", "MB", "GB", "TB", "PB", "EB"}
+
+// formatSize formats n bytes for people, e.g. as 1.5 MB, in powers of 1000
+// like network speeds. With -bytes it gives the exact number. JSON, like
+// the daemon serves, always has exact numbers.
+func formatSize(n int64) string {
+	if *rawBytes || n < 1000 && n > -1000 {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	v, unit := float64(n)/1000, sizeUnits[0]
+	for _, u := range sizeUnits[1:] {
+		if v < 999.95 && v > -999.95 {
+			break
+		}
+		v, unit = v/1000, u
+	}
+	return numbers.Sprintf("%.1f %s", v, unit)
+}
+
+// formatRate formats a speed in bytes per second, like formatSize.
+func formatRate(rate float64) string {
+	if *rawBytes {
+		return fmt.Sprintf("%.0f bytes/s", rate)
+	}
+	if rate < 1000 {
+		return numbers.Sprintf("%.0f bytes/s", rate)
+	}
+	return formatSize(int64(rate)) + "/s"
+}
+
+// parseRate parses a speed in bytes per second the way formatRate prints
+// them, e.g. 5MB/s, 500 kB/s, or a plain number of bytes, in powers of 1000.
+func parseRate(rate string) (int64, error) {
+	s := strings.TrimSpace(strings.TrimSuffix(rate, "/s"))
+	mult := 1.0
+	for i, u := range sizeUnits {
+		if strings.HasSuffix(strings.ToLower(s), strings.ToLower(u)) {
+			s = strings.TrimSpace(s[:len(s)-len(u)])
+			for ; i >= 0; i-- {
+				mult *= 1000
+			}
+			break
+		}
+	}
+	s = strings.TrimSpace(strings.TrimSuffix(s, "bytes"))
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 || v*mult >= 1<<63 {
+		return 0, fmt.Errorf("bad rate %q", rate)
+	}
+	return int64(v * mult), nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+func TestFormatSize(t *testing.T) {
+	defer func(p *message.Printer) { numbers = p }(numbers)
+	cases := []struct {
+		n    int64
+		lang language.Tag
+		want string
+	}{
+		{0, language.English, "0 bytes"},
+		{999, language.English, "999 bytes"},
+		{1000, language.English, "1.0 kB"},
+		{1500000, language.English, "1.5 MB"},
+		{999960, language.English, "1.0 MB"},
+		{1500000, language.German, "1,5 MB"},
+		{2 << 40, language.English, "2.2 TB"},
+	}
+	for _, c := range cases {
+		numbers = message.NewPrinter(c.lang)
+		if got := formatSize(c.n); got != c.want {
+			t.Errorf("testcase %v got %q want %q", c.n, got, c.want)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	cases := []struct {
+		rate string
+		want int64
+		ok   bool
+	}{
+		{"5MB/s", 5000000, true},
+		{"1.5 mb/s", 1500000, true},
+		{"500kB", 500000, true},
+		{"1000", 1000, true},
+		{"200 bytes/s", 200, true},
+		{"0", 0, true},
+		{"MB/s", 0, false},
+		{"-1MB/s", 0, false},
+		{"5 furlongs", 0, false},
+	}
+	for _, c := range cases {
+		got, err := parseRate(c.rate)
+		if (err == nil) != c.ok || got != c.want {
+			t.Errorf("testcase %q got %v, %v want %v", c.rate, got, err, c.want)
+		}
+	}
+}
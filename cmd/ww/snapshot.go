@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// With -snapshot, ww send takes a snapshot of the filesystem under each
+// directory it sends, where it can, and sends the directory as it is in
+// the snapshot, so that the tree it sends is consistent with itself even
+// while programs are writing to it. That takes Btrfs, ZFS or LVM on Linux,
+// or VSS on Windows, see takeSnapshot, and generally root or Administrator.
+// Directories it can't snapshot are sent as they are, as without it.
+
+// snapshots maps directories being sent to where they are in their
+// snapshots.
+var snapshots = map[string]string{}
+
+// snapshotDirs snapshots the directories among files, until ww exits.
+func snapshotDirs(files []string, out io.Writer) {
+	for _, filename := range files {
+		if filename == "-" || isRemote(filename) {
+			continue
+		}
+		dir := filepath.Clean(filename)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() || snapshots[dir] != "" {
+			continue
+		}
+		path, release, err := takeSnapshot(dir)
+		if err != nil {
+			fmt.Fprintf(out, "could not snapshot %s, sending it as it is: %v\n", filename, err)
+			continue
+		}
+		snapshots[dir] = path
+		onexit(func() {
+			if err := release(); err != nil {
+				fmt.Fprintf(out, "could not remove the snapshot of %s: %v\n", filename, err)
+			}
+		})
+	}
+}
+
+// snapshotOf returns where dir is in its snapshot, or dir if it has none.
+func snapshotOf(dir string) string {
+	if path, ok := snapshots[dir]; ok {
+		return path
+	}
+	return dir
+}
+
+// snapshotName returns a new name for a snapshot.
+func snapshotName() string {
+	b := make([]byte, 4)
+	crand.Read(b)
+	return "ww-snapshot-" + hex.EncodeToString(b)
+}
+
+// runTool runs a command, and returns what it printed, or an error with
+// what it printed to stderr.
+func runTool(name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %s", name, msg)
+		}
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// A mount is a line of /proc/self/mountinfo.
+type mount struct {
+	point, fstype, source string
+}
+
+// mountOf returns the mount path is under, from the mountinfo in r.
+func mountOf(r io.Reader, path string) (mount, error) {
+	var best mount
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(s.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || len(fields) < sep+3 {
+			continue
+		}
+		m := mount{point: unescapeMount(fields[4]), fstype: fields[sep+1], source: unescapeMount(fields[sep+2])}
+		rel, err := filepath.Rel(m.point, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		// Lines come in the order things were mounted, so a later mount
+		// on the same point hides earlier ones.
+		if len(m.point) >= len(best.point) {
+			best = m
+		}
+	}
+	if err := s.Err(); err != nil {
+		return best, err
+	}
+	if best.point == "" {
+		return best, fmt.Errorf("no mount for %s", path)
+	}
+	return best, nil
+}
+
+// unescapeMount undoes the octal escapes of spaces and the like in
+// mountinfo.
+func unescapeMount(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// takeSnapshot snapshots the filesystem dir is on, if it's Btrfs or ZFS,
+// or on an LVM logical volume, with their tools, and returns where dir is
+// in the snapshot, and how to get rid of it.
+func takeSnapshot(dir string) (string, func() error, error) {
+	abs, err := filepath.Abs(dir)
+	if err == nil {
+		abs, err = filepath.EvalSymlinks(abs)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", nil, err
+	}
+	m, err := mountOf(f, abs)
+	f.Close()
+	if err != nil {
+		return "", nil, err
+	}
+	switch m.fstype {
+	case "btrfs":
+		return snapshotBtrfs(abs, m)
+	case "zfs":
+		return snapshotZFS(abs, m)
+	}
+	if strings.HasPrefix(m.source, "/dev/mapper/") || strings.HasPrefix(m.source, "/dev/dm-") {
+		return snapshotLVM(abs, m)
+	}
+	return "", nil, fmt.Errorf("%s on %s isn't Btrfs, ZFS or LVM", m.source, m.point)
+}
+
+// snapshotBtrfs snapshots the subvolume dir is in, into the subvolume
+// itself, which leaves it out of the snapshot.
+func snapshotBtrfs(dir string, m mount) (string, func() error, error) {
+	// Subvolumes' root directories are always inode 256.
+	subvol := dir
+	for {
+		info, err := os.Stat(subvol)
+		if err != nil {
+			return "", nil, err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Ino == 256 || subvol == m.point {
+			break
+		}
+		subvol = filepath.Dir(subvol)
+	}
+	snap := filepath.Join(subvol, "."+snapshotName())
+	if _, err := runTool("btrfs", "subvolume", "snapshot", "-r", subvol, snap); err != nil {
+		return "", nil, err
+	}
+	rel, _ := filepath.Rel(subvol, dir)
+	return filepath.Join(snap, rel), func() error {
+		_, err := runTool("btrfs", "subvolume", "delete", snap)
+		return err
+	}, nil
+}
+
+// snapshotZFS snapshots the dataset mounted at m, which shows up in its
+// .zfs/snapshot directory.
+func snapshotZFS(dir string, m mount) (string, func() error, error) {
+	name := snapshotName()
+	snap := m.source + "@" + name
+	if _, err := runTool("zfs", "snapshot", snap); err != nil {
+		return "", nil, err
+	}
+	rel, _ := filepath.Rel(m.point, dir)
+	return filepath.Join(m.point, ".zfs", "snapshot", name, rel), func() error {
+		_, err := runTool("zfs", "destroy", snap)
+		return err
+	}, nil
+}
+
+// snapshotLVM snapshots the logical volume mounted at m, and mounts the
+// snapshot read-only in a temporary directory.
+func snapshotLVM(dir string, m mount) (string, func() error, error) {
+	out, err := runTool("lvs", "--noheadings", "-o", "vg_name,lv_name,lv_attr", m.source)
+	if err != nil {
+		return "", nil, err
+	}
+	lv := strings.Fields(out)
+	if len(lv) != 3 {
+		return "", nil, fmt.Errorf("%s isn't a logical volume", m.source)
+	}
+	name := snapshotName()
+	args := []string{"--snapshot", "--name", name}
+	if strings.HasPrefix(lv[2], "V") {
+		// Thin volumes' snapshots take no space up front, but aren't
+		// activated unless asked.
+		args = append(args, "--setactivationskip", "n")
+	} else {
+		// Space for what changes while it's being sent.
+		args = append(args, "--extents", "10%ORIGIN")
+	}
+	if _, err := runTool("lvcreate", append(args, lv[0]+"/"+lv[1])...); err != nil {
+		return "", nil, err
+	}
+	remove := func() error {
+		_, err := runTool("lvremove", "--force", lv[0]+"/"+name)
+		return err
+	}
+	mnt, err := ioutil.TempDir("", "ww-snapshot")
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+	opts := "ro"
+	if m.fstype == "xfs" {
+		// The snapshot has the same UUID, and a log that can't be
+		// replayed read-only.
+		opts += ",nouuid,norecovery"
+	}
+	if _, err := runTool("mount", "-t", m.fstype, "-o", opts, "/dev/"+lv[0]+"/"+name, mnt); err != nil {
+		os.Remove(mnt)
+		remove()
+		return "", nil, err
+	}
+	rel, _ := filepath.Rel(m.point, dir)
+	return filepath.Join(mnt, rel), func() error {
+		if _, err := runTool("umount", mnt); err != nil {
+			return err
+		}
+		os.Remove(mnt)
+		return remove()
+	}, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMountOf(t *testing.T) {
+	mountinfo := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+30 22 0:26 / /srv rw shared:2 - btrfs /dev/sdb rw,subvol=/
+31 30 0:27 / /srv/tank rw shared:3 - zfs tank/data rw
+32 22 253:0 / /mnt/my\040files rw - xfs /dev/mapper/vg-files rw
+33 31 0:28 / /srv/tank rw shared:4 - tmpfs tmpfs rw
+`
+	cases := []struct {
+		path, point, fstype string
+	}{
+		{"/home/me", "/", "ext4"},
+		{"/srv", "/srv", "btrfs"},
+		{"/srv/photos", "/srv", "btrfs"},
+		{"/srv/tankard", "/srv", "btrfs"},
+		{"/srv/tank/a", "/srv/tank", "tmpfs"},
+		{"/mnt/my files/a", "/mnt/my files", "xfs"},
+	}
+	for _, c := range cases {
+		m, err := mountOf(strings.NewReader(mountinfo), c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.point != c.point || m.fstype != c.fstype {
+			t.Errorf("testcase %q got %q %q want %q %q", c.path, m.point, m.fstype, c.point, c.fstype)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+// +build !linux,!windows
+
+package main
+
+import "errors"
+
+// takeSnapshot would snapshot the filesystem dir is on, but there's no
+// support for it on this system.
+func takeSnapshot(dir string) (string, func() error, error) {
+	return "", nil, errors.New("snapshots aren't supported on this system")
+}
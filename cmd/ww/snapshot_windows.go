@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// takeSnapshot takes a VSS shadow copy of the drive dir is on, with
+// PowerShell, and returns where dir is in it, and how to get rid of it.
+func takeSnapshot(dir string) (string, func() error, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	vol := filepath.VolumeName(abs)
+	if len(vol) != 2 || vol[1] != ':' {
+		return "", nil, errors.New("only local drives have shadow copies")
+	}
+	out, err := runTool("powershell", "-NoProfile", "-NonInteractive", "-Command", fmt.Sprintf(
+		`$r = (Get-WmiObject -List Win32_ShadowCopy).Create('%s\', 'ClientAccessible'); `+
+			`if ($r.ReturnValue -ne 0) { Write-Error "could not create shadow copy: $($r.ReturnValue)"; exit 1 }; `+
+			`$s = Get-WmiObject Win32_ShadowCopy -Filter "ID='$($r.ShadowID)'"; $s.ID; $s.DeviceObject`,
+		vol))
+	if err != nil {
+		return "", nil, err
+	}
+	lines := strings.Fields(out)
+	if len(lines) != 2 {
+		return "", nil, fmt.Errorf("could not make sense of shadow copy %q", out)
+	}
+	id, device := lines[0], lines[1]
+	return device + abs[len(vol):], func() error {
+		_, err := runTool("powershell", "-NoProfile", "-NonInteractive", "-Command", fmt.Sprintf(
+			`Get-WmiObject Win32_ShadowCopy -Filter "ID='%s'" | ForEach-Object { $_.Delete() }`, id))
+		return err
+	}, nil
+}
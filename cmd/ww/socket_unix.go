@@ -0,0 +1,18 @@
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenUnix listens on a unix socket at path that only we can connect to.
+// It's created with the umask set rather than restricted after, when others
+// could connect in between. The umask is the process's, so anything else
+// created meanwhile is only the more private for it.
+func listenUnix(path string) (net.Listener, error) {
+	old := syscall.Umask(0077)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
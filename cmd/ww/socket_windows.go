@@ -0,0 +1,9 @@
+package main
+
+import "net"
+
+// listenUnix listens on a unix socket at path. Windows has no umask, and
+// who can connect is up to the ACLs of the directory it's in.
+func listenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,150 @@
+// +build !lite
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// savedState is what the server keeps across restarts: the slots booked
+// and waiting for a peer. It's only their names, since the server never
+// has anything derived from what peers send each other.
+type savedState struct {
+	Saved time.Time `json:"saved"`
+	Slots []string  `json:"slots"`
+}
+
+// restored holds slots saved before a restart until their bookers book
+// them again, or giving up on them after a while. Each has a channel
+// that's closed when that happens, for peers that join early to wait on.
+// It's guarded by slots' lock.
+var restored = make(map[string]chan struct{})
+
+// taken reports whether the slot with key is booked, held for its booker
+// since a restart, or still being signalled on. This assumes slots is
+// locked.
+func taken(key string) bool {
+	_, ok := slots.m[key]
+	if !ok {
+		_, ok = restored[key]
+	}
+	if !ok {
+		_, ok = claims[key]
+	}
+	return ok
+}
+
+// rebooked lets peers waiting on key go ahead, since its booker is back.
+// This assumes slots is locked.
+func rebooked(key string) {
+	if c, ok := restored[key]; ok {
+		close(c)
+		delete(restored, key)
+	}
+}
+
+// awaitRebook waits until the slot with key is booked again, if it was
+// saved before a restart and hasn't been yet. It returns whether it had
+// to wait.
+func awaitRebook(ctx context.Context, key string) bool {
+	slots.RLock()
+	c, ok := restored[key]
+	slots.RUnlock()
+	if !ok {
+		return false
+	}
+	select {
+	case <-c:
+	case <-ctx.Done():
+	}
+	return true
+}
+
+// restoreSlots holds on to the slots saved in file for window, as long as
+// they were saved less than window ago.
+func restoreSlots(file string, window time.Duration) error {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var s savedState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if time.Since(s.Saved) > window {
+		return nil
+	}
+	slots.Lock()
+	for _, key := range s.Slots {
+		restored[key] = make(chan struct{})
+	}
+	slots.Unlock()
+	log.Printf("holding %d slots from before the restart for %v", len(s.Slots), window)
+	time.AfterFunc(window, func() {
+		slots.Lock()
+		defer slots.Unlock()
+		for _, key := range s.Slots {
+			if _, ok := restored[key]; ok {
+				log.Printf("%s not booked again", key)
+				rebooked(key)
+			}
+		}
+	})
+	return nil
+}
+
+// saveSlots writes the slots waiting for a peer to file every second,
+// while there are any. The file is replaced whole, so a crash part way
+// through leaves the last one.
+func saveSlots(file string) {
+	var last []string
+	for range time.Tick(time.Second) {
+		slots.RLock()
+		var keys []string
+		for key := range slots.m {
+			keys = append(keys, key)
+		}
+		for key := range restored {
+			keys = append(keys, key)
+		}
+		slots.RUnlock()
+		sort.Strings(keys)
+		b, _ := json.Marshal(savedState{time.Now(), keys})
+		if len(keys) == 0 && len(last) == 0 {
+			continue
+		}
+		// Save even if nothing changed, so that the file says how fresh
+		// the slots are.
+		tmp, err := ioutil.TempFile(filepath.Dir(file), ".ww-state")
+		if err != nil {
+			log.Printf("could not save state: %v", err)
+			continue
+		}
+		_, err = tmp.Write(b)
+		if err == nil {
+			err = tmp.Sync()
+		}
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), file)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			log.Printf("could not save state: %v", err)
+			continue
+		}
+		last = keys
+	}
+}
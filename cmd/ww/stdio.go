@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"webwormhole.io/wormhole"
+)
+
+// Senders given "-" for a file send what's piped into them, without knowing
+// its size up front. Its header has Chunked set, and every message after it
+// starts with chunkMore, or chunkLast for the last one, which may have no
+// data. Receivers older than wormhole.MinChunked need sizes, so what they're
+// sent is spooled to a temporary file first. Receivers given "-" write what
+// they receive to stdout as it comes.
+
+const (
+	chunkMore = 0
+	chunkLast = 1
+)
+
+// stdinName is what stdin is sent as, set with send -name.
+var stdinName = "stdin"
+
+// chunkedReader reads a chunked file, the chunks of which are messages read
+// from r into buf.
+type chunkedReader struct {
+	r    io.Reader
+	buf  []byte
+	p    []byte
+	last bool
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	for len(cr.p) == 0 {
+		if cr.last {
+			return 0, io.EOF
+		}
+		n, err := cr.r.Read(cr.buf)
+		if n == 0 {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		switch cr.buf[0] {
+		case chunkMore:
+		case chunkLast:
+			cr.last = true
+		default:
+			return 0, errors.New("bad chunk")
+		}
+		cr.p = cr.buf[1:n]
+	}
+	n := copy(p, cr.p)
+	cr.p = cr.p[n:]
+	return n, nil
+}
+
+// fileSize is the size of the file h describes, or -1 if it's not known.
+func fileSize(h header) int64 {
+	if h.Chunked {
+		return -1
+	}
+	return int64(h.Size)
+}
+
+// contentsOf reads the file h describes from c, from start.
+func contentsOf(c *wormhole.Conn, h header, start int64) (io.Reader, error) {
+	if h.Compress != "" {
+		return wormhole.NewDecompressor(h.Compress, &chunkedReader{r: c, buf: make([]byte, wormhole.MaxMessage)})
+	}
+	if h.Chunked {
+		return &chunkedReader{r: c, buf: make([]byte, wormhole.MaxMessage)}, nil
+	}
+	return io.LimitReader(c, int64(h.Size)-start), nil
+}
+
+// sendChunked sends what's read from r over c as a chunked file called
+// name, reading depth chunks ahead.
+func sendChunked(c *wormhole.Conn, r io.Reader, name string, depth int, m meter, buf []byte) error {
+	h, err := json.Marshal(header{Name: name, Chunked: true})
+	if err != nil {
+		return err
+	}
+	if _, err := c.Write(h); err != nil {
+		return transferErrorf(exitNetwork, "could not send file header: %v", err)
+	}
+	m.start(name, -1)
+	span := tr.start("transfer", root, "")
+	stalled := c.Congestion().Stalled
+	ra := newReadAhead(r, depth, len(buf)-1)
+	defer ra.Close()
+	rd := &timedReader{Reader: ra}
+	var written int64
+	for {
+		n, err := rd.Read(buf[1:])
+		buf[0] = chunkMore
+		if err == io.EOF {
+			buf[0] = chunkLast
+		} else if err != nil {
+			span.end(err)
+			return transferErrorf(exitDisk, "could not read %s: %v", name, err)
+		}
+		if n == 0 && buf[0] == chunkMore {
+			continue
+		}
+		if _, err := c.Write(buf[:1+n]); err != nil {
+			span.end(err)
+			return transferErrorf(exitNetwork, "could not send file: %v", err)
+		}
+		m.Write(buf[1 : 1+n])
+		written += int64(n)
+		if buf[0] == chunkLast {
+			break
+		}
+	}
+	limit := bottleneck(c.Congestion().Stalled-stalled, rd.d)
+	if limit != "" {
+		span.set("limited_by", limit)
+	}
+	span.set("size", strconv.FormatInt(written, 10))
+	span.end(nil)
+	m.done(limit)
+	return nil
+}
+
+// spoolStdin copies stdin to a temporary file called stdinName, for peers
+// too old for chunked files, and returns files with "-" replaced by its
+// path. It's removed on exit.
+func spoolStdin(files []string) ([]string, error) {
+	i := indexOf(files, "-")
+	if i < 0 {
+		return files, nil
+	}
+	dir, err := ioutil.TempDir("", "ww-stdin")
+	if err != nil {
+		return nil, transferErrorf(exitDisk, "could not keep stdin for an older peer: %v", err)
+	}
+	onexit(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, filepath.Base(stdinName))
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, transferErrorf(exitDisk, "could not keep stdin for an older peer: %v", err)
+	}
+	_, err = io.Copy(f, os.Stdin)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, transferErrorf(exitDisk, "could not keep stdin for an older peer: %v", err)
+	}
+	spooled := append([]string(nil), files...)
+	spooled[i] = path
+	return spooled, nil
+}
+
+func indexOf(list []string, s string) int {
+	for i := range list {
+		if list[i] == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// stdoutSink is a sink that writes every file it's given to stdout, one
+// after another.
+type stdoutSink struct{}
+
+func (stdoutSink) exists(name string) (bool, error)               { return false, nil }
+func (stdoutSink) create(name string, size int64) (upload, error) { return stdoutUpload{}, nil }
+
+type stdoutUpload struct{}
+
+func (stdoutUpload) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+func (stdoutUpload) commit() error               { return nil }
+func (stdoutUpload) abort()                      {}
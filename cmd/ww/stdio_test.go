@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// messages reads one message at a time, like a data channel.
+type messages [][]byte
+
+func (m *messages) Read(p []byte) (int, error) {
+	if len(*m) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, (*m)[0])
+	*m = (*m)[1:]
+	return n, nil
+}
+
+func TestChunkedReader(t *testing.T) {
+	cases := []struct {
+		msgs []string
+		want string
+		ok   bool
+	}{
+		{[]string{"\x01"}, "", true},
+		{[]string{"\x00ab", "\x00", "\x01c"}, "abc", true},
+		{[]string{"\x00ab", "\x01", "\x00extra"}, "ab", true},
+		{[]string{"\x00ab"}, "ab", false},
+		{[]string{"\x02ab"}, "", false},
+	}
+	for _, c := range cases {
+		var m messages
+		for _, s := range c.msgs {
+			m = append(m, []byte(s))
+		}
+		got, err := ioutil.ReadAll(&chunkedReader{r: &m, buf: make([]byte, msgChunkSize)})
+		if string(got) != c.want || (err == nil) != c.ok {
+			t.Errorf("testcase %q got %q, %v want %q", c.msgs, got, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+// telemetryURL is where usage reports go, for users who agree to send
+// them. It's the maintainers' server, whatever -signal says.
+const telemetryURL = "https://wrmhl.link/telemetry"
+
+// A usageReport is all a telemetry ping says. There's nothing in it about
+// what's sent, or who to.
+type usageReport struct {
+	Version   string `json:"version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	Result    string `json:"result"`              // "ok", or how it failed, e.g. "network".
+	Transport string `json:"transport,omitempty"` // "direct" or "relay".
+}
+
+// telemetryOn reports whether the user agreed to send usage reports. Strict
+// privacy turns them off too.
+func telemetryOn() bool {
+	return getConfig("telemetry") == "on" && *privacy != "strict"
+}
+
+// askTelemetry asks the user at the terminal whether to send usage reports,
+// the first time only.
+func askTelemetry() {
+	if !interactive || getConfig("telemetry") != "" {
+		return
+	}
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "send the maintainers an anonymous report each time you connect? it only has\n")
+	fmt.Fprintf(out, "the ww version, OS and architecture, whether connecting worked or how it\n")
+	fmt.Fprintf(out, "failed, and whether the connection is direct or relayed. never anything about\n")
+	fmt.Fprintf(out, "what's sent, or who to. change your mind with: %s config telemetry on|off\n", os.Args[0])
+	fmt.Fprintf(out, "send reports? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	value := "off"
+	if a := strings.ToLower(strings.TrimSpace(answer)); a == "y" || a == "yes" {
+		value = "on"
+	}
+	if err := setConfig("telemetry", value); err != nil {
+		fmt.Fprintf(out, "could not save the answer: %v\n", err)
+	}
+}
+
+var (
+	reports     sync.WaitGroup
+	reportsOnce sync.Once
+)
+
+// reportUsage sends a usage report on connecting over c, or failing to
+// with err, if the user agreed. It doesn't hold up the program for long
+// on the way out.
+func reportUsage(c *wormhole.Conn, err error) {
+	if !telemetryOn() {
+		return
+	}
+	r := usageReport{Version: version, OS: runtime.GOOS, Arch: runtime.GOARCH, Result: "ok"}
+	if err != nil {
+		r.Result = "failure"
+		status := exitstatus(err)
+		for class, s := range exitClasses {
+			if s == status {
+				r.Result = class
+			}
+		}
+	} else if route, ok := c.Route(); ok {
+		r.Transport = route.String()
+	}
+	reportsOnce.Do(func() {
+		onexit(func() {
+			done := make(chan struct{})
+			go func() {
+				reports.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+			}
+		})
+	})
+	reports.Add(1)
+	go func() {
+		defer reports.Done()
+		b, _ := json.Marshal(r)
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Post(telemetryURL, "application/json", bytes.NewReader(b))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+}
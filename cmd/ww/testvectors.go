@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"webwormhole.io/wormhole/pake"
+)
+
+func init() {
+	subcmds["testvectors"] = testvectors
+}
+
+func testvectors(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "print known answer tests for the handshake and sealing, or check some\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s [-check file]\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "other implementations can run each vector with its random bytes in place of\n")
+		fmt.Fprintf(set.Output(), "their own, and compare what they get. -check recomputes vectors from a file,\n")
+		fmt.Fprintf(set.Output(), "in the same format, from another implementation.\n\n")
+		fmt.Fprintf(set.Output(), "flags:\n")
+		set.PrintDefaults()
+	}
+	check := set.String("check", "", "file of vectors to check, - for stdin")
+	set.Parse(args[1:])
+	if set.NArg() != 0 {
+		set.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if *check == "" {
+		vs, err := pake.Vectors()
+		if err != nil {
+			fatalf("could not make test vectors: %v", err)
+		}
+		b, err := json.MarshalIndent(vs, "", "\t")
+		if err != nil {
+			fatalf("could not encode test vectors: %v", err)
+		}
+		os.Stdout.Write(append(b, '\n'))
+		return
+	}
+
+	var b []byte
+	var err error
+	if *check == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(*check)
+	}
+	if err != nil {
+		exitf(exitDisk, "could not read test vectors: %v", err)
+	}
+	var vs []pake.Vector
+	if err := json.Unmarshal(b, &vs); err != nil {
+		exitf(exitUsage, "could not decode test vectors: %v", err)
+	}
+	failed := 0
+	for _, v := range vs {
+		if err := v.Check(); err != nil {
+			fmt.Fprintf(set.Output(), "FAILED %v\n", err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(set.Output(), "ok %s\n", v.Name)
+	}
+	if failed > 0 {
+		exitf(exitFailure, "%d of %d test vectors failed", failed, len(vs))
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"webwormhole.io/wormhole"
+)
+
+// A text message is sent like a file, with Text set in its header, so that
+// receivers that don't know about them save it as a file instead of showing
+// it.
+
+// textName is what text messages are called, as files.
+const textName = "message.txt"
+
+// maxText is the longest text message receivers show rather than save.
+const maxText = 1 << 20
+
+// A textMeter is a meter that's given the text messages received.
+type textMeter interface {
+	text(msg string)
+}
+
+func (ms meters) text(msg string) {
+	for _, m := range ms {
+		if tm, ok := m.(textMeter); ok {
+			tm.text(msg)
+		}
+	}
+}
+
+// sendText sends msg over c as a text message.
+func sendText(c *wormhole.Conn, msg string) error {
+	h, err := json.Marshal(header{Name: textName, Size: len(msg), Type: "text/plain; charset=utf-8", Text: true})
+	if err != nil {
+		return err
+	}
+	if _, err := c.Write(h); err != nil {
+		return transferErrorf(exitNetwork, "could not send message header: %v", err)
+	}
+	for b := []byte(msg); len(b) > 0; {
+		n := len(b)
+		if n > msgChunkSize {
+			n = msgChunkSize
+		}
+		if _, err := c.Write(b[:n]); err != nil {
+			return transferErrorf(exitNetwork, "could not send message: %v", err)
+		}
+		b = b[n:]
+	}
+	sum := sha256.Sum256([]byte(msg))
+	return sendTrailer(c, sum[:])
+}
+
+// receiveText reads the text message described by h from c, and gives it
+// to m.
+func receiveText(c *wormhole.Conn, h header, m meter, buf []byte) error {
+	msg := make([]byte, h.Size)
+	if _, err := io.ReadFull(&chunkReader{r: c, buf: buf}, msg); err != nil {
+		return transferErrorf(exitNetwork, "could not receive message: %v", err)
+	}
+	// Messages aren't counted as files, so meters aren't told their hash.
+	sum := sha256.Sum256(msg)
+	if err := checkTrailer(c, h.Name, sum[:], nil, buf); err != nil {
+		return err
+	}
+	if tm, ok := m.(textMeter); ok {
+		tm.text(string(msg))
+	}
+	return nil
+}
+
+// text prints msg on stdout, or puts it on the clipboard if asked to.
+func (p *printer) text(msg string) {
+	if p.clipboard {
+		err := copyToClipboard(msg)
+		if err == nil {
+			fmt.Fprintf(p.w, "copied message to the clipboard\n")
+			return
+		}
+		fmt.Fprintf(p.w, "could not copy message to the clipboard: %v\n", err)
+	}
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+	io.WriteString(os.Stdout, msg)
+}
+
+// copyToClipboard puts text on the clipboard, with whichever command the
+// system has for it.
+func copyToClipboard(text string) error {
+	var cmds [][]string
+	switch runtime.GOOS {
+	case "darwin":
+		cmds = [][]string{{"pbcopy"}}
+	case "windows":
+		cmds = [][]string{{"clip"}}
+	default:
+		cmds = [][]string{
+			{"wl-copy"},
+			{"xclip", "-selection", "clipboard"},
+			{"xsel", "--clipboard", "--input"},
+		}
+		if os.Getenv("WAYLAND_DISPLAY") == "" {
+			cmds = cmds[1:]
+		}
+	}
+	for _, args := range cmds {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			continue
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		return cmd.Run()
+	}
+	return errors.New("no clipboard command found")
+}
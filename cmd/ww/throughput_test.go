@@ -0,0 +1,95 @@
+// +build !lite
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"webwormhole.io/wormhole"
+)
+
+// connect connects two peers through a signalling server of our own, over
+// loopback, with dialers set up by config. The caller calls done once
+// it's through with them.
+func connect(tb testing.TB, config func(d *wormhole.Dialer)) (a, z *wormhole.Conn, done func()) {
+	log.SetOutput(ioutil.Discard)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/s/", relay)
+	srv := httptest.NewServer(mux)
+	teardown := func() {
+		srv.Close()
+		log.SetOutput(os.Stderr)
+	}
+	da := &wormhole.Dialer{SignalServer: srv.URL}
+	dz := &wormhole.Dialer{SignalServer: srv.URL}
+	config(da)
+	config(dz)
+	slotc := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		var err error
+		a, err = da.Wormhole("pass", slotc)
+		errc <- err
+	}()
+	z, err := dz.Dial(<-slotc, "pass")
+	if err != nil {
+		teardown()
+		tb.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		z.Close()
+		teardown()
+		tb.Fatal(err)
+	}
+	return a, z, func() {
+		a.Close()
+		z.Close()
+		teardown()
+	}
+}
+
+// BenchmarkThroughput sends over loopback in messages of each size, with
+// writes going on once the buffer's drained to each low threshold: as soon
+// as it's below full, as it used to, or the default.
+func BenchmarkThroughput(b *testing.B) {
+	for _, chunk := range []int{32 << 10, wormhole.MaxMessage} {
+		for _, low := range []int{wormhole.MaxBufferSize, 0} {
+			b.Run(fmt.Sprintf("chunk=%d/low=%d", chunk, low), func(b *testing.B) {
+				a, z, closeAll := connect(b, func(d *wormhole.Dialer) { d.BufferLowThreshold = low })
+				defer closeAll()
+				const total = 64 << 20
+				done := make(chan error)
+				go func() {
+					buf := make([]byte, wormhole.MaxMessage)
+					var err error
+					for n := int64(0); n < int64(b.N)*total && err == nil; {
+						var k int
+						k, err = z.Read(buf)
+						n += int64(k)
+					}
+					done <- err
+				}()
+				b.SetBytes(total)
+				b.ResetTimer()
+				p := make([]byte, chunk)
+				for i := 0; i < b.N; i++ {
+					for n := 0; n < total; n += chunk {
+						if _, err := a.Write(p); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+				if err := <-done; err != nil && err != io.EOF {
+					b.Fatal(err)
+				}
+			})
+		}
+	}
+}
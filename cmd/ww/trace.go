@@ -0,0 +1,196 @@
+package main
+
+// A minimal OpenTelemetry tracer that exports spans as OTLP/HTTP JSON, so
+// operators can see where time goes in slow handshakes using any collector.
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type tracer struct {
+	endpoint string
+	service  string
+
+	mu    sync.Mutex // Guards spans.
+	spans []otlpSpan
+}
+
+type span struct {
+	t       *tracer
+	name    string
+	traceID string
+	id      string
+	parent  string
+	start   time.Time
+	attrs   []otlpAttr // Guarded by t.mu.
+	ended   bool       // Guarded by t.mu.
+}
+
+type otlpAttr struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+// newTracer returns a tracer exporting to the OTLP/HTTP collector at
+// endpoint, e.g. http://localhost:4318. It returns nil if endpoint is empty.
+// All methods are no-ops on a nil tracer and nil spans.
+func newTracer(endpoint, service string) *tracer {
+	if endpoint == "" {
+		return nil
+	}
+	return &tracer{
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service:  service,
+	}
+}
+
+func randhex(n int) string {
+	buf := make([]byte, n)
+	crand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// start begins a span. Its parent is either parent, or if that's nil, the
+// span referred to by traceparent, a W3C Trace Context header.
+func (t *tracer) start(name string, parent *span, traceparent string) *span {
+	if t == nil {
+		return nil
+	}
+	s := &span{t: t, name: name, id: randhex(8), start: time.Now()}
+	if parent != nil {
+		s.traceID, s.parent = parent.traceID, parent.id
+	} else if p := strings.Split(traceparent, "-"); len(p) == 4 && len(p[1]) == 32 && len(p[2]) == 16 {
+		s.traceID, s.parent = p[1], p[2]
+	} else {
+		s.traceID = randhex(16)
+	}
+	return s
+}
+
+func (s *span) set(key, value string) {
+	if s == nil {
+		return
+	}
+	a := otlpAttr{Key: key}
+	a.Value.StringValue = value
+	s.t.mu.Lock()
+	s.attrs = append(s.attrs, a)
+	s.t.mu.Unlock()
+}
+
+// end ends the span. Only the first call has any effect.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.ended = true
+	o := otlpSpan{
+		TraceID:      s.traceID,
+		SpanID:       s.id,
+		ParentSpanID: s.parent,
+		Name:         s.name,
+		Kind:         1, // Internal.
+		Start:        strconv.FormatInt(s.start.UnixNano(), 10),
+		End:          strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:   s.attrs,
+	}
+	if err != nil {
+		o.Status.Code = 2
+		o.Status.Message = err.Error()
+	}
+	s.t.spans = append(s.t.spans, o)
+}
+
+// traceparent returns the W3C Trace Context header referring to s.
+func (s *span) traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + s.traceID + "-" + s.id + "-01"
+}
+
+// flush sends finished spans to the collector.
+func (t *tracer) flush() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	service := otlpAttr{Key: "service.name"}
+	service.Value.StringValue = t.service
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttr{service}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "webwormhole.io/cmd/ww"}, Spans: spans}},
+	}}}
+
+	buf, err := json.Marshal(req)
+	if err != nil {
+		log.Printf("could not encode spans: %v", err)
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(t.endpoint, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		log.Printf("could not export spans: %v", err)
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+
+	"webwormhole.io/wormhole"
+)
+
+// Senders since wormhole.MinTrailer follow every file, text messages and
+// archives included, with a message of its wormhole.Trailer. Receivers
+// check it before they count the file done.
+
+// trailed reports whether files on c are followed by trailers.
+func trailed(c *wormhole.Conn) bool {
+	return c.PeerVersion() >= wormhole.MinTrailer
+}
+
+// A digestMeter is a meter that's told the digest of each file received,
+// once it's checked, before it's done.
+type digestMeter interface {
+	digested(sum string)
+}
+
+func (ms meters) digested(sum string) {
+	for _, m := range ms {
+		if dm, ok := m.(digestMeter); ok {
+			dm.digested(sum)
+		}
+	}
+}
+
+// sendTrailer follows the file just sent over c, the digest of which is
+// sum, with its trailer, if the peer expects one.
+func sendTrailer(c *wormhole.Conn, sum []byte) error {
+	if !trailed(c) {
+		return nil
+	}
+	t, err := c.NewTrailer(sum)
+	if err != nil {
+		return transferErrorf(exitFailure, "could not make trailer: %v", err)
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Write(b); err != nil {
+		return transferErrorf(exitNetwork, "could not send trailer: %v", err)
+	}
+	return nil
+}
+
+// sendChanged follows filename, just sent over c, with a trailer saying it
+// changed while it was being sent. Peers since wormhole.MinChanged drop it
+// and go on to the next file, and it's up to m to say so. Older ones can't,
+// so that ends the transfer.
+func sendChanged(c *wormhole.Conn, filename string, m meter) error {
+	t, err := c.ChangedTrailer()
+	if err != nil {
+		return transferErrorf(exitFailure, "could not make trailer: %v", err)
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Write(b); err != nil {
+		return transferErrorf(exitNetwork, "could not send trailer: %v", err)
+	}
+	if c.PeerVersion() < wormhole.MinChanged {
+		return transferErrorf(exitDisk, "%s changed while sending it", filename)
+	}
+	if dm, ok := m.(droppedMeter); ok {
+		dm.dropped("changed while sending, dropped")
+	}
+	return nil
+}
+
+// checkTrailer reads the trailer of the file called name just received
+// over c, if the peer sends them, checks it against sum, the digest of
+// what was received, and tells m. It returns errChanged if the sender says
+// the file changed while it was being sent.
+func checkTrailer(c *wormhole.Conn, name string, sum []byte, m meter, buf []byte) error {
+	if !trailed(c) {
+		return nil
+	}
+	n, err := c.Read(buf)
+	if err != nil {
+		return transferErrorf(exitNetwork, "could not read the hash of %s: %v", name, err)
+	}
+	var t wormhole.Trailer
+	if err := json.Unmarshal(buf[:n], &t); err != nil {
+		return transferErrorf(exitFailure, "could not decode the hash of %s: %v", name, err)
+	}
+	if t.Changed {
+		return errChanged
+	}
+	if err := c.CheckTrailer(&t, sum); err == wormhole.ErrDigestMismatch {
+		return transferErrorf(exitFailure, "%s does not match the hash the sender sent", name)
+	} else if err != nil {
+		return transferErrorf(exitFailure, "could not check the hash of %s: %v", name, err)
+	}
+	if dm, ok := m.(digestMeter); ok {
+		dm.digested(hex.EncodeToString(sum))
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+// +build tray
+
+package main
+
+// This is ww tray, an icon in the system tray, or menu bar, for sending
+// files quickly. Like ww tui, it drives the daemon through its API, so the
+// daemon has to be running. Its menu sends files picked with the desktop's
+// own dialog, and each send pops up a window, in the browser, with the
+// code, a QR code of the link to it, and how the transfer's going. Tray
+// icons don't take files dropped on them on most desktops, so files given
+// as arguments, as desktops do when they're dropped on a launcher for ww
+// tray, are sent as it starts.
+//
+// It runs on Linux, with a desktop that shows StatusNotifierItems, macOS,
+// where it needs cgo, and Windows, so it's only built with -tags tray.
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"fyne.io/systray"
+	"rsc.io/qr"
+)
+
+func init() {
+	subcmds["tray"] = tray
+}
+
+func tray(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "send files from an icon in the system tray, through the daemon\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s [file]...\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "files given are sent as it starts, e.g. when dropped on a launcher for it.\n")
+		fmt.Fprintf(set.Output(), "links to the codes are to the web client on -signal.\n\n")
+		fmt.Fprintf(set.Output(), "flags:\n")
+		set.PrintDefaults()
+	}
+	httpaddr := set.String("http", "localhost:7796", "address of the daemon's API")
+	socket := set.String("socket", "", "talk to the daemon on this unix socket instead of -http")
+	windows := set.String("window", "localhost:0", "http listen address for the windows showing codes")
+	length := set.Int("length", 2, "length of generated secrets")
+	set.Parse(args[1:])
+
+	dc := newDaemonClient(*httpaddr, *socket)
+	var list []transferStatus
+	if err := dc.do(http.MethodGet, "/transfers", nil, &list); err != nil {
+		exitf(exitNetwork, "could not reach the daemon, is ww daemon running? %v", err)
+	}
+	l, err := net.Listen("tcp", *windows)
+	if err != nil {
+		fatalf("could not listen: %v", err)
+	}
+	// The windows show codes, so they're behind a path only we know.
+	prefix := "/" + trayToken() + "/"
+	go http.Serve(l, trayHandler(dc, prefix))
+	ts := &traySender{dc: dc, base: "http://" + l.Addr().String() + prefix, length: *length}
+	if set.NArg() > 0 {
+		go ts.send(set.Args())
+	}
+
+	systray.Run(func() {
+		systray.SetIcon(trayIcon())
+		systray.SetTooltip("webwormhole")
+		send := systray.AddMenuItem("Send files…", "pick files to send")
+		systray.AddSeparator()
+		quit := systray.AddMenuItem("Quit", "")
+		go func() {
+			for {
+				select {
+				case <-send.ClickedCh:
+					go func() {
+						files, err := pickFiles()
+						if err != nil {
+							ts.fail(err)
+							return
+						}
+						if len(files) > 0 {
+							ts.send(files)
+						}
+					}()
+				case <-quit.ClickedCh:
+					systray.Quit()
+					return
+				}
+			}
+		}()
+	}, nil)
+}
+
+// trayToken returns a random token for the windows' paths.
+func trayToken() string {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		fatalf("could not make token: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// traySender sends files through the daemon, and pops up a window for
+// each send under base.
+type traySender struct {
+	dc     *daemonClient
+	base   string
+	length int
+}
+
+func (ts *traySender) send(files []string) {
+	for i, f := range files {
+		// The daemon's working directory needn't be ours.
+		if abs, err := filepath.Abs(f); err == nil {
+			files[i] = abs
+		}
+	}
+	var t transferStatus
+	req := map[string]interface{}{"files": files, "length": ts.length}
+	if err := ts.dc.do(http.MethodPost, "/send", req, &t); err != nil {
+		ts.fail(err)
+		return
+	}
+	if err := openFile(ts.base + "t/" + url.PathEscape(t.ID) + "/"); err != nil {
+		ts.fail(err)
+	}
+}
+
+// fail says why a send didn't start, where the icon's tooltip can show it
+// and in the log.
+func (ts *traySender) fail(err error) {
+	log.Printf("could not send: %v", err)
+	systray.SetTooltip("webwormhole: could not send: " + err.Error())
+}
+
+// pickFiles asks for files to send with the desktop's dialog. Picking none
+// isn't an error.
+func pickFiles() ([]string, error) {
+	var cmds [][]string
+	switch runtime.GOOS {
+	case "darwin":
+		cmds = [][]string{{"osascript",
+			"-e", "set picked to choose file with prompt \"Send files\" with multiple selections allowed",
+			"-e", "set paths to \"\"",
+			"-e", "repeat with f in picked",
+			"-e", "set paths to paths & POSIX path of f & linefeed",
+			"-e", "end repeat",
+			"-e", "return paths"}}
+	case "windows":
+		cmds = [][]string{{"powershell", "-NoProfile", "-Command",
+			"Add-Type -AssemblyName System.Windows.Forms;" +
+				"$d = New-Object System.Windows.Forms.OpenFileDialog;" +
+				"$d.Title = 'Send files'; $d.Multiselect = $true;" +
+				"if ($d.ShowDialog() -eq 'OK') { $d.FileNames }"}}
+	default:
+		cmds = [][]string{
+			{"zenity", "--file-selection", "--title=Send files", "--multiple", "--separator=\n"},
+			{"kdialog", "--title", "Send files", "--getopenfilename", "--multiple", "--separate-output"},
+		}
+	}
+	for _, cmd := range cmds {
+		if _, err := exec.LookPath(cmd[0]); err != nil {
+			continue
+		}
+		out, err := exec.Command(cmd[0], cmd[1:]...).Output()
+		if _, ok := err.(*exec.ExitError); ok {
+			// Cancelled.
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, f := range strings.Split(string(out), "\n") {
+			if f = strings.TrimSpace(f); f != "" {
+				files = append(files, f)
+			}
+		}
+		return files, nil
+	}
+	return nil, fmt.Errorf("no file dialog, install zenity or kdialog, or drop files on a launcher for ww tray")
+}
+
+// trayWindow is the page of a window showing a send's code. It follows the
+// transfer until it's over.
+var trayWindow = template.Must(template.New("").Parse(`<!doctype html>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width">
+<title>{{.Code}} - webwormhole</title>
+<style>
+body { font-family: sans-serif; text-align: center; margin: 2em; }
+#code { font-family: monospace; font-size: 2em; }
+</style>
+<p id="code">{{.Code}}</p>
+<p><img src="qr.png" width="256" height="256" alt="QR code of the link"></p>
+<p><a href="{{.Link}}">{{.Link}}</a></p>
+<p id="state">{{.State}}</p>
+<p><button id="cancel">Cancel</button></p>
+<script>
+let over = ["done", "failed", "cancelled"];
+let poll = async () => {
+	let t = await (await fetch("status")).json();
+	let n = 0, size = 0;
+	for (let f of t.files || []) {
+		n += f.bytes;
+		size += f.size;
+	}
+	let state = t.state;
+	if (t.state === "transferring" && size > 0) {
+		state += " " + Math.floor(100*n/size) + "%";
+	}
+	if (t.error) {
+		state += ": " + t.error;
+	}
+	document.getElementById("state").textContent = state;
+	if (over.includes(t.state)) {
+		document.getElementById("cancel").hidden = true;
+		return;
+	}
+	setTimeout(poll, 1000);
+};
+poll();
+document.getElementById("cancel").onclick = () => {
+	fetch("cancel", {method: "POST", headers: {"Content-Type": "application/json"}, body: "{}"});
+};
+</script>
+`))
+
+// trayHandler serves the windows for the daemon's transfers under prefix:
+// prefix/t/<id>/ is the window, with its status, qr.png, and cancel, which
+// cancels it, next to it.
+func trayHandler(dc *daemonClient, prefix string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix+"t/", func(w http.ResponseWriter, r *http.Request) {
+		if !local(w, r) {
+			return
+		}
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, prefix+"t/"), "/", 2)
+		if len(parts) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		id, what := parts[0], parts[1]
+		var t transferStatus
+		if err := dc.do(http.MethodGet, "/transfers/"+url.PathEscape(id), nil, &t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		link, _ := webLink(t.Code)
+		switch what {
+		case "":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			trayWindow.Execute(w, struct{ Code, Link, State string }{t.Code, link, t.State})
+		case "status":
+			writeJSON(w, http.StatusOK, t)
+		case "qr.png":
+			code, err := qr.Encode(link, qr.L)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(code.PNG())
+		case "cancel":
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if err := dc.do(http.MethodDelete, "/transfers/"+url.PathEscape(id), nil, &t); err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			writeJSON(w, http.StatusOK, t)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	return mux
+}
+
+// trayIcon draws the icon, a ring, as a PNG, or on Windows as an ICO with
+// the PNG in it.
+func trayIcon() []byte {
+	const size = 32
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	ink := color.NRGBA{0x20, 0x20, 0x20, 0xff}
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			dx, dy := 2*x+1-size, 2*y+1-size
+			if d := dx*dx + dy*dy; d <= 30*30 && d >= 18*18 {
+				img.Set(x, y, ink)
+			}
+		}
+	}
+	var b bytes.Buffer
+	png.Encode(&b, img)
+	if runtime.GOOS != "windows" {
+		return b.Bytes()
+	}
+	var ico bytes.Buffer
+	binary.Write(&ico, binary.LittleEndian, []uint16{0, 1, 1}) // An icon, of one image.
+	ico.Write([]byte{size, size, 0, 0})
+	binary.Write(&ico, binary.LittleEndian, []uint16{1, 32})
+	binary.Write(&ico, binary.LittleEndian, []uint32{uint32(b.Len()), 6 + 16})
+	ico.Write(b.Bytes())
+	return ico.Bytes()
+}
@@ -0,0 +1,17 @@
+// +build !tray
+
+package main
+
+import "os"
+
+func init() {
+	subcmds["tray"] = tray
+}
+
+// tray says how to get ww tray, for builds without it.
+func tray(args ...string) {
+	if len(args) > 1 && (args[1] == "-h" || args[1] == "-help" || args[1] == "--help") {
+		os.Exit(exitUsage)
+	}
+	exitf(exitUsage, "this ww was built without ww tray, build it with -tags tray")
+}
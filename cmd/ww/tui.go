@@ -0,0 +1,508 @@
+package main
+
+// This is ww tui, a terminal UI for the daemon's transfers. It polls the
+// daemon's API for them, and starts and cancels them through it too, so
+// that whoever manages many transfers on a server can keep an eye on them
+// from a terminal over ssh.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func init() {
+	subcmds["tui"] = tui
+}
+
+// tuiLogLines is how many lines of the log the UI keeps.
+const tuiLogLines = 100
+
+// daemonClient talks to the daemon's API.
+type daemonClient struct {
+	base string
+	c    *http.Client
+}
+
+// newDaemonClient returns a client for the daemon listening on httpaddr, or
+// on socket if it's set.
+func newDaemonClient(httpaddr, socket string) *daemonClient {
+	transport := &http.Transport{}
+	base := "http://" + httpaddr
+	if socket != "" {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		base = "http://localhost"
+	}
+	// Starting a send waits for its code from the signalling server.
+	return &daemonClient{base, &http.Client{Transport: transport, Timeout: time.Minute}}
+}
+
+// do calls the API, decoding the response into v.
+func (dc *daemonClient) do(method, path string, req, v interface{}) error {
+	var body []byte
+	if req != nil {
+		var err error
+		if body, err = json.Marshal(req); err != nil {
+			return err
+		}
+	}
+	r, err := http.NewRequest(method, dc.base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if req != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := dc.c.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// tuiView is what the UI shows. Only the UI's loop touches it.
+type tuiView struct {
+	list     []transferStatus
+	selected string // ID of the selected transfer.
+	details  bool   // Show the files of the selected transfer.
+	active   bool   // Hide transfers that have ended.
+
+	// What the last poll saw, to work out rates and log changes.
+	seen  map[string]transferStatus
+	at    time.Time
+	rates map[string]float64
+
+	log []string
+
+	// prompt is what's being asked for, if anything, and input the answer
+	// so far.
+	prompt string
+	input  []rune
+}
+
+func newTUIView() *tuiView {
+	return &tuiView{seen: make(map[string]transferStatus), rates: make(map[string]float64)}
+}
+
+func (v *tuiView) logf(now time.Time, format string, args ...interface{}) {
+	v.log = append(v.log, now.Format("15:04:05")+" "+fmt.Sprintf(format, args...))
+	if len(v.log) > tuiLogLines {
+		v.log = v.log[len(v.log)-tuiLogLines:]
+	}
+}
+
+// transferred is how many bytes of t have been moved.
+func transferred(t transferStatus) (n, size int64) {
+	for _, f := range t.Files {
+		n += f.Bytes
+		size += f.Size
+	}
+	return n, size
+}
+
+// update takes a new list of transfers from the daemon, logging what
+// changed since the last one.
+func (v *tuiView) update(list []transferStatus, now time.Time) {
+	dt := now.Sub(v.at).Seconds()
+	for _, t := range list {
+		old, ok := v.seen[t.ID]
+		changed := ""
+		switch {
+		case !ok:
+			changed = t.Kind + " " + t.State
+		case old.State != t.State:
+			changed = t.State
+		}
+		if changed != "" && t.Error != "" {
+			changed += ": " + t.Error
+		}
+		if changed != "" {
+			v.logf(now, "%s %s", t.ID, changed)
+		}
+		if ok && old.Code == "" && t.Code != "" {
+			v.logf(now, "%s code %s", t.ID, t.Code)
+		}
+		for _, msg := range t.Texts[len(old.Texts):] {
+			v.logf(now, "%s message: %s", t.ID, strings.Join(strings.Fields(msg), " "))
+		}
+		n, _ := transferred(t)
+		was, _ := transferred(old)
+		if ok && dt > 0 && t.State == stateTransferring {
+			// Smooth over the odd slow poll.
+			v.rates[t.ID] = 0.5*v.rates[t.ID] + 0.5*float64(n-was)/dt
+		} else {
+			v.rates[t.ID] = 0
+		}
+		v.seen[t.ID] = t
+	}
+	v.list, v.at = list, now
+	if v.index() < 0 && len(v.shown()) > 0 {
+		v.selected = v.shown()[0].ID
+	}
+}
+
+// shown are the transfers listed.
+func (v *tuiView) shown() []transferStatus {
+	if !v.active {
+		return v.list
+	}
+	var list []transferStatus
+	for _, t := range v.list {
+		if t.State != stateDone && t.State != stateFailed && t.State != stateCancelled {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+// index is where the selected transfer is in the list shown, or -1.
+func (v *tuiView) index() int {
+	for i, t := range v.shown() {
+		if t.ID == v.selected {
+			return i
+		}
+	}
+	return -1
+}
+
+// move moves the selection by n.
+func (v *tuiView) move(n int) {
+	list := v.shown()
+	if len(list) == 0 {
+		return
+	}
+	i := v.index() + n
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(list) {
+		i = len(list) - 1
+	}
+	v.selected = list[i].ID
+}
+
+// render lays the view out in lines of at most width runes, and at most
+// height of them.
+func (v *tuiView) render(width, height int) []string {
+	counts := make(map[string]int)
+	var total float64
+	for _, t := range v.list {
+		counts[t.State]++
+		total += v.rates[t.ID]
+	}
+	lines := []string{
+		fmt.Sprintf("ww tui: %d transferring, %d waiting, %d done, %d failed, %s",
+			counts[stateTransferring], counts[stateWaiting]+counts[stateConnecting],
+			counts[stateDone], counts[stateFailed]+counts[stateCancelled], formatRate(total)),
+		"",
+		fmt.Sprintf("  %-16s %-7s %-12s %-24s %-24s %-14s %s", "ID", "KIND", "STATE", "CODE", "PROGRESS", "RATE", "ROUTE"),
+	}
+	list := v.shown()
+	if len(list) == 0 {
+		lines = append(lines, "  no transfers, press s to send or r to receive")
+	}
+	for _, t := range list {
+		mark := " "
+		if t.ID == v.selected {
+			mark = ">"
+		}
+		n, size := transferred(t)
+		progress := formatSize(n)
+		if size > 0 {
+			progress = fmt.Sprintf("%3d%% of %s", n*100/size, formatSize(size))
+		}
+		rate := ""
+		if t.State == stateTransferring {
+			rate = formatRate(v.rates[t.ID])
+		}
+		lines = append(lines, fmt.Sprintf("%s %-16s %-7s %-12s %-24s %-24s %-14s %s",
+			mark, t.ID, t.Kind, t.State, t.Code, progress, rate, t.Route))
+		if !v.details || t.ID != v.selected {
+			continue
+		}
+		for _, f := range t.Files {
+			line := fmt.Sprintf("      %s  %s of %s", f.Name, formatSize(f.Bytes), formatSize(f.Size))
+			if f.LimitedBy != "" {
+				line += ", limited by " + f.LimitedBy
+			}
+			lines = append(lines, line)
+		}
+		if t.Error != "" {
+			lines = append(lines, "      "+t.Error)
+		}
+	}
+
+	footer := "s send  t text  r receive  x cancel  enter details  a active only  q quit"
+	if v.prompt != "" {
+		footer = v.prompt + ": " + string(v.input)
+	}
+	// The log gets what room is left, with its newest lines.
+	room := height - len(lines) - 3
+	if room > 0 {
+		lines = append(lines, "", "log:")
+		log := v.log
+		if len(log) > room-1 {
+			log = log[len(log)-(room-1):]
+		}
+		lines = append(lines, log...)
+	}
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+	if len(lines) > height-1 {
+		lines = lines[:height-1]
+	}
+	lines = append(lines, footer)
+	for i, l := range lines {
+		// Names, messages and errors come from the peer, and mustn't get
+		// to move the cursor around.
+		l = strings.Map(func(r rune) rune {
+			if r < 0x20 || r >= 0x7f && r < 0xa0 {
+				return '?'
+			}
+			return r
+		}, l)
+		if utf8.RuneCountInString(l) > width {
+			l = string([]rune(l)[:width])
+		}
+		lines[i] = l
+	}
+	return lines
+}
+
+// parseKeys splits what was read from the terminal into keys: the runes
+// typed, or the names of the special keys the UI uses.
+func parseKeys(b []byte) []string {
+	var keys []string
+	for len(b) > 0 {
+		switch {
+		case bytes.HasPrefix(b, []byte("\x1b[A")), bytes.HasPrefix(b, []byte("\x1bOA")):
+			keys, b = append(keys, "up"), b[3:]
+		case bytes.HasPrefix(b, []byte("\x1b[B")), bytes.HasPrefix(b, []byte("\x1bOB")):
+			keys, b = append(keys, "down"), b[3:]
+		case bytes.HasPrefix(b, []byte("\x1b[")):
+			// Some other escape sequence, up to its final byte.
+			i := 2
+			for i < len(b) && (b[i] < 0x40 || b[i] > 0x7e) {
+				i++
+			}
+			if i < len(b) {
+				i++
+			}
+			b = b[i:]
+		case b[0] == 0x1b:
+			keys, b = append(keys, "esc"), b[1:]
+		case b[0] == '\r' || b[0] == '\n':
+			keys, b = append(keys, "enter"), b[1:]
+		case b[0] == 0x7f || b[0] == '\b':
+			keys, b = append(keys, "backspace"), b[1:]
+		case b[0] == 0x03:
+			keys, b = append(keys, "ctrl-c"), b[1:]
+		default:
+			r, n := utf8.DecodeRune(b)
+			if r >= ' ' {
+				keys = append(keys, string(r))
+			}
+			b = b[n:]
+		}
+	}
+	return keys
+}
+
+func tui(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "watch, start and cancel the daemon's transfers from a terminal\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "flags:\n")
+		set.PrintDefaults()
+	}
+	httpaddr := set.String("http", "localhost:7796", "address of the daemon's API")
+	socket := set.String("socket", "", "talk to the daemon on this unix socket instead of -http")
+	set.Parse(args[1:])
+	if set.NArg() > 0 {
+		set.Usage()
+		os.Exit(exitUsage)
+	}
+	in, out := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	if !terminal.IsTerminal(in) || !terminal.IsTerminal(out) {
+		exitf(exitUsage, "ww tui needs a terminal")
+	}
+
+	dc := newDaemonClient(*httpaddr, *socket)
+	var list []transferStatus
+	if err := dc.do(http.MethodGet, "/transfers", nil, &list); err != nil {
+		exitf(exitNetwork, "could not reach the daemon, is ww daemon running? %v", err)
+	}
+
+	old, err := terminal.MakeRaw(in)
+	if err != nil {
+		fatalf("could not set up the terminal: %v", err)
+	}
+	// Draw on the alternate screen, without a cursor, and put things back
+	// on the way out.
+	fmt.Print("\033[?1049h\033[?25l")
+	onexit(func() {
+		fmt.Print("\033[?25h\033[?1049l")
+		terminal.Restore(in, old)
+	})
+
+	keys := make(chan []string)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- parseKeys(buf[:n])
+		}
+	}()
+	// Requests that start or cancel transfers can take a while, so they
+	// run on their own, and say how it went here.
+	results := make(chan string, 8)
+	request := func(what, method, path string, req interface{}) {
+		go func() {
+			var st transferStatus
+			if err := dc.do(method, path, req, &st); err != nil {
+				results <- fmt.Sprintf("could not %s: %v", what, err)
+				return
+			}
+			if st.Code != "" && method == http.MethodPost {
+				results <- fmt.Sprintf("%s %s with code %s", st.ID, what, st.Code)
+			}
+		}()
+	}
+
+	v := newTUIView()
+	v.update(list, time.Now())
+	tick := time.NewTicker(500 * time.Millisecond)
+	defer tick.Stop()
+	draw := func() {
+		width, height, err := terminal.GetSize(out)
+		if err != nil || width <= 0 || height <= 0 {
+			width, height = 80, 24
+		}
+		// In raw mode, lines need a carriage return too.
+		fmt.Print("\033[H" + strings.Join(v.render(width, height), "\033[K\r\n") + "\033[K\033[J")
+	}
+	for {
+		draw()
+		select {
+		case <-tick.C:
+			if err := dc.do(http.MethodGet, "/transfers", nil, &list); err != nil {
+				v.logf(time.Now(), "could not list transfers: %v", err)
+				continue
+			}
+			v.update(list, time.Now())
+		case msg := <-results:
+			v.logf(time.Now(), "%s", msg)
+		case ks, ok := <-keys:
+			if !ok {
+				return
+			}
+			for _, k := range ks {
+				if v.prompt != "" {
+					if err := v.answer(k, request); err != nil {
+						v.logf(time.Now(), "%v", err)
+					}
+					continue
+				}
+				switch k {
+				case "q", "ctrl-c":
+					return
+				case "up", "k":
+					v.move(-1)
+				case "down", "j":
+					v.move(1)
+				case "enter":
+					v.details = !v.details
+				case "a":
+					v.active = !v.active
+					v.move(0)
+				case "s":
+					v.prompt = "send files"
+				case "t":
+					v.prompt = "send text"
+				case "r":
+					v.prompt = "receive code"
+				case "x":
+					if v.index() >= 0 {
+						request("cancel", http.MethodDelete, "/transfers/"+v.selected, nil)
+					}
+				}
+			}
+		}
+	}
+}
+
+// answer handles key k typed at a prompt, starting a transfer with request
+// once it's answered.
+func (v *tuiView) answer(k string, request func(what, method, path string, req interface{})) error {
+	switch k {
+	case "esc", "ctrl-c":
+		v.prompt, v.input = "", nil
+		return nil
+	case "backspace":
+		if len(v.input) > 0 {
+			v.input = v.input[:len(v.input)-1]
+		}
+		return nil
+	case "enter":
+	default:
+		if utf8.RuneCountInString(k) == 1 {
+			v.input = append(v.input, []rune(k)...)
+		}
+		return nil
+	}
+	prompt, input := v.prompt, strings.TrimSpace(string(v.input))
+	v.prompt, v.input = "", nil
+	if input == "" {
+		return nil
+	}
+	switch prompt {
+	case "send files":
+		// The daemon may run elsewhere in the filesystem.
+		files := strings.Fields(input)
+		for i, f := range files {
+			if isRemote(f) {
+				continue
+			}
+			if _, err := os.Stat(f); err != nil {
+				return err
+			}
+			abs, err := filepath.Abs(f)
+			if err != nil {
+				return err
+			}
+			files[i] = abs
+		}
+		request("send", http.MethodPost, "/send", map[string]interface{}{"files": files})
+	case "send text":
+		request("send", http.MethodPost, "/send", map[string]interface{}{"text": input})
+	case "receive code":
+		request("receive", http.MethodPost, "/receive", map[string]interface{}{"code": input})
+	}
+	return nil
+}
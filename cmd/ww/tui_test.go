@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseKeys(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []string
+	}{
+		{"q", []string{"q"}},
+		{"\x1b[A\x1b[Bj", []string{"up", "down", "j"}},
+		{"\x1bOA", []string{"up"}},
+		{"\x1b", []string{"esc"}},
+		{"\x1b[1;5C\r", []string{"enter"}},
+		{"é\x7f\x03", []string{"é", "backspace", "ctrl-c"}},
+		{"\x01", nil},
+	}
+	for _, c := range cases {
+		if got := parseKeys([]byte(c.in)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("testcase %q got %q want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestTUIRender(t *testing.T) {
+	v := newTUIView()
+	v.logf(v.at, "message: \x1b[2Jhi")
+	for _, height := range []int{1, 5, 40} {
+		lines := v.render(30, height)
+		if len(lines) != height {
+			t.Errorf("testcase %v got %v lines want %v", height, len(lines), height)
+		}
+		for _, l := range lines {
+			if len([]rune(l)) > 30 || strings.ContainsRune(l, 0x1b) {
+				t.Errorf("testcase %v got line %q", height, l)
+			}
+		}
+	}
+}
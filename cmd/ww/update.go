@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// updateKey is the minisign public key release binaries are signed with,
+// set at build time with -ldflags "-X main.updateKey=RW...". Builds without
+// one refuse to update themselves. The trusted comment of each signature
+// names the binary and its version, e.g. "ww v1.2.3 ww-linux-amd64", so
+// that a signed binary for another platform, or an older one, can't be
+// passed off as the update.
+var updateKey = ""
+
+func update(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "replace this binary with the latest signed release\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "flags:\n")
+		set.PrintDefaults()
+	}
+	releases := set.String("releases", "https://github.com/saljam/webwormhole/releases/latest/download/", "where to fetch releases from")
+	set.Parse(args[1:])
+	if set.NArg() != 0 {
+		set.Usage()
+		os.Exit(exitUsage)
+	}
+	if updateKey == "" {
+		fatalf("this build of ww has no update key, update it the way you installed it")
+	}
+	pk, keyid, err := parseMinisignKey(updateKey)
+	if err != nil {
+		fatalf("bad update key: %v", err)
+	}
+	current := parseVersion(version)
+	if current == nil {
+		fatalf("this build of ww has no version to update from, update it the way you installed it")
+	}
+
+	name := "ww-" + runtime.GOOS + "-" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	bin, err := fetch(*releases + name)
+	if err != nil {
+		exitf(exitNetwork, "could not download update: %v", err)
+	}
+	sig, err := fetch(*releases + name + ".minisig")
+	if err != nil {
+		exitf(exitNetwork, "could not download signature: %v", err)
+	}
+	comment, err := verifyMinisign(pk, keyid, bin, sig)
+	if err != nil {
+		exitf(exitAuth, "could not verify update: %v", err)
+	}
+	latest, err := releaseOf(comment, name)
+	if err != nil {
+		exitf(exitAuth, "could not verify update: %v", err)
+	}
+	if !newer(parseVersion(latest), current) {
+		if !newer(current, parseVersion(latest)) {
+			fmt.Fprintf(set.Output(), "already up to date: %s\n", version)
+			return
+		}
+		exitf(exitAuth, "could not verify update: it's %s, older than this one, %s", latest, version)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		fatalf("could not find executable: %v", err)
+	}
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		fatalf("could not find executable: %v", err)
+	}
+	if err := replace(exe, bin); err != nil {
+		exitf(exitDisk, "could not replace %s: %v", exe, err)
+	}
+	fmt.Fprintf(set.Output(), "updated %s: %s\n", exe, comment)
+}
+
+func fetch(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// replace atomically replaces the file at path with contents, by renaming a
+// temporary file in the same directory over it.
+func replace(path string, contents []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".ww-update-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0755); err != nil {
+		return err
+	}
+	if runtime.GOOS != "windows" {
+		return os.Rename(f.Name(), path)
+	}
+	// Windows won't replace a running executable, but it will rename it,
+	// and back again if the new one can't take its place.
+	os.Remove(path + ".old")
+	if err := os.Rename(path, path+".old"); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Rename(path+".old", path)
+		return err
+	}
+	return nil
+}
+
+// releaseOf returns the version a signature's trusted comment gives, having
+// checked it's for the binary called name. Comments list both among their
+// fields, e.g. "ww v1.2.3 ww-linux-amd64", or with minisign's own
+// "file:ww-linux-amd64".
+func releaseOf(comment, name string) (string, error) {
+	var v string
+	named := false
+	for _, f := range strings.Fields(comment) {
+		switch {
+		case f == name || f == "file:"+name:
+			named = true
+		case parseVersion(f) != nil:
+			v = f
+		}
+	}
+	if !named {
+		return "", fmt.Errorf("it isn't %s, but %q", name, comment)
+	}
+	if v == "" {
+		return "", fmt.Errorf("it doesn't say which version it is: %q", comment)
+	}
+	return v, nil
+}
+
+// parseVersion parses a version like v1.2.3, and returns nil if it isn't
+// one.
+func parseVersion(s string) []int {
+	if !strings.HasPrefix(s, "v") {
+		return nil
+	}
+	var v []int
+	for _, n := range strings.Split(s[1:], ".") {
+		i, err := strconv.Atoi(n)
+		if err != nil || i < 0 || n != strconv.Itoa(i) {
+			return nil
+		}
+		v = append(v, i)
+	}
+	return v
+}
+
+// newer reports whether version a is newer than b, missing numbers being
+// 0, as in v1.2 and v1.2.0.
+func newer(a, b []int) bool {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+// parseMinisignKey decodes a minisign public key, as found on the second
+// line of a minisign.pub file.
+func parseMinisignKey(s string) (pk ed25519.PublicKey, keyid []byte, err error) {
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(buf) != 2+8+ed25519.PublicKeySize || string(buf[:2]) != "Ed" {
+		return nil, nil, errors.New("not a minisign ed25519 public key")
+	}
+	return ed25519.PublicKey(buf[10:]), buf[2:10], nil
+}
+
+// verifyMinisign checks a minisign signature file over msg, and returns its
+// trusted comment. Both legacy and prehashed signatures are accepted.
+func verifyMinisign(pk ed25519.PublicKey, keyid, msg, sigfile []byte) (comment string, err error) {
+	lines := strings.Split(strings.TrimSpace(string(sigfile)), "\n")
+	if len(lines) != 4 {
+		return "", errors.New("malformed signature file")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil {
+		return "", err
+	}
+	if len(sig) != 2+8+ed25519.SignatureSize {
+		return "", errors.New("malformed signature")
+	}
+	if !bytes.Equal(sig[2:10], keyid) {
+		return "", errors.New("signed with a different key")
+	}
+	switch string(sig[:2]) {
+	case "Ed":
+	case "ED":
+		h := blake2b.Sum512(msg)
+		msg = h[:]
+	default:
+		return "", errors.New("unknown signature algorithm")
+	}
+	if !ed25519.Verify(pk, msg, sig[10:]) {
+		return "", errors.New("bad signature")
+	}
+	const prefix = "trusted comment: "
+	if !strings.HasPrefix(lines[2], prefix) {
+		return "", errors.New("malformed trusted comment")
+	}
+	comment = strings.TrimSpace(lines[2][len(prefix):])
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil {
+		return "", err
+	}
+	if !ed25519.Verify(pk, append(sig[10:], comment...), global) {
+		return "", errors.New("bad trusted comment signature")
+	}
+	return comment, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisign signs msg the way minisign -S does, optionally prehashing.
+func minisign(sk ed25519.PrivateKey, keyid []byte, msg []byte, prehash bool, comment string) []byte {
+	alg := "Ed"
+	if prehash {
+		alg = "ED"
+		h := blake2b.Sum512(msg)
+		msg = h[:]
+	}
+	sig := append(append([]byte(alg), keyid...), ed25519.Sign(sk, msg)...)
+	global := ed25519.Sign(sk, append(append([]byte{}, sig[10:]...), comment...))
+	return []byte("untrusted comment: test\n" +
+		base64.StdEncoding.EncodeToString(sig) + "\n" +
+		"trusted comment: " + comment + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n")
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyid := []byte("01234567")
+	pub, gotid, err := parseMinisignKey(base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyid...), pk...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("a binary")
+	cases := []struct {
+		msg   []byte
+		sig   []byte
+		keyid []byte
+		ok    bool
+	}{
+		{msg, minisign(sk, keyid, msg, false, "ww v1"), gotid, true},
+		{msg, minisign(sk, keyid, msg, true, "ww v1"), gotid, true},
+		{[]byte("another binary"), minisign(sk, keyid, msg, true, "ww v1"), gotid, false},
+		{msg, minisign(sk, keyid, msg, true, "ww v1"), []byte("76543210"), false},
+		{msg, []byte("garbage"), gotid, false},
+	}
+	for i := range cases {
+		comment, err := verifyMinisign(pub, cases[i].keyid, cases[i].msg, cases[i].sig)
+		if (err == nil) != cases[i].ok {
+			t.Errorf("testcase %v got %v want ok=%v", i, err, cases[i].ok)
+		}
+		if err == nil && comment != "ww v1" {
+			t.Errorf("testcase %v got comment %q want %q", i, comment, "ww v1")
+		}
+	}
+}
+
+func TestReleaseOf(t *testing.T) {
+	cases := []struct {
+		comment, name, want string
+	}{
+		{"ww v1.2.3 ww-linux-amd64", "ww-linux-amd64", "v1.2.3"},
+		{"timestamp:1600000000 file:ww-linux-amd64 v2.0", "ww-linux-amd64", "v2.0"},
+		{"ww v1.2.3 ww-darwin-amd64", "ww-linux-amd64", ""},
+		{"ww v1.2.3 ww-linux-amd64.minisig", "ww-linux-amd64", ""},
+		{"ww ww-linux-amd64", "ww-linux-amd64", ""},
+		{"ww v1.2.x ww-linux-amd64", "ww-linux-amd64", ""},
+	}
+	for _, c := range cases {
+		got, err := releaseOf(c.comment, c.name)
+		if got != c.want || (err == nil) != (c.want != "") {
+			t.Errorf("releaseOf(%q, %q) = %q, %v, want %q", c.comment, c.name, got, err, c.want)
+		}
+	}
+}
+
+func TestNewer(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"v1.2.4", "v1.2.3", true},
+		{"v1.10.0", "v1.9.0", true},
+		{"v2", "v1.9.9", true},
+		{"v1.2.3", "v1.2.3", false},
+		{"v1.2", "v1.2.0", false},
+		{"v1.2.3", "v1.2.4", false},
+		{"v1.2.3", "v2.0.0", false},
+	}
+	for _, c := range cases {
+		if got := newer(parseVersion(c.a), parseVersion(c.b)); got != c.want {
+			t.Errorf("newer(%v, %v) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
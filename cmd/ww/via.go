@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+// relayCredentials returns a temporary TURN username and password, valid
+// until expiry, derived from a secret shared with the relay. This is the
+// scheme of the TURN REST API draft, as used by coturn's use-auth-secret.
+func relayCredentials(secret string, expiry time.Time) (username, password string) {
+	username = strconv.FormatInt(expiry.Unix(), 10)
+	return username, relayPassword(secret, username)
+}
+
+// relayPassword returns the password that goes with username. Usernames
+// are the expiry, optionally followed by a colon and anything else, such
+// as a session ID.
+func relayPassword(secret, username string) string {
+	m := hmac.New(sha1.New, []byte(secret))
+	m.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(m.Sum(nil))
+}
+
+// relayExpiry returns when credentials with username expire.
+func relayExpiry(username string) (time.Time, error) {
+	if colon := strings.Index(username, ":"); colon >= 0 {
+		username = username[:colon]
+	}
+	expiry, err := strconv.ParseInt(username, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(expiry, 0), nil
+}
+
+// viaExpiry is how long credentials made up for -via are good for. The
+// relay checks them again whenever an allocation is refreshed, so they
+// need to outlast the transfer.
+const viaExpiry = 24 * time.Hour
+
+// viaServer returns a TURN URL for a relay of the user's own running ww
+// relay, given as [secret@]host[:port], with credentials derived from the
+// relay's secret. The secret defaults to $WW_RELAY_SECRET.
+func viaServer(via string) (string, error) {
+	secret := os.Getenv("WW_RELAY_SECRET")
+	if at := strings.LastIndex(via, "@"); at >= 0 {
+		secret, via = via[:at], via[at+1:]
+	}
+	if secret == "" {
+		return "", fmt.Errorf("no secret for %s: use secret@%s or set $WW_RELAY_SECRET", via, via)
+	}
+	if _, _, err := net.SplitHostPort(via); err != nil {
+		via = net.JoinHostPort(via, "3478")
+	}
+	if _, port, _ := net.SplitHostPort(via); port == "" {
+		return "", fmt.Errorf("bad relay address %q", via)
+	}
+	username, password := relayCredentials(secret, time.Now().Add(viaExpiry))
+	return "turn:" + username + ":" + password + "@" + via, nil
+}
+
+// iceServers returns the STUN and TURN servers to use: those in -ice,
+// unless -stun or -turn replace them, with -turn-credentials for TURN
+// servers without their own. With -via, the relay it names replaces any
+// TURN servers.
+func iceServers() []string {
+	var servers []string
+	for _, s := range strings.Split(*iceserv, ",") {
+		turn := strings.HasPrefix(s, "turn")
+		if s != "" && !(turn && *turnserv != "") && !(!turn && *stunserv != "") {
+			servers = append(servers, s)
+		}
+	}
+	servers = append(servers, withScheme(*stunserv, "stun:")...)
+	servers = append(servers, withScheme(*turnserv, "turn:")...)
+	if creds := turnCredentials(); creds != "" {
+		sep := strings.LastIndex(creds, ":")
+		if sep < 0 {
+			exitf(exitUsage, "bad -turn-credentials: want username:password")
+		}
+		for i := range servers {
+			servers[i] = wormhole.WithCredentials(servers[i], creds[:sep], creds[sep+1:])
+		}
+	}
+	if *via == "" {
+		return servers
+	}
+	relay, err := viaServer(*via)
+	if err != nil {
+		exitf(exitUsage, "bad -via: %v", err)
+	}
+	var picked []string
+	for _, s := range servers {
+		if s != "" && !strings.HasPrefix(s, "turn") {
+			picked = append(picked, s)
+		}
+	}
+	return append(picked, relay)
+}
+
+// withScheme splits the comma separated servers in list, giving those that
+// don't have one scheme.
+func withScheme(list, scheme string) []string {
+	var servers []string
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.HasPrefix(s, "stun:") && !strings.HasPrefix(s, "turn:") && !strings.HasPrefix(s, "turns:") {
+			s = scheme + s
+		}
+		servers = append(servers, s)
+	}
+	return servers
+}
@@ -0,0 +1,107 @@
+// +build !lite
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// webhooks posts slot lifecycle events to operator configured URLs.
+//
+// Each event is a JSON object like
+//
+//	{"event": "created", "slot": "7", "time": "2020-04-01T12:00:00Z"}
+//
+// where event is one of created, matched, expired, cancelled by the
+// booker, or tried when somebody else tries a slot whose peers are still
+// signalling. Slots in a namespace other than the shared one are given as
+// namespace/slot, split at the last slash, since slots never have one. If a
+// secret is set, the X-Webwormhole-Signature header carries "sha256="
+// followed by the hex HMAC-SHA256 of the body under the secret.
+type webhooks struct {
+	urls   []string
+	secret []byte
+	queue  chan []byte
+	client *http.Client
+}
+
+type hookEvent struct {
+	Event string    `json:"event"`
+	Slot  string    `json:"slot"`
+	Time  time.Time `json:"time"`
+}
+
+// hooks is the server's webhooks, if any.
+var hooks *webhooks
+
+// newWebhooks returns webhooks for a comma separated list of URLs, or nil if
+// there are none.
+func newWebhooks(urls, secret string) *webhooks {
+	if urls == "" {
+		return nil
+	}
+	w := &webhooks{
+		urls:   strings.Split(urls, ","),
+		secret: []byte(secret),
+		queue:  make(chan []byte, 256),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	go w.run()
+	return w
+}
+
+func (w *webhooks) sign(body []byte) string {
+	m := hmac.New(sha256.New, w.secret)
+	m.Write(body)
+	return "sha256=" + hex.EncodeToString(m.Sum(nil))
+}
+
+func (w *webhooks) run() {
+	for body := range w.queue {
+		for _, u := range w.urls {
+			req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+			if err != nil {
+				log.Printf("webhook %s: %v", u, err)
+				continue
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if len(w.secret) > 0 {
+				req.Header.Set("X-Webwormhole-Signature", w.sign(body))
+			}
+			resp, err := w.client.Do(req)
+			if err != nil {
+				log.Printf("webhook %s: %v", u, err)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				log.Printf("webhook %s: %s", u, resp.Status)
+			}
+		}
+	}
+}
+
+// notify queues an event. Events are dropped rather than slowing down
+// signalling if the hooks can't keep up.
+func (w *webhooks) notify(event, slot string) {
+	if w == nil {
+		return
+	}
+	body, err := json.Marshal(hookEvent{event, slot, time.Now().UTC()})
+	if err != nil {
+		return
+	}
+	select {
+	case w.queue <- body:
+	default:
+		log.Printf("webhook queue full, dropping %s event", event)
+	}
+}
@@ -0,0 +1,589 @@
+// Command ffi is libwebwormhole, the wormhole package as a C library, for
+// languages that can call into one, like Python with ctypes (see
+// webwormhole.py). Build it with
+//
+//	go build -buildmode=c-shared -o libwebwormhole.so ./ffi
+//
+// which writes the header, libwebwormhole.h, alongside.
+//
+// Wormholes are referred to by handles, which are positive. Functions that
+// return a handle or an int return -1 on error, and ww_error tells what it
+// was. Strings returned are the caller's, to free with ww_free. All calls
+// block until they're done, and are safe to make from several threads.
+//
+//	int h = ww_new("https://wrmhl.link/", "stun:stun.l.google.com:19302", 2);
+//	char *code = ww_code(h);
+//	printf("%s\n", code);
+//	ww_free(code);
+//	if (ww_wait(h) < 0 || ww_send_file(h, "file.txt") < 0) {
+//		char *err = ww_error(h);
+//		...
+//	}
+//	ww_close(h);
+//
+// and on the other side
+//
+//	int h = ww_dial("https://wrmhl.link/", "stun:stun.l.google.com:19302", code);
+//	char *path;
+//	while ((path = ww_receive_file(h, ".")) != NULL) {
+//		...
+//		ww_free(path);
+//	}
+//
+// Files go the way ww sends them, so either side can be ww, or the web
+// client.
+package main
+
+/*
+#include <stdlib.h>
+#include <stdint.h>
+*/
+import "C"
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"webwormhole.io/wordlist"
+	"webwormhole.io/wormhole"
+)
+
+// msgChunkSize is the size of the messages files are sent in. Peers may
+// send longer ones, up to wormhole.MaxMessage.
+const msgChunkSize = 32 << 10
+
+// header describes a file, as sent ahead of it. See header in cmd/ww.
+type header struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+	// Archive is set if the file is an archive of a directory, e.g. "tar".
+	// It's kept as it is.
+	Archive string `json:"archive,omitempty"`
+	// Resume is set if the sender can resume sending the file. Files
+	// received here aren't kept when interrupted, so the answer is always
+	// to send all of it.
+	Resume string `json:"resume,omitempty"`
+	// Chunked is set if the file's size isn't known, and it's sent in
+	// messages that start with 0, up to the last one, which starts with 1.
+	// See wormhole.MinChunked.
+	Chunked bool `json:"chunked,omitempty"`
+}
+
+// hole is a wormhole and what's been going on with it.
+type hole struct {
+	w    *wormhole.Prepared // Until the peer turns up.
+	pass string
+
+	mu     sync.Mutex
+	c      *wormhole.Conn
+	err    error  // The last one, for ww_error.
+	digest string // Of the last file sent or received, for ww_digest.
+}
+
+// conn returns h's connection, once there is one.
+func (h *hole) conn() (*wormhole.Conn, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.c == nil {
+		return nil, errNotConnected
+	}
+	return h.c, nil
+}
+
+func (h *hole) fail(err error) C.int {
+	h.mu.Lock()
+	h.err = err
+	h.mu.Unlock()
+	return -1
+}
+
+// holes are the open wormholes by handle. Handle 0 has the errors of calls
+// that couldn't return one.
+var holes = struct {
+	sync.Mutex
+	m    map[C.int]*hole
+	next C.int
+}{m: map[C.int]*hole{0: {}}}
+
+func add(h *hole) C.int {
+	holes.Lock()
+	defer holes.Unlock()
+	holes.next++
+	holes.m[holes.next] = h
+	return holes.next
+}
+
+func get(handle C.int) *hole {
+	holes.Lock()
+	defer holes.Unlock()
+	h := holes.m[handle]
+	if h == nil {
+		return &hole{}
+	}
+	return h
+}
+
+// errNotConnected is returned when moving data over a wormhole still
+// waiting for the peer.
+var errNotConnected = errors.New("not connected yet: call ww_wait")
+
+func dialer(signal, ice *C.char) *wormhole.Dialer {
+	d := &wormhole.Dialer{SignalServer: C.GoString(signal)}
+	if ice != nil && C.GoString(ice) != "" {
+		d.ICEServers = strings.Split(C.GoString(ice), ",")
+	}
+	return d
+}
+
+// accept turns down the streams a peer opens alongside its files: they're
+// for features this library doesn't have.
+func accept(c *wormhole.Conn) {
+	for {
+		s, err := c.AcceptStream()
+		if err != nil {
+			return
+		}
+		s.Close()
+	}
+}
+
+// ww_new books a new wormhole on the signalling server signal, with a
+// password of length words, and returns its handle. ice is a comma
+// separated list of STUN and TURN servers, or NULL for none. Give the peer
+// the code from ww_code, and call ww_wait to connect.
+//
+//export ww_new
+func ww_new(signal, ice *C.char, length C.int) C.int {
+	if length <= 0 {
+		length = 2
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(crand.Reader, b); err != nil {
+		return get(0).fail(err)
+	}
+	w, err := dialer(signal, ice).Prepare("")
+	if err != nil {
+		return get(0).fail(err)
+	}
+	return add(&hole{w: w, pass: wordlist.Encode(b)})
+}
+
+// ww_code returns the code of a wormhole from ww_new, or NULL if it has
+// none.
+//
+//export ww_code
+func ww_code(handle C.int) *C.char {
+	h := get(handle)
+	if h.w == nil {
+		return nil
+	}
+	return C.CString(h.w.Slot() + "-" + h.pass)
+}
+
+// ww_wait waits for the peer to join a wormhole from ww_new, and connects
+// to it.
+//
+//export ww_wait
+func ww_wait(handle C.int) C.int {
+	h := get(handle)
+	if h.w == nil {
+		return h.fail(errors.New("no wormhole to wait on"))
+	}
+	c, err := h.w.Wait(h.pass)
+	if err != nil {
+		return h.fail(err)
+	}
+	h.mu.Lock()
+	h.c = c
+	h.mu.Unlock()
+	go accept(c)
+	return 0
+}
+
+// ww_dial connects to the peer waiting on the wormhole with code, and
+// returns its handle.
+//
+//export ww_dial
+func ww_dial(signal, ice, code *C.char) C.int {
+	slot, pass, err := wormhole.ParseCode(C.GoString(code))
+	if err != nil {
+		return get(0).fail(err)
+	}
+	c, err := dialer(signal, ice).Dial(slot, pass)
+	if err != nil {
+		return get(0).fail(err)
+	}
+	go accept(c)
+	return add(&hole{c: c})
+}
+
+// ww_write writes n bytes from buf to the peer, and returns how many it
+// wrote. Messages over 32KiB are split.
+//
+//export ww_write
+func ww_write(handle C.int, buf unsafe.Pointer, n C.int) C.int {
+	h := get(handle)
+	c, err := h.conn()
+	if err != nil {
+		return h.fail(err)
+	}
+	p := C.GoBytes(buf, n)
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > msgChunkSize {
+			chunk = chunk[:msgChunkSize]
+		}
+		if _, err := c.Write(chunk); err != nil {
+			return h.fail(err)
+		}
+		p = p[len(chunk):]
+	}
+	return n
+}
+
+// ww_read reads one message from the peer into buf, which should have room
+// for 64KiB, and returns its length, or 0 once the peer is done.
+//
+//export ww_read
+func ww_read(handle C.int, buf unsafe.Pointer, n C.int) C.int {
+	h := get(handle)
+	c, err := h.conn()
+	if err != nil {
+		return h.fail(err)
+	}
+	p := (*[1 << 30]byte)(buf)[:n:n]
+	read, err := c.Read(p)
+	if err == io.EOF {
+		return 0
+	}
+	if err != nil {
+		return h.fail(err)
+	}
+	return C.int(read)
+}
+
+// ww_send_file sends the file at path, the way ww send does.
+//
+//export ww_send_file
+func ww_send_file(handle C.int, path *C.char) C.int {
+	h := get(handle)
+	c, err := h.conn()
+	if err != nil {
+		return h.fail(err)
+	}
+	f, err := os.Open(C.GoString(path))
+	if err != nil {
+		return h.fail(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return h.fail(err)
+	}
+	if !info.Mode().IsRegular() {
+		return h.fail(fmt.Errorf("%s is not a regular file", info.Name()))
+	}
+	hdr, err := json.Marshal(header{Name: info.Name(), Size: int(info.Size())})
+	if err != nil {
+		return h.fail(err)
+	}
+	if _, err := c.Write(hdr); err != nil {
+		return h.fail(err)
+	}
+	sum := sha256.New()
+	written, err := io.CopyBuffer(io.MultiWriter(c, sum), f, make([]byte, msgChunkSize))
+	if err != nil {
+		return h.fail(err)
+	}
+	if written != info.Size() {
+		return h.fail(fmt.Errorf("%s changed while sending it", info.Name()))
+	}
+	if c.PeerVersion() >= wormhole.MinTrailer {
+		t, err := c.NewTrailer(sum.Sum(nil))
+		if err != nil {
+			return h.fail(err)
+		}
+		msg, err := json.Marshal(t)
+		if err != nil {
+			return h.fail(err)
+		}
+		if _, err := c.Write(msg); err != nil {
+			return h.fail(err)
+		}
+	}
+	h.mu.Lock()
+	h.digest = hex.EncodeToString(sum.Sum(nil))
+	h.mu.Unlock()
+	return 0
+}
+
+// ww_receive_file receives the next file the peer sends into the directory
+// dir, and returns where it put it. It returns NULL once the peer is done,
+// with ww_error returning NULL too, or on error.
+//
+//export ww_receive_file
+func ww_receive_file(handle C.int, dir *C.char) *C.char {
+	h := get(handle)
+	c, err := h.conn()
+	if err != nil {
+		h.fail(err)
+		return nil
+	}
+	path, digest, err := receive(c, C.GoString(dir))
+	if err != nil {
+		h.fail(err)
+		return nil
+	}
+	h.mu.Lock()
+	h.err = nil
+	h.digest = digest
+	h.mu.Unlock()
+	if path == "" {
+		return nil
+	}
+	return C.CString(path)
+}
+
+// receive receives a file from c into dir, and returns its path and
+// digest, or "" if the peer is done. Files from peers that send trailers
+// are only kept if they match theirs.
+func receive(c *wormhole.Conn, dir string) (string, string, error) {
+	buf := make([]byte, wormhole.MaxMessage)
+	n, err := c.Read(buf)
+	if err == nil && wormhole.IsOffer(buf[:n]) {
+		o, err := c.ReadOffer(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			return "", "", err
+		}
+		if err := o.Accept(); err != nil {
+			return "", "", err
+		}
+		n, err = c.Read(buf)
+	}
+	if err == io.EOF {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	var hdr header
+	if err := json.Unmarshal(buf[:n], &hdr); err != nil {
+		return "", "", err
+	}
+	if hdr.Resume != "" {
+		if err := restart(c); err != nil {
+			return "", "", err
+		}
+	}
+	name := filepath.Base(filepath.Clean(hdr.Name))
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return "", "", fmt.Errorf("bad file name %q", hdr.Name)
+	}
+	if hdr.Archive != "" {
+		name += "." + hdr.Archive
+	}
+	path := filepath.Join(dir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", "", err
+	}
+	var r io.Reader = io.LimitReader(c, int64(hdr.Size))
+	if hdr.Chunked {
+		r = &chunkedReader{r: c, buf: make([]byte, wormhole.MaxMessage)}
+	}
+	sum := sha256.New()
+	written, err := io.CopyBuffer(io.MultiWriter(f, sum), r, buf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && !hdr.Chunked && written != int64(hdr.Size) {
+		err = fmt.Errorf("EOF before receiving all bytes: (%d/%d)", written, hdr.Size)
+	}
+	if err == nil && c.PeerVersion() >= wormhole.MinTrailer {
+		err = checkTrailer(c, sum.Sum(nil), buf)
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", "", err
+	}
+	return path, hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// checkTrailer reads the trailer that follows a file from c, and checks it
+// against sum, the digest of what was received.
+func checkTrailer(c *wormhole.Conn, sum, buf []byte) error {
+	n, err := c.Read(buf)
+	if err != nil {
+		return err
+	}
+	var t wormhole.Trailer
+	if err := json.Unmarshal(buf[:n], &t); err != nil {
+		return err
+	}
+	if t.Changed {
+		// The file's dropped, but the next one can still be received.
+		return errors.New("the file changed while the sender was sending it")
+	}
+	return c.CheckTrailer(&t, sum)
+}
+
+// chunkedReader reads a file sent in chunks, each a message read from r
+// into buf, up to the last.
+type chunkedReader struct {
+	r    io.Reader
+	buf  []byte
+	p    []byte
+	last bool
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	for len(r.p) == 0 {
+		if r.last {
+			return 0, io.EOF
+		}
+		n, err := r.r.Read(r.buf)
+		if n == 0 {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if r.buf[0] > 1 {
+			return 0, errors.New("bad chunk")
+		}
+		r.last = r.buf[0] == 1
+		r.p = r.buf[1:n]
+	}
+	n := copy(p, r.p)
+	r.p = r.p[n:]
+	return n, nil
+}
+
+// restart answers a sender offering to resume a file that it should send
+// it from the start.
+func restart(c *wormhole.Conn) error {
+	if _, err := c.Write([]byte(`{"offset":0}`)); err != nil {
+		return err
+	}
+	buf := make([]byte, 1<<10)
+	n, err := c.Read(buf)
+	if err != nil {
+		return err
+	}
+	var start struct {
+		Start int64 `json:"start"`
+	}
+	if err := json.Unmarshal(buf[:n], &start); err != nil {
+		return err
+	}
+	if start.Start != 0 {
+		return fmt.Errorf("sender resumed at %d", start.Start)
+	}
+	return nil
+}
+
+// ww_digest returns the SHA-256 digest, in hex, of the last file sent or
+// received on a wormhole, or NULL if there wasn't one. Received from peers
+// that send theirs, it's been checked against it.
+//
+//export ww_digest
+func ww_digest(handle C.int) *C.char {
+	h := get(handle)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.digest == "" {
+		return nil
+	}
+	return C.CString(h.digest)
+}
+
+// ww_progress stores the bytes sent and received over a wormhole so far,
+// including headers, in sent and received.
+//
+//export ww_progress
+func ww_progress(handle C.int, sent, received *C.int64_t) {
+	c, err := get(handle).conn()
+	if err != nil {
+		*sent, *received = 0, 0
+		return
+	}
+	s, r := c.Progress()
+	*sent, *received = C.int64_t(s), C.int64_t(r)
+}
+
+// ww_set_rate_limit caps how fast a connected wormhole sends, and how fast
+// it receives, to bytes_per_sec each, or lifts the cap if it's 0. It
+// returns -1 if the wormhole isn't connected yet.
+//
+//export ww_set_rate_limit
+func ww_set_rate_limit(handle C.int, bytesPerSec C.int64_t) C.int {
+	h := get(handle)
+	c, err := h.conn()
+	if err != nil {
+		return h.fail(err)
+	}
+	c.SetRateLimit(int64(bytesPerSec))
+	return 0
+}
+
+// ww_error returns the last error on a wormhole, or NULL if there was
+// none. Handle 0 has the errors of ww_new and ww_dial.
+//
+//export ww_error
+func ww_error(handle C.int) *C.char {
+	h := get(handle)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.err == nil {
+		return nil
+	}
+	return C.CString(h.err.Error())
+}
+
+// ww_close closes a wormhole, whether connected or still waiting for the
+// peer, and frees its handle.
+//
+//export ww_close
+func ww_close(handle C.int) C.int {
+	holes.Lock()
+	h := holes.m[handle]
+	if handle != 0 {
+		delete(holes.m, handle)
+	}
+	holes.Unlock()
+	if h == nil || handle == 0 {
+		return 0
+	}
+	c, err := h.conn()
+	switch {
+	case err == nil:
+		err = c.Close()
+	case h.w != nil:
+		err = h.w.Close()
+	default:
+		err = nil
+	}
+	if err != nil {
+		return get(0).fail(err)
+	}
+	return 0
+}
+
+// ww_free frees a string returned by the library.
+//
+//export ww_free
+func ww_free(p unsafe.Pointer) {
+	C.free(p)
+}
+
+func main() {}
@@ -0,0 +1,167 @@
+"""webwormhole sends files and messages between computers over WebRTC.
+
+It's a ctypes wrapper for libwebwormhole, the C build of the wormhole
+package (see ffi.go), which it looks for next to this file, or wherever
+$WW_LIBRARY says.
+
+    import webwormhole
+
+    with webwormhole.new() as w:
+        print(w.code)
+        w.wait()
+        w.send_file("file.txt")
+
+and on the other side
+
+    with webwormhole.dial(code) as w:
+        for path in w.receive_files("."):
+            print("got", path)
+"""
+
+import ctypes
+import os
+
+SIGNAL = "https://wrmhl.link/"
+ICE = "stun:stun.l.google.com:19302"
+
+# msg_chunk_size is the most written in one message, and max_message the
+# most read in one.
+msg_chunk_size = 32 << 10
+max_message = 65535
+
+_lib = ctypes.CDLL(os.environ.get("WW_LIBRARY") or
+                   os.path.join(os.path.dirname(os.path.abspath(__file__)), "libwebwormhole.so"))
+_lib.ww_new.argtypes = [ctypes.c_char_p, ctypes.c_char_p, ctypes.c_int]
+_lib.ww_code.argtypes = [ctypes.c_int]
+_lib.ww_code.restype = ctypes.c_void_p
+_lib.ww_wait.argtypes = [ctypes.c_int]
+_lib.ww_dial.argtypes = [ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p]
+_lib.ww_write.argtypes = [ctypes.c_int, ctypes.c_char_p, ctypes.c_int]
+_lib.ww_read.argtypes = [ctypes.c_int, ctypes.c_char_p, ctypes.c_int]
+_lib.ww_send_file.argtypes = [ctypes.c_int, ctypes.c_char_p]
+_lib.ww_receive_file.argtypes = [ctypes.c_int, ctypes.c_char_p]
+_lib.ww_receive_file.restype = ctypes.c_void_p
+_lib.ww_digest.argtypes = [ctypes.c_int]
+_lib.ww_digest.restype = ctypes.c_void_p
+_lib.ww_progress.argtypes = [ctypes.c_int, ctypes.POINTER(ctypes.c_int64), ctypes.POINTER(ctypes.c_int64)]
+_lib.ww_progress.restype = None
+_lib.ww_set_rate_limit.argtypes = [ctypes.c_int, ctypes.c_int64]
+_lib.ww_error.argtypes = [ctypes.c_int]
+_lib.ww_error.restype = ctypes.c_void_p
+_lib.ww_close.argtypes = [ctypes.c_int]
+_lib.ww_free.argtypes = [ctypes.c_void_p]
+_lib.ww_free.restype = None
+
+
+class WormholeError(Exception):
+    pass
+
+
+def _string(p):
+    """_string returns the string the library returned at p, and frees it."""
+    if not p:
+        return None
+    try:
+        return ctypes.string_at(p).decode()
+    finally:
+        _lib.ww_free(p)
+
+
+def _check(handle, ret):
+    if ret < 0:
+        raise WormholeError(_string(_lib.ww_error(handle)) or "failed")
+    return ret
+
+
+def _encode(s):
+    return s.encode() if s is not None else None
+
+
+class Wormhole:
+    """A Wormhole is a connection to a peer, or a code waiting for one."""
+
+    def __init__(self, handle):
+        self._handle = handle
+
+    @property
+    def code(self):
+        """code is the code to give the peer, for wormholes from new."""
+        return _string(_lib.ww_code(self._handle))
+
+    def wait(self):
+        """wait waits for the peer to join a wormhole from new."""
+        _check(self._handle, _lib.ww_wait(self._handle))
+
+    def send_file(self, path):
+        """send_file sends the file at path, the way ww send does."""
+        _check(self._handle, _lib.ww_send_file(self._handle, os.fsencode(path)))
+
+    def receive_file(self, directory="."):
+        """receive_file receives the next file into directory, and returns
+        where it put it, or None once the peer is done."""
+        path = _string(_lib.ww_receive_file(self._handle, os.fsencode(directory)))
+        if path is None:
+            err = _string(_lib.ww_error(self._handle))
+            if err is not None:
+                raise WormholeError(err)
+        return path
+
+    def receive_files(self, directory="."):
+        """receive_files yields the paths of files as they come in, until
+        the peer is done."""
+        while True:
+            path = self.receive_file(directory)
+            if path is None:
+                return
+            yield path
+
+    def write(self, data):
+        """write sends data to the peer."""
+        return _check(self._handle, _lib.ww_write(self._handle, bytes(data), len(data)))
+
+    def read(self):
+        """read returns the next message from the peer, or b"" once it's
+        done."""
+        buf = ctypes.create_string_buffer(max_message)
+        n = _check(self._handle, _lib.ww_read(self._handle, buf, max_message))
+        return buf.raw[:n]
+
+    @property
+    def digest(self):
+        """digest is the SHA-256 of the last file sent or received, in
+        hex, checked against the sender's when the peer sent it."""
+        return _string(_lib.ww_digest(self._handle))
+
+    def progress(self):
+        """progress returns the bytes sent and received so far."""
+        sent, received = ctypes.c_int64(), ctypes.c_int64()
+        _lib.ww_progress(self._handle, ctypes.byref(sent), ctypes.byref(received))
+        return sent.value, received.value
+
+    def set_rate_limit(self, bytes_per_sec):
+        """set_rate_limit caps how fast the wormhole sends, and how fast it
+        receives, to bytes_per_sec each. 0 lifts the cap."""
+        _check(self._handle, _lib.ww_set_rate_limit(self._handle, bytes_per_sec))
+
+    def close(self):
+        """close hangs up, or gives up on waiting for the peer."""
+        if self._handle > 0:
+            handle, self._handle = self._handle, 0
+            _check(0, _lib.ww_close(handle))
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *exc):
+        self.close()
+
+
+def new(signal=SIGNAL, ice=ICE, length=2):
+    """new books a new wormhole on the signalling server. Give the peer its
+    code, then wait for it."""
+    return Wormhole(_check(0, _lib.ww_new(_encode(signal), _encode(ice), length)))
+
+
+def dial(code, signal=SIGNAL, ice=ICE):
+    """dial connects to the peer waiting on the wormhole with code."""
+    return Wormhole(_check(0, _lib.ww_dial(_encode(signal), _encode(ice), _encode(code))))
@@ -4,15 +4,19 @@ go 1.13
 
 require (
 	filippo.io/cpace v0.0.0-20200503185815-340c58da85ed
+	fyne.io/systray v1.10.0
 	github.com/NYTimes/gziphandler v1.1.1
 	github.com/golang/protobuf v1.3.5 // indirect
 	github.com/gorilla/websocket v1.4.2
 	github.com/lucas-clemente/quic-go v0.15.2 // indirect
 	github.com/pion/rtp v1.4.0 // indirect
 	github.com/pion/sdp/v2 v2.3.5 // indirect
+	github.com/pion/stun v0.3.3
+	github.com/pion/turn/v2 v2.0.3
 	github.com/pion/webrtc/v2 v2.2.4
 	golang.org/x/crypto v0.0.0-20200323165209-0ec3e9974c59
 	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e // indirect
-	golang.org/x/sys v0.0.0-20200327173247-9dae0f8f5775 // indirect
+	golang.org/x/sys v0.0.0-20200515095857-1151b9dac4a9
+	golang.org/x/text v0.3.3
 	rsc.io/qr v0.2.0
 )
@@ -0,0 +1,26 @@
+// webwormhole is a client library for WebWormhole, for building web pages
+// of your own on its protocol. It speaks the same protocol as the web client
+// and ww, using their WebAssembly build for the handshake and sealing.
+//
+//	import { load, newWormhole, relays, Sender } from "webwormhole";
+//	await load("util.wasm");
+//	let signal = "https://webwormhole.io/";
+//	let pc = new RTCPeerConnection({iceServers: [{urls: "stun:stun.l.google.com:19302"}, ...await relays(signal)]});
+//	let dc = pc.createDataChannel("data", {negotiated: true, id: 0});
+//	let w = await newWormhole(pc, {signal});
+//	console.log("code", w.code);
+//	await w.connected;
+//	dc.onopen = () => new Sender(dc).send(file);
+//
+// The data channel must be the negotiated channel with id 0, as here.
+
+export { load } from "./util.js";
+export type { Util, Handle } from "./util.js";
+export { protocol, minProtocol, WormholeError, newWormhole, dial, rendezvous, exportKey, release, relays } from "./signal.js";
+export type { Reason, Options, Wormhole } from "./signal.js";
+export { chunkSize, Sender, Receiver } from "./transfer.js";
+export type { Header, Progress, Handlers } from "./transfer.js";
+
+// version is the version of this library. It follows its own releases, not
+// the protocol's.
+export const version = "0.1.0";
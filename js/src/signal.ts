@@ -0,0 +1,412 @@
+// Signalling: meeting the peer through the signalling server, agreeing on
+// a key with PAKE, and swapping session descriptions and ICE candidates
+// sealed with it. This follows web/dial.js, and wormhole/dial.go on the
+// other end.
+
+import { type Handle, type Util, util } from "./util.js";
+
+// protocol is the version of the protocol spoken between peers, and
+// minProtocol the oldest version we can still talk to. These correspond to
+// wormhole.Protocol and wormhole.MinProtocol in the Go package. Later
+// versions add streams and resuming, which this library doesn't speak yet.
+export const protocol = 1;
+export const minProtocol = 0;
+
+// Reason is why connecting failed.
+export type Reason =
+	| "no such slot"
+	| "couldn't get slot"
+	| "somebody else tried the code"
+	| "slot busy"
+	| "timed out"
+	| "bad key"
+	| "couldn't generate key"
+	| "couldn't connect to signalling server"
+	| "peer too old"
+	| "peer too new";
+
+// WormholeError is what the promises here reject with.
+export class WormholeError extends Error {
+	readonly reason: Reason;
+
+	constructor(reason: Reason) {
+		super(reason);
+		this.reason = reason;
+		this.name = "WormholeError";
+	}
+}
+
+export interface Options {
+	// signal is the URL of the signalling server, e.g.
+	// "https://webwormhole.io/".
+	signal: string;
+	// ttl is how long, in seconds, the code of a new wormhole lasts unless
+	// renewed. Servers cap it to their own limit.
+	ttl?: number;
+	// noRelay ignores the peer's relay candidates, so that data is never
+	// relayed.
+	noRelay?: boolean;
+	// length is the number of words in new passwords. The default is 2.
+	length?: number;
+	// onCode is called with a new code if the slot is lost while waiting
+	// for the peer, e.g. because the server restarted and somebody else
+	// got it. The old code won't work.
+	onCode?: (code: string) => void;
+}
+
+// A Wormhole is a wormhole waiting for the peer, from newWormhole.
+export interface Wormhole {
+	// code is the code to give the peer.
+	code: string;
+	// connected resolves once the peer has joined and the session
+	// descriptions are swapped. The data channel opens after.
+	connected: Promise<void>;
+	// renew restarts the code's ttl, as long as nobody's joined yet.
+	renew(): void;
+}
+
+interface SessionMessage {
+	type?: string;
+	sdp?: string;
+	candidate?: string;
+	version?: number;
+	minversion?: number;
+}
+
+// codeAttempts is how many times newWormhole tries for a slot again, if it
+// loses the one it had or the server has none free.
+const codeAttempts = 3;
+
+let socketURL = (signal: string): string => {
+	let u = new URL("s/", signal.endsWith("/") ? signal : signal + "/");
+	u.protocol = u.protocol === "https:" ? "wss:" : "ws:";
+	return u.href;
+};
+
+// relays returns the TURN servers the signalling server runs itself, with
+// credentials for this session, if it has any. Add them to the peer
+// connection's iceServers before connecting.
+export async function relays(signal: string): Promise<RTCIceServer[]> {
+	let r = await fetch(new URL("relay", signal.endsWith("/") ? signal : signal + "/"));
+	if (!r.ok) {
+		return [];
+	}
+	return await r.json() as RTCIceServer[];
+}
+
+// describe returns our session description along with our protocol version.
+let describe = (pc: RTCPeerConnection): string =>
+	JSON.stringify(Object.assign(pc.localDescription!.toJSON(), {
+		version: protocol,
+		minversion: minProtocol,
+	}));
+
+// incompatible returns a reason we can't talk to the sender of msg, if any.
+let incompatible = (msg: SessionMessage): Reason | null => {
+	if ((msg.version || 0) < minProtocol) {
+		return "peer too old";
+	}
+	if ((msg.minversion || 0) > protocol) {
+		return "peer too new";
+	}
+	return null;
+};
+
+let connectedTo = (pc: RTCPeerConnection): boolean =>
+	pc.iceConnectionState === "connected" || pc.iceConnectionState === "completed";
+
+let relayed = (candidate: string): boolean => candidate.includes(" typ relay");
+
+// remote returns what to pass on from a peer's message, without relay
+// candidates if noRelay is set.
+let remote = (msg: SessionMessage, noRelay?: boolean): RTCSessionDescriptionInit => {
+	if (noRelay && msg.sdp) {
+		msg.sdp = msg.sdp.split("\r\n").filter(l => !(l.startsWith("a=candidate:") && relayed(l))).join("\r\n");
+	}
+	return msg as RTCSessionDescriptionInit;
+};
+
+// handles are the util handles of each peer connection's handshake.
+let handles = new WeakMap<RTCPeerConnection, Handle>();
+
+let keep = (u: Util, pc: RTCPeerConnection, h: Handle) => {
+	if (handles.has(pc)) {
+		u.release(handles.get(pc)!);
+	}
+	handles.set(pc, h);
+};
+
+// exportKey derives n bytes for label from the handshake pc connected with,
+// the same as the peer gets. See wormhole.Conn.ExportKey.
+export async function exportKey(pc: RTCPeerConnection, label: string, n: number): Promise<Uint8Array | null> {
+	let u = await util();
+	return handles.has(pc) ? u.exportkey(handles.get(pc)!, label, n) : null;
+}
+
+// release forgets the handshake pc connected with, once it's done with.
+export async function release(pc: RTCPeerConnection): Promise<void> {
+	let u = await util();
+	if (handles.has(pc)) {
+		u.release(handles.get(pc)!);
+		handles.delete(pc);
+	}
+}
+
+// peerMessage handles a sealed message from the peer after the key is
+// agreed: its session description or an ICE candidate. It returns a reason
+// to give up, if any.
+let peerMessage = async (pc: RTCPeerConnection, ws: WebSocket, u: Util, key: Uint8Array, msg: SessionMessage, noRelay?: boolean): Promise<Reason | null> => {
+	if (msg.type === "offer" || msg.type === "answer" || msg.version) {
+		let reason = incompatible(msg);
+		if (reason) {
+			return reason;
+		}
+	}
+	if (msg.type === "offer") {
+		await pc.setRemoteDescription(new RTCSessionDescription(remote(msg, noRelay)));
+		await pc.setLocalDescription(await pc.createAnswer());
+		ws.send(u.seal(key, describe(pc))!);
+	} else if (msg.type === "answer") {
+		await pc.setRemoteDescription(new RTCSessionDescription(remote(msg, noRelay)));
+	} else if (msg.candidate) {
+		if (!(noRelay && relayed(msg.candidate))) {
+			pc.addIceCandidate(new RTCIceCandidate(msg as RTCIceCandidateInit));
+		}
+	}
+	return null;
+};
+
+// newWormhole creates a wormhole, the A side, and resolves once it has a
+// code for the peer to dial.
+export function newWormhole(pc: RTCPeerConnection, options: Options): Promise<Wormhole> {
+	return book(pc, options);
+}
+
+// book books a slot, the one in want with its password if given, and waits
+// for the peer on it.
+let book = async (pc: RTCPeerConnection, options: Options, want?: [string, string]): Promise<Wormhole> => {
+	let u = await util();
+	let base = socketURL(options.signal);
+	let ttl = options.ttl || 0;
+	let ws: WebSocket;
+	let key: Uint8Array | null = null;
+	let slot = "", pass = "";
+	let attempts = 0;
+	// rebookUntil is when to give up booking the slot again, if the
+	// signalling server drops us while waiting for the peer.
+	let rebookUntil = 0;
+	let slotC!: { resolve: (code: string) => void, reject: (err: WormholeError) => void };
+	let connC!: { resolve: () => void, reject: (err: WormholeError) => void };
+	let slotP = new Promise<string>((resolve, reject) => { slotC = {resolve, reject}; });
+	let connected = new Promise<void>((resolve, reject) => { connC = {resolve, reject}; });
+	let fail = (reason: Reason) => (slot ? connC : slotC).reject(new WormholeError(reason));
+	// Hold on to candidates until there's a key to send them with.
+	let pending: RTCIceCandidate[] | null = [];
+	let offerP: Promise<void> | null = null;
+	pc.onicecandidate = e => {
+		if (!e.candidate) {
+			return;
+		}
+		if (pending) {
+			pending.push(e.candidate);
+		} else {
+			ws.send(u.seal(key!, JSON.stringify(e.candidate))!);
+		}
+	};
+	let newCode = (s: string) => {
+		slot = s;
+		pass = want ? want[1] : u.password(options.length || 2)!;
+		if (offerP) {
+			options.onCode?.(slot + "-" + pass);
+			return;
+		}
+		slotC.resolve(slot + "-" + pass);
+		offerP = pc.createOffer().then(offer => pc.setLocalDescription(offer));
+	};
+	let onmessage = async (m: MessageEvent) => {
+		if (rebookUntil) {
+			rebookUntil = 0;
+			if (m.data !== slot) {
+				newCode(m.data);
+			}
+			return;
+		}
+		if (!slot) {
+			newCode(m.data);
+			return;
+		}
+		if (!key) {
+			let [k, msgB, h] = u.exchange(pass, m.data);
+			if (k === null) {
+				connC.reject(new WormholeError("couldn't generate key"));
+				return;
+			}
+			key = k;
+			keep(u, pc, h!);
+			ws.send(msgB!);
+			await offerP;
+			ws.send(u.seal(key, describe(pc))!);
+			for (let c of pending!) {
+				ws.send(u.seal(key, JSON.stringify(c))!);
+			}
+			pending = null;
+			return;
+		}
+		let json = u.open(key, m.data);
+		if (json === null) {
+			// Auth failed. Send something so B knows.
+			ws.send(u.seal(key, "bye")!);
+			ws.close();
+			connC.reject(new WormholeError("bad key"));
+			return;
+		}
+		let msg = JSON.parse(json) as SessionMessage;
+		let reason = await peerMessage(pc, ws, u, key, msg, options.noRelay);
+		if (reason) {
+			ws.close();
+			connC.reject(new WormholeError(reason));
+		} else if (msg.type === "answer") {
+			connC.resolve();
+		}
+	};
+	let open = (query: string) => {
+		ws = new WebSocket(base + query);
+		ws.onmessage = onmessage;
+		ws.onclose = e => {
+			if (e.code === 4404) {
+				fail("no such slot");
+			} else if (e.code === 4429) {
+				fail("slot busy");
+			} else if (e.code === 4423 && !connectedTo(pc)) {
+				// Somebody else tried our code. Don't connect to whoever
+				// has it.
+				pc.close();
+				fail("somebody else tried the code");
+			} else if ((e.code === 4409 || e.code === 4503) && !key && !want && attempts < codeAttempts) {
+				let delay = e.code === 4503 ? 1000 * 2 ** attempts : 0;
+				attempts++;
+				setTimeout(() => open("?" + new URLSearchParams({ttl: String(ttl)})), delay);
+			} else if (e.code === 4409 || e.code === 4503) {
+				fail("couldn't get slot");
+			} else if (e.code === 4408) {
+				fail("timed out");
+			} else if (slot && !key && (e.code === 1001 || e.code === 1006)) {
+				if (!rebookUntil) {
+					rebookUntil = Date.now() + 60 * 1000;
+				}
+				if (Date.now() > rebookUntil) {
+					fail("couldn't connect to signalling server");
+					return;
+				}
+				setTimeout(() => open("?" + new URLSearchParams({ttl: String(ttl), slot})), 1000);
+			} else if (e.code === 1006) {
+				fail("couldn't connect to signalling server");
+			}
+		};
+	};
+	open("?" + new URLSearchParams(want ? {ttl: String(ttl), slot: want[0]} : {ttl: String(ttl)}));
+
+	return {
+		code: await slotP,
+		connected,
+		renew() {
+			if (!key) {
+				ws.send("renew");
+			}
+		},
+	};
+};
+
+// dial joins the wormhole with code, the B side, and resolves once the
+// session descriptions are swapped.
+export async function dial(pc: RTCPeerConnection, code: string, options: Options): Promise<void> {
+	let u = await util();
+	let [slot, ...rest] = code.split("-");
+	let pass = rest.join("-");
+	let ws = new WebSocket(socketURL(options.signal) + slot);
+	let key: Uint8Array | null = null;
+	return new Promise<void>((resolve, reject) => {
+		let fail = (reason: Reason) => reject(new WormholeError(reason));
+		ws.onopen = () => {
+			let [h, msgA] = u.start(pass);
+			if (h === null) {
+				fail("couldn't generate key");
+				return;
+			}
+			keep(u, pc, h);
+			ws.send(msgA!);
+		};
+		ws.onmessage = async m => {
+			if (!key) {
+				key = u.finish(handles.get(pc)!, m.data);
+				if (key === null) {
+					fail("couldn't generate key");
+					return;
+				}
+				pc.onicecandidate = e => {
+					if (e.candidate) {
+						ws.send(u.seal(key!, JSON.stringify(e.candidate))!);
+					}
+				};
+				return;
+			}
+			let json = u.open(key, m.data);
+			if (json === null) {
+				ws.send(u.seal(key, "bye")!);
+				ws.close();
+				fail("bad key");
+				return;
+			}
+			let msg = JSON.parse(json) as SessionMessage;
+			let reason = await peerMessage(pc, ws, u, key, msg, options.noRelay);
+			if (reason) {
+				// Let the other side know why we're hanging up.
+				ws.send(u.seal(key, JSON.stringify({version: protocol, minversion: minProtocol}))!);
+				ws.close();
+				fail(reason);
+			} else if (msg.type === "offer") {
+				resolve();
+			}
+		};
+		ws.onerror = () => fail("couldn't connect to signalling server");
+		ws.onclose = e => {
+			if (e.code === 4404) {
+				fail("no such slot");
+			} else if (e.code === 4429) {
+				fail("slot busy");
+			} else if (e.code === 4423 && !connectedTo(pc)) {
+				pc.close();
+				fail("somebody else tried the code");
+			} else if (e.code === 4503) {
+				fail("couldn't get slot");
+			} else if (e.code === 4408) {
+				fail("timed out");
+			}
+		};
+	});
+}
+
+// rendezvous meets a device paired with this one, from the secret they
+// share after pairing, see exportKey. Whichever gets there first waits for the other, so
+// neither needs a code.
+export async function rendezvous(pc: RTCPeerConnection, secret: Uint8Array, options: Options): Promise<void> {
+	let u = await util();
+	let [slot, pass] = u.paired(secret);
+	for (let attempt = 0; ; attempt++) {
+		try {
+			return await dial(pc, slot + "-" + pass, options);
+		} catch (err) {
+			if (!(err instanceof WormholeError) || err.reason !== "no such slot") {
+				throw err;
+			}
+		}
+		try {
+			return await (await book(pc, options, [slot, pass])).connected;
+		} catch (err) {
+			if (!(err instanceof WormholeError) || err.reason !== "couldn't get slot" || attempt >= 3) {
+				throw err;
+			}
+			// The peer booked it at the same time we did. Join it instead.
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Transfer: sending files over the data channel the way ww and the web
+// client do. Each file is a JSON header, then its bytes in messages of up to
+// chunkSize, one file after the other.
+
+// Header describes a file, as sent ahead of it. See header in cmd/ww.
+export interface Header {
+	name: string;
+	size: number;
+	type?: string;
+	// modified is the modification time in milliseconds since the epoch,
+	// like a File's lastModified.
+	modified?: number;
+	// mode is the Unix permission bits, from senders that keep them.
+	mode?: number;
+	// archive is set if the file is an archive of a directory, e.g. "tar".
+	archive?: string;
+	// text is set if the file is a text message, to show rather than save.
+	text?: boolean;
+}
+
+// chunkSize is the most sent in one message. 64k is okay for most modern
+// browsers, 32 is conservative.
+export const chunkSize = 32 << 10;
+
+// Progress is called as a file goes, with how much of it is done.
+export type Progress = (header: Header, offset: number) => void;
+
+// Sender sends files over a data channel, one at a time.
+export class Sender {
+	readonly dc: RTCDataChannel;
+	private ready: Promise<void> = Promise.resolve();
+	private resolve: () => void = () => {};
+	// highWater is how much may be buffered before sending waits for it to
+	// drain to the data channel's low threshold.
+	highWater = 1 << 20;
+
+	constructor(dc: RTCDataChannel) {
+		this.dc = dc;
+		dc.binaryType = "arraybuffer";
+		dc.bufferedAmountLowThreshold = 512 << 10;
+		dc.addEventListener("bufferedamountlow", () => this.resolve());
+	}
+
+	private async write(buf: Uint8Array) {
+		for (let offset = 0; offset < buf.length; offset += chunkSize) {
+			await this.ready;
+			this.dc.send(buf.subarray(offset, Math.min(offset + chunkSize, buf.length)));
+		}
+		if (this.dc.bufferedAmount >= this.highWater) {
+			this.ready = new Promise(resolve => this.resolve = resolve);
+		}
+	}
+
+	// send sends file, calling progress as it goes.
+	async send(file: File, progress?: Progress): Promise<void> {
+		let header: Header = {
+			name: file.name,
+			size: file.size,
+			type: file.type,
+			modified: file.lastModified,
+		};
+		this.dc.send(new TextEncoder().encode(JSON.stringify(header)));
+		let reader = file.stream().getReader();
+		let offset = 0;
+		for (;;) {
+			let { done, value } = await reader.read();
+			if (done) {
+				break;
+			}
+			await this.write(value!);
+			offset += value!.length;
+			progress?.(header, offset);
+		}
+		if (offset !== file.size) {
+			throw new Error(`${file.name} changed while sending it`);
+		}
+	}
+
+	// close closes the data channel once everything sent has gone, so that
+	// the peer doesn't take it for the connection dropping.
+	async close(): Promise<void> {
+		while (this.dc.bufferedAmount > 0) {
+			await new Promise(r => setTimeout(r, 100));
+		}
+		this.dc.close();
+	}
+}
+
+// Handlers are what a Receiver tells about the files it gets.
+export interface Handlers {
+	// start is called with each file's header as it starts.
+	start?: (header: Header) => void;
+	progress?: Progress;
+	// done is called with each file once it's all there.
+	done: (header: Header, file: Blob) => void;
+	// error is called if the peer sends something that doesn't make
+	// sense. The transfer can't go on after.
+	error?: (err: Error) => void;
+}
+
+// Receiver receives files from a data channel, keeping each in memory until
+// it's whole.
+export class Receiver {
+	readonly dc: RTCDataChannel;
+	readonly handlers: Handlers;
+	private header: Header | null = null;
+	private parts: ArrayBuffer[] = [];
+	private offset = 0;
+
+	constructor(dc: RTCDataChannel, handlers: Handlers) {
+		this.dc = dc;
+		this.handlers = handlers;
+		dc.binaryType = "arraybuffer";
+		dc.addEventListener("message", e => this.message(e.data));
+	}
+
+	private message(data: ArrayBuffer) {
+		try {
+			if (!this.header) {
+				this.header = JSON.parse(new TextDecoder().decode(data)) as Header;
+				this.parts = [];
+				this.offset = 0;
+				this.handlers.start?.(this.header);
+			} else {
+				this.parts.push(data);
+				this.offset += data.byteLength;
+				if (this.offset > this.header.size) {
+					throw new Error("received more bytes than expected");
+				}
+				this.handlers.progress?.(this.header, this.offset);
+			}
+			if (this.offset === this.header.size) {
+				let h = this.header;
+				this.header = null;
+				this.handlers.done(h, new Blob(this.parts, {type: h.type || ""}));
+				this.parts = [];
+			}
+		} catch (err) {
+			this.dc.close();
+			this.handlers.error?.(err as Error);
+		}
+	}
+}
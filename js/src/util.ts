@@ -0,0 +1,58 @@
+// The handshake, sealing and code words come from the Go implementation,
+// compiled to Web Assembly as util.wasm (see web/util_js.go), so that they
+// can't drift apart from what ww does.
+
+// Handle refers to a handshake kept by util until it's released.
+export type Handle = number;
+
+// Util is what util.wasm puts on globalThis.util. All functions return null
+// on error.
+export interface Util {
+	start(pass: string): [Handle, string] | [null, null];
+	finish(handle: Handle, msgB: string): Uint8Array | null;
+	exchange(pass: string, msgA: string): [Uint8Array, string, Handle] | [null, null, null];
+	open(key: Uint8Array, sealed: string): string | null;
+	seal(key: Uint8Array, message: string): string | null;
+	release(handle: Handle): void;
+	exportkey(handle: Handle, label: string, n: number): Uint8Array | null;
+	paired(secret: Uint8Array): [string, string];
+	password(length: number): string | null;
+	qrencode(url: string): Uint8Array | null;
+}
+
+// Go is the runtime wasm_exec.js from the Go distribution defines. It has
+// to be loaded before util.wasm is.
+declare class Go {
+	importObject: WebAssembly.Imports;
+	run(instance: WebAssembly.Instance): Promise<void>;
+}
+
+let loaded: Promise<Util> | null = null;
+
+// load instantiates util.wasm from url, or the bytes given, once, and
+// returns its functions.
+export function load(wasm: string | URL | BufferSource): Promise<Util> {
+	if (!loaded) {
+		loaded = (async () => {
+			const go = new Go();
+			let source: BufferSource;
+			if (typeof wasm === "string" || wasm instanceof URL) {
+				source = await (await fetch(wasm.toString())).arrayBuffer();
+			} else {
+				source = wasm;
+			}
+			const { instance } = await WebAssembly.instantiate(source, go.importObject);
+			go.run(instance);
+			return (globalThis as any).util as Util;
+		})();
+	}
+	return loaded;
+}
+
+// util returns the functions of util.wasm, once load has been called.
+export async function util(): Promise<Util> {
+	if (!loaded) {
+		throw new Error("util.wasm not loaded");
+	}
+	return loaded;
+}
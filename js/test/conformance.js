@@ -0,0 +1,53 @@
+// conformance checks the library against the Go implementation: the known
+// answer tests ww checks other implementations with, and a handshake
+// between both sides. Run it with make js, which builds util.wasm first.
+
+import fs from "fs";
+import { load, protocol, minProtocol } from "../dist/index.js";
+
+let root = new URL("../../", import.meta.url);
+let failed = 0;
+let check = (name, ok) => {
+	console.log((ok ? "ok " : "FAILED ") + name);
+	if (!ok) {
+		failed++;
+	}
+};
+let hex = b => Buffer.from(b).toString("hex");
+let unhex = h => new Uint8Array(Buffer.from(h, "hex"));
+
+await import(new URL("dist/wasm_exec.js", new URL("../", import.meta.url)));
+let util = await load(fs.readFileSync(new URL("../dist/util.wasm", import.meta.url)));
+
+let vectors = JSON.parse(fs.readFileSync(new URL("wormhole/pake/testdata/vectors.json", root)));
+for (let v of vectors) {
+	check(`open ${v.name}`, util.open(unhex(v.key), v.sealed) === v.message);
+	check(`seal ${v.name}`, util.open(unhex(v.key), util.seal(unhex(v.key), v.message)) === v.message);
+}
+
+let [a, msgA] = util.start("correct-horse-battery");
+let [keyB, msgB, b] = util.exchange("correct-horse-battery", msgA);
+let keyA = util.finish(a, msgB);
+check("handshake", keyA !== null && hex(keyA) === hex(keyB));
+check("exportkey", hex(util.exportkey(a, "self", 32)) === hex(util.exportkey(b, "self", 32)));
+let [, wrongB] = util.exchange("wrong-horse-battery", util.start("correct-horse-battery")[1]);
+check("wrong password", util.finish(a, wrongB) === null);
+util.release(a);
+util.release(b);
+
+// Devices keep their secrets, so this can't change. See TestPaired.
+let [slot, pass] = util.paired(new Uint8Array(32).fill(1));
+check("paired", slot === "449adc127475b6f3" && pass === "0f6781afb97b86e49a9cc50de827c9bf");
+
+check("password", /^[a-z]+-[a-z]+$/.test(util.password(2)));
+
+let dial = fs.readFileSync(new URL("wormhole/dial.go", root), "utf8");
+let goProtocol = +dial.match(/^const Protocol = (\d+)$/m)[1];
+let goMinProtocol = +dial.match(/^const MinProtocol = (\d+)$/m)[1];
+check("protocol", goMinProtocol <= protocol && minProtocol <= goProtocol);
+
+if (failed) {
+	console.log(`${failed} checks failed`);
+	process.exit(1);
+}
+process.exit(0);
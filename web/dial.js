@@ -1,6 +1,52 @@
 import { genpassword } from './wordlist.js';
 
-const signalserver = ((location.protocol==="https:")?"wss://":"ws://")+location.host+"/s/";
+// base is where the signalling server is: at the namespace's path, for
+// pages served at /ns/NAME/, or at the root.
+const base = (location.pathname.match(/^\/ns\/[^/]+\//) || ["/"])[0];
+
+const signalserver = ((location.protocol==="https:")?"wss://":"ws://")+location.host+base+"s/";
+
+// protocol is the version of the protocol spoken between peers, and
+// minprotocol the oldest version we can still talk to. These correspond to
+// wormhole.Protocol and wormhole.MinProtocol in the Go package. Version 2
+// added streams, which this client doesn't support yet.
+const protocol = 1;
+const minprotocol = 0;
+
+// describe returns our session description along with our protocol version.
+let describe = pc => {
+	return JSON.stringify(Object.assign(pc.localDescription.toJSON(), {
+		version: protocol,
+		minversion: minprotocol,
+	}));
+}
+
+// incompatible returns a reason we can't talk to the sender of msg, if any.
+let incompatible = msg => {
+	if ((msg.version || 0) < minprotocol) {
+		return "peer too old";
+	}
+	if ((msg.minversion || 0) > protocol) {
+		return "peer too new";
+	}
+	return null;
+}
+
+// connectedto is whether pc has connected to the peer already.
+let connectedto = pc => pc.iceConnectionState === "connected" || pc.iceConnectionState === "completed";
+
+// relayed is whether an ICE candidate is a TURN relay.
+let relayed = candidate => candidate.includes(" typ relay");
+
+// remote returns what to pass on from a peer's message, without relay
+// candidates if norelay is set. Peers that don't trickle send their
+// candidates in the session description.
+let remote = (msg, norelay) => {
+	if (norelay && msg.sdp) {
+		msg.sdp = msg.sdp.split("\r\n").filter(l => !(l.startsWith("a=candidate:") && relayed(l))).join("\r\n");
+	}
+	return msg;
+}
 
 export let goready = new Promise(async r => {
 	if (!WebAssembly.instantiateStreaming) { // for Safari.
@@ -15,10 +61,217 @@ export let goready = new Promise(async r => {
 	r();
 });
 
-// newwormhole creates wormhole, the A side.
-export let newwormhole = async (pc) => {
-	let ws = new WebSocket(signalserver);
+// authorize makes sure the signalling server will serve us. Private
+// servers answer 401 until we post a token they like, which they keep in a
+// cookie for next time.
+export let authorize = async () => {
+	let r = await fetch(base+"auth");
+	while (r.status === 401) {
+		let token = prompt("This server needs an access token.");
+		if (token === null) {
+			throw "unauthorized";
+		}
+		r = await fetch(base+"auth", {method: "POST", body: token});
+	}
+}
+
+// relays returns the TURN servers the signalling server runs itself, with
+// credentials for this session, if any.
+export let relays = async () => {
+	let r = await fetch(base+"relay");
+	if (!r.ok) {
+		return [];
+	}
+	return await r.json();
+}
+
+// handles are the util handles of each peer connection's handshake.
+let handles = new WeakMap();
+
+// keep makes h the handshake handle of pc, releasing any it had before.
+let keep = (pc, h) => {
+	if (handles.has(pc)) {
+		util.release(handles.get(pc));
+	}
+	handles.set(pc, h);
+}
+
+// exportkey derives n bytes for label from the handshake pc connected
+// with, the same as the peer gets. See wormhole.Conn.ExportKey.
+export let exportkey = (pc, label, n) => handles.has(pc) ? util.exportkey(handles.get(pc), label, n) : null;
+
+// release forgets the handshake pc connected with, once it's done with.
+export let release = pc => {
+	if (handles.has(pc)) {
+		util.release(handles.get(pc));
+		handles.delete(pc);
+	}
+}
+
+// cancellers call off each peer connection's signalling, while it's under
+// way.
+let cancellers = new WeakMap();
+
+// cancel calls off signalling for pc, if it's still under way: it tells the
+// signalling server, which frees the slot or hangs up on the peer, releases
+// the handshake and closes pc. Whatever's waiting for it to connect rejects
+// with "cancelled".
+export let cancel = pc => {
+	if (cancellers.has(pc)) {
+		cancellers.get(pc)();
+		cancellers.delete(pc);
+	}
+	release(pc);
+	pc.close();
+}
+
+// Signal is a session with the signalling server at url. It's a websocket,
+// or where those don't get through, e.g. past a proxy that doesn't know
+// them, it long-polls the server over plain HTTP instead, the same as the
+// Go package does. It works like a WebSocket either way.
+class Signal {
+	constructor(url) {
+		this.readyState = WebSocket.CONNECTING;
+		this.ws = new WebSocket(url);
+		this.ws.onopen = e => this.opened(e);
+		this.ws.onmessage = e => this.onmessage && this.onmessage(e);
+		this.ws.onerror = e => {
+			if (this.readyState !== WebSocket.CONNECTING && this.onerror) {
+				this.onerror(e);
+			}
+		}
+		this.ws.onclose = e => {
+			if (this.readyState === WebSocket.CONNECTING) {
+				// It never opened, so try without.
+				console.log("websocket failed, long-polling instead");
+				this.ws = null;
+				this.poll(url);
+				return
+			}
+			this.closed(e);
+		}
+	}
+	opened(e) {
+		this.readyState = WebSocket.OPEN;
+		if (this.onopen) {
+			this.onopen(e);
+		}
+	}
+	closed(e) {
+		this.readyState = WebSocket.CLOSED;
+		if (this.onclose) {
+			this.onclose(e);
+		}
+	}
+	failed() {
+		if (this.onerror) {
+			this.onerror(new Event("error"));
+		}
+		this.closed({code: 1006, reason: ""});
+	}
+	// poll opens a session at url, and reads from it until it's closed. See
+	// cmd/ww/poll.go.
+	async poll(url) {
+		let u = new URL(url.replace(/^ws/, "http"));
+		this.abort = new AbortController();
+		this.sending = Promise.resolve();
+		let session;
+		try {
+			let r = await fetch(u, {method: "POST"});
+			if (!r.ok) {
+				throw r.status;
+			}
+			session = (await r.json()).session;
+		} catch (err) {
+			this.failed();
+			return
+		}
+		this.url = u.origin + u.pathname.slice(0, u.pathname.lastIndexOf("/s/")) + "/poll/" + session;
+		if (this.readyState !== WebSocket.CONNECTING) {
+			this.hangup();
+			return
+		}
+		this.opened(new Event("open"));
+		while (this.readyState === WebSocket.OPEN) {
+			let b;
+			try {
+				let r = await fetch(this.url, {signal: this.abort.signal});
+				if (r.status === 404) {
+					b = {messages: [], close: {code: 1006, reason: "session gone"}};
+				} else if (!r.ok) {
+					throw r.status;
+				} else {
+					b = await r.json();
+				}
+			} catch (err) {
+				if (this.readyState === WebSocket.OPEN) {
+					this.failed();
+				}
+				return
+			}
+			for (let data of b.messages) {
+				if (this.onmessage) {
+					this.onmessage({data});
+				}
+			}
+			if (b.close) {
+				this.closed(b.close);
+			}
+		}
+	}
+	send(m) {
+		if (this.ws) {
+			this.ws.send(m);
+			return
+		}
+		// One at a time, to keep them in order.
+		this.sending = this.sending.then(() => fetch(this.url, {method: "POST", body: m})).catch(() => {});
+	}
+	close() {
+		if (this.ws) {
+			this.readyState = WebSocket.CLOSING;
+			this.ws.close();
+			return
+		}
+		if (this.readyState === WebSocket.OPEN) {
+			this.readyState = WebSocket.CLOSING;
+			this.hangup().then(() => this.closed({code: 1005, reason: ""}));
+		} else if (this.readyState === WebSocket.CONNECTING) {
+			// poll hangs up once the session's open.
+			this.readyState = WebSocket.CLOSING;
+		}
+	}
+	hangup() {
+		this.abort.abort();
+		return this.sending.then(() => fetch(this.url, {method: "DELETE"})).catch(() => {});
+	}
+}
+
+// calloff is how cancel calls off signalling on ws.
+let calloff = ws => {
+	if (ws.readyState === WebSocket.OPEN) {
+		ws.send("cancel");
+	}
+	ws.close();
+}
+
+// codeattempts is how many times newwormhole tries for a slot again, if it
+// loses the one it had or the server has none free.
+const codeattempts = 3;
+
+// newwormhole creates wormhole, the A side. The code expires after ttl
+// seconds unless renewed with the function it returns. With norelay, the
+// peer's relay candidates are ignored. If the slot is lost while waiting,
+// it gets a new code and passes it to oncode. If want is set, it's the slot
+// and password to use instead of new ones, and losing the slot is an error.
+export let newwormhole = async (pc, ttl, norelay, oncode, want) => {
+	let ws;
 	let key, slot, pass;
+	let attempts = 0;
+	// rebookuntil is when to give up booking the slot again, if the
+	// signalling server drops us while waiting for the peer, e.g. to
+	// restart.
+	let rebookuntil = 0;
 	let slotC, connC;
 	let slotP = new Promise((resolve, reject) => {
 		slotC = {resolve, reject};
@@ -26,31 +279,71 @@ export let newwormhole = async (pc) => {
 	let connP = new Promise((resolve, reject) => {
 		connC = {resolve, reject};
 	});
-	ws.onmessage = async m => {
+	let cancelled = false;
+	cancellers.set(pc, () => {
+		cancelled = true;
+		calloff(ws);
+		slotC.reject("cancelled");
+		connC.reject("cancelled");
+	});
+	// Start gathering candidates while waiting for the peer, holding on
+	// to them until there's a key to send them with, after the offer.
+	let pending = [];
+	let offerP;
+	pc.onicecandidate = e => {
+		if (!e.candidate) {
+			return
+		}
+		if (pending) {
+			pending.push(e.candidate);
+		} else {
+			ws.send(util.seal(key, JSON.stringify(e.candidate)));
+		}
+	}
+	// newcode takes slot s, with a new password to go with it. The first
+	// code is returned, and later ones go to oncode.
+	let newcode = s => {
+		slot = s;
+		pass = want ? want[1] : genpassword(2);
+		console.log("assigned slot:", slot);
+		if (offerP) {
+			oncode(slot + "-" + pass);
+			return
+		}
+		slotC.resolve(slot + "-" + pass);
+		offerP = pc.createOffer().then(offer => pc.setLocalDescription(offer));
+	}
+	let onmessage = async m => {
+		if (rebookuntil) {
+			// The server's telling us the slot we booked again, or another
+			// one if ours was taken.
+			rebookuntil = 0;
+			if (m.data !== slot) {
+				newcode(m.data);
+			}
+			return
+		}
 		if (!slot) {
-			slot = m.data;
-			pass = genpassword(2);
-			console.log("assigned slot:", slot);
-			slotC.resolve(slot + "-" + pass);
+			newcode(m.data);
 			return
 		}
 		if (!key) {
 			console.log("got pake message a:", m.data);
-			let msgB;
-			[key, msgB] = util.exchange(pass, m.data);
+			let msgB, h;
+			[key, msgB, h] = util.exchange(pass, m.data);
 			console.log("message b:", msgB);
 			if (key == null) {
 				connC.reject("couldn't generate key")
 			}
+			keep(pc, h);
 			console.log("generated key");
 			ws.send(msgB);
-			pc.onicecandidate=e=>{
-				if (e.candidate) {
-					ws.send(util.seal(key, JSON.stringify(e.candidate)));
-				}
+			await offerP;
+			ws.send(util.seal(key, describe(pc)));
+			for (let c of pending) {
+				ws.send(util.seal(key, JSON.stringify(c)));
 			}
-			await pc.setLocalDescription(await pc.createOffer());
-			ws.send(util.seal(key, JSON.stringify(pc.localDescription)));
+			pending = null;
 			return
 		}
 		let jsonmsg = util.open(key, m.data);
@@ -62,61 +355,116 @@ export let newwormhole = async (pc) => {
 			return
 		}
 		let msg = JSON.parse(jsonmsg);
+		if (msg.type === "offer" || msg.type === "answer" || msg.version) {
+			let reason = incompatible(msg);
+			if (reason) {
+				ws.close();
+				connC.reject(reason);
+				return
+			}
+		}
 		if (msg.type === "offer") {
-			await pc.setRemoteDescription(new RTCSessionDescription(msg));
+			await pc.setRemoteDescription(new RTCSessionDescription(remote(msg, norelay)));
 			await pc.setLocalDescription(await pc.createAnswer());
-			ws.send(util.seal(key, JSON.stringify(pc.localDescription)))
+			ws.send(util.seal(key, describe(pc)))
 			return
 		}
 		if (msg.type === "answer") {
-			await pc.setRemoteDescription(new RTCSessionDescription(msg));
+			await pc.setRemoteDescription(new RTCSessionDescription(remote(msg, norelay)));
 			return
 		}
 		if (msg.candidate) {
-			pc.addIceCandidate(new RTCIceCandidate(msg));
+			if (!(norelay && relayed(msg.candidate))) {
+				pc.addIceCandidate(new RTCIceCandidate(msg));
+			}
 			return
 		}
 		console.log("unknown message type", msg)
 	}
-	ws.onopen = e => {
-		console.log("websocket session established")
-	}
-	ws.onerror = e => {
-		connC.reject("couldn't connect to signalling server")
-		console.log("websocket session error", e)
+	let book = query => {
+		ws = new Signal(signalserver + query);
+		ws.onmessage = onmessage;
+		ws.onopen = e => {
+			console.log("websocket session established")
+		}
+		ws.onerror = e => {
+			console.log("websocket session error", e)
+		}
+		ws.onclose = e => {
+			if (cancelled) {
+				return
+			}
+			if (e.code === 4404) {
+				connC.reject("no such slot")
+			} else if (e.code === 4429) {
+				connC.reject("slot busy")
+			} else if (e.code === 4423 && !connectedto(pc)) {
+				// Somebody else tried our code. Don't connect to whoever
+				// has it.
+				pc.close();
+				connC.reject("somebody else tried the code")
+			} else if ((e.code === 4409 || e.code === 4503) && !key && !want && attempts < codeattempts) {
+				// Somebody else took our slot while we were away from the
+				// server, or it has none free for now, so try for another.
+				let delay = e.code === 4503 ? 1000 * 2**attempts : 0;
+				attempts++;
+				console.log("couldn't get slot, trying again in", delay, "ms");
+				setTimeout(() => book("?ttl=" + ttl), delay);
+			} else if (e.code === 4409 || e.code === 4503) {
+				(slot ? connC : slotC).reject("couldn't get slot")
+			} else if (e.code === 4408) {
+				connC.reject("timed out")
+			} else if (e.code === 4410) {
+				connC.reject("peer cancelled")
+			} else if (slot && !key && (e.code === 1001 || e.code === 1006)) {
+				if (!rebookuntil) {
+					rebookuntil = Date.now() + 60*1000;
+				}
+				if (Date.now() > rebookuntil) {
+					connC.reject("couldn't connect to signalling server")
+					return
+				}
+				console.log("lost the signalling server, booking the slot again")
+				setTimeout(() => book("?" + new URLSearchParams({ttl, slot})), 1000);
+			} else if (e.code === 1006) {
+				(slot ? connC : slotC).reject("couldn't connect to signalling server")
+			} else {
+				console.log("websocket session closed", e)
+			}
+		}
 	}
-	ws.onclose = e => {
-		if (e.code === 404) {
-			connC.reject("no such slot")
-		} else if (e.code === 500) {
-			connC.reject("couldn't get slot")
-		} else if (e.code === 408) {
-			connC.reject("timed out")
-		} else {
-			console.log("websocket session closed", e)
+	book("?" + new URLSearchParams(want ? {ttl, slot: want[0]} : {ttl}));
+
+	let renew = () => {
+		if (!key) {
+			ws.send("renew");
 		}
 	}
 
-	return [await slotP, connP];
+	return [await slotP, connP, renew];
 }
 
-// dial joins a wormhole, the B side.
-export let dial = async (pc, code) => {
+// dial joins a wormhole, the B side. See newwormhole for norelay.
+export let dial = async (pc, code, norelay) => {
 	let [slot, ...passparts] = code.split("-");
 	let pass = passparts.join("-");
 
 	console.log("dialling slot:", slot);
 
-	let ws = new WebSocket(signalserver+slot);
+	let ws = new Signal(signalserver+slot);
 	let key;
 	let connC;
 	let connP = new Promise((resolve, reject) => {
 		connC = {resolve, reject};
 	});
+	cancellers.set(pc, () => {
+		calloff(ws);
+		connC.reject("cancelled");
+	});
 	ws.onmessage = async m => {
 		if (!key) {
 			console.log("got pake message b:", m.data);
-			key = util.finish(m.data);
+			key = util.finish(handles.get(pc), m.data);
 			if (key == null) {
 				connC.reject("couldn't generate key")
 			}
@@ -137,25 +485,37 @@ export let dial = async (pc, code) => {
 			return
 		}
 		let msg = JSON.parse(jmsg);
+		if (msg.type === "offer" || msg.type === "answer" || msg.version) {
+			let reason = incompatible(msg);
+			if (reason) {
+				ws.send(util.seal(key, JSON.stringify({version: protocol, minversion: minprotocol})));
+				ws.close();
+				connC.reject(reason);
+				return
+			}
+		}
 		if (msg.type === "offer") {
-			await pc.setRemoteDescription(new RTCSessionDescription(msg));
+			await pc.setRemoteDescription(new RTCSessionDescription(remote(msg, norelay)));
 			await pc.setLocalDescription(await pc.createAnswer());
-			ws.send(util.seal(key, JSON.stringify(pc.localDescription)))
+			ws.send(util.seal(key, describe(pc)))
 			return
 		}
 		if (msg.type === "answer") {
-			await pc.setRemoteDescription(new RTCSessionDescription(msg));
+			await pc.setRemoteDescription(new RTCSessionDescription(remote(msg, norelay)));
 			return
 		}
 		if (msg.candidate) {
-			pc.addIceCandidate(new RTCIceCandidate(msg));
+			if (!(norelay && relayed(msg.candidate))) {
+				pc.addIceCandidate(new RTCIceCandidate(msg));
+			}
 			return
 		}
 		console.log("unknown message type", msg)
 	}
 	ws.onopen = async e => {
 		console.log("websocket opened")
-		let msgA = util.start(pass)
+		let [h, msgA] = util.start(pass)
+		keep(pc, h);
 		if (msgA == null) {
 			connC.reject("couldn't generate A's PAKE message")
 		}
@@ -167,15 +527,46 @@ export let dial = async (pc, code) => {
 		console.log("websocket session error", e)
 	}
 	ws.onclose = e => {
-		if (e.code === 404) {
+		if (e.code === 4404) {
 			connC.reject("no such slot")
-		} else if (e.code === 500) {
+		} else if (e.code === 4429) {
+			connC.reject("slot busy")
+		} else if (e.code === 4423 && !connectedto(pc)) {
+			pc.close();
+			connC.reject("somebody else tried the code")
+		} else if (e.code === 4503) {
 			connC.reject("couldn't get slot")
-		} else if (e.code === 408) {
+		} else if (e.code === 4408) {
 			connC.reject("timed out")
+		} else if (e.code === 4410) {
+			connC.reject("peer cancelled")
 		} else {
 			console.log("websocket session closed", e)
 		}
 	}
 	return await connP
 }
+
+// rendezvous meets a device paired with this one on slot, with pass, both
+// derived from the secret they share. Whichever gets there first waits for
+// the other, so neither needs a code. See newwormhole for ttl and norelay.
+export let rendezvous = async (pc, slot, pass, ttl, norelay) => {
+	for (let attempt = 0; ; attempt++) {
+		try {
+			return await dial(pc, slot + "-" + pass, norelay);
+		} catch (err) {
+			if (err !== "no such slot") {
+				throw err;
+			}
+		}
+		try {
+			let [, finish] = await newwormhole(pc, ttl, norelay, null, [slot, pass]);
+			return await finish;
+		} catch (err) {
+			if (err !== "couldn't get slot" || attempt >= 3) {
+				throw err;
+			}
+			// The peer booked it at the same time we did. Join it instead.
+		}
+	}
+}
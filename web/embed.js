@@ -0,0 +1,72 @@
+// embed.js puts the web client in a frame on another site, so it can offer
+// sending files by wormhole without sending people away.
+//
+//	<div id="wormhole"></div>
+//	<script type="module">
+//	import { embed } from 'https://webwormhole.io/embed.js';
+//	let w = embed(document.getElementById("wormhole"), {
+//		theme: {background: "#fff", color: "#333"},
+//	});
+//	w.on("code", e => console.log("share", e.code));
+//	w.on("progress", e => console.log(e.direction, e.name, e.offset, e.size));
+//	w.on("connected", () => w.send(document.querySelector("input[type=file]").files));
+//	</script>
+//
+// Options are server, the URL of the webwormhole server to use, by default
+// the one this script came from; theme, CSS values for background, color,
+// fontFamily and fontSize; lang, the language to show it in, e.g. "es", if
+// it's been translated into it (see i18n.js); and only and transport, as
+// the URL parameters of the same names. Events are ready, code, connected, progress, sent,
+// received, disconnected and error. The server has to allow the site to
+// frame it, see ww server -embed-origins.
+
+export let embed = (parent, options = {}) => {
+	let server = new URL("./", options.server || import.meta.url);
+	let page = options.lang ? new URL(options.lang + "/", server) : server;
+	let params = new URLSearchParams({embed: "1"});
+	for (let k of ["only", "transport"]) {
+		if (options[k]) {
+			params.set(k, options[k]);
+		}
+	}
+	let frame = document.createElement("iframe");
+	frame.src = page.href + "?" + params;
+	frame.style.border = "none";
+	frame.style.width = "100%";
+	frame.style.height = "100%";
+
+	let handlers = {};
+	let onmessage = e => {
+		if (e.source !== frame.contentWindow || e.origin !== server.origin || !e.data || e.data.type !== "webwormhole") {
+			return
+		}
+		for (let fn of handlers[e.data.event] || []) {
+			fn(e.data);
+		}
+	}
+	window.addEventListener("message", onmessage);
+	let post = msg => frame.contentWindow.postMessage(Object.assign({type: "webwormhole"}, msg), server.origin);
+	frame.addEventListener("load", () => post({command: "init", theme: options.theme}));
+	parent.appendChild(frame);
+
+	return {
+		frame,
+		// on calls fn with each event of the type given.
+		on(event, fn) {
+			(handlers[event] = handlers[event] || []).push(fn);
+		},
+		// send sends files, a FileList or array of File, once connected.
+		send(files) {
+			post({command: "send", files: Array.from(files)});
+		},
+		// close disconnects from the peer, or calls off connecting to it.
+		close() {
+			post({command: "close"});
+		},
+		// remove takes the frame off the page.
+		remove() {
+			window.removeEventListener("message", onmessage);
+			frame.remove();
+		},
+	};
+}
@@ -0,0 +1,111 @@
+// Folders are sent as tar streams, as ww sends directories, for it to
+// unpack as they arrive. util.tarstream makes the headers, and the stream
+// is a Blob of them and the folder's files, which the browser only reads
+// as it's sent. Folders come from the File System Access API, as handles,
+// or from older browsers as entries when dropped, or as files with their
+// paths from a webkitdirectory input.
+
+// tarfile returns the tar stream of the folder called name, with entries,
+// a list of {path, file} with paths relative to it and file null for
+// directories, as a File like any other to send. Its archive is "tar", for
+// the header.
+export let tarfile = (name, entries) => {
+	entries = [{path: "", file: null}].concat(entries);
+	let [size, headers] = util.tarstream(entries.map(e => ({
+		name: e.path === "" ? name : name + "/" + e.path,
+		size: e.file ? e.file.size : 0,
+		modified: e.file ? e.file.lastModified : 0,
+		dir: !e.file,
+	})));
+	if (headers === null) {
+		throw "could not pack " + name;
+	}
+	let parts = [];
+	entries.forEach((e, i) => {
+		parts.push(headers[i]);
+		if (e.file) {
+			parts.push(e.file);
+			parts.push(new Uint8Array((512 - e.file.size%512) % 512));
+		}
+	});
+	parts.push(new Uint8Array(1024));
+	let f = new File(parts, name + ".tar", {type: "application/x-tar"});
+	if (f.size !== size) {
+		throw "could not pack " + name;
+	}
+	f.archive = "tar";
+	return f;
+}
+
+// byname sorts a list of things with names as ww walks directories.
+let byname = list => list.sort((a, b) => a.name < b.name ? -1 : a.name > b.name ? 1 : 0);
+
+// walkhandle lists what's in the folder of handle, a
+// FileSystemDirectoryHandle, as entries for tarfile.
+export let walkhandle = async (handle, prefix = "") => {
+	let children = [];
+	for await (let child of handle.values()) {
+		children.push(child);
+	}
+	let entries = [];
+	for (let child of byname(children)) {
+		let path = prefix + child.name;
+		if (child.kind === "directory") {
+			entries.push({path, file: null});
+			entries = entries.concat(await walkhandle(child, path + "/"));
+		} else {
+			entries.push({path, file: await child.getFile()});
+		}
+	}
+	return entries;
+}
+
+// packhandle returns the tar stream of the folder of handle.
+export let packhandle = async handle => tarfile(handle.name, await walkhandle(handle));
+
+// walkentry lists what's in the folder of entry, a
+// FileSystemDirectoryEntry, as entries for tarfile.
+export let walkentry = async (entry, prefix = "") => {
+	let reader = entry.createReader();
+	let children = [];
+	while (true) {
+		// They come a few at a time, until there are none left.
+		let some = await new Promise((resolve, reject) => reader.readEntries(resolve, reject));
+		if (some.length === 0) {
+			break;
+		}
+		children = children.concat(some);
+	}
+	let entries = [];
+	for (let child of byname(children)) {
+		let path = prefix + child.name;
+		if (child.isDirectory) {
+			entries.push({path, file: null});
+			entries = entries.concat(await walkentry(child, path + "/"));
+		} else {
+			entries.push({path, file: await new Promise((resolve, reject) => child.file(resolve, reject))});
+		}
+	}
+	return entries;
+}
+
+// packfiles returns the tar stream of the folder files were picked from,
+// with a webkitdirectory input, which gives each file's path from the
+// folder's parent. Directories with nothing in them aren't there to go in.
+export let packfiles = files => {
+	let name = files[0].webkitRelativePath.split("/")[0];
+	let dirs = new Set();
+	let entries = [];
+	for (let f of Array.from(files).sort((a, b) => a.webkitRelativePath < b.webkitRelativePath ? -1 : 1)) {
+		let elems = f.webkitRelativePath.split("/").slice(1);
+		for (let i = 1; i < elems.length; i++) {
+			let dir = elems.slice(0, i).join("/");
+			if (!dirs.has(dir)) {
+				dirs.add(dir);
+				entries.push({path: dir, file: null});
+			}
+		}
+		entries.push({path: elems.join("/"), file: f});
+	}
+	return tarfile(name, entries);
+}
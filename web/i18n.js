@@ -0,0 +1,130 @@
+// The page is in English unless its path starts with a language it has
+// been translated into, e.g. https://webwormhole.io/es/, which ww server
+// serves the same page at. ww prints URLs like that for senders to hand
+// to receivers, with ww -lang, or in the language of their locale.
+
+// translations are the page's strings by language, keyed by their English.
+// In those with %s, it stands for what's filled in.
+const translations = {
+	de: {
+		"OPEN": "ÖFFNEN",
+		"OPEN FOLDER": "ORDNER ÖFFNEN",
+		"WEB WORMHOLE LETS YOU SEND FILES FROM ONE PLACE TO ANOTHER": "MIT WEB WORMHOLE SCHICKST DU DATEIEN VON EINEM ORT ZUM ANDEREN",
+		"OPEN IMAGES, PDFS AND TEXT": "BILDER, PDFS UND TEXT ÖFFNEN",
+		"LOADING...": "LADEN...",
+		"GOT A CODE? TYPE HERE": "CODE BEKOMMEN? HIER EINGEBEN",
+		"PAIR A DEVICE": "GERÄT KOPPELN",
+		"WAITING FOR FILES": "WARTE AUF DATEIEN",
+		"OR DRAG FILES TO SEND": "ODER DATEIEN ZUM SENDEN HIERHER ZIEHEN",
+		"IDLE - DISCONNECTING IN %s": "UNTÄTIG - TRENNE IN %s",
+		"CODE EXPIRES IN %s - RENEW": "CODE LÄUFT IN %s AB - ERNEUERN",
+		"TO %s": "AN %s",
+		"FORGET": "VERGESSEN",
+		"Forget %s? You'll need to pair with it again.": "%s vergessen? Du musst das Gerät dann neu koppeln.",
+		"Name this device, as the other will know it.": "Name für dieses Gerät, wie das andere es kennen soll.",
+		"PAIRED WITH %s": "GEKOPPELT MIT %s",
+		"DISCONNECTED - THE OTHER SIDE SENT FILES BUT THIS PAGE ONLY SENDS": "GETRENNT - DIE ANDERE SEITE HAT DATEIEN GESCHICKT, ABER DIESE SEITE SENDET NUR",
+		"DISCONNECTED AFTER BEING IDLE": "GETRENNT, WEIL NICHTS LOS WAR",
+		"DISCONNECTED": "GETRENNT",
+		"NETWORK ERROR TRY AGAIN": "NETZWERKFEHLER, NOCH EINMAL VERSUCHEN",
+		"WAITING FOR %s": "WARTE AUF %s",
+		"WAITING FOR THE OTHER SIDE - SHARE CODE OR URL": "WARTE AUF DIE ANDERE SEITE - CODE ODER URL TEILEN",
+		"GOT A NEW CODE - SHARE THIS ONE INSTEAD": "NEUER CODE - STATTDESSEN DIESEN TEILEN",
+		"CONNECTING": "VERBINDE",
+		"CANCEL": "ABBRECHEN",
+		"CANCELLED": "ABGEBROCHEN",
+		"THE OTHER SIDE CANCELLED": "DIE ANDERE SEITE HAT ABGEBROCHEN",
+		"BAD KEY TRY AGAIN": "FALSCHER SCHLÜSSEL, NOCH EINMAL VERSUCHEN",
+		"NOT AUTHORIZED": "NICHT BERECHTIGT",
+		"NO SUCH SLOT": "DIESEN CODE GIBT ES NICHT",
+		"SOMEBODY ELSE TRIED YOUR CODE - IT MAY HAVE BEEN INTERCEPTED": "JEMAND ANDERES HAT DEINEN CODE VERSUCHT - ER WURDE VIELLEICHT ABGEFANGEN",
+		"SOMEBODY ELSE IS ALREADY USING THIS CODE": "JEMAND ANDERES BENUTZT DIESEN CODE SCHON",
+		"CODE TIMED OUT GENERATE ANOTHER": "CODE ABGELAUFEN, EINEN NEUEN ERZEUGEN",
+		"THE OTHER SIDE NEEDS TO UPDATE": "DIE ANDERE SEITE MUSS AKTUALISIEREN",
+		"RELOAD THE PAGE TO UPDATE": "ZUM AKTUALISIEREN DIE SEITE NEU LADEN",
+		"COULD NOT CONNECT TRY AGAIN": "KEINE VERBINDUNG, NOCH EINMAL VERSUCHEN",
+		"NEW WORMHOLE": "NEUES WORMHOLE",
+		"JOIN WORMHOLE": "WORMHOLE BEITRETEN",
+		"bytes": "Bytes",
+		"RECEIPT - CHECK IT WITH WW VERIFY -KEY %s": "QUITTUNG - PRÜFEN MIT WW VERIFY -KEY %s",
+		"RESUME SENDING FILES LEFT FROM BEFORE (%s)": "ÜBRIGE DATEIEN VON VORHIN WEITER SENDEN (%s)",
+		"SENDING THEM ONCE CONNECTED": "SIE WERDEN NACH DEM VERBINDEN GESENDET",
+	},
+	es: {
+		"OPEN": "ABRIR",
+		"OPEN FOLDER": "ABRIR CARPETA",
+		"WEB WORMHOLE LETS YOU SEND FILES FROM ONE PLACE TO ANOTHER": "WEB WORMHOLE TE PERMITE ENVIAR ARCHIVOS DE UN LUGAR A OTRO",
+		"OPEN IMAGES, PDFS AND TEXT": "ABRIR IMÁGENES, PDFS Y TEXTO",
+		"LOADING...": "CARGANDO...",
+		"GOT A CODE? TYPE HERE": "¿TIENES UN CÓDIGO? ESCRÍBELO AQUÍ",
+		"PAIR A DEVICE": "VINCULAR UN DISPOSITIVO",
+		"WAITING FOR FILES": "ESPERANDO ARCHIVOS",
+		"OR DRAG FILES TO SEND": "O ARRASTRA ARCHIVOS PARA ENVIAR",
+		"IDLE - DISCONNECTING IN %s": "INACTIVO - DESCONECTANDO EN %s",
+		"CODE EXPIRES IN %s - RENEW": "EL CÓDIGO CADUCA EN %s - RENOVAR",
+		"TO %s": "A %s",
+		"FORGET": "OLVIDAR",
+		"Forget %s? You'll need to pair with it again.": "¿Olvidar %s? Tendrás que vincularlo de nuevo.",
+		"Name this device, as the other will know it.": "Nombre de este dispositivo, como lo conocerá el otro.",
+		"PAIRED WITH %s": "VINCULADO CON %s",
+		"DISCONNECTED - THE OTHER SIDE SENT FILES BUT THIS PAGE ONLY SENDS": "DESCONECTADO - EL OTRO LADO ENVIÓ ARCHIVOS PERO ESTA PÁGINA SOLO ENVÍA",
+		"DISCONNECTED AFTER BEING IDLE": "DESCONECTADO POR INACTIVIDAD",
+		"DISCONNECTED": "DESCONECTADO",
+		"NETWORK ERROR TRY AGAIN": "ERROR DE RED, INTÉNTALO DE NUEVO",
+		"WAITING FOR %s": "ESPERANDO A %s",
+		"WAITING FOR THE OTHER SIDE - SHARE CODE OR URL": "ESPERANDO AL OTRO LADO - COMPARTE EL CÓDIGO O LA URL",
+		"GOT A NEW CODE - SHARE THIS ONE INSTEAD": "CÓDIGO NUEVO - COMPARTE ESTE EN SU LUGAR",
+		"CONNECTING": "CONECTANDO",
+		"CANCEL": "CANCELAR",
+		"CANCELLED": "CANCELADO",
+		"THE OTHER SIDE CANCELLED": "EL OTRO LADO CANCELÓ",
+		"BAD KEY TRY AGAIN": "CLAVE INCORRECTA, INTÉNTALO DE NUEVO",
+		"NOT AUTHORIZED": "NO AUTORIZADO",
+		"NO SUCH SLOT": "ESE CÓDIGO NO EXISTE",
+		"SOMEBODY ELSE TRIED YOUR CODE - IT MAY HAVE BEEN INTERCEPTED": "ALGUIEN MÁS PROBÓ TU CÓDIGO - PUEDE QUE LO HAYAN INTERCEPTADO",
+		"SOMEBODY ELSE IS ALREADY USING THIS CODE": "ALGUIEN MÁS YA ESTÁ USANDO ESTE CÓDIGO",
+		"CODE TIMED OUT GENERATE ANOTHER": "EL CÓDIGO CADUCÓ, GENERA OTRO",
+		"THE OTHER SIDE NEEDS TO UPDATE": "EL OTRO LADO TIENE QUE ACTUALIZAR",
+		"RELOAD THE PAGE TO UPDATE": "RECARGA LA PÁGINA PARA ACTUALIZAR",
+		"COULD NOT CONNECT TRY AGAIN": "NO SE PUDO CONECTAR, INTÉNTALO DE NUEVO",
+		"NEW WORMHOLE": "NUEVO WORMHOLE",
+		"JOIN WORMHOLE": "UNIRSE AL WORMHOLE",
+		"bytes": "bytes",
+		"RECEIPT - CHECK IT WITH WW VERIFY -KEY %s": "RECIBO - COMPRUÉBALO CON WW VERIFY -KEY %s",
+		"RESUME SENDING FILES LEFT FROM BEFORE (%s)": "SEGUIR ENVIANDO LOS ARCHIVOS PENDIENTES (%s)",
+		"SENDING THEM ONCE CONNECTED": "SE ENVIARÁN AL CONECTAR",
+	},
+};
+
+// lang is the language the page is in, from the first part of its path
+// after any namespace's.
+export const lang = (() => {
+	let first = location.pathname.replace(/^\/ns\/[^/]+/, "").split("/")[1];
+	return translations[first] ? first : "en";
+})();
+
+// t returns s in the page's language, with each %s replaced by the next of
+// args.
+export let t = (s, ...args) => {
+	let translated = (translations[lang] || {})[s] || s;
+	return translated.replace(/%s/g, () => args.length ? args.shift() : "%s");
+}
+
+// translatepage translates the text of elements marked with data-t, and
+// their placeholders and button labels.
+export let translatepage = () => {
+	document.documentElement.lang = lang;
+	for (let el of document.querySelectorAll("[data-t]")) {
+		for (let node of el.childNodes) {
+			if (node.nodeType === Node.TEXT_NODE && node.textContent.trim() !== "") {
+				node.textContent = t(node.textContent.trim());
+			}
+		}
+		if (el.placeholder) {
+			el.placeholder = t(el.placeholder);
+		}
+		if (el.type === "submit") {
+			el.value = t(el.value);
+		}
+	}
+}
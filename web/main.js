@@ -1,21 +1,85 @@
-import { goready, newwormhole, dial } from './dial.js';
+import { goready, authorize, relays, newwormhole, dial, rendezvous, exportkey, release, cancel } from './dial.js';
+import { t, translatepage } from './i18n.js';
+import { handles, keep, forget, forgetall, kept, reopen } from './queue.js';
+import { packhandle, walkentry, tarfile, packfiles } from './folder.js';
 
 // TODO multiple streams.
 let receiving;
 let sending;
 let datachannel;
+let peerconnection;
 
-let pick = e => {
+let pick = async e => {
 	let files = document.getElementById("filepicker").files;
 	for (let i = 0; i < files.length; i++) {
-		send(files[i]);
+		await send(files[i]);
 	}
 }
 
-let drop = e => {
-	let files = e.dataTransfer.files;
+// pickhandles picks files with the File System Access API instead of the
+// file input, for handles to them to keep.
+let pickhandles = async e => {
+	e.preventDefault();
+	let picked;
+	try {
+		picked = await showOpenFilePicker({multiple: true});
+	} catch (err) {
+		// Dismissed.
+		return;
+	}
+	for (let handle of picked) {
+		await send(await handle.getFile(), handle);
+	}
+}
+
+// pickfolder sends the folder picked, as a tar stream.
+let pickfolder = async e => {
+	let files = document.getElementById("folderpicker").files;
+	if (files.length > 0) {
+		await send(packfiles(files));
+	}
+}
+
+// pickfolderhandle picks a folder with the File System Access API instead
+// of the folder input, for a handle to it to keep.
+let pickfolderhandle = async e => {
+	e.preventDefault();
+	let handle;
+	try {
+		handle = await showDirectoryPicker();
+	} catch (err) {
+		// Dismissed.
+		return;
+	}
+	await send(await packhandle(handle), handle);
+}
+
+let drop = async e => {
+	let files = Array.from(e.dataTransfer.files);
+	let items = Array.from(e.dataTransfer.items || []).filter(item => item.kind === "file");
+	if (items.length !== files.length) {
+		items = [];
+	}
+	// The items are only there while the event is handled, so get all their
+	// handles, or failing that entries, before waiting on any. Folders are
+	// only told apart from files by them.
+	let dropped = items.map(item => {
+		if (handles && item.getAsFileSystemHandle) {
+			return item.getAsFileSystemHandle();
+		}
+		return item.webkitGetAsEntry ? item.webkitGetAsEntry() : null;
+	});
 	for (let i = 0; i < files.length; i++) {
-		send(files[i]);
+		let d = await dropped[i];
+		if (d && d.kind === "file") {
+			await send(await d.getFile(), d);
+		} else if (d && d.kind === "directory") {
+			await send(await packhandle(d), d);
+		} else if (d && d.isDirectory) {
+			await send(tarfile(d.name, await walkentry(d)));
+		} else {
+			await send(files[i]);
+		}
 	}
 }
 
@@ -28,11 +92,15 @@ class DataChannelWriter {
 		this.dc.onbufferedamountlow = () => {
 			this.resolve()
 		};
+		// Don't keep writers waiting on a channel that's gone.
+		this.dc.addEventListener("close", () => this.resolve());
 		this.ready = new Promise((resolve) => {
 			this.resolve = resolve;
 			this.resolve();
 		});
 	}
+	// write writes buf, and returns whether it could before the channel
+	// closed.
 	async write(buf) {
 		for (let offset = 0; offset < buf.length; offset += this.chunksize) {
 			let end = offset+this.chunksize;
@@ -40,31 +108,98 @@ class DataChannelWriter {
 				end = buf.length;
 			}
 			await this.ready;
+			if (this.dc.readyState !== "open") {
+				return false;
+			}
 			this.dc.send(buf.subarray(offset, end));
 		}
 		if (this.dc.bufferedAmount >= this.bufferedAmountHighThreshold) {
 			this.ready = new Promise((resolve) => this.resolve = resolve);
 		}
+		return true;
 	}
 }
 
-let send = async f => {
-	if (sending) {
-		console.log("haven't finished sending", sending.name);
+// size formats a number of bytes in the user's locale, in powers of 1000
+// like ww does, e.g. 1.5 MB.
+let size = n => {
+	const units = [t("bytes"), "kB", "MB", "GB", "TB"];
+	let i = 0;
+	while (n >= 999.95 && i < units.length-1) {
+		n /= 1000;
+		i++;
+	}
+	let digits = i == 0 ? 0 : 1;
+	return n.toLocaleString(undefined, {minimumFractionDigits: digits, maximumFractionDigits: digits}) + " " + units[i];
+}
+
+// abandon marks transfer, being sent or received, as cut short, e.g. by
+// cancelling.
+let abandon = transfer => {
+	transfer.li.removeChild(transfer.progress);
+	transfer.li.classList.add("cancelled");
+}
+
+// queue are the files waiting to be sent, as a list of {f, key}, with the
+// key of the file's handle if it's kept. leftover are those that weren't
+// sent before the connection closed, for the user to resume sending to the
+// next peer, along with those whose handles were kept from before the page
+// was loaded, which are {key, handle} until they're reopened.
+let queue = [];
+let leftover = [];
+let draining = false;
+
+// send queues f to be sent, and keeps handle, if there is one, so that
+// it's still there to send if the page is reloaded.
+let send = async (f, handle) => {
+	if (only === "receive") {
+		return
+	}
+	queue.push({f, key: handle ? await keep(handle) : null});
+	sendnext();
+}
+
+// sendnext sends the files queued, one at a time, unless it already is.
+let sendnext = async () => {
+	if (draining) {
 		return
 	}
+	draining = true;
+	while (queue.length > 0 && datachannel && datachannel.readyState === "open") {
+		let next = queue.shift();
+		if (!await sendfile(next)) {
+			// Cut off, so what's left is left for the next peer, unless
+			// it was cancelled.
+			if (!next.dropped) {
+				leftover = leftover.concat([next], queue);
+			}
+			queue = [];
+			showleftover();
+			break;
+		}
+		forget(next.key);
+	}
+	draining = false;
+}
 
+// sendfile sends next.f, and returns whether it could before the
+// connection closed.
+let sendfile = async next => {
+	let f = next.f;
 	console.log("sending", f.name);
 	datachannel.send(new TextEncoder('utf8').encode(JSON.stringify({
 		name: f.name,
 		size: f.size,
 		type: f.type,
+		modified: f.lastModified,
+		archive: f.archive,
 	})));
 
-	sending = {f};
+	sending = {f, next};
 	sending.offset = 0;
+	sending.started = new Date();
 	sending.li = document.createElement('li');
-	sending.li.appendChild(document.createTextNode(`↑ ${f.name}`));
+	sending.li.appendChild(document.createTextNode(`↑ ${f.name} (${size(f.size)})`));
 	sending.li.appendChild(document.createElement(`progress`));
 	sending.progress = sending.li.getElementsByTagName("progress")[0];
 	document.getElementById("transfers").appendChild(sending.li);
@@ -88,9 +223,15 @@ let send = async f => {
 			if (end > f.size) {
 				end = f.size;
 			}
-			await writer.write(await read(f.slice(sending.offset, end)));
+			if (!await writer.write(await read(f.slice(sending.offset, end)))) {
+				abandon(sending);
+				sending = null;
+				return false;
+			}
+			active();
 			sending.offset = end;
 			sending.progress.value = sending.offset / f.size;
+			progress("send", f.name, sending.offset, f.size);
 		}
 	} else {
 		let reader = f.stream().getReader();
@@ -99,28 +240,105 @@ let send = async f => {
 			if (done) {
 				break;
 			}
-			await writer.write(value);
+			if (!await writer.write(value)) {
+				reader.cancel();
+				abandon(sending);
+				sending = null;
+				return false;
+			}
+			active();
 			sending.offset += value.length;
 			sending.progress.value = sending.offset / f.size;
+			progress("send", f.name, sending.offset, f.size);
 		}
 	}
 	sending.li.removeChild(sending.progress);
+	if (receipt) {
+		record(f.name, f.size, sending.started, new Response(f).arrayBuffer());
+	}
 	sending = null;
+	emit("sent", {name: f.name, size: f.size});
+	return true;
 }
 
+// showleftover shows how many files are left to resume sending, if any.
+let showleftover = () => {
+	let button = document.getElementById("resume");
+	button.textContent = t("RESUME SENDING FILES LEFT FROM BEFORE (%s)", leftover.length);
+	button.classList.toggle("left", leftover.length > 0 && only !== "receive");
+}
+
+// resume queues the files left over to be sent again, each from its start,
+// asking to read those kept from before the page was loaded first.
+let resume = async () => {
+	let left = leftover;
+	leftover = [];
+	showleftover();
+	let files = (await reopen(left.filter(l => !l.f))).concat(left.filter(l => l.f));
+	queue = queue.concat(files);
+	if (document.body.classList.contains("connected")) {
+		sendnext();
+	} else if (files.length > 0) {
+		document.getElementById("info").innerHTML = t("SENDING THEM ONCE CONNECTED");
+	}
+}
+
+// dropqueue forgets the files queued or left over, and the one being sent,
+// for when the user cancels.
+let dropqueue = () => {
+	queue = [];
+	leftover = [];
+	if (sending) {
+		sending.next.dropped = true;
+	}
+	showleftover();
+	forgetall();
+}
+
+// safetypes are the types of files to open rather than save, when asked
+// to, by extension, like ww receive -open. None of them run anything.
+const safetypes = {
+	png: "image/png",
+	jpg: "image/jpeg",
+	jpeg: "image/jpeg",
+	gif: "image/gif",
+	webp: "image/webp",
+	bmp: "image/bmp",
+	pdf: "application/pdf",
+	txt: "text/plain",
+};
+
+// safetype returns the type to open the file called name as, if it's safe
+// to.
+let safetype = name => {
+	let dot = name.lastIndexOf(".");
+	return dot < 0 ? null : safetypes[name.substring(dot+1).toLowerCase()] || null;
+}
+
+// maxtext is the longest text message to show rather than save, like ww's.
+const maxtext = 1<<20;
+
 // receive is the new message handler.
 //
 // This function cannot be async without carefully thinking through the
 // order of messages coming in.
 let receive = e => {
+	active();
+	if (only === "send") {
+		// Don't take anything from the peer, however it's sent.
+		refused = true;
+		datachannel.close();
+		return
+	}
 	if (!receiving) {
 		receiving = JSON.parse(new TextDecoder('utf8').decode(e.data));
 		receiving.data = new Uint8Array(receiving.size);
 		receiving.offset = 0;
+		receiving.started = new Date();
 		receiving.li = document.createElement('li');
 		receiving.li.appendChild(document.createElement("a"));
 		receiving.a = receiving.li.getElementsByTagName("a")[0];
-		receiving.a.appendChild(document.createTextNode(`↓ ${receiving.name}`));
+		receiving.a.appendChild(document.createTextNode(`↓ ${receiving.name} (${size(receiving.size)})`));
 		receiving.li.appendChild(document.createElement('progress'));
 		receiving.progress = receiving.li.getElementsByTagName("progress")[0];
 		document.getElementById("transfers").appendChild(receiving.li);
@@ -131,64 +349,453 @@ let receive = e => {
 	receiving.data.set(data, receiving.offset);
 	receiving.offset += data.length;
 	receiving.progress.value = receiving.offset / receiving.size;
+	progress("receive", receiving.name, receiving.offset, receiving.size);
 
 	if (receiving.offset > receiving.data.length) {
 		throw "received more bytes than expected";
 	}
 	if (receiving.offset == receiving.data.length) {
-		let blob = new Blob([receiving.data])
-		receiving.a.href = URL.createObjectURL(blob);
-		receiving.a.download = receiving.name;
-		receiving.a.click();
+		let type = safetype(receiving.name);
+		if (receiving.text && receiving.size <= maxtext) {
+			// Show text messages rather than save them.
+			let pre = document.createElement("pre");
+			pre.className = "message";
+			pre.textContent = new TextDecoder('utf8').decode(receiving.data);
+			receiving.li.replaceChild(pre, receiving.a);
+		} else if (document.getElementById("autoopen").checked && type) {
+			// Give it the type ourselves, so the browser shows it as that
+			// and not as whatever it looks like.
+			receiving.a.href = URL.createObjectURL(new Blob([receiving.data], {type}));
+			receiving.a.target = "_blank";
+			if (!window.open(receiving.a.href)) {
+				// Blocked as a popup, so save it instead.
+				receiving.a.download = receiving.name;
+				receiving.a.click();
+			}
+		} else {
+			receiving.a.href = URL.createObjectURL(new Blob([receiving.data]));
+			receiving.a.download = receiving.name;
+			receiving.a.click();
+		}
 		receiving.li.removeChild(receiving.progress);
+		if (receipt) {
+			record(receiving.name, receiving.size, receiving.started, Promise.resolve(receiving.data));
+		}
+		emit("received", {name: receiving.name, size: receiving.size});
 		receiving = null;
 	}
 }
 
-let connect = async e => {
-	let pc = new RTCPeerConnection({"iceServers":[{"urls":"stun:stun.l.google.com:19302"}]});
+// ttl is how long, in seconds, the code of a new wormhole lasts unless
+// renewed.
+const ttl = 10*60;
+
+// transport is the transport policy from the URL, like ww's
+// -transport-policy: all, no-relay to never relay data, or relay-only to
+// always relay it, e.g. https://webwormhole.io/?transport=no-relay
+const transport = new URLSearchParams(location.search).get("transport") || "all";
+
+// only restricts the page to one way: send to only send files and never
+// receive any, or receive to only receive them, e.g.
+// https://webwormhole.io/?only=receive for a "send me files" link. This is
+// for handing out links with a purpose, not a security boundary, as anyone
+// can edit the URL. Nothing in the URL changes the signalling server, which
+// is always the one the page came from.
+const only = new URLSearchParams(location.search).get("only");
+
+// receipt is whether to show a QR code of a receipt of the files
+// transferred once disconnected, like ww's -receipt-qr, for a camera to
+// capture, e.g. https://webwormhole.io/?receipt. It's the manifest ww
+// -manifest-out writes, to check with ww verify and the key shown.
+const receipt = new URLSearchParams(location.search).has("receipt");
+
+// receipted are the files transferred so far, as promises of their
+// entries in the receipt, and receiptkey the key its MAC is under.
+let receipted = [];
+let receiptkey = null;
+
+// gotime formats d as Go formats times in JSON, without trailing zeros.
+let gotime = d => d.toISOString().replace(/\.?0+Z$/, "Z");
+
+// gojson encodes v as JSON as Go does, escaping what it escapes, for MACs
+// to match.
+let gojson = v => JSON.stringify(v).replace(/[<>&\u2028\u2029]/g, c => "\\u" + c.charCodeAt(0).toString(16).padStart(4, "0"));
+
+// record adds a file to the receipt, once data, its contents, resolves.
+let record = (name, size, started, data) => {
+	receipted.push(data.then(async d => ({
+		name,
+		size,
+		sha256: tohex(new Uint8Array(await crypto.subtle.digest("SHA-256", d))),
+		time: gotime(started),
+	})));
+}
+
+// showreceipt shows the receipt of the files transferred as a QR code.
+let showreceipt = async () => {
+	let files = await Promise.all(receipted);
+	receipted = [];
+	let key = await crypto.subtle.importKey("raw", receiptkey, {name: "HMAC", hash: "SHA-256"}, false, ["sign"]);
+	let mac = await crypto.subtle.sign("HMAC", key, new TextEncoder().encode(gojson(files)));
+	let qr = util.qrencode(gojson({files, mac: tohex(new Uint8Array(mac))}));
+	if (qr === null) {
+		return;
+	}
+	document.getElementById("qr").src = URL.createObjectURL(new Blob([qr]));
+	document.getElementById("qr").classList.add("receipt");
+	document.getElementById("info").textContent = t("RECEIPT - CHECK IT WITH WW VERIFY -KEY %s", tohex(receiptkey));
+}
+
+// embedded is whether the page is in a frame on another site, set with the
+// embed URL parameter by embed.js. The site talks to it with postMessage,
+// and gets events back, once it has sent init. See embed.js.
+const embedded = new URLSearchParams(location.search).has("embed") && window.parent !== window;
+
+// embedder is the origin of the site that sent init, which events go to.
+let embedder = null;
+
+// emit tells the embedding site, if any, about event.
+let emit = (event, detail) => {
+	if (embedder) {
+		window.parent.postMessage(Object.assign({type: "webwormhole", event}, detail), embedder);
+	}
+}
+
+// progress emits a progress event for a transfer, at most every 100ms and
+// once it's done.
+let lastprogress = 0;
+let progress = (direction, name, offset, size) => {
+	if (offset < size && Date.now() - lastprogress < 100) {
+		return
+	}
+	lastprogress = Date.now();
+	emit("progress", {direction, name, offset, size});
+}
+
+// themable are the styles an embedding site can set on the page.
+const themable = ["background", "color", "fontFamily", "fontSize"];
+
+let command = async e => {
+	if (e.source !== window.parent || !e.data || e.data.type !== "webwormhole") {
+		return
+	}
+	if (e.data.command === "init") {
+		embedder = e.origin;
+		let theme = e.data.theme || {};
+		for (let k of themable) {
+			if (typeof theme[k] === "string") {
+				document.body.style[k] = theme[k];
+			}
+		}
+		emit("ready");
+		return
+	}
+	if (e.origin !== embedder) {
+		return
+	}
+	if (e.data.command === "send" && datachannel && datachannel.readyState === "open") {
+		for (let f of e.data.files || []) {
+			await send(f);
+		}
+	} else if (e.data.command === "close") {
+		cancelconnection();
+	}
+}
+
+// readytext is what to show once connected.
+const readytext = only === "receive" ? t("WAITING FOR FILES") : t("OR DRAG FILES TO SEND");
+
+// refused is whether the connection was closed for the peer sending
+// something the page doesn't take.
+let refused = false;
+
+// cancelled is whether the connection was closed for the user cancelling.
+let cancelled = false;
+
+// cancelconnection calls off whatever's under way: waiting for the peer or
+// connecting to it, which frees the slot and tells the peer, or sending and
+// receiving, which closes the connection for the peer to stop. Whatever was
+// received of a file so far is dropped.
+let cancelconnection = () => {
+	if (document.body.classList.contains("connected")) {
+		cancelled = true;
+		datachannel.close();
+	} else if (document.body.classList.contains("dialling")) {
+		// connect says it's cancelled once dialling gives up, so the
+		// channel shouldn't say it's disconnected too.
+		datachannel.onclose = null;
+		cancel(peerconnection);
+	}
+}
+
+let countdown = null;
+
+// idletimeout is how long, in seconds, a connection may sit with nothing
+// sent either way before it's closed, like ww's -idle-timeout, and
+// idlewarning how long before then to start counting down. Set the timeout
+// with the idle URL parameter, e.g. https://webwormhole.io/?idle=3600, or 0
+// to never disconnect.
+const idletimeout = Number(new URLSearchParams(location.search).get("idle") || 10*60);
+const idlewarning = 30;
+
+let lastactive = 0;
+let idlewatch = null;
+let idled = false;
+
+let active = () => {
+	lastactive = Date.now();
+}
+
+let watchidle = () => {
+	active();
+	if (!(idletimeout > 0)) {
+		return;
+	}
+	let warned = false;
+	idlewatch = setInterval(() => {
+		let left = Math.round(idletimeout - (Date.now() - lastactive)/1000);
+		if (left > idlewarning) {
+			if (warned) {
+				document.getElementById("info").innerHTML = readytext;
+				warned = false;
+			}
+			return;
+		}
+		if (left <= 0) {
+			clearInterval(idlewatch);
+			idled = true;
+			datachannel.close();
+			return;
+		}
+		warned = true;
+		document.getElementById("info").textContent = t("IDLE - DISCONNECTING IN %s", Math.floor(left/60) + ":" + String(left%60).padStart(2, "0"));
+	}, 1000);
+}
+
+let startcountdown = renew => {
+	let deadline = Date.now() + ttl*1000;
+	let button = document.getElementById("renew");
+	let tick = () => {
+		let left = Math.max(0, Math.round((deadline - Date.now())/1000));
+		button.textContent = t("CODE EXPIRES IN %s - RENEW", Math.floor(left/60) + ":" + String(left%60).padStart(2, "0"));
+	};
+	button.onclick = () => {
+		renew();
+		deadline = Date.now() + ttl*1000;
+		tick();
+	};
+	tick();
+	countdown = setInterval(tick, 1000);
+	button.classList.add("counting");
+}
+
+let stopcountdown = () => {
+	clearInterval(countdown);
+	document.getElementById("renew").classList.remove("counting");
+}
+
+// showcode shows code, and the QR code of the URL to it.
+let showcode = code => {
+	emit("code", {code});
+	document.getElementById("magiccode").value = code;
+	location.hash = code;
+	let qr = util.qrencode(location.href);
+	if (qr === null) {
+		document.getElementById("qr").src = "";
+	} else {
+		document.getElementById("qr").src = URL.createObjectURL(new Blob([qr]));
+	}
+}
+
+// devices are the user's own, paired with PAIR A DEVICE here or ww self
+// pair, as a list of {name, secret, paired} like ww keeps. Codes for
+// transfers between them are derived from the secret, so anyone who can read
+// this site's storage can stand in for them.
+let devices = () => JSON.parse(localStorage.getItem("devices") || "[]");
+
+let savedevices = ds => {
+	localStorage.setItem("devices", JSON.stringify(ds));
+	showdevices();
+}
+
+let tohex = b => Array.from(b, x => x.toString(16).padStart(2, "0")).join("");
+let fromhex = h => new Uint8Array(h.match(/../g).map(x => parseInt(x, 16)));
+
+// showdevices lists the paired devices, to connect to with one click.
+let showdevices = () => {
+	let ul = document.getElementById("devices");
+	ul.innerHTML = "";
+	for (let d of devices()) {
+		let li = document.createElement("li");
+		let go = document.createElement("button");
+		go.type = "button";
+		go.className = "button";
+		go.textContent = t("TO %s", d.name.toUpperCase());
+		go.onclick = e => connect(e, d);
+		let forget = document.createElement("button");
+		forget.type = "button";
+		forget.className = "forget";
+		forget.textContent = t("FORGET");
+		forget.onclick = () => {
+			if (confirm(t("Forget %s? You'll need to pair with it again.", d.name))) {
+				savedevices(devices().filter(x => x.name !== d.name));
+			}
+		};
+		li.appendChild(go);
+		li.appendChild(forget);
+		ul.appendChild(li);
+	}
+}
+
+// pairing is the name to give this device on the other, while pairing.
+let pairing = null;
+
+let startpairing = async e => {
+	await goready;
+	let name = prompt(t("Name this device, as the other will know it."), localStorage.getItem("name") || "browser");
+	if (!name) {
+		return;
+	}
+	localStorage.setItem("name", name);
+	pairing = name;
+	connect(e);
+}
+
+// maxname is the most characters of a paired device's name to keep.
+const maxname = 64;
+
+// cleanname makes what the peer calls itself fit to keep and show, with no
+// control characters and no more than maxname of the rest.
+let cleanname = name => {
+	if (typeof name !== "string") {
+		return "";
+	}
+	return Array.from(name.replace(/\p{C}/gu, "").trim()).slice(0, maxname).join("").trim();
+}
+
+// pair swaps names with the peer instead of sending files, and keeps the
+// secret the handshake exports for later.
+let pair = pc => {
+	let name = pairing;
+	pairing = null;
+	stopcountdown();
+	datachannel.onmessage = e => {
+		let hello = JSON.parse(new TextDecoder('utf8').decode(e.data));
+		let secret = exportkey(pc, "self", 32);
+		release(pc);
+		let peer = cleanname(hello.name);
+		if (!peer || secret === null) {
+			datachannel.close();
+			return;
+		}
+		let ds = devices().filter(x => x.name !== peer);
+		ds.push({name: peer, secret: tohex(secret), paired: new Date().toISOString()});
+		savedevices(ds);
+		datachannel.onclose = () => {
+			disconnected();
+			document.getElementById("info").textContent = t("PAIRED WITH %s", peer.toUpperCase());
+		};
+		datachannel.close();
+	};
+	datachannel.send(new TextEncoder('utf8').encode(JSON.stringify({name}) + "\n"));
+}
+
+let connect = async (e, device) => {
+	let pc = new RTCPeerConnection({
+		"iceServers":[{"urls":"stun:stun.l.google.com:19302"}],
+		"iceTransportPolicy": transport === "relay-only" ? "relay" : "all",
+	});
+	peerconnection = pc;
 	datachannel = pc.createDataChannel("data", {negotiated: true, id: 0});
-	datachannel.onopen = connected;
+	datachannel.onopen = pairing ? () => pair(pc) : () => connected(pc);
 	datachannel.onmessage = receive;
 	datachannel.binaryType = "arraybuffer"
 	datachannel.onclose = e => {
+		release(pc);
 		disconnected();
-		document.getElementById("info").innerHTML = "DISCONNECTED";
+		if (receiving) {
+			// Drop what came of the file so far.
+			abandon(receiving);
+			receiving = null;
+		}
+		emit("disconnected", {refused, idled, cancelled});
+		if (cancelled) {
+			document.getElementById("info").innerHTML = t("CANCELLED");
+		} else if (refused) {
+			document.getElementById("info").innerHTML = t("DISCONNECTED - THE OTHER SIDE SENT FILES BUT THIS PAGE ONLY SENDS");
+		} else if (idled) {
+			document.getElementById("info").innerHTML = t("DISCONNECTED AFTER BEING IDLE");
+		} else {
+			document.getElementById("info").innerHTML = t("DISCONNECTED");
+		}
+		idled = false;
+		refused = false;
+		cancelled = false;
+		if (receipt && receipted.length > 0 && receiptkey && crypto.subtle) {
+			showreceipt();
+		}
 	};
 	datachannel.onerror = e => {
 		console.log("datachannel error:", e);
 		disconnected();
-		document.getElementById("info").innerHTML = "NETWORK ERROR TRY AGAIN";
+		document.getElementById("info").innerHTML = t("NETWORK ERROR TRY AGAIN");
 	};
 	try {
-		if (document.getElementById("magiccode").value === "") {
+		await authorize();
+		if (transport !== "no-relay") {
+			let config = pc.getConfiguration();
+			config.iceServers = config.iceServers.concat(await relays());
+			pc.setConfiguration(config);
+		}
+		if (device) {
 			dialling();
-			document.getElementById("info").innerHTML = "WAITING FOR THE OTHER SIDE - SHARE CODE OR URL";
-			let [code, finish] = await newwormhole(pc);
-			document.getElementById("magiccode").value = code;
-			location.hash = code;
-			let qr = util.qrencode(location.href);
-			if (qr === null) {
-				document.getElementById("qr").src = "";
-			} else {
-				document.getElementById("qr").src = URL.createObjectURL(new Blob([qr]));
-			}
+			document.getElementById("info").textContent = t("WAITING FOR %s", device.name.toUpperCase());
+			let [slot, pass] = util.paired(fromhex(device.secret));
+			await rendezvous(pc, slot, pass, ttl, transport === "no-relay");
+		} else if (document.getElementById("magiccode").value === "") {
+			dialling();
+			document.getElementById("info").innerHTML = t("WAITING FOR THE OTHER SIDE - SHARE CODE OR URL");
+			let [code, finish, renew] = await newwormhole(pc, ttl, transport === "no-relay", code => {
+				showcode(code);
+				document.getElementById("info").innerHTML = t("GOT A NEW CODE - SHARE THIS ONE INSTEAD");
+				stopcountdown();
+				startcountdown(renew);
+			});
+			showcode(code);
+			startcountdown(renew);
 			await finish;
 		} else {
 			dialling();
-			document.getElementById("info").innerHTML = "CONNECTING";
-			await dial(pc, document.getElementById("magiccode").value);
+			document.getElementById("info").innerHTML = t("CONNECTING");
+			await dial(pc, document.getElementById("magiccode").value, transport === "no-relay");
 		}
 	} catch (err) {
+		release(pc);
+		pairing = null;
 		disconnected();
-		if (err == "bad key") {
-			document.getElementById("info").innerHTML = "BAD KEY TRY AGAIN";
+		emit("error", {message: String(err)});
+		if (err == "cancelled") {
+			document.getElementById("info").innerHTML = t("CANCELLED");
+		} else if (err == "peer cancelled") {
+			document.getElementById("info").innerHTML = t("THE OTHER SIDE CANCELLED");
+		} else if (err == "bad key") {
+			document.getElementById("info").innerHTML = t("BAD KEY TRY AGAIN");
+		} else if (err == "unauthorized") {
+			document.getElementById("info").innerHTML = t("NOT AUTHORIZED");
 		} else if (err == "no such slot") {
-			document.getElementById("info").innerHTML = "NO SUCH SLOT";
+			document.getElementById("info").innerHTML = t("NO SUCH SLOT");
+		} else if (err == "somebody else tried the code") {
+			document.getElementById("info").innerHTML = t("SOMEBODY ELSE TRIED YOUR CODE - IT MAY HAVE BEEN INTERCEPTED");
+		} else if (err == "slot busy") {
+			document.getElementById("info").innerHTML = t("SOMEBODY ELSE IS ALREADY USING THIS CODE");
 		} else if (err == "timed out") {
-			document.getElementById("info").innerHTML = "CODE TIMED OUT GENERATE ANOTHER";
+			document.getElementById("info").innerHTML = t("CODE TIMED OUT GENERATE ANOTHER");
+		} else if (err == "peer too old") {
+			document.getElementById("info").innerHTML = t("THE OTHER SIDE NEEDS TO UPDATE");
+		} else if (err == "peer too new") {
+			document.getElementById("info").innerHTML = t("RELOAD THE PAGE TO UPDATE");
 		} else {
-			document.getElementById("info").innerHTML = "COULD NOT CONNECT TRY AGAIN";
+			document.getElementById("info").innerHTML = t("COULD NOT CONNECT TRY AGAIN");
 		}
 	}
 }
@@ -200,25 +807,36 @@ let dialling = () => {
 
 	document.getElementById("dial").disabled = true;
 	document.getElementById("magiccode").readOnly = true;
+	document.getElementById("qr").removeAttribute("src");
+	document.getElementById("qr").classList.remove("receipt");
 }
 
-let connected = () => {
+let connected = pc => {
+	stopcountdown();
+	receiptkey = receipt ? exportkey(pc, "manifest", 32) : null;
 	document.body.classList.remove("dialling");
 	document.body.classList.add("connected");
 	document.body.classList.remove("disconnected");
 
-	document.body.addEventListener('drop', drop);
-	document.body.addEventListener('dragenter', highlight);
-	document.body.addEventListener('dragover', highlight);
-	document.body.addEventListener('drop', unhighlight);
-	document.body.addEventListener('dragleave', unhighlight);
+	if (only !== "receive") {
+		document.body.addEventListener('drop', drop);
+		document.body.addEventListener('dragenter', highlight);
+		document.body.addEventListener('dragover', highlight);
+		document.body.addEventListener('drop', unhighlight);
+		document.body.addEventListener('dragleave', unhighlight);
+	}
 
-	document.getElementById("info").innerHTML = "OR DRAG FILES TO SEND";
+	document.getElementById("info").innerHTML = readytext;
+	emit("connected");
 
 	location.hash = "";
+	watchidle();
+	sendnext();
 }
 
 let disconnected = () => {
+	stopcountdown();
+	clearInterval(idlewatch);
 	document.body.classList.remove("dialling");
 	document.body.classList.remove("connected");
 	document.body.classList.add("disconnected");
@@ -236,6 +854,16 @@ let disconnected = () => {
 	location.hash = "";
 }
 
+// hashcode returns the code in the URL, if any. Browsers percent-encode
+// words that aren't in ASCII, like those of wordlists in other languages.
+let hashcode = () => {
+	try {
+		return decodeURIComponent(location.hash.substring(1));
+	} catch (e) {
+		return location.hash.substring(1);
+	}
+}
+
 let highlight = e => {
 	document.body.classList.add("highlight");
 }
@@ -250,32 +878,62 @@ let preventdefault = e => {
 }
 
 document.addEventListener('DOMContentLoaded', async () => {
+	translatepage();
+	if (embedded) {
+		document.body.classList.add("embedded");
+		window.addEventListener("message", command);
+	}
+	if (only === "send" || only === "receive") {
+		document.body.classList.add(only + "-only");
+	}
 	document.getElementById("magiccode").value = "";
 	document.getElementById("magiccode").addEventListener('input', async ()=>{
 		await goready;
 		if (document.getElementById("magiccode").value === "") {
-			document.getElementById("dial").value = "NEW WORMHOLE";
+			document.getElementById("dial").value = t("NEW WORMHOLE");
 		} else {
-			document.getElementById("dial").value = "JOIN WORMHOLE";
+			document.getElementById("dial").value = t("JOIN WORMHOLE");
 		}
 	});
 	document.getElementById("filepicker").addEventListener('change', pick);
+	// Framed by another site, the page may not be allowed the picker.
+	document.getElementById("folderpicker").addEventListener('change', pickfolder);
+	if (handles && !embedded) {
+		document.getElementById("filepicker").addEventListener('click', pickhandles);
+		document.getElementById("folderpicker").addEventListener('click', pickfolderhandle);
+	}
+	document.getElementById("resume").addEventListener('click', resume);
 	document.getElementById("dialog").addEventListener('submit', preventdefault);
 	document.getElementById("dialog").addEventListener('submit', connect);
+	document.getElementById("pair").addEventListener('click', startpairing);
+	document.getElementById("cancel").addEventListener('click', () => {
+		dropqueue();
+		cancelconnection();
+	});
+	// Closing the tab would otherwise leave the peer waiting, for as long
+	// as it takes it to notice.
+	window.addEventListener('pagehide', cancelconnection);
+	document.getElementById("autoopen").checked = localStorage.getItem("autoopen") === "on";
+	document.getElementById("autoopen").addEventListener('change', e => {
+		localStorage.setItem("autoopen", e.target.checked ? "on" : "off");
+	});
 	document.body.addEventListener('drop', preventdefault);
 	document.body.addEventListener('dragenter', preventdefault);
 	document.body.addEventListener('dragover', preventdefault);
 	document.body.addEventListener('drop', preventdefault);
 	document.body.addEventListener('dragleave', preventdefault);
+	leftover = await kept();
+	showleftover();
 	await goready;
+	showdevices();
 	if (document.getElementById("magiccode").value === "") {
-		document.getElementById("dial").value = "NEW WORMHOLE";
+		document.getElementById("dial").value = t("NEW WORMHOLE");
 	} else {
-		document.getElementById("dial").value = "JOIN WORMHOLE";
+		document.getElementById("dial").value = t("JOIN WORMHOLE");
 	}
-	if (location.hash.substring(1) != "") {
-		document.getElementById("magiccode").value = location.hash.substring(1);
-		document.getElementById("dial").value = "JOIN WORMHOLE";
+	if (hashcode() != "") {
+		document.getElementById("magiccode").value = hashcode();
+		document.getElementById("dial").value = t("JOIN WORMHOLE");
 		connect();
 	} else {
 		document.getElementById("dial").disabled = false;
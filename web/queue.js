@@ -0,0 +1,107 @@
+import { packhandle } from './folder.js';
+
+// The files and folders queued to be sent are kept in IndexedDB, as
+// handles from the File System Access API, in browsers that have it, so
+// that reloading the page by accident doesn't lose them. Handles outlive
+// the page, but the permission to read them needn't, so the page asks for
+// it again, which browsers only let it do when the user clicks something,
+// before sending them to the next peer it connects to. Browsers without
+// the API only queue files for as long as the page is open.
+
+// handles is whether the browser gives out handles we can keep.
+export const handles = "showOpenFilePicker" in window && "indexedDB" in window;
+
+// request resolves to the result of an IndexedDB request, or rejects with
+// its error.
+let request = req => new Promise((resolve, reject) => {
+	req.onsuccess = () => resolve(req.result);
+	req.onerror = () => reject(req.error);
+});
+
+// db is the database the handles are kept in, once it's being opened.
+let db = null;
+
+// store returns the object store of kept handles, in a transaction of mode.
+let store = async mode => {
+	if (!db) {
+		let open = indexedDB.open("webwormhole", 1);
+		open.onupgradeneeded = () => {
+			open.result.createObjectStore("queue", {autoIncrement: true});
+		};
+		db = request(open);
+	}
+	return (await db).transaction("queue", mode).objectStore("queue");
+}
+
+// keep keeps handle, and resolves to the key to forget it with once it's
+// sent. It resolves to null if it couldn't be kept, e.g. in a private
+// window, and the file is sent all the same.
+export let keep = async handle => {
+	try {
+		return await request((await store("readwrite")).add({handle, queued: new Date()}));
+	} catch (err) {
+		console.log("could not keep file handle:", err);
+		return null;
+	}
+}
+
+// forget forgets the handle kept under key.
+export let forget = async key => {
+	if (key === null) {
+		return;
+	}
+	try {
+		await request((await store("readwrite")).delete(key));
+	} catch (err) {
+		console.log("could not forget file handle:", err);
+	}
+}
+
+// forgetall forgets every handle kept.
+export let forgetall = async () => {
+	if (!handles) {
+		return;
+	}
+	try {
+		await request((await store("readwrite")).clear());
+	} catch (err) {
+		console.log("could not forget file handles:", err);
+	}
+}
+
+// kept resolves to the handles kept from before, in the order they were
+// queued, as a list of {key, handle}.
+export let kept = async () => {
+	if (!handles) {
+		return [];
+	}
+	try {
+		let s = await store("readonly");
+		let [keys, values] = await Promise.all([request(s.getAllKeys()), request(s.getAll())]);
+		return keys.map((key, i) => ({key, handle: values[i].handle}));
+	} catch (err) {
+		console.log("could not read file handles:", err);
+		return [];
+	}
+}
+
+// reopen asks to read the files of entries again, a list of {key, handle}
+// from kept, and resolves to those it may, as a list of {key, f}. Those it
+// may not it forgets. It has to be called from a click, or the like.
+export let reopen = async entries => {
+	let files = [];
+	for (let {key, handle} of entries) {
+		try {
+			if (await handle.queryPermission({mode: "read"}) !== "granted" &&
+				await handle.requestPermission({mode: "read"}) !== "granted") {
+				throw "permission denied";
+			}
+			files.push({key, f: handle.kind === "directory" ? await packhandle(handle) : await handle.getFile()});
+		} catch (err) {
+			// Moved, deleted, or not ours to read any more.
+			console.log("could not reopen", handle.name, err);
+			forget(key);
+		}
+	}
+	return files;
+}
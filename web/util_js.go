@@ -1,135 +1,240 @@
 // +build js,wasm
 
 // Package util is a set of wrappers for crypto (and other) functions to be
-// invoked via Web Assembly.
+// invoked via Web Assembly. The crypto itself is in webwormhole.io/wormhole/pake,
+// shared with the ww tool; this only converts to and from JavaScript values.
 //
 // All functions return nil/null on error.
 //
-//	msgA = util.start("some pass")
-//	[keyB, msgB] = util.exchange("some pass", msgA)
-//	keyA = util.finish(msgB)
+//	[a, msgA] = util.start("some pass")
+//	[keyB, msgB, b] = util.exchange("some pass", msgA)
+//	keyA = util.finish(a, msgB)
 //	util.open(keyA, util.seal(keyB, "hello"))
+//	secret = util.exportkey(a, "self", 32)
+//	key = util.exportkey(a, "file 1", 32)
+//	sealed = util.sealchunk(key, 0, chunk, false)
+//	chunk = util.openchunk(key, 0, sealed, false)
+//	util.release(a)
+//	util.release(b)
+//	[slot, pass] = util.paired(secret)
+//	pass = util.password(2)
+//	[size, headers] = util.tarstream([{name: "dir", dir: true}, ...])
 package main
 
 import (
+	"archive/tar"
+	"bytes"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
-	"io"
 	"syscall/js"
+	"time"
 
-	"filippo.io/cpace"
-	"golang.org/x/crypto/hkdf"
-	"golang.org/x/crypto/nacl/secretbox"
 	"rsc.io/qr"
+	"webwormhole.io/wordlist"
+	"webwormhole.io/wormhole/pake"
 )
 
-// state is the PAKE state so far.
+// A session is a handshake, A or B side, as it goes: the PAKE state until
+// the A side finishes, and the master secret after, kept for exportkey.
+type session struct {
+	state *pake.State
+	mk    []byte
+}
+
+// sessions holds the handshakes going on, by handle.
 //
 // We can't pass Go pointers to JavaScript, but we need to keep
 // the PAKE state (at least for the A side) between invocations.
-// We keep it as a single instance variable here, which means an
-// instance of this program can only do one A handshake at a time.
-// If more is needed this can be changed into a map[something]*cpace.State.
-var state *cpace.State
+// So JavaScript gets a handle for each handshake instead, and passes
+// it back, which lets a page run several at once. Handles are kept
+// until released.
+var sessions = make(map[int]*session)
 
-// start(pass string) (base64msgA string)
-func start(_ js.Value, args []js.Value) interface{} {
-	pass := args[0].String()
+// nextHandle is the handle the next session gets.
+var nextHandle = 1
+
+// newSession keeps s and returns its handle.
+func newSession(s *session) int {
+	h := nextHandle
+	nextHandle++
+	sessions[h] = s
+	return h
+}
+
+// protocol is the version of the peer protocol the web client speaks, as
+// in dial.js.
+const protocol = 1
+
+// bytesToJS copies b into a new Uint8Array.
+func bytesToJS(b []byte) js.Value {
+	dst := js.Global().Get("Uint8Array").New(len(b))
+	js.CopyBytesToJS(dst, b)
+	return dst
+}
 
-	msgA, s, err := cpace.Start(pass, cpace.NewContextInfo("", "", nil))
+// bytesFromJS copies v, a Uint8Array or an ArrayBuffer, into Go.
+func bytesFromJS(v js.Value) []byte {
+	if v.InstanceOf(js.Global().Get("ArrayBuffer")) {
+		v = js.Global().Get("Uint8Array").New(v)
+	}
+	b := make([]byte, v.Length())
+	js.CopyBytesToGo(b, v)
+	return b
+}
+
+// start(pass string) (handle int, base64msgA string)
+func start(_ js.Value, args []js.Value) interface{} {
+	msgA, s, err := pake.Start(args[0].String())
 	if err != nil {
-		return nil
+		return []interface{}{nil, nil}
 	}
-	state = s
 
-	return base64.URLEncoding.EncodeToString(msgA)
+	return []interface{}{
+		newSession(&session{state: s}),
+		base64.URLEncoding.EncodeToString(msgA),
+	}
 }
 
-// finish(base64msgB string) (key []byte)
+// finish(handle int, base64msgB string) (key []byte)
 func finish(_ js.Value, args []js.Value) interface{} {
-	msgB, err := base64.URLEncoding.DecodeString(args[0].String())
+	s, ok := sessions[args[0].Int()]
+	if !ok || s.state == nil {
+		return nil
+	}
+	msgB, err := base64.URLEncoding.DecodeString(args[1].String())
 	if err != nil {
 		return nil
 	}
-
-	mk, err := state.Finish(msgB)
+	mk, err := s.state.Finish(msgB)
 	if err != nil {
 		return nil
 	}
-	hkdf := hkdf.New(sha256.New, mk, nil, nil)
-	key := [32]byte{}
-	_, err = io.ReadFull(hkdf, key[:])
+	s.state, s.mk = nil, mk
+	key, err := pake.Key(mk)
 	if err != nil {
 		return nil
 	}
 
-	dst := js.Global().Get("Uint8Array").New(32)
-	js.CopyBytesToJS(dst, key[:])
-
-	return dst
+	return bytesToJS(key[:])
 }
 
-// finish(pass, base64msgA string) (key []byte, base64msgB string)
+// exchange(pass, base64msgA string) (key []byte, base64msgB string, handle int)
 func exchange(_ js.Value, args []js.Value) interface{} {
-	pass := args[0].String()
 	msgA, err := base64.URLEncoding.DecodeString(args[1].String())
 	if err != nil {
-		return []interface{}{nil, nil}
+		return []interface{}{nil, nil, nil}
 	}
-
-	msgB, mk, err := cpace.Exchange(pass, cpace.NewContextInfo("", "", nil), msgA)
+	msgB, mk, err := pake.Exchange(args[0].String(), msgA)
 	if err != nil {
-		return []interface{}{nil, nil}
+		return []interface{}{nil, nil, nil}
 	}
-	hkdf := hkdf.New(sha256.New, mk, nil, nil)
-	key := [32]byte{}
-	_, err = io.ReadFull(hkdf, key[:])
+	key, err := pake.Key(mk)
 	if err != nil {
-		return []interface{}{nil, nil}
+		return []interface{}{nil, nil, nil}
 	}
 
-	dst := js.Global().Get("Uint8Array").New(32)
-	js.CopyBytesToJS(dst, key[:])
 	return []interface{}{
-		dst,
+		bytesToJS(key[:]),
 		base64.URLEncoding.EncodeToString(msgB),
+		newSession(&session{mk: mk}),
 	}
 }
 
+// release(handle int)
+func release(_ js.Value, args []js.Value) interface{} {
+	delete(sessions, args[0].Int())
+	return nil
+}
+
 // open(key []byte, base64ciphertext string) (cleartext string)
 func open(_ js.Value, args []js.Value) interface{} {
 	var key [32]byte
 	js.CopyBytesToGo(key[:], args[0])
-	encrypted, err := base64.URLEncoding.DecodeString(args[1].String())
+	sealed, err := base64.URLEncoding.DecodeString(args[1].String())
 	if err != nil {
 		return nil
 	}
-
-	var nonce [24]byte
-	copy(nonce[:], encrypted[:24])
-	clear, ok := secretbox.Open(nil, encrypted[24:], &nonce, &key)
-	if !ok {
+	clear, err := pake.Open(&key, sealed)
+	if err != nil {
 		return nil
 	}
 
 	return string(clear)
 }
 
-// open(key []byte, cleartext string) (base64ciphertext string)
+// seal(key []byte, cleartext string) (base64ciphertext string)
 func seal(_ js.Value, args []js.Value) interface{} {
 	var key [32]byte
 	js.CopyBytesToGo(key[:], args[0])
-	clear := args[1].String()
+	sealed, err := pake.Seal(&key, []byte(args[1].String()))
+	if err != nil {
+		return nil
+	}
+
+	return base64.URLEncoding.EncodeToString(sealed)
+}
+
+// sealchunk(key []byte, counter int, chunk []byte, last bool) (sealed []byte)
+//
+// Files are sealed a chunk at a time, so the page never holds more than
+// one: chunk number counter of the file, from 0, up to the last, which has
+// last set. Use a key for one file only, see pake.SealChunk.
+func sealchunk(_ js.Value, args []js.Value) interface{} {
+	var key [32]byte
+	js.CopyBytesToGo(key[:], args[0])
+	if args[1].Int() < 0 {
+		return nil
+	}
+	return bytesToJS(pake.SealChunk(nil, &key, uint64(args[1].Int()), args[3].Truthy(), bytesFromJS(args[2])))
+}
 
-	var nonce [24]byte
-	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+// openchunk(key []byte, counter int, sealed []byte, last bool) (chunk []byte)
+func openchunk(_ js.Value, args []js.Value) interface{} {
+	var key [32]byte
+	js.CopyBytesToGo(key[:], args[0])
+	if args[1].Int() < 0 {
+		return nil
+	}
+	chunk, err := pake.OpenChunk(nil, &key, uint64(args[1].Int()), args[3].Truthy(), bytesFromJS(args[2]))
+	if err != nil {
 		return nil
 	}
+	return bytesToJS(chunk)
+}
 
-	result := secretbox.Seal(nonce[:], []byte(clear), &nonce, &key)
+// exportkey(handle int, label string, n int) (key []byte)
+func exportkey(_ js.Value, args []js.Value) interface{} {
+	sess, ok := sessions[args[0].Int()]
+	if !ok || sess.mk == nil {
+		return nil
+	}
+	// Which side doesn't matter for exported keys.
+	s, err := pake.NewSchedule(sess.mk, protocol, pake.SideA)
+	if err != nil {
+		return nil
+	}
+	b, err := s.Export(args[1].String(), args[2].Int())
+	if err != nil {
+		return nil
+	}
+	return bytesToJS(b)
+}
+
+// paired(secret []byte) (slot, pass string)
+func paired(_ js.Value, args []js.Value) interface{} {
+	secret := make([]byte, args[0].Length())
+	js.CopyBytesToGo(secret, args[0])
+	slot, pass := pake.Paired(secret)
+	return []interface{}{slot, pass}
+}
 
-	return base64.URLEncoding.EncodeToString(result)
+// password(length int) (pass string)
+func password(_ js.Value, args []js.Value) interface{} {
+	b := make([]byte, args[0].Int())
+	if _, err := rand.Read(b); err != nil {
+		return nil
+	}
+	return wordlist.Encode(b)
 }
 
 // qrencode(url string) (png []byte)
@@ -138,20 +243,63 @@ func qrencode(_ js.Value, args []js.Value) interface{} {
 	if err != nil {
 		return nil
 	}
-	png := code.PNG()
-	dst := js.Global().Get("Uint8Array").New(len(png))
-	js.CopyBytesToJS(dst, png)
-	return dst
+	return bytesToJS(code.PNG())
+}
+
+// tarstream(entries []{name string, size, modified int, dir bool}) (size int, headers [][]byte)
+//
+// Folders are sent as tar streams, as ww sends directories, without the
+// page holding more than a header of one: this makes the header of each
+// entry, the files in the folder and the directories, the folder itself
+// first, for the page to follow with its contents, padded to 512 bytes,
+// and to end with 1024 zero bytes, and returns how long that makes it.
+// Names are from the folder's parent, and modified is in milliseconds
+// since the epoch.
+func tarstream(_ js.Value, args []js.Value) interface{} {
+	entries := args[0]
+	// The stream ends with two empty blocks.
+	size := int64(2 * 512)
+	headers := make([]interface{}, entries.Length())
+	for i := range headers {
+		e := entries.Index(i)
+		hdr := &tar.Header{
+			Name:     e.Get("name").String(),
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			ModTime:  time.Unix(0, int64(e.Get("modified").Float())*int64(time.Millisecond)),
+		}
+		if e.Get("dir").Truthy() {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			hdr.Mode = 0755
+		} else {
+			hdr.Size = int64(e.Get("size").Float())
+		}
+		var b bytes.Buffer
+		if err := tar.NewWriter(&b).WriteHeader(hdr); err != nil {
+			return []interface{}{nil, nil}
+		}
+		size += int64(b.Len()) + (hdr.Size+511)/512*512
+		headers[i] = bytesToJS(b.Bytes())
+	}
+	return []interface{}{float64(size), headers}
 }
 
 func main() {
 	js.Global().Set("util", map[string]interface{}{
-		"start":    js.FuncOf(start),
-		"finish":   js.FuncOf(finish),
-		"exchange": js.FuncOf(exchange),
-		"open":     js.FuncOf(open),
-		"seal":     js.FuncOf(seal),
-		"qrencode": js.FuncOf(qrencode),
+		"start":     js.FuncOf(start),
+		"finish":    js.FuncOf(finish),
+		"exchange":  js.FuncOf(exchange),
+		"open":      js.FuncOf(open),
+		"seal":      js.FuncOf(seal),
+		"sealchunk": js.FuncOf(sealchunk),
+		"openchunk": js.FuncOf(openchunk),
+		"release":   js.FuncOf(release),
+		"exportkey": js.FuncOf(exportkey),
+		"paired":    js.FuncOf(paired),
+		"password":  js.FuncOf(password),
+		"qrencode":  js.FuncOf(qrencode),
+		"tarstream": js.FuncOf(tarstream),
 	})
 
 	// TODO release functions and exit when done.
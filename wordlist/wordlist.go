@@ -1,48 +1,211 @@
-// Package wordlist provides an encoder and a decoder for the PGP Word List.
+// Package wordlist encodes bytes as words, for codes people can read out to
+// each other, and decodes them back.
 //
-// PGP Word List is like NATO phonetic alphabet but for bytes.
+// The default is the PGP Word List, which is like the NATO phonetic
+// alphabet but for bytes, with a list of words for even bytes and another
+// for odd ones, so swapped or missing words stand out.
 // https://en.wikipedia.org/wiki/PGP_Words
+//
+// Other lists, like the EFF's or ones in other languages, can be added with
+// New or Read, and Register. Peers never need to agree on a list: a code's
+// words are its password as they are, so whoever types them in joins the
+// same as with any other list. Only decoding them back to bytes needs it.
 package wordlist
 
-import "strings"
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// A List is a list of words to encode bytes as, a word a byte.
+type List struct {
+	name string
+	// words are laid out with the word for byte b at b*step, and for
+	// lists with odd and even words, the odd one after it.
+	words []string
+	step  int
+	index map[string]int
+}
+
+// PGP is the PGP Word List, the default.
+var PGP = mustNew("pgp", pgpWords)
+
+// New returns a list called name of words, which has 256 of them, one for
+// every byte, or 512, in pairs of the word for a byte at an even position
+// and the one for it at an odd, as in the PGP Word List. Words are matched
+// regardless of case, but otherwise as they are, so lists in languages with
+// accents had best be in NFC, as codes typed in usually are. They can't be
+// empty or have dashes or spaces in them, which codes are split on.
+func New(name string, words []string) (*List, error) {
+	l := &List{name: name, index: make(map[string]int, len(words))}
+	switch len(words) {
+	case 256:
+		l.step = 1
+	case 512:
+		l.step = 2
+	default:
+		return nil, fmt.Errorf("wordlist %s has %d words, not 256 or 512", name, len(words))
+	}
+	for i, w := range words {
+		if w == "" || strings.IndexFunc(w, func(r rune) bool { return r == '-' || unicode.IsSpace(r) }) >= 0 {
+			return nil, fmt.Errorf("wordlist %s has %q, which can't be in a code", name, w)
+		}
+		key := strings.ToLower(w)
+		if _, ok := l.index[key]; ok {
+			return nil, fmt.Errorf("wordlist %s has %q more than once", name, w)
+		}
+		l.index[key] = i
+		l.words = append(l.words, w)
+	}
+	return l, nil
+}
+
+func mustNew(name string, words []string) *List {
+	l, err := New(name, words)
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+// Read reads a list called name from r, with a word a line as for New.
+// Blank lines and those starting with # are skipped.
+func Read(name string, r io.Reader) (*List, error) {
+	var words []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return New(name, words)
+}
+
+// Name returns the list's name.
+func (l *List) Name() string { return l.name }
 
-// Encode returns the words representing the bytes in buf.
-func Encode(buf []byte) []string {
+// EncodeWords returns the words representing the bytes in buf.
+func (l *List) EncodeWords(buf []byte) []string {
 	words := make([]string, len(buf))
 	for i := range buf {
-		words[i] = pgpWords[int(buf[i])*2+i%2]
+		words[i] = l.words[int(buf[i])*l.step+i%l.step]
 	}
 	return words
 }
 
-// Decode decodes the array of words in words. It returns the bytes
-// it represents and the parity of each word.
+// Encode returns the words representing the bytes in buf, joined with
+// dashes as in codes.
+func (l *List) Encode(buf []byte) string {
+	return strings.Join(l.EncodeWords(buf), "-")
+}
+
+// DecodeWords decodes words, returning the bytes they represent and the
+// parity of each word, which for lists with odd and even words says which
+// of them it is, and is otherwise 0.
 //
 // It does not perform any parity validation. If it encounters a word
-// not in its dictionary it returns nil.
-func Decode(words []string) (bytes []byte, parity []byte) {
-	bytes = make([]byte, len(words))
-	parity = make([]byte, len(words))
-	for i := range words {
-		j, ok := index(words[i])
+// not in its list it returns what it decoded before it, and false.
+func (l *List) DecodeWords(words []string) (bytes []byte, parity []byte, ok bool) {
+	bytes = make([]byte, 0, len(words))
+	parity = make([]byte, 0, len(words))
+	for _, w := range words {
+		j, ok := l.index[strings.ToLower(w)]
 		if !ok {
-			return nil, nil
+			return bytes, parity, false
 		}
-		bytes[i] = byte(j / 2)
-		parity[i] = byte(j % 2)
+		bytes = append(bytes, byte(j/l.step))
+		parity = append(parity, byte(j%l.step))
 	}
-	return bytes, parity
+	return bytes, parity, true
 }
 
-func index(word string) (i int, ok bool) {
-	for i := range pgpWords {
-		if strings.ToLower(word) == strings.ToLower(pgpWords[i]) {
-			return i, true
+// ErrUnknownWord is returned by Decode for words not in the list.
+var ErrUnknownWord = errors.New("not a word in the list")
+
+// ErrOutOfPlace is returned by Decode, for lists with odd and even words,
+// when a word is where the other kind should be, because words were
+// swapped or left out.
+var ErrOutOfPlace = errors.New("word out of place")
+
+// Decode decodes a code's words, joined with dashes, back to the bytes they
+// represent.
+func (l *List) Decode(code string) ([]byte, error) {
+	if code == "" {
+		return []byte{}, nil
+	}
+	words := strings.Split(code, "-")
+	bytes, parity, ok := l.DecodeWords(words)
+	if !ok {
+		return nil, fmt.Errorf("%q: %w", words[len(bytes)], ErrUnknownWord)
+	}
+	for i := range parity {
+		if l.step == 2 && int(parity[i]) != i%2 {
+			return nil, fmt.Errorf("%q: %w", words[i], ErrOutOfPlace)
 		}
 	}
-	return 0, false
+	return bytes, nil
 }
 
+var lists = struct {
+	sync.RWMutex
+	m map[string]*List
+}{m: map[string]*List{"pgp": PGP}}
+
+// Register makes l available to Lookup by its name, replacing any list
+// registered with it before.
+func Register(l *List) {
+	lists.Lock()
+	defer lists.Unlock()
+	lists.m[l.name] = l
+}
+
+// Lookup returns the list registered as name, if any.
+func Lookup(name string) (*List, bool) {
+	lists.RLock()
+	defer lists.RUnlock()
+	l, ok := lists.m[name]
+	return l, ok
+}
+
+// Names returns the names of the lists registered, in order.
+func Names() []string {
+	lists.RLock()
+	defer lists.RUnlock()
+	var names []string
+	for name := range lists.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// EncodeWords returns the words in the PGP Word List representing the
+// bytes in buf.
+func EncodeWords(buf []byte) []string { return PGP.EncodeWords(buf) }
+
+// Encode returns the words in the PGP Word List representing the bytes in
+// buf, joined with dashes.
+func Encode(buf []byte) string { return PGP.Encode(buf) }
+
+// DecodeWords decodes words in the PGP Word List, see List.DecodeWords.
+func DecodeWords(words []string) (bytes []byte, parity []byte, ok bool) {
+	return PGP.DecodeWords(words)
+}
+
+// Decode decodes a code's words in the PGP Word List, see List.Decode.
+func Decode(code string) ([]byte, error) { return PGP.Decode(code) }
+
 var pgpWords = []string{
 	"aardvark", "adroitness",
 	"absurd", "adviser",
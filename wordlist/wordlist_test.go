@@ -1,7 +1,10 @@
 package wordlist
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -14,7 +17,7 @@ func TestEncodeWords(t *testing.T) {
 		{[]byte{0}, []string{"aardvark"}},
 		{[]byte{1}, []string{"absurd"}},
 		{[]byte{8, 8}, []string{"aimless", "antenna"}},
-		{[]byte{19, 52}, []string{"Aztec", "confidence"}},
+		{[]byte{19, 52}, []string{"aztec", "confidence"}},
 	}
 	for i := range cases {
 		if out := EncodeWords(cases[i].in); reflect.DeepEqual(out, cases[i].out) != true {
@@ -47,3 +50,46 @@ func TestDecodeWords(t *testing.T) {
 	}
 
 }
+
+func TestDecode(t *testing.T) {
+	cases := []struct {
+		code  string
+		bytes []byte
+		err   error
+	}{
+		{"aimless-antenna", []byte{8, 8}, nil},
+		{"Aztec-CONFIDENCE", []byte{19, 52}, nil},
+		{"antenna-aimless", nil, ErrOutOfPlace},
+		{"aztec-notaword", nil, ErrUnknownWord},
+	}
+	for i := range cases {
+		bytes, err := Decode(cases[i].code)
+		if !reflect.DeepEqual(bytes, cases[i].bytes) || !errors.Is(err, cases[i].err) {
+			t.Errorf("testcase %v got %v,%v want %v,%v", i, bytes, err, cases[i].bytes, cases[i].err)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	var lines []string
+	for i := 0; i < 256; i++ {
+		lines = append(lines, fmt.Sprintf("wort%d", i))
+	}
+	l, err := Read("de", strings.NewReader("# a list\n\n"+strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := l.Encode([]byte{0, 1}); code != "wort0-wort1" {
+		t.Errorf("got %q want wort0-wort1", code)
+	}
+	if b, err := l.Decode("wort1-wort1"); err != nil || !reflect.DeepEqual(b, []byte{1, 1}) {
+		t.Errorf("got %v,%v want [1 1]", b, err)
+	}
+	lines[1] = "wort0"
+	if _, err := Read("de", strings.NewReader(strings.Join(lines, "\n"))); err == nil {
+		t.Errorf("took a list with a word twice")
+	}
+	if _, err := Read("de", strings.NewReader(strings.Join(lines[:255], "\n"))); err == nil {
+		t.Errorf("took a list of 255 words")
+	}
+}
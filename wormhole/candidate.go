@@ -0,0 +1,144 @@
+package wormhole
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// A Candidate is an ICE candidate, an address one of the peers may be
+// reached at, for Dialer.OnCandidate and Dialer.OnSelectedPair.
+type Candidate struct {
+	// Remote is set for the peer's candidates, rather than ours.
+	Remote bool
+	// Type is host, srflx, prflx or relay.
+	Type string
+	// Protocol is udp or tcp.
+	Protocol string
+	// Address is the IP address and port, or for peers that hide their
+	// local addresses, like browsers, an mDNS name instead of the IP.
+	Address string
+}
+
+func (c Candidate) String() string {
+	return c.Type + " " + c.Protocol + " " + c.Address
+}
+
+// localCandidate converts a candidate pion gathered.
+func localCandidate(c *webrtc.ICECandidate) Candidate {
+	return Candidate{
+		Type:     c.Typ.String(),
+		Protocol: c.Protocol.String(),
+		Address:  net.JoinHostPort(c.Address, strconv.Itoa(int(c.Port))),
+	}
+}
+
+// parseCandidate parses one of the peer's candidates from its SDP
+// attribute, as in RFC 5245 section 15.1, e.g.
+//
+//	candidate:1 1 udp 2130706431 192.0.2.1 5000 typ host
+func parseCandidate(s string) (Candidate, bool) {
+	f := strings.Fields(strings.TrimPrefix(strings.TrimPrefix(s, "a="), "candidate:"))
+	if len(f) < 8 || f[6] != "typ" {
+		return Candidate{}, false
+	}
+	return Candidate{
+		Remote:   true,
+		Type:     f[7],
+		Protocol: strings.ToLower(f[2]),
+		Address:  net.JoinHostPort(f[4], f[5]),
+	}, true
+}
+
+// hideRelated blanks out the related address and port of candidate, an
+// SDP attribute like those parseCandidate parses, which for server
+// reflexive and relay candidates are the local ones they were gathered
+// from.
+func hideRelated(candidate string) string {
+	f := strings.Fields(candidate)
+	// After the foundation, component, protocol, priority, address and
+	// port, the rest come in name value pairs.
+	for i := 6; i+1 < len(f); i += 2 {
+		switch f[i] {
+		case "raddr":
+			f[i+1] = "0.0.0.0"
+		case "rport":
+			f[i+1] = "0"
+		}
+	}
+	return strings.Join(f, " ")
+}
+
+// remoteCandidate calls OnCandidate with the peer's candidate s, if both
+// are set.
+func (c *Conn) remoteCandidate(s string) {
+	if c.dialer.OnCandidate == nil {
+		return
+	}
+	if candidate, ok := parseCandidate(s); ok {
+		c.dialer.OnCandidate(candidate)
+	}
+}
+
+// sdpCandidates calls OnCandidate with the candidates in the peer's
+// session description, from peers that don't trickle them.
+func (c *Conn) sdpCandidates(sd webrtc.SessionDescription) {
+	if c.dialer.OnCandidate == nil {
+		return
+	}
+	for _, l := range strings.Split(sd.SDP, "\n") {
+		if strings.HasPrefix(l, "a=candidate:") {
+			c.remoteCandidate(strings.TrimSpace(l))
+		}
+	}
+}
+
+// selectedPair returns the candidate pair ICE connected with, and false if
+// it hasn't yet.
+func (c *Conn) selectedPair() (pair webrtc.ICECandidatePairStats, local, remote webrtc.ICECandidateStats, ok bool) {
+	stats := c.pc.GetStats()
+	for _, s := range stats {
+		pair, ok := s.(webrtc.ICECandidatePairStats)
+		if !ok || !pair.Nominated || pair.State != webrtc.StatsICECandidatePairStateSucceeded {
+			continue
+		}
+		local, ok1 := stats[pair.LocalCandidateID].(webrtc.ICECandidateStats)
+		remote, ok2 := stats[pair.RemoteCandidateID].(webrtc.ICECandidateStats)
+		if ok1 && ok2 {
+			return pair, local, remote, true
+		}
+	}
+	return pair, local, remote, false
+}
+
+// statsCandidate converts a candidate from the connection's stats.
+func statsCandidate(s webrtc.ICECandidateStats, remote bool) Candidate {
+	return Candidate{
+		Remote:   remote,
+		Type:     s.CandidateType.String(),
+		Protocol: s.Protocol,
+		Address:  net.JoinHostPort(s.IP, strconv.Itoa(int(s.Port))),
+	}
+}
+
+// pairSelected calls OnSelectedPair with the candidate pair ICE connected
+// with, if it's not the one it was last called with.
+func (c *Conn) pairSelected() {
+	// The candidate pair's stats can lag ICE's state a little.
+	for i := 0; i < 10; i++ {
+		if _, local, remote, ok := c.selectedPair(); ok {
+			l, r := statsCandidate(local, false), statsCandidate(remote, true)
+			c.stateMu.Lock()
+			defer c.stateMu.Unlock()
+			if c.pair != [2]Candidate{l, r} {
+				c.pair = [2]Candidate{l, r}
+				c.dialer.OnSelectedPair(l, r)
+			}
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,61 @@
+package wormhole
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v2"
+)
+
+func TestNoHostCandidates(t *testing.T) {
+	const local = "192.168.1.2"
+	candidates := []*webrtc.ICECandidate{
+		{Foundation: "1", Priority: 1, Address: local, Protocol: webrtc.ICEProtocolUDP, Port: 5000, Typ: webrtc.ICECandidateTypeHost, Component: 1},
+		{Foundation: "2", Priority: 1, Address: "203.0.113.1", Protocol: webrtc.ICEProtocolUDP, Port: 6000, Typ: webrtc.ICECandidateTypeSrflx, Component: 1, RelatedAddress: local, RelatedPort: 5000},
+		{Foundation: "3", Priority: 1, Address: "198.51.100.1", Protocol: webrtc.ICEProtocolUDP, Port: 7000, Typ: webrtc.ICECandidateTypeRelay, Component: 1, RelatedAddress: local, RelatedPort: 5001},
+	}
+	for _, hide := range []bool{false, true} {
+		var sent []string
+		c := &Conn{dialer: &Dialer{NoHostCandidates: hide}}
+		c.sendCandidate = func(candidate webrtc.ICECandidateInit) {
+			sent = append(sent, candidate.Candidate)
+		}
+		for _, candidate := range candidates {
+			c.gathered(candidate)
+		}
+		leaked := false
+		for _, s := range sent {
+			leaked = leaked || strings.Contains(s, local)
+			if _, ok := parseCandidate(s); !ok {
+				t.Errorf("hide %v: sent %q, which doesn't parse", hide, s)
+			}
+		}
+		if len(sent) != len(candidates) && !hide || len(sent) != len(candidates)-1 && hide {
+			t.Errorf("hide %v: sent %q", hide, sent)
+		}
+		if leaked == hide {
+			t.Errorf("hide %v: sent %q", hide, sent)
+		}
+	}
+}
+
+func TestHideRelated(t *testing.T) {
+	tests := []struct {
+		candidate, want string
+	}{
+		{"candidate:1 1 udp 2130706431 192.0.2.1 5000 typ host",
+			"candidate:1 1 udp 2130706431 192.0.2.1 5000 typ host"},
+		{"candidate:2 1 udp 1694498815 203.0.113.1 6000 typ srflx raddr 192.0.2.1 rport 5000",
+			"candidate:2 1 udp 1694498815 203.0.113.1 6000 typ srflx raddr 0.0.0.0 rport 0"},
+		{"candidate:3 1 tcp 16777215 198.51.100.1 7000 typ relay raddr 192.0.2.1 rport 5001 tcptype passive",
+			"candidate:3 1 tcp 16777215 198.51.100.1 7000 typ relay raddr 0.0.0.0 rport 0 tcptype passive"},
+		// An address that happens to be called raddr isn't one to hide.
+		{"candidate:4 1 udp 1 raddr 5000 typ host",
+			"candidate:4 1 udp 1 raddr 5000 typ host"},
+	}
+	for _, test := range tests {
+		if got := hideRelated(test.candidate); got != test.want {
+			t.Errorf("hideRelated(%q) = %q, want %q", test.candidate, got, test.want)
+		}
+	}
+}
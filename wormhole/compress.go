@@ -0,0 +1,85 @@
+package wormhole
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+)
+
+// Senders may offer to compress the files they send, for slow links, with
+// SendOfferCompressed, and receivers pick one of the ways offered before
+// answering, with UseCompression. How compressed files are framed is up to
+// applications; see cmd/ww.
+
+// MinCompress is the first version of the peer protocol whose receivers
+// may pick a way of compressing the files offered to them.
+const MinCompress = 10
+
+// Gzip is compressing with gzip, as in RFC 1952.
+const Gzip = "gzip"
+
+// Compressions are the ways of compressing files this package can do, in
+// the order it prefers them.
+var Compressions = []string{Gzip}
+
+// ErrUnknownCompression is returned for ways of compressing that this
+// package can't do, or that weren't offered.
+var ErrUnknownCompression = errors.New("unknown compression")
+
+// NewCompressor returns a writer that compresses what's written to it with
+// alg, one of Compressions, into w. Closing it flushes what's left, but
+// doesn't close w.
+func NewCompressor(alg string, w io.Writer) (io.WriteCloser, error) {
+	switch alg {
+	case Gzip:
+		// The point is to keep up with the link rather than to squeeze
+		// the most out of it.
+		return gzip.NewWriterLevel(w, gzip.BestSpeed)
+	}
+	return nil, ErrUnknownCompression
+}
+
+// NewDecompressor returns a reader that decompresses what's read from r,
+// compressed with alg, one of Compressions.
+func NewDecompressor(alg string, r io.Reader) (io.ReadCloser, error) {
+	switch alg {
+	case Gzip:
+		// gzip.NewReader reads the header straight away, so leave that
+		// for the first Read.
+		return &gzipReader{r: r}, nil
+	}
+	return nil, ErrUnknownCompression
+}
+
+type gzipReader struct {
+	r   io.Reader
+	z   *gzip.Reader
+	err error
+}
+
+func (g *gzipReader) Read(p []byte) (int, error) {
+	if g.z == nil && g.err == nil {
+		g.z, g.err = gzip.NewReader(g.r)
+	}
+	if g.err != nil {
+		return 0, g.err
+	}
+	return g.z.Read(p)
+}
+
+func (g *gzipReader) Close() error {
+	if g.z == nil {
+		return nil
+	}
+	return g.z.Close()
+}
+
+// offered reports whether alg is among algs.
+func offered(alg string, algs []string) bool {
+	for _, a := range algs {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
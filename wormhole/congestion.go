@@ -0,0 +1,53 @@
+package wormhole
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// Congestion describes how much the network has been holding up writes to
+// a connection and its streams. Senders can look at it to tell whether a
+// transfer is waiting on the network or on something else, like a disk.
+type Congestion struct {
+	// Buffered is the number of bytes written but not yet sent or
+	// acknowledged by the peer.
+	Buffered uint64
+	// Stalled is the total time writes have spent waiting for buffers to
+	// drain.
+	Stalled time.Duration
+}
+
+// Congestion returns the connection's congestion so far.
+func (c *Conn) Congestion() Congestion {
+	s := c.sched
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var buffered uint64
+	for d := range s.chans {
+		buffered += d.BufferedAmount()
+	}
+	return Congestion{
+		Buffered: buffered,
+		Stalled:  time.Duration(atomic.LoadInt64(&s.stalled)),
+	}
+}
+
+// Traffic returns the number of bytes sent and received so far over the
+// connection and its open streams, or zero once it's closed.
+func (c *Conn) Traffic() (sent, received uint64) {
+	select {
+	case <-c.closed:
+		// Asking a closed connection for stats only logs errors.
+		return 0, 0
+	default:
+	}
+	for _, s := range c.pc.GetStats() {
+		if d, ok := s.(webrtc.DataChannelStats); ok {
+			sent += d.BytesSent
+			received += d.BytesReceived
+		}
+	}
+	return sent, received
+}
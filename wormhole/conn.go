@@ -0,0 +1,134 @@
+package wormhole
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+
+	"webwormhole.io/wordlist"
+)
+
+// Applications that only want a connection to read and write, the way ww
+// uses it, can get one with a code, like ww's, without dealing in slots
+// and passwords:
+//
+//	l, err := wormhole.Listen(ctx, nil)
+//	...
+//	fmt.Println("ww receive", l.Code())
+//	c, err := l.Accept(ctx)
+//
+// and on the other side:
+//
+//	c, err := wormhole.NewConn(ctx, "7-tiger-jupiter", nil)
+//
+// Both give up, freeing the slot, once ctx is done.
+
+// DefaultSignalServer is the signalling server ww uses, and the one NewConn
+// and Listen use without a Dialer.
+const DefaultSignalServer = "https://wrmhl.link/"
+
+// DefaultICEServers are the STUN servers ww uses, and the ones NewConn and
+// Listen use without a Dialer.
+var DefaultICEServers = []string{"stun:stun.l.google.com:19302"}
+
+// ErrBadCode is returned for codes that aren't a slot and a password.
+var ErrBadCode = errors.New("bad code")
+
+// ParseCode splits a code, like 7-tiger-jupiter, into its slot and
+// password.
+func ParseCode(code string) (slot, pass string, err error) {
+	parts := strings.SplitN(strings.TrimSpace(code), "-", 2)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", ErrBadCode
+	}
+	return parts[0], parts[1], nil
+}
+
+// NewConn joins the wormhole with code, which the peer got from Listen or
+// ww, using the options of d, or the defaults if it's nil. The connection
+// is a *Conn, for the rest of what it can do.
+func NewConn(ctx context.Context, code string, d *Dialer) (io.ReadWriteCloser, error) {
+	slot, pass, err := ParseCode(code)
+	if err != nil {
+		return nil, err
+	}
+	c, err := orDefault(d).DialContext(ctx, slot, pass)
+	if err != nil {
+		// Not a nil *Conn in a non-nil interface.
+		return nil, err
+	}
+	return c, nil
+}
+
+// A Listener is a new wormhole, with a code for the peer to join it with.
+type Listener struct {
+	w    *Prepared
+	pass string
+}
+
+// Listen books a new wormhole on the signalling server, using the options
+// of d, or the defaults if it's nil. Give the peer its Code, and call
+// Accept to connect, or Close to give up.
+func Listen(ctx context.Context, d *Dialer) (*Listener, error) {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, err
+	}
+	w, err := orDefault(d).prepare(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{w: w, pass: wordlist.Encode(b)}, nil
+}
+
+// Code returns the code for the peer to join the wormhole with.
+func (l *Listener) Code() string {
+	return l.w.Slot() + "-" + l.pass
+}
+
+// Accept waits for the peer to join, and connects to it. The connection
+// is a *Conn, for the rest of what it can do. Each wormhole only takes
+// one peer.
+func (l *Listener) Accept(ctx context.Context) (io.ReadWriteCloser, error) {
+	c, err := l.w.WaitContext(ctx, l.pass)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close gives up on the wormhole, freeing the slot.
+func (l *Listener) Close() error {
+	return l.w.Close()
+}
+
+func orDefault(d *Dialer) *Dialer {
+	if d == nil {
+		return &Dialer{SignalServer: DefaultSignalServer, ICEServers: DefaultICEServers}
+	}
+	return d
+}
+
+// afterDone calls f once ctx is done, unless stop is called first. stop
+// reports whether f was called.
+func afterDone(ctx context.Context, f func()) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+	stopc, called := make(chan struct{}), make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f()
+			called <- true
+		case <-stopc:
+			called <- false
+		}
+	}()
+	return func() bool {
+		close(stopc)
+		return <-called
+	}
+}
@@ -29,34 +29,215 @@
 package wormhole
 
 import (
-	crand "crypto/rand"
+	"bytes"
+	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"net/url"
 	"path"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"filippo.io/cpace"
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v2"
-	"golang.org/x/crypto/hkdf"
-	"golang.org/x/crypto/nacl/secretbox"
+	"webwormhole.io/wormhole/pake"
 )
 
-// protocolVersion is an identifier for the current signalling scheme.
-// It's intended to help clients print a friendlier message urging them
-// to upgrade if the signalling server has a diffect version.
-const protocolVersion = "3"
+// SignalProtocol is the version of the protocol spoken with the signalling
+// server, and MinSignalProtocol the oldest server this package can use.
+// Servers say which versions they speak in the X-Version and X-Min-Version
+// headers of their responses, and turn away clients that send an X-Version
+// older than they speak with 426 Upgrade Required. Servers without
+// X-Min-Version speak only X-Version.
+//
+// Versions 1 and 2 predate this package. Servers since version 3 keep
+// speaking it; newer features, like picking slots and cancelling them, are
+// optional and clients fall back without them.
+const (
+	SignalProtocol    = 3
+	MinSignalProtocol = 3
+)
+
+// protocolVersion is SignalProtocol as servers send it.
+var protocolVersion = strconv.Itoa(SignalProtocol)
+
+// Protocol is the version of the protocol spoken between peers, as opposed
+// to the one spoken with the signalling server. Peers exchange it in their
+// encrypted offer and answer. Peers predating this exchange count as 0.
+//
+// Versions:
+//
+//	1  peers exchange versions
+//	2  peers may open more data channels as streams, see OpenStream, and
+//	   say when they are ready for data on the first one
+//	3  keys past signalling are derived for their purpose and direction,
+//	   see pake.Schedule
+//	4  receivers can say where to resume a file from, see Partial
+//	5  senders may list the files they're about to send, for receivers to
+//	   pick from, see MinBatch
+//	6  senders may send files whose size they don't know up front, see
+//	   MinChunked
+//	7  senders follow every file with the hash of its contents, see Trailer
+//	8  senders can tell receivers to drop a file that changed while it was
+//	   being sent, and go on to the next, see MinChanged
+//	9  receivers read messages of up to MaxMessage bytes, see
+//	   MinLargeMessages
+//	10 receivers may pick a way of compressing the files offered to them,
+//	   see MinCompress
+//	11 peers can seal what they send with ratchets, see MinRatchet
+const Protocol = 11
+
+// MinProtocol is the oldest version of the peer protocol this package can
+// still talk to.
+const MinProtocol = 0
+
+// MinBatch is the first version of the peer protocol whose receivers
+// understand a list of the files about to be sent, and answer it with the
+// ones they want; see Offer.
+const MinBatch = 5
+
+// MinChunked is the first version of the peer protocol whose receivers
+// take files of unknown size, sent in chunks up to an end marker, like
+// what's piped into a sender. The format is up to applications; see cmd/ww.
+const MinChunked = 6
+
+// MinLargeMessages is the first version of the peer protocol whose
+// receivers read messages of up to MaxMessage bytes. Older ones only read
+// up to 32KiB at a time, and drop longer messages.
+const MinLargeMessages = 9
+
+// MaxMessage is the longest message that can be written to a Conn or
+// Stream.
+const MaxMessage = 65535
 
 // ErrBadVersion is returned when the signalling server runs an incompatible
-// version of the signalling protocol.
+// version of the signalling protocol, when it doesn't say which one; see
+// SignalVersionError.
 var ErrBadVersion = errors.New("bad version")
 
+// SignalVersionError is returned when the signalling server speaks an
+// incompatible version of the signalling protocol.
+type SignalVersionError struct {
+	// Server is the version the server speaks, and ServerMin the oldest it
+	// accepts.
+	Server, ServerMin int
+}
+
+func (e *SignalVersionError) Error() string {
+	if e.Server < MinSignalProtocol {
+		return fmt.Sprintf("signalling server speaks version %d, need at least %d", e.Server, MinSignalProtocol)
+	}
+	return fmt.Sprintf("signalling server needs version %d or newer, have %d", e.ServerMin, SignalProtocol)
+}
+
+// checkSignal returns a *SignalVersionError if we can't talk to the server
+// that sent h. Responses that don't say count as compatible.
+func checkSignal(h http.Header) error {
+	v := h.Get("X-Version")
+	if v == "" {
+		return nil
+	}
+	server, _ := strconv.Atoi(v)
+	min := server
+	if m, err := strconv.Atoi(h.Get("X-Min-Version")); err == nil {
+		min = m
+	}
+	if server < MinSignalProtocol || min > SignalProtocol {
+		return &SignalVersionError{server, min}
+	}
+	return nil
+}
+
+// VersionError is returned when the peer speaks an incompatible version of
+// the peer protocol.
+type VersionError struct {
+	// Peer is the version the peer speaks, and PeerMin the oldest it accepts.
+	Peer, PeerMin int
+}
+
+func (e *VersionError) Error() string {
+	if e.Peer < MinProtocol {
+		return fmt.Sprintf("peer speaks protocol version %d, need at least %d", e.Peer, MinProtocol)
+	}
+	return fmt.Sprintf("peer needs protocol version %d or newer, have %d", e.PeerMin, Protocol)
+}
+
+// sessionDesc is a session description along with the sender's protocol
+// version. Older peers ignore the extra fields.
+type sessionDesc struct {
+	webrtc.SessionDescription
+	Version    int `json:"version,omitempty"`
+	MinVersion int `json:"minversion,omitempty"`
+}
+
+func newSessionDesc(sd webrtc.SessionDescription) sessionDesc {
+	return sessionDesc{sd, Protocol, MinProtocol}
+}
+
+// checkVersion returns a *VersionError if we can't talk to the sender of sd.
+func (sd *sessionDesc) checkVersion() error {
+	if sd.Version < MinProtocol || sd.MinVersion > Protocol {
+		return &VersionError{sd.Version, sd.MinVersion}
+	}
+	return nil
+}
+
+// ErrNoSuchSlot is returned when joining a slot nobody is waiting on.
+var ErrNoSuchSlot = errors.New("no such slot")
+
+// ErrSlotTaken is returned when reserving a slot somebody else already holds.
+var ErrSlotTaken = errors.New("slot taken")
+
+// ErrSlotTried is returned when somebody else tries the slot while the
+// peers on it are still signalling, which could mean the code was
+// intercepted. Whoever tried it gets ErrSlotBusy, from servers that tell
+// them apart, or ErrSlotTried too.
+var ErrSlotTried = errors.New("somebody else tried the code")
+
+// ErrSlotBusy is returned when joining a slot whose peers have already met,
+// and are busy connecting to each other.
+var ErrSlotBusy = errors.New("slot busy")
+
+// ErrNoFreeSlot is returned when the signalling server has no slots left
+// to assign.
+var ErrNoFreeSlot = errors.New("no free slot")
+
+// ErrForbidden is returned when the signalling server refuses to serve us,
+// e.g. because of where we're connecting from.
+var ErrForbidden = errors.New("forbidden by signalling server")
+
+// ErrUnauthorized is returned when the signalling server only serves
+// clients that authenticate, and we didn't, or not well enough.
+var ErrUnauthorized = errors.New("not authorized by signalling server")
+
+// ErrTimedOut is returned when the signalling server gives up on waiting
+// for the other peer.
+var ErrTimedOut = errors.New("timed out")
+
+// ErrCancelled is returned when the slot was cancelled with Dialer.Cancel
+// while waiting for the peer, or the peer called it off while signalling.
+var ErrCancelled = errors.New("cancelled")
+
+// ErrBadKey is returned when the peers could not agree on a key, typically
+// because they used different passwords.
+var ErrBadKey = errors.New("bad key")
+
+// ErrNoRelay is returned when the TransportPolicy is RelayOnly, but there's
+// no TURN server to relay through, neither in ICEServers nor offered by the
+// signalling server.
+var ErrNoRelay = errors.New("no turn server to relay through")
+
 // Accessing pion/webrtc APIs like DataChannel.Detach() requires
 // that we do this voodoo.
 var rtcapi *webrtc.API
@@ -64,6 +245,10 @@ var rtcapi *webrtc.API
 func init() {
 	s := webrtc.SettingEngine{}
 	s.DetachDataChannels()
+	// Send candidates as they're gathered rather than wait for all of
+	// them, since some STUN and TURN servers can take a while to answer
+	// or never do.
+	s.SetTrickle(true)
 	rtcapi = webrtc.NewAPI(webrtc.WithSettingEngine(s))
 }
 
@@ -73,9 +258,21 @@ type Conn struct {
 	d  *webrtc.DataChannel
 	pc *webrtc.PeerConnection
 
+	// dialer holds the options this connection was made with.
+	dialer *Dialer
 	// wsaddr is the url to the signalling websocket.
 	wsaddr string
 
+	// peerVersion is the peer protocol version the other side speaks.
+	peerVersion int
+
+	// relay is the TURN server picked by probing, if any.
+	relay string
+
+	// keys derives keys from the secret agreed with PAKE, for the version
+	// both peers speak.
+	keys *pake.Schedule
+
 	// opened signals that the underlying DataChannel is open and ready
 	// to handle data.
 	opened chan struct{}
@@ -84,22 +281,104 @@ type Conn struct {
 	// flushc is a condition variable to coordinate flushed state of the
 	// underlying channel.
 	flushc *sync.Cond
+	// closed is closed when the connection is.
+	closed    chan struct{}
+	closeOnce sync.Once
+	// streams queues streams the peer opened until they're accepted.
+	streams chan *Stream
+	// ready is closed when the peer has its end of the connection set up.
+	ready     chan struct{}
+	readyOnce sync.Once
+	// sched orders writes between streams.
+	sched *sched
+	// eof is set once reads have reached the end of the peer's data, after
+	// which it isn't reading any more either.
+	eof int32
+
+	// state is the last State given to Dialer.OnState, and pair the last
+	// candidate pair given to Dialer.OnSelectedPair.
+	stateMu sync.Mutex
+	state   State
+	pair    [2]Candidate
+
+	// trickle holds on to our ICE candidates until sendCandidate is set,
+	// once the peer has our session description.
+	trickle       sync.Mutex
+	candidates    []webrtc.ICECandidateInit
+	sendCandidate func(webrtc.ICECandidateInit)
+}
+
+// ExportKey derives a secret of n bytes from the connection's key, for
+// the application to use for its own purposes. Both peers get the same
+// secret for the same label, and different labels give unrelated secrets.
+func (c *Conn) ExportKey(label string, n int) ([]byte, error) {
+	return c.keys.Export(label, n)
+}
+
+// Keys returns the connection's key schedule, for the application to seal
+// messages of its own. For sessions left open for long, see Ratcheted.
+func (c *Conn) Keys() *pake.Schedule {
+	return c.keys
+}
+
+// PeerVersion returns the version of the peer protocol the other side speaks.
+func (c *Conn) PeerVersion() int {
+	return c.peerVersion
+}
+
+// MessageLimit returns the longest message the peer reads.
+func (c *Conn) MessageLimit() int {
+	if c.peerVersion < MinLargeMessages {
+		return 32 << 10
+	}
+	return MaxMessage
+}
+
+// commonVersion returns the newest version of the peer protocol both sides
+// speak.
+func (c *Conn) commonVersion() int {
+	if c.peerVersion < Protocol {
+		return c.peerVersion
+	}
+	return Protocol
+}
+
+// keyVersion returns the version of the key schedule to use: the common
+// version, or the newest that changed keys if it's newer than that.
+func (c *Conn) keyVersion() int {
+	if v := c.commonVersion(); v < pake.MaxVersion {
+		return v
+	}
+	return pake.MaxVersion
 }
 
 func (c *Conn) Write(p []byte) (n int, err error) {
+	return write(c.sched, c.d, c.flushc, c.ReadWriteCloser, p)
+}
+
+// write writes p to the detached data channel w of d, once s lets it.
+func write(s *sched, d *webrtc.DataChannel, flushc *sync.Cond, w io.Writer, p []byte) (n int, err error) {
+	s.sendLimit.take(len(p))
+	s.wait(d)
 	// The webrtc package's channel does not have a blocking Write, so
 	// we can't just use io.Copy until the issue is fixed upsteam.
-	// Work around this by blocking here and waiting for flushes.
+	// Work around this by blocking here once the buffer's full, until it
+	// drains to its low threshold; see Dialer.BufferLowThreshold.
 	// https://github.com/pion/sctp/issues/77
-	c.flushc.L.Lock()
-	for c.d.BufferedAmount() > c.d.BufferedAmountLowThreshold() {
-		c.flushc.Wait()
+	flushc.L.Lock()
+	if d.BufferedAmount()+uint64(len(p)) > s.buffer {
+		start := time.Now()
+		for d.BufferedAmount() > d.BufferedAmountLowThreshold() {
+			flushc.Wait()
+		}
+		atomic.AddInt64(&s.stalled, int64(time.Since(start)))
 	}
-	c.flushc.L.Unlock()
-	return c.ReadWriteCloser.Write(p)
+	flushc.L.Unlock()
+	n, err = w.Write(p)
+	atomic.AddInt64(&s.sent, int64(n))
+	return n, err
 }
 
-// TODO benchmark this buffer madness.
 func (c *Conn) flushed() {
 	c.flushc.L.Lock()
 	c.flushc.Signal()
@@ -107,7 +386,8 @@ func (c *Conn) flushed() {
 }
 
 func (c *Conn) Close() (err error) {
-	for c.d.BufferedAmount() != 0 {
+	// There's no waiting for a peer that's gone to take what's left.
+	for c.d.BufferedAmount() != 0 && atomic.LoadInt32(&c.eof) == 0 {
 		// SetBufferedAmountLowThreshold does not seem to take effect
 		// when after the last Write().
 		time.Sleep(time.Second) // ew.
@@ -118,6 +398,8 @@ func (c *Conn) Close() (err error) {
 			err = e
 		}
 	}
+	c.closeOnce.Do(func() { close(c.closed) })
+	c.setState(Disconnected)
 	defer tryclose(c.pc)
 	defer tryclose(c.d)
 	defer tryclose(c.ReadWriteCloser)
@@ -131,7 +413,29 @@ func (c *Conn) open() {
 		c.err <- err
 		return
 	}
-	close(c.opened)
+	if c.peerVersion < 2 {
+		close(c.opened)
+		c.connected()
+		go c.reprobe(c.relay)
+		return
+	}
+	// Data on our channel can race ahead of the peer setting up theirs,
+	// which pion then mistakes for a new stream. Wait for the peer to say
+	// it's ready, over a stream of its own, before letting anyone write.
+	if _, err := c.pc.CreateDataChannel(readyLabel, nil); err != nil {
+		c.err <- err
+		return
+	}
+	go func() {
+		select {
+		case <-c.ready:
+		case <-c.closed:
+			return
+		}
+		close(c.opened)
+		c.connected()
+		c.reprobe(c.relay)
+	}()
 }
 
 // It's not really clear to me when this will be invoked.
@@ -140,83 +444,446 @@ func (c *Conn) error(err error) {
 	c.err <- err
 }
 
-func readEncJSON(ws *websocket.Conn, key *[32]byte, v interface{}) error {
+// closeError translates the close codes the signalling server uses into
+// the errors above. The server uses HTTP status codes offset into the
+// private range of WebSocket close codes.
+func closeError(err error) error {
+	if e, ok := err.(*websocket.CloseError); ok {
+		switch e.Code - 4000 {
+		case http.StatusNotFound:
+			return ErrNoSuchSlot
+		case http.StatusConflict:
+			return ErrSlotTaken
+		case http.StatusServiceUnavailable:
+			return ErrNoFreeSlot
+		case http.StatusLocked:
+			return ErrSlotTried
+		case http.StatusTooManyRequests:
+			return ErrSlotBusy
+		case http.StatusRequestTimeout:
+			return ErrTimedOut
+		case http.StatusGone:
+			return ErrCancelled
+		}
+	}
+	return err
+}
+
+func readEncJSON(ws *sigconn, key *[32]byte, v interface{}) error {
 	_, buf, err := ws.ReadMessage()
 	if err != nil {
-		return err
+		return closeError(err)
 	}
 	encrypted, err := base64.URLEncoding.DecodeString(string(buf))
 	if err != nil {
 		return err
 	}
-	var nonce [24]byte
-	copy(nonce[:], encrypted[:24])
-	jsonmsg, ok := secretbox.Open(nil, encrypted[24:], &nonce, key)
-	if !ok {
-		return errors.New("bad key")
+	jsonmsg, err := pake.Open(key, encrypted)
+	if err != nil {
+		return ErrBadKey
 	}
 	return json.Unmarshal(jsonmsg, v)
 }
 
-func writeEncJSON(ws *websocket.Conn, key *[32]byte, v interface{}) error {
+func writeEncJSON(ws *sigconn, key *[32]byte, v interface{}) error {
 	jsonmsg, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
-	var nonce [24]byte
-	if _, err := io.ReadFull(crand.Reader, nonce[:]); err != nil {
+	if ws.strict {
+		// Trailing white space is still valid JSON, also to older peers.
+		pad := padSize - len(jsonmsg)%padSize
+		jsonmsg = append(jsonmsg, bytes.Repeat([]byte(" "), pad)...)
+	}
+	sealed, err := pake.Seal(key, jsonmsg)
+	if err != nil {
 		return err
 	}
 	return ws.WriteMessage(
 		websocket.TextMessage,
-		[]byte(base64.URLEncoding.EncodeToString(
-			secretbox.Seal(nonce[:], jsonmsg, &nonce, key),
-		)),
+		[]byte(base64.URLEncoding.EncodeToString(sealed)),
 	)
 }
 
-func readBase64(ws *websocket.Conn) ([]byte, error) {
+func readBase64(ws *sigconn) ([]byte, error) {
 	_, buf, err := ws.ReadMessage()
 	if err != nil {
-		return nil, err
+		return nil, closeError(err)
 	}
 	return base64.URLEncoding.DecodeString(string(buf))
 }
 
-func writeBase64(ws *websocket.Conn, p []byte) error {
+func writeBase64(ws *sigconn, p []byte) error {
 	return ws.WriteMessage(websocket.TextMessage, []byte(base64.URLEncoding.EncodeToString(p)))
 }
 
-func readString(ws *websocket.Conn) (string, error) {
+func readString(ws *sigconn) (string, error) {
 	_, buf, err := ws.ReadMessage()
-	return string(buf), err
+	return string(buf), closeError(err)
+}
+
+// gathered trickles out a newly gathered local candidate.
+func (c *Conn) gathered(candidate *webrtc.ICECandidate) {
+	if candidate == nil {
+		// Done gathering.
+		return
+	}
+	if c.dialer.OnCandidate != nil {
+		c.dialer.OnCandidate(localCandidate(candidate))
+	}
+	init := candidate.ToJSON()
+	if c.dialer.NoHostCandidates {
+		if candidate.Typ == webrtc.ICECandidateTypeHost {
+			return
+		}
+		init.Candidate = hideRelated(init.Candidate)
+	}
+	c.trickle.Lock()
+	defer c.trickle.Unlock()
+	if c.sendCandidate == nil {
+		c.candidates = append(c.candidates, init)
+		return
+	}
+	c.sendCandidate(init)
+}
+
+// startTrickle sends the candidates gathered so far, and any more as
+// they're gathered. It must be called after sending our session
+// description, which the peer expects first.
+func (c *Conn) startTrickle(ws *sigconn, key *[32]byte) {
+	c.trickle.Lock()
+	defer c.trickle.Unlock()
+	c.sendCandidate = func(candidate webrtc.ICECandidateInit) {
+		// It's fine if this fails after the signalling server is
+		// gone, we've connected by then.
+		writeEncJSON(ws, key, candidate)
+	}
+	for _, candidate := range c.candidates {
+		c.sendCandidate(candidate)
+	}
+	c.candidates = nil
 }
 
 // addCandidates waits for candidate to trickle in. We close the websocket
 // when we get a successful connection so this should fail and exit at some
 // point.
-func (c *Conn) addCandidates(ws *websocket.Conn, key *[32]byte) {
+func (c *Conn) addCandidates(ws *sigconn, key *[32]byte) {
 	for {
 		var candidate webrtc.ICECandidateInit
 		err := readEncJSON(ws, key, &candidate)
-		if err != nil {
-			return
+		if err == ErrSlotTried || err == ErrCancelled {
+			// Don't let the connection come up regardless.
+			select {
+			case c.err <- err:
+			case <-c.opened:
+			case <-c.closed:
+			}
 		}
-		err = c.pc.AddICECandidate(candidate)
 		if err != nil {
 			return
 		}
+		// Skip candidates we can't use, like link-local IPv6 addresses
+		// with a zone, rather than give up on the rest. Browsers hide
+		// local addresses behind mDNS names like "<uuid>.local", which pion
+		// resolves in the background, and drops if nothing answers.
+		if c.dialer.TransportPolicy == NoRelay && relayed(candidate.Candidate) {
+			continue
+		}
+		c.remoteCandidate(candidate.Candidate)
+		c.pc.AddICECandidate(candidate)
+	}
+}
+
+// relayed is whether an ICE candidate is a TURN relay.
+func relayed(candidate string) bool {
+	return strings.Contains(candidate, " typ relay")
+}
+
+// filterRemote removes the relay candidates from a peer's session
+// description under the NoRelay policy. Peers that don't trickle send
+// their candidates this way.
+func (c *Conn) filterRemote(sd webrtc.SessionDescription) webrtc.SessionDescription {
+	if c.dialer.TransportPolicy != NoRelay {
+		c.sdpCandidates(sd)
+		return sd
+	}
+	lines := strings.SplitAfter(sd.SDP, "\n")
+	sdp := ""
+	for _, l := range lines {
+		if strings.HasPrefix(l, "a=candidate:") && relayed(l) {
+			continue
+		}
+		sdp += l
+	}
+	sd.SDP = sdp
+	c.sdpCandidates(sd)
+	return sd
+}
+
+// A Dialer contains options for connecting to a peer.
+type Dialer struct {
+	// SignalServer is the URL of the signalling server.
+	SignalServer string
+
+	// ICEServers is an optional list of STUN and TURN URLs to use for
+	// NAT traversal. TURN URLs can carry credentials, as in
+	// turn:username:password@host:port, see WithCredentials.
+	ICEServers []string
+
+	// Record, if not nil, receives a recording of the frames exchanged with
+	// the signalling server, for debugging. Frames are recorded as they
+	// appear on the wire, so everything after the PAKE is encrypted.
+	Record io.Writer
+
+	// Header is sent along with the request to the signalling server,
+	// e.g. with an Authorization header for private servers.
+	Header http.Header
+
+	// TLSClientConfig, if not nil, is used to connect to the signalling
+	// server, e.g. to present a client certificate.
+	TLSClientConfig *tls.Config
+
+	// Trace, if not nil, is called as each phase of connecting starts:
+	//	signal  reaching the signalling server and waiting for the peer
+	//	pake    agreeing on a key
+	//	sdp     exchanging the offer and answer
+	//	ice     waiting for the data channel to open
+	// The function it returns is called when the phase ends.
+	Trace func(phase string) (end func(err error))
+
+	// TTL, if not zero, is how long a booked slot should wait for the peer
+	// before it expires. Servers cap it to their own limit.
+	TTL time.Duration
+
+	// Renew, if not nil, can be sent on while waiting for the peer to
+	// restart the TTL of the booked slot.
+	Renew chan struct{}
+
+	// Revoke, if not empty, is a secret that lets whoever has it cancel
+	// the slot booked with Cancel while it waits for the peer, e.g. from
+	// another process. Only its hash is sent when booking.
+	Revoke string
+
+	// Rebook, if not zero, is how long to keep trying to book the same
+	// slot again if the signalling server drops the connection while
+	// waiting for the peer, e.g. to restart. Servers that save their
+	// state hold the slot for a while, so the code stays good.
+	Rebook time.Duration
+
+	// If ICEServers has more than one TURN server over UDP, only the one
+	// with the lowest round trip time when dialing is used. With a
+	// ReprobeInterval, they're probed again periodically while the
+	// connection is open, and OnFasterRelay is called if another one has
+	// become noticeably faster. It's up to OnFasterRelay to move the
+	// connection over, e.g. by dialing again with only the new relay.
+	ReprobeInterval time.Duration
+	OnFasterRelay   func(old, new string)
+
+	// STUNTimeout is how long each STUN server in ICEServers has to answer
+	// a probe when dialing, before it's left out, by default 2s. ICE only
+	// gathers relay candidates once it's heard from every STUN server or
+	// given up on it, so with TURN servers around, STUN servers are probed
+	// first, all at once. Ones that don't answer are left out of
+	// connections made in the next few minutes too, without probing them.
+	STUNTimeout time.Duration
+
+	// BufferSize is how many bytes each data channel may buffer before
+	// writes block. The default, and the most, is MaxBufferSize.
+	BufferSize int
+
+	// BufferLowThreshold is how far a data channel's buffer has to drain
+	// once it's full before writes go on, by default half of BufferSize.
+	// Going on as soon as there's room wakes writers for every message the
+	// network takes, and leaving it to drain too far leaves the network
+	// waiting on them.
+	BufferLowThreshold int
+
+	// NoHostCandidates keeps the local addresses of this machine from the
+	// peer, by only sending it server reflexive and relay candidates, with
+	// the local addresses they're related to blanked out, as browsers do.
+	// Peers on the same network may then have to connect through the relay.
+	NoHostCandidates bool
+
+	// TransportPolicy restricts the routes to the peer ICE may use.
+	TransportPolicy TransportPolicy
+
+	// OnState, if not nil, is called as the connection goes from one State
+	// to another, e.g. to show whether it's relayed.
+	OnState func(s State)
+
+	// OnCandidate, if not nil, is called with each ICE candidate as it's
+	// gathered, or comes from the peer, and OnSelectedPair with the pair
+	// of them ICE connects with, and again if it changes to another, e.g.
+	// to find out why peers don't connect, or connect only through a
+	// relay. They're called from other goroutines.
+	OnCandidate    func(c Candidate)
+	OnSelectedPair func(local, remote Candidate)
+
+	// OnProgress, if not nil, is called with the bytes written to and read
+	// from the connection and its streams so far, every ProgressInterval
+	// while they change, and once more when it's closed. The default
+	// interval is 100ms. Applications know how much they mean to send, so
+	// they can show it against that.
+	OnProgress       func(sent, received int64)
+	ProgressInterval time.Duration
+
+	// StrictPrivacy hides more of this client from the signalling server,
+	// for untrusted servers. Messages are padded so that their sizes don't
+	// tell what kind of client sent them, and sent after a short random
+	// delay so that their timing tells less about the network. Connecting
+	// takes a little longer.
+	StrictPrivacy bool
+
+	// LongPoll signals over plain HTTP, long-polling the server, without
+	// trying a websocket first. Without it, that's only done if the
+	// websocket's turned down by something other than the server, e.g. a
+	// proxy. It's slower, so it's for networks where websockets hang
+	// rather than fail.
+	LongPoll bool
+}
+
+// A TransportPolicy says whether a connection may, or must, go through a
+// TURN relay.
+type TransportPolicy int
+
+const (
+	// AllTransports connects directly if possible, or through a relay if
+	// not.
+	AllTransports TransportPolicy = iota
+
+	// NoRelay only connects directly, so that data is never relayed. TURN
+	// servers are ignored, and so are the peer's relay candidates.
+	NoRelay
+
+	// RelayOnly only connects through a relay, so that the peer never
+	// learns our addresses. It fails without a TURN server.
+	RelayOnly
+)
+
+// MaxBufferSize is the largest Dialer.BufferSize. Any threshold amount
+// >= 1MiB seems to occasionally lock up pion, so stay well under.
+const MaxBufferSize = 512 << 10
+
+func (d *Dialer) stunTimeout() time.Duration {
+	if d.STUNTimeout <= 0 {
+		return probeTimeout
+	}
+	return d.STUNTimeout
+}
+
+func (d *Dialer) bufferSize() uint64 {
+	if d.BufferSize <= 0 || d.BufferSize > MaxBufferSize {
+		return MaxBufferSize
+	}
+	return uint64(d.BufferSize)
+}
+
+func (d *Dialer) lowThreshold() uint64 {
+	if d.BufferLowThreshold <= 0 || uint64(d.BufferLowThreshold) > d.bufferSize() {
+		return d.bufferSize() / 2
+	}
+	return uint64(d.BufferLowThreshold)
+}
+
+// renewals forwards messages on d.Renew to the signalling server until stop
+// is called.
+func (d *Dialer) renewals(ws *sigconn) (stop func()) {
+	if d.Renew == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-d.Renew:
+				ws.WriteMessage(websocket.TextMessage, []byte("renew"))
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// ICEServer parses a STUN or TURN URL, as in Dialer.ICEServers. TURN URLs
+// may carry credentials, as in turn:username:password@host:port.
+func ICEServer(s string) webrtc.ICEServer {
+	at := strings.LastIndex(s, "@")
+	colon := strings.Index(s, ":")
+	if at < 0 || colon < 0 || !strings.HasPrefix(s, "turn") {
+		return webrtc.ICEServer{URLs: []string{s}}
+	}
+	userinfo := s[colon+1 : at]
+	sep := strings.LastIndex(userinfo, ":")
+	if sep < 0 {
+		return webrtc.ICEServer{URLs: []string{s}}
+	}
+	return webrtc.ICEServer{
+		URLs:           []string{s[:colon+1] + s[at+1:]},
+		Username:       userinfo[:sep],
+		Credential:     userinfo[sep+1:],
+		CredentialType: webrtc.ICECredentialTypePassword,
+	}
+}
+
+// WithCredentials returns the TURN URL u with username and credential, for
+// Dialer.ICEServers. STUN URLs, and TURN URLs that have credentials
+// already, are returned as they are.
+func WithCredentials(u, username, credential string) string {
+	colon := strings.Index(u, ":")
+	if colon < 0 || !strings.HasPrefix(u, "turn") || strings.Contains(u, "@") {
+		return u
+	}
+	return u[:colon+1] + username + ":" + credential + "@" + u[colon+1:]
+}
+
+// hasRelay reports whether any of urls is a TURN server.
+func hasRelay(urls []string) bool {
+	for _, s := range urls {
+		if strings.HasPrefix(s, "turn") {
+			return true
+		}
+	}
+	return false
+}
+
+// phases tracks the phase of connecting for Dialer.Trace.
+type phases struct {
+	trace func(string) func(error)
+	end   func(error)
+}
+
+// next ends the current phase and starts the named one.
+func (p *phases) next(name string) {
+	if p.trace == nil {
+		return
+	}
+	p.done(nil)
+	p.end = p.trace(name)
+}
+
+// done ends the current phase.
+func (p *phases) done(err error) {
+	if p.end != nil {
+		p.end(err)
+		p.end = nil
 	}
 }
 
-func newConn(sigserv string, iceserv []string) (*Conn, error) {
+func (d *Dialer) newConn() (*Conn, error) {
 	c := &Conn{
-		opened: make(chan struct{}),
-		err:    make(chan error),
-		flushc: sync.NewCond(&sync.Mutex{}),
+		dialer:  d,
+		opened:  make(chan struct{}),
+		err:     make(chan error),
+		flushc:  sync.NewCond(&sync.Mutex{}),
+		closed:  make(chan struct{}),
+		streams: make(chan *Stream, 16),
+		ready:   make(chan struct{}),
+		sched:   newSched(d.bufferSize()),
 	}
+	c.setState(Connecting)
 
-	u, err := url.Parse(sigserv)
+	u, err := url.Parse(d.SignalServer)
 	if err != nil {
 		return nil, err
 	}
@@ -228,15 +895,51 @@ func newConn(sigserv string, iceserv []string) (*Conn, error) {
 	u.Path = path.Join(u.Path, "/s/")
 	c.wsaddr = u.String()
 
+	return c, nil
+}
+
+// listen creates c's peer connection, using the ICE servers of the Dialer
+// along with any relays the signalling server offered over ws.
+func (c *Conn) listen(ws *sigconn) (err error) {
+	d := c.dialer
 	rtccfg := webrtc.Configuration{}
-	for i := range iceserv {
-		if iceserv[i] != "" {
-			rtccfg.ICEServers = append(rtccfg.ICEServers, webrtc.ICEServer{URLs: []string{iceserv[i]}})
+	servers := append(append([]string{}, d.ICEServers...), ws.relays...)
+	switch d.TransportPolicy {
+	case NoRelay:
+		all := servers
+		servers = nil
+		for _, s := range all {
+			if !strings.HasPrefix(s, "turn") {
+				servers = append(servers, s)
+			}
+		}
+	case RelayOnly:
+		rtccfg.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+		if !hasRelay(servers) {
+			return ErrNoRelay
+		}
+	}
+	// STUN servers that don't answer only hold up relay candidates, so
+	// only probe them if there are both, while picking a relay rather than
+	// one after the other.
+	dead := make(chan map[string]bool, 1)
+	go func() {
+		if d.TransportPolicy == RelayOnly || !hasRelay(servers) {
+			dead <- nil
+			return
+		}
+		dead <- unanswered(servers, d.stunTimeout())
+	}()
+	servers, c.relay = pickRelay(servers)
+	skip := <-dead
+	for _, s := range servers {
+		if s != "" && !skip[s] {
+			rtccfg.ICEServers = append(rtccfg.ICEServers, ICEServer(s))
 		}
 	}
 	c.pc, err = rtcapi.NewPeerConnection(rtccfg)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	sigh := true
 	c.d, err = c.pc.CreateDataChannel("data", &webrtc.DataChannelInit{
@@ -244,50 +947,311 @@ func newConn(sigserv string, iceserv []string) (*Conn, error) {
 		ID:         new(uint16),
 	})
 	if err != nil {
-		return nil, err
+		return err
 	}
+	c.sched.set(c.d, 0)
 	c.d.OnOpen(c.open)
 	c.d.OnError(c.error)
+	c.pc.OnDataChannel(c.accept)
+	c.pc.OnICECandidate(c.gathered)
+	c.pc.OnICEConnectionStateChange(c.iceStateChanged)
 	c.d.OnBufferedAmountLow(c.flushed)
-	// Any threshold amount >= 1MiB seems to occasionally lock up pion.
-	// Choose 512 KiB as a safe default.
-	c.d.SetBufferedAmountLowThreshold(512 << 10)
+	c.d.SetBufferedAmountLowThreshold(d.lowThreshold())
 
-	return c, nil
+	return nil
 }
 
 // Wormhole is like Dial, but asks the signalling server to assign it a slot
 // and writes it to slotc as soon as it gets it.
 func Wormhole(pass string, sigserv string, iceserv []string, slotc chan string) (*Conn, error) {
-	c, err := newConn(sigserv, iceserv)
+	d := &Dialer{SignalServer: sigserv, ICEServers: iceserv}
+	return d.Wormhole(pass, slotc)
+}
+
+// Wormhole is like Dial, but asks the signalling server to assign it a slot
+// and writes it to slotc as soon as it gets it.
+func (d *Dialer) Wormhole(pass string, slotc chan string) (*Conn, error) {
+	w, err := d.Prepare("")
 	if err != nil {
 		return nil, err
 	}
-	ws, r, err := websocket.DefaultDialer.Dial(c.wsaddr+"/", nil)
+	slotc <- w.Slot()
+	return w.Wait(pass)
+}
+
+// Reserve is like Wormhole, but asks the signalling server for a specific
+// slot instead of having one assigned. It returns ErrSlotTaken if the slot
+// is already held by someone else.
+//
+// This allows both peers to use a code agreed on ahead of time.
+func Reserve(slot, pass string, sigserv string, iceserv []string) (*Conn, error) {
+	d := &Dialer{SignalServer: sigserv, ICEServers: iceserv}
+	return d.Reserve(slot, pass)
+}
+
+// Reserve is like Wormhole, but asks the signalling server for a specific
+// slot instead of having one assigned. It returns ErrSlotTaken if the slot
+// is already held by someone else.
+func (d *Dialer) Reserve(slot, pass string) (*Conn, error) {
+	w, err := d.Prepare(slot)
 	if err != nil {
-		if r != nil && r.Header.Get("X-Version") != protocolVersion {
-			return nil, ErrBadVersion
-		}
 		return nil, err
 	}
+	return w.Wait(pass)
+}
 
-	slot, err := readString(ws)
+// A Prepared wormhole has a slot booked on the signalling server, and is
+// getting its side of the connection ready while it waits for the peer.
+type Prepared struct {
+	c    *Conn
+	ws   *sigconn
+	p    *phases
+	slot string
+	// sd is the offer, set before its error is sent on offer.
+	sd    webrtc.SessionDescription
+	offer chan error
+	// closed is closed by Close.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Prepare books a slot (the one given, or any if empty) and starts
+// gathering ICE candidates while waiting for the peer, so that connecting
+// takes less time once the peer turns up. Applications can call it before
+// they know what they'll send, and pick a password to go with the slot at
+// their leisure. Call Wait to connect, or Close to give up.
+func (d *Dialer) Prepare(slot string) (w *Prepared, err error) {
+	return d.prepare(context.Background(), slot)
+}
+
+// prepare is Prepare, giving up on booking the slot once ctx is done.
+func (d *Dialer) prepare(ctx context.Context, slot string) (w *Prepared, err error) {
+	p := &phases{trace: d.Trace}
+	defer func() {
+		if err != nil {
+			p.done(err)
+		}
+	}()
+	p.next("signal")
+	c, err := d.newConn()
+	if err != nil {
+		return nil, err
+	}
+	w = &Prepared{c: c, p: p, offer: make(chan error, 1), closed: make(chan struct{})}
+	w.ws, w.slot, err = d.book(ctx, c.wsaddr, slot)
 	if err != nil {
 		return nil, err
 	}
-	slotc <- slot
+	if err := c.listen(w.ws); err != nil {
+		w.ws.Close()
+		return nil, err
+	}
+	// Gathering candidates can take a while, especially when some STUN
+	// servers don't answer, so get on with it while waiting for the peer.
+	go func() {
+		var err error
+		w.sd, err = c.pc.CreateOffer(nil)
+		if err == nil {
+			err = c.pc.SetLocalDescription(w.sd)
+		}
+		w.offer <- err
+	}()
+	return w, nil
+}
+
+// book books slot on the signalling server at wsaddr, or any slot if it's
+// empty, and returns the one it got.
+func (d *Dialer) book(ctx context.Context, wsaddr, slot string) (*sigconn, string, error) {
+	q := url.Values{}
+	if slot != "" {
+		q.Set("slot", slot)
+	}
+	if d.TTL > 0 {
+		q.Set("ttl", strconv.Itoa(int(d.TTL/time.Second)))
+	}
+	if d.Revoke != "" {
+		h := sha256.Sum256([]byte(d.Revoke))
+		q.Set("revoke", hex.EncodeToString(h[:]))
+	}
+	wsaddr += "/"
+	if len(q) > 0 {
+		wsaddr += "?" + q.Encode()
+	}
+	ws, err := d.dialSignal(ctx, "book", wsaddr)
+	if err != nil {
+		return nil, "", err
+	}
+	got, err := readString(ws)
+	if err != nil {
+		ws.Close()
+		return nil, "", err
+	}
+	if slot != "" && got != slot {
+		// Older servers ignore the request and assign any slot.
+		ws.Close()
+		return nil, "", ErrBadVersion
+	}
+	return ws, got, nil
+}
+
+// dropped reports whether err means the signalling server went away,
+// rather than turned us down.
+func dropped(err error) bool {
+	switch err {
+	case ErrNoSuchSlot, ErrSlotTaken, ErrTimedOut, ErrNoFreeSlot, ErrSlotTried, ErrSlotBusy, ErrCancelled:
+		// closeError made these of the server's reasons.
+		return false
+	}
+	e, ok := err.(*websocket.CloseError)
+	return !ok || e.Code == websocket.CloseGoingAway || e.Code == websocket.CloseAbnormalClosure
+}
+
+// waitPeer waits for the peer's first message. If the signalling server
+// drops the connection in the meantime, it books the slot again, for as
+// long as the Dialer's Rebook allows.
+func (w *Prepared) waitPeer() ([]byte, error) {
+	d := w.c.dialer
+	for {
+		stop := d.renewals(w.ws)
+		msg, err := readBase64(w.ws)
+		stop()
+		if w.isClosed() {
+			return nil, io.ErrClosedPipe
+		}
+		if err == nil || d.Rebook <= 0 || !dropped(err) {
+			return msg, err
+		}
+		w.ws.Close()
+		deadline := time.Now().Add(d.Rebook)
+		for {
+			select {
+			case <-time.After(time.Second):
+			case <-w.closed:
+				return nil, io.ErrClosedPipe
+			}
+			var ws *sigconn
+			ws, _, err = d.book(context.Background(), w.c.wsaddr, w.slot)
+			if err == nil {
+				w.ws = ws
+				break
+			}
+			if _, ok := err.(*SignalVersionError); ok {
+				return nil, err
+			}
+			switch {
+			case err == ErrSlotTaken, err == ErrForbidden, err == ErrUnauthorized, err == ErrBadVersion,
+				time.Now().After(deadline):
+				return nil, err
+			}
+		}
+	}
+}
+
+// Slot returns the slot booked for the wormhole.
+func (w *Prepared) Slot() string {
+	return w.slot
+}
+
+// Close gives up on the wormhole, freeing the slot.
+func (w *Prepared) Close() error {
+	w.closeOnce.Do(func() { close(w.closed) })
+	w.p.done(io.ErrClosedPipe)
+	w.ws.Close()
+	return w.c.pc.Close()
+}
+
+func (w *Prepared) isClosed() bool {
+	select {
+	case <-w.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Cancel frees slot on the signalling server, which was booked with the
+// Dialer's Revoke, and returns once the server confirms it's gone. The peer
+// waiting on it gets ErrCancelled. It returns ErrNoSuchSlot if nobody is
+// waiting on slot anymore.
+func (d *Dialer) Cancel(slot string) error {
+	u, err := url.Parse(d.SignalServer)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "ws" || u.Scheme == "http" {
+		u.Scheme = "http"
+	} else {
+		u.Scheme = "https"
+	}
+	u.Path = path.Join(u.Path, "/s/", slot)
+	r, err := http.NewRequest(http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range d.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("X-Revoke", d.Revoke)
+	r.Header.Set("X-Version", protocolVersion)
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: d.TLSClientConfig, Proxy: http.ProxyFromEnvironment},
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusUpgradeRequired:
+		if err := checkSignal(resp.Header); err != nil {
+			return err
+		}
+	case http.StatusNotFound:
+		return ErrNoSuchSlot
+	case http.StatusForbidden:
+		return ErrForbidden
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	}
+	// Older servers only take websockets.
+	return ErrBadVersion
+}
+
+// WaitContext is like Wait, but gives up on the wormhole, freeing the
+// slot, once ctx is done.
+func (w *Prepared) WaitContext(ctx context.Context, pass string) (*Conn, error) {
+	stop := afterDone(ctx, func() { w.Close() })
+	c, err := w.Wait(pass)
+	if stop() {
+		if c != nil {
+			c.Close()
+		}
+		return nil, ctx.Err()
+	}
+	return c, err
+}
+
+// Wait waits for the peer, and connects to it using pass as the PAKE
+// password.
+func (w *Prepared) Wait(pass string) (_ *Conn, err error) {
+	c, p := w.c, w.p
+	defer func() { p.done(err) }()
 
-	msgA, err := readBase64(ws)
+	msgA, err := w.waitPeer()
 	if err != nil {
 		return nil, err
 	}
+	ws := w.ws
 
-	msgB, mk, err := cpace.Exchange(pass, cpace.NewContextInfo("", "", nil), msgA)
+	p.next("pake")
+	msgB, mk, err := pake.Exchange(pass, msgA)
 	if err != nil {
 		return nil, err
 	}
-	key := [32]byte{}
-	_, err = io.ReadFull(hkdf.New(sha256.New, mk, nil, nil), key[:])
+	key, err := pake.Key(mk)
 	if err != nil {
 		return nil, err
 	}
@@ -296,42 +1260,46 @@ func Wormhole(pass string, sigserv string, iceserv []string, slotc chan string)
 		return nil, err
 	}
 
-	offer, err := c.pc.CreateOffer(nil)
-	if err != nil {
+	p.next("sdp")
+	if err := <-w.offer; err != nil {
 		return nil, err
 	}
-	err = c.pc.SetLocalDescription(offer)
+	err = writeEncJSON(ws, key, newSessionDesc(w.sd))
 	if err != nil {
 		return nil, err
 	}
-	err = writeEncJSON(ws, &key, offer)
+	c.startTrickle(ws, key)
+
+	var answer sessionDesc
+	err = readEncJSON(ws, key, &answer)
 	if err != nil {
 		return nil, err
 	}
-
-	var answer webrtc.SessionDescription
-	err = readEncJSON(ws, &key, &answer)
+	if err := answer.checkVersion(); err != nil {
+		return nil, err
+	}
+	c.peerVersion = answer.Version
+	c.keys, err = pake.NewSchedule(mk, c.keyVersion(), pake.SideB)
 	if err != nil {
 		return nil, err
 	}
-	err = c.pc.SetRemoteDescription(answer)
+	err = c.pc.SetRemoteDescription(c.filterRemote(answer.SessionDescription))
 	if err != nil {
 		return nil, err
 	}
 
-	go c.addCandidates(ws, &key)
+	p.next("ice")
+	go c.addCandidates(ws, key)
 
 	// TODO put a timeout here.
 	select {
 	case <-c.opened:
 	case err = <-c.err:
+	case <-w.closed:
+		err = io.ErrClosedPipe
 	}
 
-	ws.WriteControl(
-		websocket.CloseMessage,
-		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "done"),
-		time.Now().Add(10*time.Second),
-	)
+	ws.done()
 	return c, err
 }
 
@@ -343,31 +1311,53 @@ func Wormhole(pass string, sigserv string, iceserv []string, slotc chan string)
 //
 // iceserv is an optional list of STUN and TURN URLs to use for NAT traversal.
 func Dial(slot, pass string, sigserv string, iceserv []string) (*Conn, error) {
-	c, err := newConn(sigserv, iceserv)
+	d := &Dialer{SignalServer: sigserv, ICEServers: iceserv}
+	return d.Dial(slot, pass)
+}
+
+// Dial returns an established WebRTC data channel to a peer. See Dial.
+func (d *Dialer) Dial(slot, pass string) (*Conn, error) {
+	return d.DialContext(context.Background(), slot, pass)
+}
+
+// DialContext is like Dial, but gives up once ctx is done.
+func (d *Dialer) DialContext(ctx context.Context, slot, pass string) (c *Conn, err error) {
+	p := &phases{trace: d.Trace}
+	defer func() { p.done(err) }()
+	p.next("signal")
+	c, err = d.newConn()
 	if err != nil {
 		return nil, err
 	}
 
 	// Start the handshake
-	ws, r, err := websocket.DefaultDialer.Dial(c.wsaddr+"/"+slot, nil)
+	ws, err := d.dialSignal(ctx, "join", c.wsaddr+"/"+slot)
 	if err != nil {
-		if r != nil && r.Header.Get("X-Version") != protocolVersion {
-			return nil, ErrBadVersion
-		}
 		return nil, err
 	}
+	if err := c.listen(ws); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	conn := c
+	stop := afterDone(ctx, func() {
+		ws.Close()
+		conn.pc.Close()
+	})
+	defer func() {
+		if stop() {
+			if err == nil {
+				conn.Close()
+			}
+			c, err = nil, ctx.Err()
+		}
+	}()
 
-	// The identity arguments are to bind endpoint identities in PAKE. Cf. Unknown
-	// Key-Share Attack. https://tools.ietf.org/html/draft-ietf-mmusic-sdp-uks-03
-	//
-	// In the context of a program like magic-wormhole we do not have ahead of time
-	// information on the identity of the remote party. We only have the slot name,
-	// and sometimes even that at this stage. But that's okay, since:
-	//   a) The password is randomly generated and ephemeral.
-	//   b) A peer only gets one guess.
-	// An unintended destination is likely going to fail PAKE.
-
-	msgA, pake, err := cpace.Start(pass, cpace.NewContextInfo("", "", nil))
+	p.next("pake")
+	msgA, state, err := pake.Start(pass)
+	if err != nil {
+		return nil, err
+	}
 	err = writeBase64(ws, msgA)
 	if err != nil {
 		return nil, err
@@ -377,22 +1367,32 @@ func Dial(slot, pass string, sigserv string, iceserv []string) (*Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	mk, err := pake.Finish(msgB)
+	mk, err := state.Finish(msgB)
 	if err != nil {
 		return nil, err
 	}
-	key := [32]byte{}
-	_, err = io.ReadFull(hkdf.New(sha256.New, mk, nil, nil), key[:])
+	key, err := pake.Key(mk)
 	if err != nil {
 		return nil, err
 	}
 
-	var offer webrtc.SessionDescription
-	err = readEncJSON(ws, &key, &offer)
+	p.next("sdp")
+	var offer sessionDesc
+	err = readEncJSON(ws, key, &offer)
 	if err != nil {
 		return nil, err
 	}
-	err = c.pc.SetRemoteDescription(offer)
+	if err := offer.checkVersion(); err != nil {
+		// Let the other side know why we're hanging up.
+		writeEncJSON(ws, key, sessionDesc{Version: Protocol, MinVersion: MinProtocol})
+		return nil, err
+	}
+	c.peerVersion = offer.Version
+	c.keys, err = pake.NewSchedule(mk, c.keyVersion(), pake.SideA)
+	if err != nil {
+		return nil, err
+	}
+	err = c.pc.SetRemoteDescription(c.filterRemote(offer.SessionDescription))
 	if err != nil {
 		return nil, err
 	}
@@ -405,23 +1405,23 @@ func Dial(slot, pass string, sigserv string, iceserv []string) (*Conn, error) {
 		return nil, err
 	}
 
-	err = writeEncJSON(ws, &key, answer)
+	err = writeEncJSON(ws, key, newSessionDesc(answer))
 	if err != nil {
 		return nil, err
 	}
+	c.startTrickle(ws, key)
 
-	go c.addCandidates(ws, &key)
+	p.next("ice")
+	go c.addCandidates(ws, key)
 
 	// TODO put a timeout here.
 	select {
 	case <-c.opened:
 	case err = <-c.err:
+	case <-ctx.Done():
+		err = ctx.Err()
 	}
 
-	ws.WriteControl(
-		websocket.CloseMessage,
-		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "done"),
-		time.Now().Add(10*time.Second),
-	)
+	ws.done()
 	return c, err
 }
@@ -0,0 +1,224 @@
+package wormhole
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Senders may start by offering the files they're about to send, if the
+// receiver is at least MinBatch, and receivers answer with the ones they
+// want before any of them are sent. Offers and answers are JSON, split into
+// as many messages as it takes.
+
+// offerChunk is the most of an offer or answer sent in one message.
+const offerChunk = 32 << 10
+
+// offerPrefix starts every offer, so receivers can tell one from whatever
+// else a sender may start with.
+var offerPrefix = []byte(`{"files":`)
+
+// ErrAnswered is returned when an Offer is answered more than once.
+var ErrAnswered = errors.New("offer already answered")
+
+// ErrRejected is returned by SendOffer when the peer declines the offer,
+// with Reject.
+var ErrRejected = errors.New("peer declined the offer")
+
+// ErrBadAnswer is returned by SendOffer when the peer picks files that
+// weren't offered.
+var ErrBadAnswer = errors.New("peer picked files that weren't offered")
+
+// An OfferedFile describes a file in an Offer.
+type OfferedFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Type is the file's MIME type, if the sender can tell.
+	Type string `json:"type,omitempty"`
+	// Archive is set if the file is an archive of a directory, e.g. "tar".
+	Archive string `json:"archive,omitempty"`
+	// SHA256 is the hash of the file in hex, for regular files. Archives
+	// are put together as they're sent, so they have none.
+	SHA256 string `json:"sha256,omitempty"`
+	// Chunked is set for files of unknown size, like stdin. Size is 0.
+	Chunked bool `json:"chunked,omitempty"`
+}
+
+// An Offer lists the files a peer is about to send, in order. Receivers
+// get one with ReadOffer, and answer it once with Accept, AcceptOnly or
+// Reject.
+type Offer struct {
+	Files []OfferedFile `json:"files"`
+	// Compressions are the ways the sender can compress the files, in the
+	// order it prefers them, for the receiver to pick one of with
+	// UseCompression. See MinCompress.
+	Compressions []string `json:"compress,omitempty"`
+
+	c        *Conn
+	answered bool
+	compress string
+}
+
+// offerAnswer picks the files of an offer the receiver wants, by index in
+// increasing order. None means none. Declined is set by receivers turning
+// the offer down as a whole, rather than picking none of it; older ones
+// leave it out, and older senders take it for none.
+type offerAnswer struct {
+	Accept   []int  `json:"accept"`
+	Declined bool   `json:"declined,omitempty"`
+	Compress string `json:"compress,omitempty"`
+}
+
+// IsOffer reports whether msg, the first message a peer sent, starts an
+// Offer.
+func IsOffer(msg []byte) bool {
+	return bytes.HasPrefix(msg, offerPrefix)
+}
+
+// SendOffer offers files to the peer on c, and returns the indices of the
+// ones it accepted, in increasing order. It returns ErrRejected if the peer
+// declined them all with Reject.
+func (c *Conn) SendOffer(files []OfferedFile) ([]int, error) {
+	picked, _, err := c.SendOfferCompressed(files, nil)
+	return picked, err
+}
+
+// SendOfferCompressed is SendOffer, also offering to compress the files
+// with one of algs, in the order the sender prefers them. It also returns
+// the one the peer picked, or "" for none.
+func (c *Conn) SendOfferCompressed(files []OfferedFile, algs []string) ([]int, string, error) {
+	if files == nil {
+		files = []OfferedFile{}
+	}
+	if err := c.writeLong(&Offer{Files: files, Compressions: algs}); err != nil {
+		return nil, "", err
+	}
+	var a offerAnswer
+	if err := c.readLong(nil, &a); err != nil {
+		return nil, "", err
+	}
+	if a.Declined {
+		return nil, "", ErrRejected
+	}
+	if !picks(a.Accept, len(files)) || a.Compress != "" && !offered(a.Compress, algs) {
+		return nil, "", ErrBadAnswer
+	}
+	return a.Accept, a.Compress, nil
+}
+
+// ReadOffer reads the offer the peer started with on c. Its first message,
+// which IsOffer was true of, has been read already into first.
+func (c *Conn) ReadOffer(first []byte) (*Offer, error) {
+	o := &Offer{c: c}
+	if err := c.readLong(first, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Accept asks for all the files offered.
+func (o *Offer) Accept() error {
+	all := make([]int, len(o.Files))
+	for i := range all {
+		all[i] = i
+	}
+	return o.AcceptOnly(all)
+}
+
+// AcceptOnly asks for the files offered at indices picked, in increasing
+// order.
+func (o *Offer) AcceptOnly(picked []int) error {
+	if !picks(picked, len(o.Files)) {
+		return ErrBadAnswer
+	}
+	if picked == nil {
+		picked = []int{}
+	}
+	return o.answer(offerAnswer{Accept: picked, Compress: o.compress})
+}
+
+// UseCompression asks for the files to be compressed with alg, one of the
+// offer's Compressions, once they're accepted. It returns
+// ErrUnknownCompression if alg wasn't offered.
+func (o *Offer) UseCompression(alg string) error {
+	if !offered(alg, o.Compressions) {
+		return ErrUnknownCompression
+	}
+	o.compress = alg
+	return nil
+}
+
+// Reject declines the offer, asking for none of the files. The sender's
+// SendOffer returns ErrRejected.
+func (o *Offer) Reject() error {
+	return o.answer(offerAnswer{Accept: []int{}, Declined: true})
+}
+
+func (o *Offer) answer(a offerAnswer) error {
+	if o.answered {
+		return ErrAnswered
+	}
+	o.answered = true
+	return o.c.writeLong(a)
+}
+
+// picks reports whether picked are indices of a list of n, in increasing
+// order.
+func picks(picked []int, n int) bool {
+	next := 0
+	for _, i := range picked {
+		if i < next || i >= n {
+			return false
+		}
+		next = i + 1
+	}
+	return true
+}
+
+// writeLong writes v to c as JSON, split into messages of up to offerChunk.
+func (c *Conn) writeLong(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	for len(b) > 0 {
+		n := len(b)
+		if n > offerChunk {
+			n = offerChunk
+		}
+		if _, err := c.Write(b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// readLong reads v, written with writeLong, from c. The first of its
+// messages may have been read already, into first.
+func (c *Conn) readLong(first []byte, v interface{}) error {
+	r := io.MultiReader(bytes.NewReader(first), &messageReader{r: c, buf: make([]byte, offerChunk)})
+	return json.NewDecoder(r).Decode(v)
+}
+
+// messageReader reads whole messages from r, however little it's asked for
+// at a time, since a message can't be read in parts.
+type messageReader struct {
+	r   io.Reader
+	buf []byte
+	p   []byte
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	if len(r.p) == 0 {
+		n, err := r.r.Read(r.buf)
+		r.p = r.buf[:n]
+		if n == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, r.p)
+	r.p = r.p[n:]
+	return n, nil
+}
@@ -0,0 +1,184 @@
+package wormhole
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+	"webwormhole.io/wormhole/pake"
+)
+
+// pair returns two ends of a connection made directly between two peer
+// connections, without a signalling server, and a function to close them.
+func pair(t *testing.T) (a, b *Conn, done func()) {
+	mk := bytes.Repeat([]byte{7}, 32)
+	var ends [2]*Conn
+	opened := make(chan error, 2)
+	gathered := make([]chan webrtc.ICECandidateInit, 2)
+	for i, side := range []pake.Side{pake.SideA, pake.SideB} {
+		keys, err := pake.NewSchedule(mk, pake.MaxVersion, side)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := &Dialer{}
+		c := &Conn{
+			dialer:      d,
+			peerVersion: Protocol,
+			keys:        keys,
+			flushc:      sync.NewCond(&sync.Mutex{}),
+			closed:      make(chan struct{}),
+			sched:       newSched(d.bufferSize()),
+		}
+		c.pc, err = rtcapi.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigh := true
+		c.d, err = c.pc.CreateDataChannel("data", &webrtc.DataChannelInit{
+			Negotiated: &sigh,
+			ID:         new(uint16),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.sched.set(c.d, 0)
+		c.d.OnBufferedAmountLow(c.flushed)
+		c.d.SetBufferedAmountLowThreshold(d.lowThreshold())
+		c.d.OnOpen(func() {
+			var err error
+			c.ReadWriteCloser, err = c.d.Detach()
+			opened <- err
+		})
+		gathered[i] = make(chan webrtc.ICECandidateInit, 32)
+		ch := gathered[i]
+		c.pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+			if candidate != nil {
+				ch <- candidate.ToJSON()
+			}
+		})
+		ends[i] = c
+	}
+	a, b = ends[0], ends[1]
+
+	offer, err := a.pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.pc.SetRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := b.pc.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.pc.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.pc.SetRemoteDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	// Both have the other's description now, so candidates can be added.
+	stop := make(chan struct{})
+	trickle := func(from chan webrtc.ICECandidateInit, to *Conn) {
+		for {
+			select {
+			case candidate := <-from:
+				to.pc.AddICECandidate(candidate)
+			case <-stop:
+				return
+			}
+		}
+	}
+	go trickle(gathered[0], b)
+	go trickle(gathered[1], a)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-opened:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out connecting")
+		}
+	}
+	close(stop)
+	// Conn.Close waits for what's buffered to go, which the tests leave
+	// nothing of consequence in, so close the peer connections directly.
+	return a, b, func() {
+		a.pc.Close()
+		b.pc.Close()
+	}
+}
+
+func TestSendOfferCompressed(t *testing.T) {
+	a, b, done := pair(t)
+	defer done()
+	files := []OfferedFile{{Name: "a", Size: 1}, {Name: "b", Size: 2}}
+	algs := []string{Gzip}
+
+	tests := []struct {
+		name     string
+		answer   offerAnswer
+		accepted []int
+		compress string
+		err      error
+	}{
+		{"all", offerAnswer{Accept: []int{0, 1}}, []int{0, 1}, "", nil},
+		{"one", offerAnswer{Accept: []int{1}}, []int{1}, "", nil},
+		{"none", offerAnswer{Accept: []int{}}, []int{}, "", nil},
+		{"compressed", offerAnswer{Accept: []int{0}, Compress: Gzip}, []int{0}, Gzip, nil},
+		{"declined", offerAnswer{Accept: []int{}, Declined: true}, nil, "", ErrRejected},
+		{"out of order", offerAnswer{Accept: []int{1, 0}}, nil, "", ErrBadAnswer},
+		{"twice", offerAnswer{Accept: []int{0, 0}}, nil, "", ErrBadAnswer},
+		{"past the end", offerAnswer{Accept: []int{2}}, nil, "", ErrBadAnswer},
+		{"negative", offerAnswer{Accept: []int{-1}}, nil, "", ErrBadAnswer},
+		{"compressed some other way", offerAnswer{Accept: []int{0}, Compress: "zstd"}, nil, "", ErrBadAnswer},
+	}
+	buf := make([]byte, MaxMessage)
+	for _, tt := range tests {
+		type result struct {
+			accepted []int
+			compress string
+			err      error
+		}
+		resc := make(chan result, 1)
+		go func() {
+			accepted, compress, err := a.SendOfferCompressed(files, algs)
+			resc <- result{accepted, compress, err}
+		}()
+		n, err := b.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.ReadOffer(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		// Answered directly, since a well behaved Offer won't answer
+		// badly.
+		if err := b.writeLong(tt.answer); err != nil {
+			t.Fatal(err)
+		}
+		res := <-resc
+		if res.err != tt.err || !equalInts(res.accepted, tt.accepted) || res.compress != tt.compress {
+			t.Errorf("%s: got %v, %q, %v, want %v, %q, %v", tt.name,
+				res.accepted, res.compress, res.err, tt.accepted, tt.compress, tt.err)
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) || (a == nil) != (b == nil) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
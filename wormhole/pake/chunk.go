@@ -0,0 +1,42 @@
+package pake
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// ChunkOverhead is how much longer SealChunk makes a chunk.
+const ChunkOverhead = secretbox.Overhead
+
+// Files too big to seal whole are sealed in chunks, each with a nonce made
+// of its place in the file, counting from 0, and whether it's the last, as
+// in age's STREAM, so that chunks can't be dropped, reordered or cut off
+// at the end without Open failing. Since nonces repeat from file to file,
+// every file needs a key of its own, e.g. derived with Schedule.Export.
+
+func chunkNonce(counter uint64, last bool) *[24]byte {
+	var n [24]byte
+	binary.BigEndian.PutUint64(n[:8], counter)
+	if last {
+		n[23] = 1
+	}
+	return &n
+}
+
+// SealChunk encrypts and authenticates chunk, number counter of a file,
+// appending the result to out. The last chunk of a file has last set, and
+// may be empty.
+func SealChunk(out []byte, key *[32]byte, counter uint64, last bool, chunk []byte) []byte {
+	return secretbox.Seal(out, chunk, chunkNonce(counter, last), key)
+}
+
+// OpenChunk decrypts and authenticates the chunk sealed by SealChunk with
+// the same counter and last, appending the result to out.
+func OpenChunk(out []byte, key *[32]byte, counter uint64, last bool, sealed []byte) ([]byte, error) {
+	msg, ok := secretbox.Open(out, sealed, chunkNonce(counter, last), key)
+	if !ok {
+		return nil, ErrOpen
+	}
+	return msg, nil
+}
@@ -0,0 +1,34 @@
+package pake
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChunk(t *testing.T) {
+	key := new([32]byte)
+	key[0] = 1
+	chunk := []byte("some of a file")
+	sealed := SealChunk(nil, key, 7, false, chunk)
+	if len(sealed) != len(chunk)+ChunkOverhead {
+		t.Errorf("got %v bytes sealed want %v", len(sealed), len(chunk)+ChunkOverhead)
+	}
+	other := new([32]byte)
+	cases := []struct {
+		key     *[32]byte
+		counter uint64
+		last    bool
+		ok      bool
+	}{
+		{key, 7, false, true},
+		{key, 8, false, false},
+		{key, 7, true, false},
+		{other, 7, false, false},
+	}
+	for _, c := range cases {
+		got, err := OpenChunk(nil, c.key, c.counter, c.last, sealed)
+		if (err == nil) != c.ok || (c.ok && !bytes.Equal(got, chunk)) {
+			t.Errorf("testcase %v/%v got %q, %v", c.counter, c.last, got, err)
+		}
+	}
+}
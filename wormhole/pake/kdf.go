@@ -0,0 +1,158 @@
+package pake
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Side is which side of the handshake a peer took.
+type Side int
+
+const (
+	SideA Side = iota // Called Start: the side joining with a code.
+	SideB             // Called Exchange: the side that waited.
+)
+
+// Purpose is what a key is derived for. Each purpose gets keys of its own,
+// so that using one for one thing can't weaken another.
+type Purpose string
+
+const (
+	// Signal keys seal the signalling messages. The version isn't known
+	// yet when the first is sealed, so it's derived the same way in all of
+	// them, as with Key.
+	Signal Purpose = "signal"
+	// Control keys are for messages about a transfer, one each way.
+	Control Purpose = "control"
+	// Data keys are for the transfer itself, one each way.
+	Data Purpose = "data"
+	// MAC keys authenticate things both sides agree on, like a summary of
+	// what was sent.
+	MAC Purpose = "mac"
+)
+
+// Direction is which way the traffic protected by a key goes.
+type Direction int
+
+const (
+	Both    Direction = iota // Shared by both sides.
+	Send                     // From this side to the peer.
+	Receive                  // From the peer to this side.
+)
+
+// MinLabelled is the first version of the peer protocol that derives keys
+// for purposes other than Signal. See wormhole.Protocol.
+const MinLabelled = 3
+
+// MaxVersion is the newest version of the peer protocol whose keys this
+// package knows how to derive. Later versions that don't change keys use
+// these.
+const MaxVersion = 3
+
+// ErrNoKey is returned when asking for a key that isn't derived in the
+// negotiated version, or isn't derived for that direction.
+var ErrNoKey = errors.New("no such key in this version")
+
+// A Schedule derives the keys for a connection from the master secret the
+// handshake agreed on, as the peers' common protocol version says to.
+type Schedule struct {
+	mk      []byte
+	version int
+	side    Side
+}
+
+// NewSchedule returns the key schedule of the side that agreed on master
+// secret mk, for protocol version.
+func NewSchedule(mk []byte, version int, side Side) (*Schedule, error) {
+	if len(mk) != sha256.Size {
+		return nil, fmt.Errorf("master secret is %d bytes, want %d", len(mk), sha256.Size)
+	}
+	if version < 0 || version > MaxVersion {
+		return nil, fmt.Errorf("no key schedule for protocol version %d", version)
+	}
+	if side != SideA && side != SideB {
+		return nil, fmt.Errorf("no side %d", side)
+	}
+	return &Schedule{mk, version, side}, nil
+}
+
+// Version returns the protocol version the keys are derived for.
+func (s *Schedule) Version() int {
+	return s.version
+}
+
+// Key returns the key for purpose p in direction dir. Signal and MAC keys
+// are shared by both directions, Control and Data keys have one for each.
+func (s *Schedule) Key(p Purpose, dir Direction) (*[32]byte, error) {
+	if p == Signal {
+		if dir != Both {
+			return nil, ErrNoKey
+		}
+		return Key(s.mk)
+	}
+	if s.version < MinLabelled {
+		return nil, ErrNoKey
+	}
+	var way string
+	switch {
+	case p == MAC && dir == Both:
+		way = "both"
+	case (p == Control || p == Data) && (dir == Send || dir == Receive):
+		// Both sides have to agree which way is which.
+		if (dir == Send) == (s.side == SideA) {
+			way = "a to b"
+		} else {
+			way = "b to a"
+		}
+	default:
+		return nil, ErrNoKey
+	}
+	key := new([32]byte)
+	if err := s.derive(fmt.Sprintf("%s %s", p, way), key[:]); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Export derives n bytes for the application using label. Both peers get
+// the same bytes for the same label, and different labels give unrelated
+// ones.
+func (s *Schedule) Export(label string, n int) ([]byte, error) {
+	if n <= 0 || n > 255*sha256.Size {
+		return nil, fmt.Errorf("can't export %d bytes", n)
+	}
+	b := make([]byte, n)
+	if s.version < MinLabelled {
+		_, err := io.ReadFull(hkdf.New(sha256.New, s.mk, nil, []byte("webwormhole export "+label)), b)
+		return b, err
+	}
+	if label == "" {
+		return nil, fmt.Errorf("can't export without a label")
+	}
+	return b, s.derive("export "+label, b)
+}
+
+// derive fills b with the key labelled label, qualified by the version so
+// that versions never share keys.
+func (s *Schedule) derive(label string, b []byte) error {
+	info := fmt.Sprintf("webwormhole v%d %s", s.version, label)
+	_, err := io.ReadFull(hkdf.New(sha256.New, s.mk, nil, []byte(info)), b)
+	return err
+}
+
+// Paired returns the slot and password for transfers between devices that
+// paired once, and kept a secret they exported then. Slots can't have
+// dashes in them, so both are hex.
+func Paired(secret []byte) (slot, pass string) {
+	derive := func(what string, n int) string {
+		b := make([]byte, n)
+		io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte("webwormhole self "+what)), b)
+		return hex.EncodeToString(b)
+	}
+	return derive("slot", 8), derive("pass", 16)
+}
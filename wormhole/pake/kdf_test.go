@@ -0,0 +1,129 @@
+package pake
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+func TestNewSchedule(t *testing.T) {
+	mk := make([]byte, 32)
+	cases := []struct {
+		mk      []byte
+		version int
+		side    Side
+		ok      bool
+	}{
+		{mk, 0, SideA, true},
+		{mk, MaxVersion, SideB, true},
+		{mk, MaxVersion + 1, SideA, false},
+		{mk, -1, SideA, false},
+		{mk[:16], MaxVersion, SideA, false},
+		{mk, MaxVersion, Side(2), false},
+	}
+	for _, c := range cases {
+		_, err := NewSchedule(c.mk, c.version, c.side)
+		if got := err == nil; got != c.ok {
+			t.Errorf("testcase %d bytes v%d side %d got %v want %v", len(c.mk), c.version, c.side, err, c.ok)
+		}
+	}
+}
+
+func TestScheduleKey(t *testing.T) {
+	mk := bytes.Repeat([]byte{1}, 32)
+	a, _ := NewSchedule(mk, MaxVersion, SideA)
+	b, _ := NewSchedule(mk, MaxVersion, SideB)
+	old, _ := NewSchedule(mk, MinLabelled-1, SideA)
+	key := func(s *Schedule, p Purpose, dir Direction) []byte {
+		k, err := s.Key(p, dir)
+		if err != nil {
+			return nil
+		}
+		return k[:]
+	}
+	legacy, _ := Key(mk)
+
+	cases := []struct {
+		name string
+		got  []byte
+		want []byte
+	}{
+		{"a sends what b receives", key(a, Data, Send), key(b, Data, Receive)},
+		{"b sends what a receives", key(b, Control, Send), key(a, Control, Receive)},
+		{"both share mac", key(a, MAC, Both), key(b, MAC, Both)},
+		{"signal is unchanged", key(a, Signal, Both), legacy[:]},
+		{"older versions signal the same", key(old, Signal, Both), legacy[:]},
+		{"older versions have no data keys", key(old, Data, Send), nil},
+		{"mac has no direction", key(a, MAC, Send), nil},
+		{"data has a direction", key(a, Data, Both), nil},
+		{"no such purpose", key(a, Purpose("other"), Both), nil},
+	}
+	for _, c := range cases {
+		if !bytes.Equal(c.got, c.want) {
+			t.Errorf("testcase %q got %x want %x", c.name, c.got, c.want)
+		}
+	}
+
+	distinct := map[string]bool{}
+	for _, k := range [][]byte{
+		key(a, Data, Send), key(a, Data, Receive),
+		key(a, Control, Send), key(a, Control, Receive),
+		key(a, MAC, Both), key(a, Signal, Both),
+	} {
+		if distinct[string(k)] {
+			t.Errorf("key %x derived twice", k)
+		}
+		distinct[string(k)] = true
+	}
+}
+
+func TestScheduleExport(t *testing.T) {
+	mk := bytes.Repeat([]byte{1}, 32)
+	a, _ := NewSchedule(mk, MaxVersion, SideA)
+	b, _ := NewSchedule(mk, MaxVersion, SideB)
+	old, _ := NewSchedule(mk, MinLabelled-1, SideA)
+
+	x, _ := a.Export("manifest", 32)
+	y, _ := b.Export("manifest", 32)
+	if !bytes.Equal(x, y) {
+		t.Errorf("sides exported different keys")
+	}
+	z, _ := old.Export("manifest", 32)
+	if bytes.Equal(x, z) {
+		t.Errorf("versions exported the same key")
+	}
+	want := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, mk, nil, []byte("webwormhole export manifest")), want)
+	if !bytes.Equal(z, want) {
+		t.Errorf("older versions changed their export")
+	}
+
+	cases := []struct {
+		label string
+		n     int
+		ok    bool
+	}{
+		{"manifest", 1, true},
+		{"manifest", 255 * 32, true},
+		{"manifest", 255*32 + 1, false},
+		{"manifest", 0, false},
+		{"", 32, false},
+	}
+	for _, c := range cases {
+		_, err := a.Export(c.label, c.n)
+		if got := err == nil; got != c.ok {
+			t.Errorf("testcase %q %d got %v want %v", c.label, c.n, err, c.ok)
+		}
+	}
+}
+
+func TestPaired(t *testing.T) {
+	// Devices keep their secrets, so this can't change.
+	slot, pass := Paired(bytes.Repeat([]byte{1}, 32))
+	if slot != "449adc127475b6f3" || pass != "0f6781afb97b86e49a9cc50de827c9bf" {
+		t.Errorf("got %v %v", slot, pass)
+	}
+}
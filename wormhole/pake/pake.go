@@ -0,0 +1,108 @@
+// Package pake implements the password authenticated key exchange
+// webwormhole peers use to agree on a key, and the sealing of signalling
+// messages with that key.
+//
+// It's shared by the ww tool and the web client, compiled to Web
+// Assembly, so that both always speak the same thing.
+//
+//	msgA, s, _ := pake.Start("some pass")
+//	msgB, mkB, _ := pake.Exchange("some pass", msgA)
+//	mkA, _ := s.Finish(msgB)
+//	keyA, _ := pake.Key(mkA)
+//	keyB, _ := pake.Key(mkB)
+//	sealed, _ := pake.Seal(keyB, []byte("hello"))
+//	msg, _ := pake.Open(keyA, sealed)
+package pake
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"filippo.io/cpace"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// ErrOpen is returned when a message could not be opened, typically
+// because it was sealed with a different key.
+var ErrOpen = errors.New("could not open message")
+
+// nonceSize is the length of the random nonce sealed messages start with.
+const nonceSize = 24
+
+// The identity arguments are to bind endpoint identities in PAKE. Cf. Unknown
+// Key-Share Attack. https://tools.ietf.org/html/draft-ietf-mmusic-sdp-uks-03
+//
+// In the context of a program like magic-wormhole we do not have ahead of time
+// information on the identity of the remote party. We only have the slot name,
+// and sometimes even that at this stage. But that's okay, since:
+//   a) The password is randomly generated and ephemeral.
+//   b) A peer only gets one guess.
+// An unintended destination is likely going to fail PAKE.
+func contextInfo() *cpace.ContextInfo {
+	return cpace.NewContextInfo("", "", nil)
+}
+
+// State is the joining side's state between Start and Finish.
+type State struct {
+	s *cpace.State
+}
+
+// Start begins the exchange on the joining side, returning the first
+// message to send the peer.
+func Start(pass string) (msgA []byte, s *State, err error) {
+	msgA, cs, err := cpace.Start(pass, contextInfo())
+	if err != nil {
+		return nil, nil, err
+	}
+	return msgA, &State{cs}, nil
+}
+
+// Finish completes the exchange with the peer's reply, returning the
+// master secret. It fails if the peer's reply is malformed, but not if it
+// used a different password: that only shows when messages don't open.
+func (s *State) Finish(msgB []byte) (mk []byte, err error) {
+	return s.s.Finish(msgB)
+}
+
+// Exchange answers the first message of the exchange on the waiting side,
+// returning the reply to send the peer and the master secret.
+func Exchange(pass string, msgA []byte) (msgB, mk []byte, err error) {
+	return cpace.Exchange(pass, contextInfo(), msgA)
+}
+
+// Key derives the key signalling messages are sealed with from the master
+// secret.
+func Key(mk []byte) (*[32]byte, error) {
+	key := new([32]byte)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, mk, nil, nil), key[:]); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Seal encrypts and authenticates msg with key, prefixed with a random
+// nonce.
+func Seal(key *[32]byte, msg []byte) ([]byte, error) {
+	var nonce [nonceSize]byte
+	if _, err := io.ReadFull(crand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], msg, &nonce, key), nil
+}
+
+// Open decrypts and authenticates a message sealed with key.
+func Open(key *[32]byte, sealed []byte) ([]byte, error) {
+	if len(sealed) < nonceSize {
+		return nil, ErrOpen
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], sealed[:nonceSize])
+	msg, ok := secretbox.Open(nil, sealed[nonceSize:], &nonce, key)
+	if !ok {
+		return nil, ErrOpen
+	}
+	return msg, nil
+}
@@ -0,0 +1,107 @@
+package pake
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func handshake(t *testing.T, passA, passB string) (keyA, keyB *[32]byte) {
+	msgA, s, err := Start(passA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgB, mkB, err := Exchange(passB, msgA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkA, err := s.Finish(msgB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyA, err = Key(mkA); err != nil {
+		t.Fatal(err)
+	}
+	if keyB, err = Key(mkB); err != nil {
+		t.Fatal(err)
+	}
+	return keyA, keyB
+}
+
+func TestHandshake(t *testing.T) {
+	cases := []struct {
+		passA, passB string
+		want         bool
+	}{
+		{"correct-horse", "correct-horse", true},
+		{"correct-horse", "correct-house", false},
+		{"", "", true},
+	}
+	for _, c := range cases {
+		keyA, keyB := handshake(t, c.passA, c.passB)
+		sealed, err := Seal(keyB, []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := Open(keyA, sealed)
+		if got := err == nil && string(msg) == "hello"; got != c.want {
+			t.Errorf("testcase %q/%q got %v want %v", c.passA, c.passB, got, c.want)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	key, _ := handshake(t, "pass", "pass")
+	sealed, err := Seal(key, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	cases := []struct {
+		sealed []byte
+		want   error
+	}{
+		{sealed, nil},
+		{tampered, ErrOpen},
+		{sealed[:nonceSize-1], ErrOpen},
+		{nil, ErrOpen},
+	}
+	for _, c := range cases {
+		if _, err := Open(key, c.sealed); err != c.want {
+			t.Errorf("testcase %x got %v want %v", c.sealed, err, c.want)
+		}
+	}
+	again, _ := Seal(key, []byte("hello"))
+	if bytes.Equal(sealed, again) {
+		t.Errorf("sealing twice gave the same bytes, nonce isn't random")
+	}
+}
+
+// TestVectors checks the published test vectors still hold, so a change
+// that breaks compatibility doesn't go unnoticed. Regenerate them with
+// ww testvectors only when that's intended.
+func TestVectors(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var published []Vector
+	if err := json.Unmarshal(b, &published); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range published {
+		if err := v.Check(); err != nil {
+			t.Error(err)
+		}
+	}
+	vs, err := Vectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vs, published) {
+		t.Errorf("testdata/vectors.json is out of date")
+	}
+}
@@ -0,0 +1,159 @@
+package pake
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Ratchets seal messages with keys that change every rekeyAfter messages
+// or rekeyEvery, whichever comes first, so that sessions open for days
+// don't wear out a key. Each key is derived from the one before it, and
+// forgotten once it's replaced, so a key leaked later doesn't open older
+// messages.
+var (
+	rekeyAfter uint64 = 1 << 24
+	rekeyEvery        = 24 * time.Hour
+)
+
+// maxSkip is the most keys a Ratchet moves forward at once to open a
+// message.
+const maxSkip = 1 << 10
+
+// headerSize is the length of the epoch and sequence number in front of
+// each ratcheted message.
+const headerSize = 4 + 8
+
+// RatchetOverhead is how much longer Ratchet.Seal makes a message.
+const RatchetOverhead = headerSize + secretbox.Overhead
+
+var (
+	// ErrReplay is returned when opening a message that was already opened,
+	// or that came after one that was.
+	ErrReplay = errors.New("message replayed or out of order")
+	// ErrExhausted is returned when a Ratchet has run out of keys.
+	ErrExhausted = errors.New("ratchet out of keys")
+)
+
+// A Ratchet seals or opens the messages going one way. Messages have to be
+// opened in the order they were sealed, as on a reliable, ordered channel.
+type Ratchet struct {
+	mu      sync.Mutex
+	key     [32]byte
+	epoch   uint32
+	seq     uint64 // Next to seal, or lowest to open.
+	started time.Time
+	now     func() time.Time
+}
+
+func newRatchet(key *[32]byte) *Ratchet {
+	r := &Ratchet{key: *key, now: time.Now}
+	r.started = r.now()
+	return r
+}
+
+// Ratchets returns ratchets for sending and receiving with the keys for
+// purpose p, which has to be a purpose with a key each way.
+func (s *Schedule) Ratchets(p Purpose) (send, receive *Ratchet, err error) {
+	sk, err := s.Key(p, Send)
+	if err != nil {
+		return nil, nil, err
+	}
+	rk, err := s.Key(p, Receive)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newRatchet(sk), newRatchet(rk), nil
+}
+
+// Epoch returns how many times the key has changed.
+func (r *Ratchet) Epoch() uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.epoch
+}
+
+// nextKey derives the key after key.
+func nextKey(key *[32]byte) *[32]byte {
+	next := new([32]byte)
+	io.ReadFull(hkdf.New(sha256.New, key[:], nil, []byte("webwormhole ratchet")), next[:])
+	return next
+}
+
+// advance moves r on to the key after the current one.
+func (r *Ratchet) advance() {
+	next := nextKey(&r.key)
+	r.key = *next
+	*next = [32]byte{}
+	r.epoch++
+	r.seq = 0
+	r.started = r.now()
+}
+
+func nonce(epoch uint32, seq uint64) *[24]byte {
+	var n [24]byte
+	binary.BigEndian.PutUint32(n[:4], epoch)
+	binary.BigEndian.PutUint64(n[4:12], seq)
+	return &n
+}
+
+// Seal encrypts and authenticates msg, moving on to the next key first if
+// it's time to.
+func (r *Ratchet) Seal(msg []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seq >= rekeyAfter || r.now().Sub(r.started) >= rekeyEvery {
+		if r.epoch == 1<<32-1 {
+			return nil, ErrExhausted
+		}
+		r.advance()
+	}
+	n := nonce(r.epoch, r.seq)
+	r.seq++
+	return secretbox.Seal(append([]byte(nil), n[:headerSize]...), msg, n, &r.key), nil
+}
+
+// Open decrypts and authenticates a message sealed by the peer's Ratchet,
+// following it on to later keys as needed.
+func (r *Ratchet) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < headerSize {
+		return nil, ErrOpen
+	}
+	epoch := binary.BigEndian.Uint32(sealed[:4])
+	seq := binary.BigEndian.Uint64(sealed[4:headerSize])
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case epoch < r.epoch, epoch == r.epoch && seq < r.seq:
+		return nil, ErrReplay
+	case epoch-r.epoch > maxSkip:
+		return nil, ErrOpen
+	}
+	key := r.key
+	// The keys on the way to epoch's, and its own if it's not kept, are as
+	// much to forget.
+	defer func() { key = [32]byte{} }()
+	for e := r.epoch; e < epoch; e++ {
+		next := nextKey(&key)
+		key = *next
+		*next = [32]byte{}
+	}
+	msg, ok := secretbox.Open(nil, sealed[headerSize:], nonce(epoch, seq), &key)
+	if !ok {
+		return nil, ErrOpen
+	}
+	// Only move on once the message proves the peer did.
+	if epoch != r.epoch {
+		r.key = key
+		r.epoch = epoch
+	}
+	r.seq = seq + 1
+	return msg, nil
+}
@@ -0,0 +1,113 @@
+package pake
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func ratchets(t *testing.T) (send, receive *Ratchet) {
+	mk := bytes.Repeat([]byte{1}, 32)
+	a, _ := NewSchedule(mk, MaxVersion, SideA)
+	b, _ := NewSchedule(mk, MaxVersion, SideB)
+	send, _, err := a.Ratchets(Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, receive, err = b.Ratchets(Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return send, receive
+}
+
+func TestRatchet(t *testing.T) {
+	defer func(n uint64) { rekeyAfter = n }(rekeyAfter)
+	rekeyAfter = 3
+
+	send, receive := ratchets(t)
+	clock := time.Now()
+	send.now = func() time.Time { return clock }
+	var sealed [][]byte
+	for i := 0; i < 10; i++ {
+		if i == 7 {
+			clock = clock.Add(rekeyEvery)
+		}
+		b, err := send.Seal([]byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed = append(sealed, b)
+	}
+	// 3 per key, and a new one after a day.
+	if got, want := send.Epoch(), uint32(3); got != want {
+		t.Errorf("sender got epoch %v want %v", got, want)
+	}
+	for i, b := range sealed {
+		msg, err := receive.Open(b)
+		if err != nil || !bytes.Equal(msg, []byte{byte(i)}) {
+			t.Errorf("testcase %d got %x, %v", i, msg, err)
+		}
+	}
+	if got, want := receive.Epoch(), send.Epoch(); got != want {
+		t.Errorf("receiver got epoch %v want %v", got, want)
+	}
+}
+
+func TestRatchetOpen(t *testing.T) {
+	defer func(n uint64) { rekeyAfter = n }(rekeyAfter)
+	rekeyAfter = 2
+
+	send, receive := ratchets(t)
+	seal := func() []byte {
+		b, err := send.Seal([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	first, second, third := seal(), seal(), seal()
+	tampered := append([]byte(nil), third...)
+	tampered[len(tampered)-1] ^= 1
+	cases := []struct {
+		name   string
+		sealed []byte
+		want   error
+	}{
+		{"second", second, nil},
+		{"first after second", first, ErrReplay},
+		{"second again", second, ErrReplay},
+		{"tampered", tampered, ErrOpen},
+		{"third after tampered", third, nil},
+		{"second after next key", second, ErrReplay},
+		{"short", third[:headerSize-1], ErrOpen},
+	}
+	for _, c := range cases {
+		if _, err := receive.Open(c.sealed); err != c.want {
+			t.Errorf("testcase %q got %v want %v", c.name, err, c.want)
+		}
+	}
+
+	for send.Epoch() <= maxSkip+1 {
+		seal()
+	}
+	if _, err := receive.Open(seal()); err != ErrOpen {
+		t.Errorf("skipping %d keys got %v want %v", send.Epoch()-receive.Epoch(), err, ErrOpen)
+	}
+}
+
+func TestRatchetDirections(t *testing.T) {
+	mk := bytes.Repeat([]byte{1}, 32)
+	a, _ := NewSchedule(mk, MaxVersion, SideA)
+	send, receive, err := a.Ratchets(Control)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := send.Seal([]byte("hello"))
+	if _, err := receive.Open(b); err != ErrOpen {
+		t.Errorf("opened own message, got %v want %v", err, ErrOpen)
+	}
+	if _, _, err := a.Ratchets(MAC); err != ErrNoKey {
+		t.Errorf("ratchets for mac got %v want %v", err, ErrNoKey)
+	}
+}
@@ -0,0 +1,212 @@
+package pake
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// A Vector is a known answer test for a handshake and a signalling
+// message sealed with the key it agrees on, for other implementations to
+// check they're compatible with this one.
+//
+// Byte strings are in hex, except those that go over the wire, which are in
+// the padded URL-safe base64 they're sent in.
+type Vector struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+
+	// RandomA is what the joining side reads from its source of randomness
+	// in Start: a 16 byte salt, then 64 bytes reduced to its scalar.
+	RandomA string `json:"random_a"`
+	// RandomB is what the waiting side reads in Exchange: 64 bytes reduced
+	// to its scalar.
+	RandomB string `json:"random_b"`
+
+	MsgA      string `json:"msg_a"`
+	MsgB      string `json:"msg_b"`
+	MasterKey string `json:"master_key"`
+	Key       string `json:"key"`
+	// Keys are the keys derived in protocol version MaxVersion, by the
+	// label they're derived with, as seen by side A.
+	Keys map[string]string `json:"keys"`
+
+	// Nonce is what Seal reads from its source of randomness.
+	Nonce   string `json:"nonce"`
+	Message string `json:"message"`
+	Sealed  string `json:"sealed"`
+}
+
+var randomMu sync.Mutex
+
+// withRandom runs fn with crypto/rand.Reader replaced by r, because cpace
+// takes no source of randomness of its own. It's only for test vectors:
+// anything else reading crypto/rand meanwhile gets r's bytes too. It fails
+// unless fn reads all of r.
+func withRandom(r *bytes.Reader, fn func() error) error {
+	randomMu.Lock()
+	defer randomMu.Unlock()
+	saved := crand.Reader
+	crand.Reader = r
+	defer func() { crand.Reader = saved }()
+	if err := fn(); err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%d random bytes left unread", r.Len())
+	}
+	return nil
+}
+
+// compute fills in v's outputs from its inputs.
+func (v *Vector) compute() error {
+	randA, err := hex.DecodeString(v.RandomA)
+	if err != nil {
+		return fmt.Errorf("random_a: %v", err)
+	}
+	randB, err := hex.DecodeString(v.RandomB)
+	if err != nil {
+		return fmt.Errorf("random_b: %v", err)
+	}
+	nonce, err := hex.DecodeString(v.Nonce)
+	if err != nil {
+		return fmt.Errorf("nonce: %v", err)
+	}
+
+	var msgA, msgB, mkA, mkB, sealed []byte
+	var s *State
+	if err := withRandom(bytes.NewReader(randA), func() (err error) {
+		msgA, s, err = Start(v.Password)
+		return err
+	}); err != nil {
+		return fmt.Errorf("start: %v", err)
+	}
+	if err := withRandom(bytes.NewReader(randB), func() (err error) {
+		msgB, mkB, err = Exchange(v.Password, msgA)
+		return err
+	}); err != nil {
+		return fmt.Errorf("exchange: %v", err)
+	}
+	if mkA, err = s.Finish(msgB); err != nil {
+		return fmt.Errorf("finish: %v", err)
+	}
+	if !bytes.Equal(mkA, mkB) {
+		return fmt.Errorf("sides derived different master keys")
+	}
+	key, err := Key(mkA)
+	if err != nil {
+		return err
+	}
+	if err := withRandom(bytes.NewReader(nonce), func() (err error) {
+		sealed, err = Seal(key, []byte(v.Message))
+		return err
+	}); err != nil {
+		return fmt.Errorf("seal: %v", err)
+	}
+	if _, err := Open(key, sealed); err != nil {
+		return fmt.Errorf("open: %v", err)
+	}
+
+	keys, err := NewSchedule(mkA, MaxVersion, SideA)
+	if err != nil {
+		return err
+	}
+	v.Keys = make(map[string]string)
+	for _, k := range []struct {
+		p   Purpose
+		dir Direction
+	}{
+		{Control, Send}, {Control, Receive}, {Data, Send}, {Data, Receive}, {MAC, Both},
+	} {
+		key, err := keys.Key(k.p, k.dir)
+		if err != nil {
+			return err
+		}
+		label := string(k.p)
+		if k.dir == Send {
+			label += " a to b"
+		} else if k.dir == Receive {
+			label += " b to a"
+		}
+		v.Keys[label] = hex.EncodeToString(key[:])
+	}
+	export, err := keys.Export("test", 32)
+	if err != nil {
+		return err
+	}
+	v.Keys["export test"] = hex.EncodeToString(export)
+
+	v.MsgA = base64.URLEncoding.EncodeToString(msgA)
+	v.MsgB = base64.URLEncoding.EncodeToString(msgB)
+	v.MasterKey = hex.EncodeToString(mkA)
+	v.Key = hex.EncodeToString(key[:])
+	v.Sealed = base64.URLEncoding.EncodeToString(sealed)
+	return nil
+}
+
+// Check recomputes v from its inputs, and reports the first output that
+// differs.
+func (v Vector) Check() error {
+	got := v
+	if err := got.compute(); err != nil {
+		return fmt.Errorf("%s: %v", v.Name, err)
+	}
+	for _, f := range []struct{ name, is, want string }{
+		{"msg_a", v.MsgA, got.MsgA},
+		{"msg_b", v.MsgB, got.MsgB},
+		{"master_key", v.MasterKey, got.MasterKey},
+		{"key", v.Key, got.Key},
+		{"sealed", v.Sealed, got.Sealed},
+	} {
+		if f.is != f.want {
+			return fmt.Errorf("%s: %s is %s, want %s", v.Name, f.name, f.is, f.want)
+		}
+	}
+	for label, want := range got.Keys {
+		if is := v.Keys[label]; is != want {
+			return fmt.Errorf("%s: keys[%q] is %s, want %s", v.Name, label, is, want)
+		}
+	}
+	return nil
+}
+
+// vectorRandom returns n bytes for the input called what of the vector
+// called name, the same every time.
+func vectorRandom(name, what string, n int) string {
+	b := make([]byte, n)
+	io.ReadFull(hkdf.New(sha256.New, []byte(name), nil, []byte("webwormhole test vector "+what)), b)
+	return hex.EncodeToString(b)
+}
+
+// Vectors returns the published test vectors.
+func Vectors() ([]Vector, error) {
+	inputs := []struct{ name, password, message string }{
+		{"words", "correct-horse-battery",
+			`{"type":"offer","sdp":"v=0\r\n","version":2}`},
+		{"empty", "", ""},
+		{"unicode", "🐛-wörm-hole", `{"candidate":"candidate:1 1 udp 2130706431 192.0.2.1 9 typ host"}`},
+	}
+	var vs []Vector
+	for _, in := range inputs {
+		v := Vector{
+			Name:     in.name,
+			Password: in.password,
+			RandomA:  vectorRandom(in.name, "a", 16+64),
+			RandomB:  vectorRandom(in.name, "b", 64),
+			Nonce:    vectorRandom(in.name, "nonce", nonceSize),
+			Message:  in.message,
+		}
+		if err := v.compute(); err != nil {
+			return nil, fmt.Errorf("%s: %v", in.name, err)
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
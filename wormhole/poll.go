@@ -0,0 +1,168 @@
+package wormhole
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Where websockets don't get through to the signalling server, e.g. past a
+// proxy that doesn't know them, the Dialer long-polls it over plain HTTP
+// instead. It POSTs to the URL it would have opened the websocket on, and
+// gets the ID of a session standing in for it, which it polls with GETs at
+// /poll/ID for the server's messages, sends its own to with POSTs, and
+// hangs up on with a DELETE. Each GET gets the messages since the last one,
+// and then the close frame, once the server's sent it.
+
+// A transport carries messages to and from the signalling server: a
+// websocket, or a pollconn where those don't get through.
+type transport interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	Close() error
+}
+
+// pollBatch is what the server answers a GET with.
+type pollBatch struct {
+	Messages []string `json:"messages"`
+	Close    *struct {
+		Code   int    `json:"code"`
+		Reason string `json:"reason"`
+	} `json:"close"`
+}
+
+// A pollconn is a transport that long-polls the signalling server.
+type pollconn struct {
+	client *http.Client
+	url    string
+	header http.Header
+	ctx    context.Context
+	cancel func()
+	once   sync.Once
+
+	// msgs are messages received and not read yet, and closed is the
+	// error reading on returns once they're all read. They're only used by
+	// ReadMessage.
+	msgs   []string
+	closed error
+}
+
+// dialPoll opens a session at addr, the URL of the signalling websocket,
+// and returns the server's response, so that it can be checked for errors
+// the way the websocket's would be. Only opening it is cut short by ctx.
+func (d *Dialer) dialPoll(ctx context.Context, addr string, header http.Header) (*pollconn, *http.Response, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Scheme == "ws" {
+		u.Scheme = "http"
+	} else {
+		u.Scheme = "https"
+	}
+	p := &pollconn{
+		client: &http.Client{Transport: &http.Transport{TLSClientConfig: d.TLSClientConfig, Proxy: http.ProxyFromEnvironment}},
+		header: header,
+	}
+	r, err := p.do(ctx, http.MethodPost, u.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Body.Close()
+	var open struct {
+		Session string `json:"session"`
+	}
+	if r.StatusCode != http.StatusOK {
+		return nil, r, fmt.Errorf("could not poll: %s", r.Status)
+	}
+	if err := json.NewDecoder(r.Body).Decode(&open); err != nil || open.Session == "" {
+		return nil, r, errors.New("could not poll: bad session")
+	}
+	// Sessions are at /poll/ of wherever the server's /s/ is.
+	u.Path = u.Path[:strings.LastIndex(u.Path, "/s/")] + "/poll/" + open.Session
+	u.RawQuery = ""
+	p.url = u.String()
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	return p, r, nil
+}
+
+func (p *pollconn) do(ctx context.Context, method, u string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range p.header {
+		req.Header[k] = v
+	}
+	return p.client.Do(req.WithContext(ctx))
+}
+
+func (p *pollconn) ReadMessage() (int, []byte, error) {
+	for len(p.msgs) == 0 {
+		if p.closed != nil {
+			return 0, nil, p.closed
+		}
+		r, err := p.do(p.ctx, http.MethodGet, p.url, nil)
+		if err != nil {
+			return 0, nil, err
+		}
+		var b pollBatch
+		err = json.NewDecoder(r.Body).Decode(&b)
+		r.Body.Close()
+		switch {
+		case r.StatusCode == http.StatusNotFound:
+			// The server's forgotten it, as if the websocket dropped.
+			p.closed = &websocket.CloseError{Code: websocket.CloseAbnormalClosure, Text: "session gone"}
+		case r.StatusCode != http.StatusOK || err != nil:
+			return 0, nil, fmt.Errorf("could not poll: %s", r.Status)
+		case b.Close != nil:
+			p.closed = &websocket.CloseError{Code: b.Close.Code, Text: b.Close.Reason}
+		}
+		p.msgs = b.Messages
+	}
+	m := p.msgs[0]
+	p.msgs = p.msgs[1:]
+	return websocket.TextMessage, []byte(m), nil
+}
+
+func (p *pollconn) WriteMessage(messageType int, data []byte) error {
+	r, err := p.do(p.ctx, http.MethodPost, p.url, data)
+	if err != nil {
+		return err
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("could not send: %s", r.Status)
+	}
+	return nil
+}
+
+// WriteControl hangs up on close frames. The server doesn't need pings.
+func (p *pollconn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if messageType == websocket.CloseMessage {
+		return p.Close()
+	}
+	return nil
+}
+
+func (p *pollconn) Close() error {
+	p.once.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if r, err := p.do(ctx, http.MethodDelete, p.url, nil); err == nil {
+			r.Body.Close()
+		}
+		p.cancel()
+	})
+	return nil
+}
@@ -0,0 +1,108 @@
+package wormhole
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// sched schedules writes between a connection's data channels by priority.
+// All channels share one SCTP association with a single send queue, so
+// something small written behind a full buffer of file data has to wait
+// for all of it. Instead, writes to a channel wait while any channel with
+// a higher priority has data buffered, and, for a while after a channel
+// with a higher priority last wrote, until its own buffer is nearly empty.
+//
+// Priorities only affect what we send, the peer schedules its own writes.
+type sched struct {
+	// buffer is how much each channel may have buffered before writes
+	// wait for it to drain to its low threshold, see Dialer.BufferSize.
+	buffer uint64
+
+	mu    sync.Mutex
+	chans map[*webrtc.DataChannel]int
+	last  map[*webrtc.DataChannel]time.Time
+	// stalled is the time in nanoseconds writes spent waiting for flushes.
+	stalled int64
+	// sent and received count the bytes written and read, for Progress.
+	sent, received int64
+	// sendLimit and recvLimit pace writes and reads, see SetRateLimit.
+	sendLimit, recvLimit Bucket
+}
+
+const (
+	// yieldBuffer is how much a channel may have buffered while it's
+	// yielding to another with a higher priority.
+	yieldBuffer = 64 << 10
+	// yieldTime is how long a channel yields after one with a higher
+	// priority wrote.
+	yieldTime = time.Second
+)
+
+func newSched(buffer uint64) *sched {
+	return &sched{
+		buffer: buffer,
+		chans:  make(map[*webrtc.DataChannel]int),
+		last:   make(map[*webrtc.DataChannel]time.Time),
+	}
+}
+
+func (s *sched) set(d *webrtc.DataChannel, priority int) {
+	s.mu.Lock()
+	s.chans[d] = priority
+	s.mu.Unlock()
+}
+
+func (s *sched) remove(d *webrtc.DataChannel) {
+	s.mu.Lock()
+	delete(s.chans, d)
+	delete(s.last, d)
+	s.mu.Unlock()
+}
+
+// blocked reports whether d has to give way to a channel with a higher
+// priority.
+func (s *sched) blocked(d *webrtc.DataChannel) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.chans[d]
+	for e, q := range s.chans {
+		if q <= p {
+			continue
+		}
+		if e.BufferedAmount() > 0 {
+			return true
+		}
+		if time.Since(s.last[e]) < yieldTime && d.BufferedAmount() > yieldBuffer {
+			return true
+		}
+	}
+	return false
+}
+
+// wait blocks until d may write.
+func (s *sched) wait(d *webrtc.DataChannel) {
+	// There's no callback for a channel's buffer emptying out below its
+	// low threshold, so poll.
+	for s.blocked(d) {
+		time.Sleep(time.Millisecond)
+	}
+	s.mu.Lock()
+	s.last[d] = time.Now()
+	s.mu.Unlock()
+}
+
+// SetPriority sets the priority of writes on the connection's own channel
+// relative to its streams. Higher priorities go first, and the default is
+// 0. For example, lowering the priority of a bulk transfer below that of a
+// stream for control messages keeps them responsive.
+func (c *Conn) SetPriority(priority int) {
+	c.sched.set(c.d, priority)
+}
+
+// SetPriority sets the priority of writes on the stream. See
+// Conn.SetPriority.
+func (s *Stream) SetPriority(priority int) {
+	s.sched.set(s.d, priority)
+}
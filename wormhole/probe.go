@@ -0,0 +1,218 @@
+package wormhole
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// probeTimeout is how long to wait for a relay to answer a probe, and for a
+// STUN server unless Dialer.STUNTimeout says otherwise.
+const probeTimeout = 2 * time.Second
+
+// deadFor is how long a STUN server that didn't answer is skipped for.
+const deadFor = 10 * time.Minute
+
+// deadSTUN remembers when STUN servers didn't answer, by address, so that
+// connections made after don't wait on them again.
+var deadSTUN = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+// relayAddr returns the UDP address of the TURN server at url, or "" if it's
+// not a TURN server reachable over UDP.
+func relayAddr(url string) string {
+	s := ICEServer(url).URLs[0]
+	if !strings.HasPrefix(s, "turn:") {
+		return ""
+	}
+	s = s[len("turn:"):]
+	if i := strings.Index(s, "?"); i >= 0 {
+		if s[i+1:] != "transport=udp" {
+			return ""
+		}
+		s = s[:i]
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		s = net.JoinHostPort(s, "3478")
+	}
+	return s
+}
+
+// stunAddr returns the UDP address of the STUN server at url, or "" if it's
+// not a STUN server.
+func stunAddr(url string) string {
+	s := ICEServer(url).URLs[0]
+	if !strings.HasPrefix(s, "stun:") {
+		return ""
+	}
+	s = s[len("stun:"):]
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		s = net.JoinHostPort(s, "3478")
+	}
+	return s
+}
+
+// probe measures the round trip time to a STUN or TURN server at addr with
+// a binding request, waiting up to timeout for an answer.
+func probe(addr string, timeout time.Duration) (time.Duration, error) {
+	conn, err := net.DialTimeout("udp", addr, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	req, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	conn.SetDeadline(start.Add(timeout))
+	if _, err := conn.Write(req.Raw); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		res := &stun.Message{Raw: buf[:n]}
+		if res.Decode() == nil && res.TransactionID == req.TransactionID {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// fastestRelay probes the TURN servers among urls and returns the one that
+// answered first, along with its round trip time. It returns "" if none
+// answered.
+func fastestRelay(urls []string) (best string, rtt time.Duration) {
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, u := range urls {
+		addr := relayAddr(u)
+		if addr == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(u, addr string) {
+			defer wg.Done()
+			d, err := probe(addr, probeTimeout)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			if best == "" || d < rtt {
+				best, rtt = u, d
+			}
+			mu.Unlock()
+		}(u, addr)
+	}
+	wg.Wait()
+	return best, rtt
+}
+
+// pickRelay returns urls with all TURN servers over UDP but the fastest
+// removed, if there's more than one of them. It returns the chosen one too.
+func pickRelay(urls []string) (picked []string, relay string) {
+	n := 0
+	for _, u := range urls {
+		if relayAddr(u) != "" {
+			n++
+		}
+	}
+	if n < 2 {
+		return urls, ""
+	}
+	relay, _ = fastestRelay(urls)
+	if relay == "" {
+		// Leave it to ICE.
+		return urls, ""
+	}
+	for _, u := range urls {
+		if relayAddr(u) == "" || u == relay {
+			picked = append(picked, u)
+		}
+	}
+	return picked, relay
+}
+
+// unanswered probes the STUN servers among urls all at once, and returns
+// those that don't answer within timeout. Ones that didn't answer lately
+// aren't probed again, and count as not answering. ICE only gathers relay
+// candidates once every STUN server has answered or timed out, after 5s,
+// so it's better off without them.
+func unanswered(urls []string, timeout time.Duration) map[string]bool {
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		dead = make(map[string]bool)
+	)
+	now := time.Now()
+	deadSTUN.Lock()
+	for _, u := range urls {
+		addr := stunAddr(u)
+		if addr == "" {
+			continue
+		}
+		if t, ok := deadSTUN.m[addr]; ok && now.Sub(t) < deadFor {
+			dead[u] = true
+			continue
+		}
+		wg.Add(1)
+		go func(u, addr string) {
+			defer wg.Done()
+			_, err := probe(addr, timeout)
+			deadSTUN.Lock()
+			if err != nil {
+				deadSTUN.m[addr] = time.Now()
+			} else {
+				delete(deadSTUN.m, addr)
+			}
+			deadSTUN.Unlock()
+			if err != nil {
+				mu.Lock()
+				dead[u] = true
+				mu.Unlock()
+			}
+		}(u, addr)
+	}
+	deadSTUN.Unlock()
+	wg.Wait()
+	return dead
+}
+
+// reprobe periodically probes the relays again for as long as c is open,
+// and calls d.OnFasterRelay if one is now noticeably faster than the one in
+// use.
+func (c *Conn) reprobe(current string) {
+	d := c.dialer
+	if current == "" || d.ReprobeInterval <= 0 || d.OnFasterRelay == nil {
+		return
+	}
+	t := time.NewTicker(d.ReprobeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-c.closed:
+			return
+		}
+		now, err := probe(relayAddr(current), probeTimeout)
+		if err != nil {
+			now = probeTimeout
+		}
+		best, rtt := fastestRelay(d.ICEServers)
+		// Don't bother with migrating for small gains.
+		if best != "" && best != current && rtt < now*3/4 {
+			d.OnFasterRelay(current, best)
+			current = best
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package wormhole
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// A State is how far along a connection is, for Dialer.OnState.
+type State string
+
+const (
+	// Connecting is from dialing until the data channel opens.
+	Connecting State = "connecting"
+	// Direct and Relayed are connected, straight to the peer or through a
+	// TURN server. A connection can go from one to the other if ICE
+	// changes the route.
+	Direct  State = "direct"
+	Relayed State = "relayed"
+	// Disconnected is after ICE loses the peer, or the connection closes.
+	// A connection can come back from it if ICE finds the peer again.
+	Disconnected State = "disconnected"
+)
+
+// defaultProgressInterval is how often OnProgress is called if the Dialer
+// doesn't say.
+const defaultProgressInterval = 100 * time.Millisecond
+
+// setState calls OnState with s, if it's not the state it was last called
+// with.
+func (c *Conn) setState(s State) {
+	if c.dialer.OnState == nil {
+		return
+	}
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if s == c.state {
+		return
+	}
+	c.state = s
+	c.dialer.OnState(s)
+}
+
+// routeState returns Direct or Relayed for the route the connection takes,
+// or "" if it's not known.
+func (c *Conn) routeState() State {
+	// The candidate pair's stats can lag ICE's state a little.
+	for i := 0; i < 10; i++ {
+		if r, ok := c.Route(); ok {
+			if r.Relayed() {
+				return Relayed
+			}
+			return Direct
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return ""
+}
+
+// setRoute calls OnState with the route the connection takes, if known.
+func (c *Conn) setRoute() {
+	s := c.routeState()
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+	if s != "" {
+		c.setState(s)
+	}
+}
+
+// iceStateChanged follows ICE's state for OnState once the data channel is
+// open, and for OnSelectedPair.
+func (c *Conn) iceStateChanged(s webrtc.ICEConnectionState) {
+	connected := s == webrtc.ICEConnectionStateConnected || s == webrtc.ICEConnectionStateCompleted
+	if connected && c.dialer.OnSelectedPair != nil {
+		go c.pairSelected()
+	}
+	select {
+	case <-c.opened:
+	default:
+		return
+	}
+	switch s {
+	case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+		go c.setRoute()
+	case webrtc.ICEConnectionStateDisconnected, webrtc.ICEConnectionStateFailed, webrtc.ICEConnectionStateClosed:
+		c.setState(Disconnected)
+	}
+}
+
+// connected reports the connection's state and starts reporting its
+// progress, once the data channel is open.
+func (c *Conn) connected() {
+	if c.dialer.OnState != nil {
+		go c.setRoute()
+	}
+	if c.dialer.OnProgress == nil {
+		return
+	}
+	interval := c.dialer.ProgressInterval
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		var lastSent, lastReceived int64
+		for {
+			select {
+			case <-t.C:
+			case <-c.closed:
+				c.dialer.OnProgress(c.Progress())
+				return
+			}
+			sent, received := c.Progress()
+			if sent != lastSent || received != lastReceived {
+				c.dialer.OnProgress(sent, received)
+				lastSent, lastReceived = sent, received
+			}
+		}
+	}()
+}
+
+// Progress returns the number of bytes written to and read from the
+// connection and its streams so far. Unlike Traffic, it only counts what
+// the application wrote and read, and keeps counting once closed.
+func (c *Conn) Progress() (sent, received int64) {
+	return atomic.LoadInt64(&c.sched.sent), atomic.LoadInt64(&c.sched.received)
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	atomic.AddInt64(&c.sched.received, int64(n))
+	c.sched.recvLimit.take(n)
+	if err == io.EOF {
+		atomic.StoreInt32(&c.eof, 1)
+	}
+	return n, err
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Read(p)
+	atomic.AddInt64(&s.sched.received, int64(n))
+	s.sched.recvLimit.take(n)
+	return n, err
+}
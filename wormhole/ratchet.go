@@ -0,0 +1,86 @@
+package wormhole
+
+import (
+	"errors"
+	"io"
+
+	"webwormhole.io/wormhole/pake"
+)
+
+// MinRatchet is the first version of the peer protocol whose peers can
+// seal what they send over a connection with ratchets, see Ratcheted.
+const MinRatchet = 11
+
+// ErrNoRatchet is returned by Ratcheted when the peer's too old for it.
+var ErrNoRatchet = errors.New("peer can't ratchet")
+
+// Ratcheted returns c with each message sealed and opened with the
+// pake.Ratchets of its Data keys, on top of the data channel's own
+// encryption, for sessions left open for days, like ww pipe's, which then
+// change keys as they go. Both peers have to use it, which they can from
+// MinRatchet, and nothing else on c may use its Data keys.
+func (c *Conn) Ratcheted() (io.ReadWriteCloser, error) {
+	if c.peerVersion < MinRatchet {
+		return nil, ErrNoRatchet
+	}
+	send, receive, err := c.keys.Ratchets(pake.Data)
+	if err != nil {
+		return nil, err
+	}
+	return newRatcheted(c, c.MessageLimit(), send, receive), nil
+}
+
+// ratcheted seals messages written to it, cut down to the peer's limit,
+// and opens those read from it, until it runs out of keys.
+type ratcheted struct {
+	rw            io.ReadWriteCloser
+	limit         int
+	send, receive *pake.Ratchet
+	buf, msg      []byte
+}
+
+func newRatcheted(rw io.ReadWriteCloser, limit int, send, receive *pake.Ratchet) *ratcheted {
+	return &ratcheted{rw: rw, limit: limit - pake.RatchetOverhead, send: send, receive: receive}
+}
+
+func (r *ratcheted) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		k := len(p) - n
+		if k > r.limit {
+			k = r.limit
+		}
+		sealed, err := r.send.Seal(p[n : n+k])
+		if err != nil {
+			return n, err
+		}
+		if _, err := r.rw.Write(sealed); err != nil {
+			return n, err
+		}
+		n += k
+	}
+	return n, nil
+}
+
+func (r *ratcheted) Read(p []byte) (int, error) {
+	for len(r.msg) == 0 {
+		if r.buf == nil {
+			r.buf = make([]byte, MaxMessage)
+		}
+		n, err := r.rw.Read(r.buf)
+		if err != nil {
+			return 0, err
+		}
+		r.msg, err = r.receive.Open(r.buf[:n])
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.msg)
+	r.msg = r.msg[n:]
+	return n, nil
+}
+
+func (r *ratcheted) Close() error {
+	return r.rw.Close()
+}
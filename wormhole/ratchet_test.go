@@ -0,0 +1,98 @@
+package wormhole
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"webwormhole.io/wormhole/pake"
+)
+
+func TestRatcheted(t *testing.T) {
+	mk := bytes.Repeat([]byte{7}, 32)
+	ends := func(side pake.Side) (send, receive *pake.Ratchet) {
+		s, err := pake.NewSchedule(mk, pake.MaxVersion, side)
+		if err != nil {
+			t.Fatal(err)
+		}
+		send, receive, err = s.Ratchets(pake.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return send, receive
+	}
+	as, ar := ends(pake.SideA)
+	bs, br := ends(pake.SideB)
+	an, bn := net.Pipe()
+	const limit = 100
+	a := newRatcheted(an, limit, as, ar)
+	b := newRatcheted(bn, limit, bs, br)
+
+	msgs := [][]byte{[]byte("hi"), bytes.Repeat([]byte("0123456789"), 25), {}}
+	var want []byte
+	for _, m := range msgs {
+		want = append(want, m...)
+	}
+	go func() {
+		for _, m := range msgs {
+			a.Write(m)
+		}
+		a.Close()
+	}()
+	got, err := ioutil.ReadAll(b)
+	if err != nil && err != io.EOF && err != io.ErrClosedPipe {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q want %q", got, want)
+	}
+
+	// Messages that don't open end the connection, rather than being
+	// skipped.
+	an, bn = net.Pipe()
+	b = newRatcheted(bn, limit, bs, br)
+	go func() {
+		sealed, _ := as.Seal([]byte("tampered"))
+		sealed[len(sealed)-1] ^= 1
+		an.Write(sealed)
+	}()
+	if _, err := b.Read(make([]byte, limit)); err != pake.ErrOpen {
+		t.Errorf("read a tampered message: %v", err)
+	}
+}
+
+func TestRatchetedSplits(t *testing.T) {
+	mk := bytes.Repeat([]byte{7}, 32)
+	s, _ := pake.NewSchedule(mk, pake.MaxVersion, pake.SideA)
+	send, receive, _ := s.Ratchets(pake.Data)
+	var sizes []int
+	w := &sizeWriter{sizes: &sizes}
+	r := newRatcheted(w, 100, send, receive)
+	if n, err := r.Write(make([]byte, 250)); n != 250 || err != nil {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+	total := 0
+	for _, n := range sizes {
+		if n > 100 {
+			t.Errorf("sent messages of %v bytes, over the limit", sizes)
+		}
+		total += n - pake.RatchetOverhead
+	}
+	if total != 250 {
+		t.Errorf("sent messages of %v bytes, want 250 in all", sizes)
+	}
+}
+
+// sizeWriter records the size of each message written to it.
+type sizeWriter struct {
+	sizes *[]int
+}
+
+func (w *sizeWriter) Write(p []byte) (int, error) {
+	*w.sizes = append(*w.sizes, len(p))
+	return len(p), nil
+}
+func (w *sizeWriter) Read(p []byte) (int, error) { return 0, io.EOF }
+func (w *sizeWriter) Close() error               { return nil }
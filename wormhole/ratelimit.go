@@ -0,0 +1,84 @@
+package wormhole
+
+import (
+	"sync"
+	"time"
+)
+
+// A Bucket is a token bucket that paces bytes to a rate, allowing bursts of
+// up to a second's worth. The zero Bucket doesn't limit anything.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second, or 0 for unlimited.
+	tokens float64
+	last   time.Time
+}
+
+// SetRate changes b's rate to rate bytes per second, or lifts the limit if
+// it's 0. It starts out with a full second's worth.
+func (b *Bucket) SetRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = float64(rate)
+	b.tokens = b.rate
+	b.last = time.Now()
+}
+
+// refill adds the tokens earned since it was last called, up to a second's
+// worth. It's called with b.mu held.
+func (b *Bucket) refill(now time.Time) {
+	b.tokens += b.rate * now.Sub(b.last).Seconds()
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// Wait takes n bytes worth of tokens, and returns how long to wait to make
+// up for going over the rate.
+func (b *Bucket) Wait(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Allow takes n bytes worth of tokens if there are enough, for callers that
+// would rather drop what's over the rate than wait.
+func (b *Bucket) Allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// take takes n bytes worth of tokens, sleeping for as long as Wait says.
+func (b *Bucket) take(n int) {
+	if d := b.Wait(n); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// SetRateLimit caps how fast the connection and its streams send, and how
+// fast they receive, to bytesPerSec each, e.g. to leave room for others on
+// a shared link. Reading slower makes the peer send slower too, once the
+// buffers in between fill up. Bursts of up to a second's worth go through
+// at once. It can be changed at any time, and 0 lifts the limit.
+func (c *Conn) SetRateLimit(bytesPerSec int64) {
+	c.sched.sendLimit.SetRate(bytesPerSec)
+	c.sched.recvLimit.SetRate(bytesPerSec)
+}
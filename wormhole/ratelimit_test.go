@@ -0,0 +1,70 @@
+package wormhole
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketWait(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  int64
+		takes []int
+		want  time.Duration // For the last take.
+	}{
+		{"unlimited", 0, []int{1 << 30}, 0},
+		{"within the burst", 1000, []int{1000}, 0},
+		{"over the burst", 1000, []int{1500}, 500 * time.Millisecond},
+		{"running into debt", 1000, []int{1000, 1000}, time.Second},
+		{"deeper into debt", 1000, []int{1000, 500, 500}, time.Second},
+	}
+	for _, tt := range tests {
+		var b Bucket
+		b.SetRate(tt.rate)
+		var got time.Duration
+		for _, n := range tt.takes {
+			got = b.Wait(n)
+		}
+		// Tokens trickle back in between takes.
+		if got > tt.want || got < tt.want-10*time.Millisecond {
+			t.Errorf("%s: waited %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBucketAllow(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  int64
+		takes []int
+		want  []bool
+	}{
+		{"unlimited", 0, []int{1 << 30, 1 << 30}, []bool{true, true}},
+		{"within the burst", 100, []int{60, 40}, []bool{true, true}},
+		{"over the burst", 100, []int{101, 100}, []bool{false, true}},
+		{"out of tokens", 100, []int{100, 50}, []bool{true, false}},
+	}
+	for _, tt := range tests {
+		var b Bucket
+		b.SetRate(tt.rate)
+		for i, n := range tt.takes {
+			if got := b.Allow(n); got != tt.want[i] {
+				t.Errorf("%s: take %d of %d allowed %v, want %v", tt.name, i, n, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestBucketZero(t *testing.T) {
+	var b Bucket
+	if d := b.Wait(1 << 30); d != 0 {
+		t.Errorf("zero bucket waited %v", d)
+	}
+	b.SetRate(1000)
+	b.Wait(5000)
+	// Changing the rate forgets the debt.
+	b.SetRate(1000)
+	if d := b.Wait(1000); d != 0 {
+		t.Errorf("waited %v after SetRate", d)
+	}
+}
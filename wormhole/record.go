@@ -0,0 +1,171 @@
+package wormhole
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A Frame is an entry in a session recording. Recordings are a stream of
+// JSON encoded frames.
+type Frame struct {
+	Time time.Time `json:"time"`
+	// Event is one of:
+	//	book   started booking a slot on the signalling server at Data
+	//	join   started joining a slot on the signalling server at Data
+	//	in     received message Data
+	//	out    sent message Data
+	//	error  the signalling connection failed with error Data
+	//	close  we closed the signalling connection
+	Event string `json:"event"`
+	Data  string `json:"data,omitempty"`
+}
+
+// maxJitter is the longest a message to the signalling server is held
+// back for with Dialer.StrictPrivacy.
+const maxJitter = 100 * time.Millisecond
+
+// padSize is what encrypted messages are padded to a multiple of with
+// Dialer.StrictPrivacy.
+const padSize = 512
+
+// sigconn is a connection to the signalling server. It records frames going
+// through it if asked to.
+type sigconn struct {
+	transport
+
+	rec *json.Encoder
+	mu  sync.Mutex // Guards rec.
+	wmu sync.Mutex // Serialises writes.
+
+	// strict pads messages and delays them at random, for
+	// Dialer.StrictPrivacy.
+	strict bool
+
+	// relays are TURN URLs the signalling server offered for this session,
+	// for a relay of its own.
+	relays []string
+}
+
+func (d *Dialer) dialSignal(ctx context.Context, event, addr string) (*sigconn, error) {
+	s := &sigconn{strict: d.StrictPrivacy}
+	if d.Record != nil {
+		s.rec = json.NewEncoder(d.Record)
+	}
+	s.record(event, addr)
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = d.TLSClientConfig
+	header := http.Header{}
+	for k, v := range d.Header {
+		header[k] = v
+	}
+	if _, ok := header["User-Agent"]; !ok {
+		// The server has no use for it. An empty one isn't sent at all.
+		header.Set("User-Agent", "")
+	}
+	header.Set("X-Version", protocolVersion)
+	var t transport
+	var r *http.Response
+	var err error
+	if !d.LongPoll {
+		t, r, err = dialWebsocket(ctx, &dialer, addr, header)
+	}
+	if d.LongPoll || err != nil && (r == nil || r.Header.Get("X-Version") == "") {
+		// It wasn't the signalling server that turned the websocket down,
+		// if it was turned down at all. Something in the way may not let
+		// them through, so try without.
+		if err != nil {
+			s.record("error", err.Error())
+		}
+		pt, pr, perr := d.dialPoll(ctx, addr, header)
+		if perr == nil || pr != nil || d.LongPoll {
+			t, r, err = pt, pr, perr
+		}
+	}
+	if err != nil {
+		s.record("error", err.Error())
+		if r != nil && r.StatusCode == http.StatusForbidden {
+			return nil, ErrForbidden
+		}
+		if r != nil && r.StatusCode == http.StatusUnauthorized {
+			return nil, ErrUnauthorized
+		}
+		if r != nil {
+			if err := checkSignal(r.Header); err != nil {
+				return nil, err
+			}
+			if r.Header.Get("X-Version") == "" {
+				return nil, ErrBadVersion
+			}
+		}
+		return nil, err
+	}
+	if err := checkSignal(r.Header); err != nil {
+		t.Close()
+		return nil, err
+	}
+	s.transport = t
+	for _, v := range r.Header["X-Relay"] {
+		s.relays = append(s.relays, strings.Split(v, ",")...)
+	}
+	return s, nil
+}
+
+// dialWebsocket opens the signalling websocket at addr.
+func dialWebsocket(ctx context.Context, dialer *websocket.Dialer, addr string, header http.Header) (transport, *http.Response, error) {
+	ws, r, err := dialer.DialContext(ctx, addr, header)
+	if err != nil {
+		return nil, r, err
+	}
+	return ws, r, nil
+}
+
+func (s *sigconn) record(event, data string) {
+	if s.rec == nil {
+		return
+	}
+	s.mu.Lock()
+	s.rec.Encode(Frame{time.Now(), event, data})
+	s.mu.Unlock()
+}
+
+func (s *sigconn) ReadMessage() (messageType int, p []byte, err error) {
+	messageType, p, err = s.transport.ReadMessage()
+	if err != nil {
+		s.record("error", err.Error())
+		return
+	}
+	s.record("in", string(p))
+	return
+}
+
+func (s *sigconn) WriteMessage(messageType int, data []byte) error {
+	s.record("out", string(data))
+	s.wmu.Lock()
+	if s.strict {
+		// Sleep while holding the lock, to keep messages in order.
+		time.Sleep(time.Duration(rand.Int63n(int64(maxJitter))))
+	}
+	err := s.transport.WriteMessage(messageType, data)
+	s.wmu.Unlock()
+	if err != nil {
+		s.record("error", err.Error())
+	}
+	return err
+}
+
+// done tells the signalling server we no longer need the connection.
+func (s *sigconn) done() {
+	s.record("close", "")
+	s.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "done"),
+		time.Now().Add(10*time.Second),
+	)
+}
@@ -0,0 +1,155 @@
+package wormhole
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// ResumeChunk is the size of the chunks files are hashed in to resume them.
+// Transfers resume from the end of the last chunk the receiver verified.
+const ResumeChunk = 1 << 20
+
+// MinResume is the first version of the peer protocol whose receivers can
+// say where to resume from.
+const MinResume = 4
+
+// ResumeToken returns the token that identifies a file to resume sending,
+// from its name, size and modification time. It's the same every time the
+// same file is sent, whatever the code, so a receiver can tell it's one it
+// has part of.
+func ResumeToken(name string, size int64, modified time.Time) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d", name, size, modified.UnixNano())
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// A ChunkHasher hashes what's written to it in chunks of ResumeChunk.
+type ChunkHasher struct {
+	// Sums are the hashes of each chunk done so far.
+	Sums [][]byte
+	h    hash.Hash
+	n    int
+}
+
+func (c *ChunkHasher) Write(p []byte) (int, error) {
+	if c.h == nil {
+		c.h = sha256.New()
+	}
+	written := len(p)
+	for len(p) > 0 {
+		n := ResumeChunk - c.n
+		if n > len(p) {
+			n = len(p)
+		}
+		c.h.Write(p[:n])
+		c.n += n
+		p = p[n:]
+		if c.n == ResumeChunk {
+			c.Sums = append(c.Sums, c.h.Sum(nil))
+			c.h.Reset()
+			c.n = 0
+		}
+	}
+	return written, nil
+}
+
+// Offset returns how many bytes the chunks done so far cover.
+func (c *ChunkHasher) Offset() int64 {
+	return int64(len(c.Sums)) * ResumeChunk
+}
+
+// SumOf returns the hash of chunk hashes sums, which peers compare to agree
+// on where to resume from.
+func SumOf(sums [][]byte) []byte {
+	h := sha256.New()
+	for _, s := range sums {
+		h.Write(s)
+	}
+	return h.Sum(nil)
+}
+
+// VerifyChunks returns how many of the first chunks read from r have the
+// hashes in sums, stopping at the first that doesn't.
+func VerifyChunks(r io.Reader, sums [][]byte) (int, error) {
+	buf := make([]byte, ResumeChunk)
+	for i, sum := range sums {
+		if _, err := io.ReadFull(r, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return i, nil
+		} else if err != nil {
+			return i, err
+		}
+		got := sha256.Sum256(buf)
+		if !bytes.Equal(got[:], sum) {
+			return i, nil
+		}
+	}
+	return len(sums), nil
+}
+
+// A Partial is what a receiver keeps of a file it didn't receive all of,
+// to resume it later from the chunks it had.
+type Partial struct {
+	// Token is the sender's ResumeToken for the file.
+	Token string `json:"token"`
+	// Name is the name the file is saved as, and Size how long it is.
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Sums are the hashes of the chunks received, in hex.
+	Sums []string `json:"sums"`
+}
+
+// LoadPartial reads the partial saved in the file at path.
+func LoadPartial(path string) (*Partial, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Partial{}
+	if err := json.Unmarshal(buf, p); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return p, nil
+}
+
+// Save writes p to the file at path, replacing it whole so that a crash
+// never leaves half of one.
+func (p *Partial) Save(path string) error {
+	buf, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// SetSums sets p's chunk hashes to sums.
+func (p *Partial) SetSums(sums [][]byte) {
+	p.Sums = p.Sums[:0]
+	for _, s := range sums {
+		p.Sums = append(p.Sums, hex.EncodeToString(s))
+	}
+}
+
+// Chunks returns p's chunk hashes, or an error if any are malformed.
+func (p *Partial) Chunks() ([][]byte, error) {
+	var sums [][]byte
+	for _, s := range p.Sums {
+		b, err := hex.DecodeString(s)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("bad chunk hash %q", s)
+		}
+		sums = append(sums, b)
+	}
+	return sums, nil
+}
@@ -0,0 +1,39 @@
+package wormhole
+
+import "time"
+
+// Route describes the path a connection takes to the peer, from the ICE
+// candidate pair in use.
+type Route struct {
+	// Local and Remote are the candidate types at either end: host,
+	// srflx, prflx or relay.
+	Local, Remote string
+	// RTT is the latest round trip time ICE measured.
+	RTT time.Duration
+}
+
+// Relayed reports whether the route goes through a TURN server.
+func (r Route) Relayed() bool {
+	return r.Local == "relay" || r.Remote == "relay"
+}
+
+func (r Route) String() string {
+	if r.Relayed() {
+		return "relay"
+	}
+	return "direct"
+}
+
+// Route returns the route the connection takes, and false if it's not
+// known yet.
+func (c *Conn) Route() (Route, bool) {
+	pair, local, remote, ok := c.selectedPair()
+	if !ok {
+		return Route{}, false
+	}
+	return Route{
+		Local:  local.CandidateType.String(),
+		Remote: remote.CandidateType.String(),
+		RTT:    time.Duration(pair.CurrentRoundTripTime * float64(time.Second)),
+	}, true
+}
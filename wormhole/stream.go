@@ -0,0 +1,125 @@
+package wormhole
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// ErrNoStreams is returned by OpenStream when the peer speaks a version of
+// the protocol without streams.
+var ErrNoStreams = errors.New("peer does not support streams")
+
+// readyLabel labels the stream a peer opens to say it's ready for data on
+// the connection's own channel. It's not passed on to AcceptStream.
+const readyLabel = "webwormhole-ready"
+
+// Stream is a data channel to the peer in addition to the connection's own.
+// Each stream is ordered and reliable, but independent of the others, so
+// that, say, control messages don't have to wait behind file data.
+type Stream struct {
+	io.ReadWriteCloser
+	d      *webrtc.DataChannel
+	flushc *sync.Cond
+	sched  *sched
+}
+
+// Label returns the label the stream was opened with.
+func (s *Stream) Label() string {
+	return s.d.Label()
+}
+
+func (s *Stream) Write(p []byte) (n int, err error) {
+	return write(s.sched, s.d, s.flushc, s.ReadWriteCloser, p)
+}
+
+func (s *Stream) Close() error {
+	for s.d.BufferedAmount() != 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+	s.sched.remove(s.d)
+	err := s.ReadWriteCloser.Close()
+	if e := s.d.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// newStream sets up d, and calls fn once it's open.
+func (c *Conn) newStream(d *webrtc.DataChannel, fn func(*Stream, error)) {
+	s := &Stream{d: d, flushc: sync.NewCond(&sync.Mutex{}), sched: c.sched}
+	c.sched.set(d, 0)
+	d.OnOpen(func() {
+		// Channels the peer opens don't pick these up if they're set
+		// any earlier, so wait until now.
+		d.OnBufferedAmountLow(func() {
+			s.flushc.L.Lock()
+			s.flushc.Signal()
+			s.flushc.L.Unlock()
+		})
+		d.SetBufferedAmountLowThreshold(c.dialer.lowThreshold())
+		rwc, err := d.Detach()
+		if err != nil {
+			fn(nil, err)
+			return
+		}
+		s.ReadWriteCloser = rwc
+		fn(s, nil)
+	})
+}
+
+// OpenStream opens a new stream to the peer. The label is for the peer to
+// tell streams apart. It returns ErrNoStreams if the peer is too old to
+// accept streams.
+func (c *Conn) OpenStream(label string) (*Stream, error) {
+	if c.peerVersion < 2 {
+		return nil, ErrNoStreams
+	}
+	d, err := c.pc.CreateDataChannel(label, nil)
+	if err != nil {
+		return nil, err
+	}
+	type result struct {
+		s   *Stream
+		err error
+	}
+	opened := make(chan result, 1)
+	c.newStream(d, func(s *Stream, err error) { opened <- result{s, err} })
+	select {
+	case r := <-opened:
+		return r.s, r.err
+	case <-c.closed:
+		return nil, io.ErrClosedPipe
+	}
+}
+
+// AcceptStream waits for the peer to open a stream.
+func (c *Conn) AcceptStream() (*Stream, error) {
+	select {
+	case s := <-c.streams:
+		return s, nil
+	case <-c.closed:
+		return nil, io.ErrClosedPipe
+	}
+}
+
+// accept queues a stream opened by the peer for AcceptStream.
+func (c *Conn) accept(d *webrtc.DataChannel) {
+	if d.Label() == readyLabel {
+		c.readyOnce.Do(func() { close(c.ready) })
+		return
+	}
+	c.newStream(d, func(s *Stream, err error) {
+		if err != nil {
+			return
+		}
+		select {
+		case c.streams <- s:
+		case <-c.closed:
+			s.Close()
+		}
+	})
+}
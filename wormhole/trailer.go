@@ -0,0 +1,85 @@
+package wormhole
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// MinTrailer is the first version of the peer protocol whose senders
+// follow every file they send with a Trailer, and whose receivers expect
+// one. What counts as a file is up to applications; see cmd/ww.
+const MinTrailer = 7
+
+// MinChanged is the first version of the peer protocol whose receivers drop
+// a file whose trailer says it changed while it was being sent, and go on
+// to the next one. Older receivers take it for a mismatch.
+const MinChanged = 8
+
+// ErrDigestMismatch is returned by CheckTrailer when what was received is
+// not what the sender sent.
+var ErrDigestMismatch = errors.New("contents do not match the sender's hash")
+
+// A Trailer follows a file, with the SHA-256 digest of its contents as the
+// sender read them. The transport already checks every message, but not
+// that none went missing or were mangled on the way in and out of either
+// application. Its MAC, under a key only the two peers have, lets the
+// receiver tell it came from the sender.
+type Trailer struct {
+	SHA256 string `json:"sha256"`
+	MAC    string `json:"mac"`
+
+	// Changed is set by senders when the file changed while they were
+	// reading it, so that what was sent is torn. No digest matches a
+	// trailer from ChangedTrailer.
+	Changed bool `json:"changed,omitempty"`
+}
+
+// NewTrailer returns the trailer for a file with digest sum, to send over c.
+func (c *Conn) NewTrailer(sum []byte) (*Trailer, error) {
+	mac, err := c.trailerMAC(sum)
+	if err != nil {
+		return nil, err
+	}
+	return &Trailer{SHA256: hex.EncodeToString(sum), MAC: hex.EncodeToString(mac)}, nil
+}
+
+// ChangedTrailer returns the trailer for a file that changed while it was
+// being sent over c.
+func (c *Conn) ChangedTrailer() (*Trailer, error) {
+	t, err := c.NewTrailer(nil)
+	if err != nil {
+		return nil, err
+	}
+	t.Changed = true
+	return t, nil
+}
+
+// CheckTrailer checks that t, received over c, came from the peer and
+// matches sum, the digest of what was received. It returns
+// ErrDigestMismatch if not.
+func (c *Conn) CheckTrailer(t *Trailer, sum []byte) error {
+	got, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return ErrDigestMismatch
+	}
+	want, err := c.trailerMAC(sum)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(got, want) || t.SHA256 != hex.EncodeToString(sum) {
+		return ErrDigestMismatch
+	}
+	return nil
+}
+
+func (c *Conn) trailerMAC(sum []byte) ([]byte, error) {
+	key, err := c.ExportKey("trailer", sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(sum)
+	return h.Sum(nil), nil
+}
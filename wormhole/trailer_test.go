@@ -0,0 +1,54 @@
+package wormhole
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"webwormhole.io/wormhole/pake"
+)
+
+func TestCheckTrailer(t *testing.T) {
+	keys := func(mk byte, side pake.Side) *Conn {
+		s, err := pake.NewSchedule(bytes.Repeat([]byte{mk}, 32), pake.MaxVersion, side)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Conn{keys: s}
+	}
+	sender, receiver, stranger := keys(1, pake.SideA), keys(1, pake.SideB), keys(2, pake.SideA)
+	sum := sha256.Sum256([]byte("hello"))
+	other := sha256.Sum256([]byte("world"))
+	trailer := func(c *Conn, sum []byte) *Trailer {
+		tr, err := c.NewTrailer(sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tr
+	}
+	changed, err := sender.ChangedTrailer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		trailer *Trailer
+		ok      bool
+	}{
+		{"from the sender", trailer(sender, sum[:]), true},
+		{"for other contents", trailer(sender, other[:]), false},
+		{"from a stranger", trailer(stranger, sum[:]), false},
+		{"with the digest swapped", &Trailer{SHA256: trailer(sender, other[:]).SHA256, MAC: trailer(sender, sum[:]).MAC}, false},
+		{"with the MAC swapped", &Trailer{SHA256: trailer(sender, sum[:]).SHA256, MAC: trailer(sender, other[:]).MAC}, false},
+		{"with a MAC that isn't hex", &Trailer{SHA256: trailer(sender, sum[:]).SHA256, MAC: "not hex"}, false},
+		{"empty", &Trailer{}, false},
+		{"for a changed file", changed, false},
+	}
+	for _, tt := range tests {
+		err := receiver.CheckTrailer(tt.trailer, sum[:])
+		if tt.ok && err != nil || !tt.ok && err != ErrDigestMismatch {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}